@@ -21,6 +21,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"html/template"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
@@ -357,8 +358,29 @@ func (_ RefFieldType) Field() Field {
 }
 
 // RefField contains a reference to another node.
+//
+// The reference is either the path of the node or a node URI
+// referencing it by id (see NodeURIScheme).
 type RefField string
 
+// Node returns the referenced node.
+//
+// If the reference is empty or the node does not exist, it returns
+// nil, nil.
+func (f RefField) Node(m *MonstiClient, site string) (*Node, error) {
+	if f == "" {
+		return nil, nil
+	}
+	uri, err := url.Parse(string(f))
+	if err != nil {
+		return nil, fmt.Errorf("service: Could not parse reference: %v", err)
+	}
+	if id, ok := ParseNodeURI(uri); ok {
+		return m.GetNodeByID(site, id)
+	}
+	return m.GetNode(site, uri.Path)
+}
+
 func (t RefField) Init(*MonstiClient, string) error {
 	return nil
 }
@@ -829,4 +851,11 @@ type FieldConfig struct {
 	Required bool
 	// Hidden fields won't show up in the web interface.
 	Hidden bool
+	// Searchable fields get added to the full-text search index. The
+	// fields core.Title, core.Description, and core.Body are always
+	// searchable.
+	Searchable bool
+	// Translatable fields may hold a value per locale of the site (see
+	// Node.Translations).
+	Translatable bool
 }
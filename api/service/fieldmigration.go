@@ -0,0 +1,286 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// FieldMigration describes a change of a node type's fields.
+//
+// Node types list their field migrations in NodeType.FieldMigrations.
+// The list may only be appended to. Nodes record the number of
+// applied field migrations (see Node.FieldsVersion). Pending field
+// migrations are applied when a node gets loaded. To migrate all
+// nodes at once, start monsti-daemon with -migrate-fields.
+type FieldMigration struct {
+	// Field is the id of the (possibly new) field.
+	Field string
+	// From is the old id of the field if it has been renamed.
+	From string
+	// Conversion names the conversion of the field's value if the field
+	// type changed. The conversions TextToHTML, HTMLToText, and ToList
+	// are built in. Others may be registered by modules, see
+	// RegisterFieldConversion.
+	Conversion string
+	// Default is the JSON encoded value of nodes without a value for
+	// the field, e.g. for new fields.
+	Default string
+}
+
+// FieldConversion converts the JSON decoded value of a field.
+type FieldConversion func(value interface{}) (interface{}, error)
+
+var (
+	htmlTags = regexp.MustCompile(`<[^>]*>`)
+
+	fieldConversions = map[string]FieldConversion{
+		"TextToHTML": func(value interface{}) (interface{}, error) {
+			text, ok := value.(string)
+			if !ok {
+				return nil, fmt.Errorf("Expected string, got %T", value)
+			}
+			return strings.Replace(html.EscapeString(text), "\n", "<br>", -1), nil
+		},
+		"HTMLToText": func(value interface{}) (interface{}, error) {
+			text, ok := value.(string)
+			if !ok {
+				return nil, fmt.Errorf("Expected string, got %T", value)
+			}
+			return html.UnescapeString(htmlTags.ReplaceAllString(text, "")), nil
+		},
+		"ToList": func(value interface{}) (interface{}, error) {
+			if _, ok := value.([]interface{}); ok {
+				return value, nil
+			}
+			return []interface{}{value}, nil
+		},
+	}
+	fieldConversionsMutex sync.RWMutex
+	// registeredConversions lists the names of conversions registered
+	// by RegisterFieldConversion.
+	registeredConversions []string
+)
+
+// RegisterFieldConversion registers a conversion to be used by field
+// migrations of the module's node types.
+//
+// Conversions are only known to the registering process. To allow
+// other modules and Monsti to load migrated nodes, modules using
+// module.StartModule will answer ConvertField signals for their
+// registered conversions.
+func RegisterFieldConversion(name string, conversion FieldConversion) {
+	fieldConversionsMutex.Lock()
+	defer fieldConversionsMutex.Unlock()
+	fieldConversions[name] = conversion
+	registeredConversions = append(registeredConversions, name)
+}
+
+// RegisteredFieldConversions returns the names of the conversions
+// registered by RegisterFieldConversion.
+func RegisteredFieldConversions() []string {
+	fieldConversionsMutex.RLock()
+	defer fieldConversionsMutex.RUnlock()
+	return append([]string(nil), registeredConversions...)
+}
+
+// GetFieldConversion returns the locally registered conversion with
+// the given name or nil.
+func GetFieldConversion(name string) FieldConversion {
+	fieldConversionsMutex.RLock()
+	defer fieldConversionsMutex.RUnlock()
+	return fieldConversions[name]
+}
+
+type ConvertFieldArgs struct {
+	Conversion string
+	// Value is the JSON encoded value.
+	Value []byte
+}
+
+type ConvertFieldRet struct {
+	// Known is false if the conversion is unknown to the module.
+	Known bool
+	Value []byte
+}
+
+type convertFieldHandler struct{}
+
+func (r *convertFieldHandler) Name() string {
+	return "monsti.ConvertField"
+}
+
+func (r *convertFieldHandler) Handle(args interface{}) (interface{}, error) {
+	args_ := args.(ConvertFieldArgs)
+	conversion := GetFieldConversion(args_.Conversion)
+	if conversion == nil {
+		return ConvertFieldRet{}, nil
+	}
+	var value interface{}
+	if err := json.Unmarshal(args_.Value, &value); err != nil {
+		return nil, fmt.Errorf("service: Could not decode field value: %v", err)
+	}
+	value, err := conversion(value)
+	if err != nil {
+		return nil, err
+	}
+	ret, err := json.Marshal(value)
+	return ConvertFieldRet{true, ret}, err
+}
+
+// NewConvertFieldHandler constructs a signal handler that converts
+// field values using the locally registered conversions.
+func NewConvertFieldHandler() SignalHandler {
+	return new(convertFieldHandler)
+}
+
+// convertField converts the given JSON encoded value using the named
+// conversion. Conversions unknown to this process are requested from
+// the modules.
+func convertField(m *MonstiClient, name string, value []byte) ([]byte,
+	error) {
+	if conversion := GetFieldConversion(name); conversion != nil {
+		var decoded interface{}
+		if err := json.Unmarshal(value, &decoded); err != nil {
+			return nil, fmt.Errorf("Could not decode field value: %v", err)
+		}
+		converted, err := conversion(decoded)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(converted)
+	}
+	if m != nil {
+		var rets []ConvertFieldRet
+		err := m.EmitSignal("monsti.ConvertField",
+			ConvertFieldArgs{name, value}, &rets)
+		if err != nil {
+			return nil, fmt.Errorf("Could not emit signal: %v", err)
+		}
+		for _, ret := range rets {
+			if ret.Known {
+				return ret.Value, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("Unknown field conversion %q", name)
+}
+
+// migrateFields applies the given field migrations to the raw fields
+// of a node.
+func migrateFields(m *MonstiClient,
+	fields map[string]map[string]*json.RawMessage,
+	migrations []FieldMigration) error {
+	get := func(id string) *json.RawMessage {
+		parts := strings.SplitN(id, ".", 2)
+		if len(parts) != 2 {
+			return nil
+		}
+		return fields[parts[0]][parts[1]]
+	}
+	set := func(id string, value *json.RawMessage) {
+		parts := strings.SplitN(id, ".", 2)
+		if len(parts) != 2 {
+			return
+		}
+		if value == nil {
+			delete(fields[parts[0]], parts[1])
+			return
+		}
+		if fields[parts[0]] == nil {
+			fields[parts[0]] = make(map[string]*json.RawMessage)
+		}
+		fields[parts[0]][parts[1]] = value
+	}
+	for _, migration := range migrations {
+		if migration.From != "" {
+			if value := get(migration.From); value != nil {
+				set(migration.From, nil)
+				if get(migration.Field) == nil {
+					set(migration.Field, value)
+				}
+			}
+		}
+		value := get(migration.Field)
+		if value != nil && migration.Conversion != "" {
+			converted, err := convertField(m, migration.Conversion, *value)
+			if err != nil {
+				return fmt.Errorf("Could not convert field %v: %v", migration.Field,
+					err)
+			}
+			raw := json.RawMessage(converted)
+			set(migration.Field, &raw)
+		}
+		if value == nil && migration.Default != "" {
+			raw := json.RawMessage(migration.Default)
+			set(migration.Field, &raw)
+		}
+	}
+	return nil
+}
+
+// MigrateNodeFields applies the pending field migrations of the given
+// node and its draft and writes them back, keeping their change
+// times. If dryRun is true, nothing gets written.
+//
+// Returns the migrated node files.
+func (s *MonstiClient) MigrateNodeFields(site, path string, dryRun bool) (
+	[]string, error) {
+	var migrated []string
+	for _, file := range []string{"node.json", "node.draft.json"} {
+		data, err := s.GetNodeData(site, path, file)
+		if err != nil {
+			return migrated, err
+		}
+		if data == nil {
+			continue
+		}
+		var node nodeJSON
+		if err := json.Unmarshal(data, &node); err != nil {
+			return migrated, fmt.Errorf("service: Could not unmarshal node: %v",
+				err)
+		}
+		nodeType, err := s.GetNodeType(node.Type)
+		if err != nil {
+			return migrated, err
+		}
+		if node.FieldsVersion >= len(nodeType.FieldMigrations) {
+			continue
+		}
+		migrated = append(migrated, file)
+		if dryRun {
+			continue
+		}
+		getNodeType := func(string) (*NodeType, error) { return nodeType, nil }
+		ret, err := dataToNode(data, getNodeType, s, site)
+		if err != nil {
+			return migrated, fmt.Errorf("service: Could not convert node: %v", err)
+		}
+		if data, err = nodeToData(ret, true); err != nil {
+			return migrated, fmt.Errorf("service: Could not convert node: %v", err)
+		}
+		if err := s.WriteNodeData(site, path, file, data); err != nil {
+			return migrated, err
+		}
+	}
+	return migrated, nil
+}
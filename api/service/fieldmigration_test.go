@@ -0,0 +1,97 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDataToNodeFieldMigrations(t *testing.T) {
+	RegisterFieldConversion("test.Upper",
+		func(value interface{}) (interface{}, error) {
+			return strings.ToUpper(value.(string)), nil
+		})
+	nodeType := NodeType{
+		Id: "foo.Bar",
+		Fields: []*FieldConfig{
+			{Id: "foo.Title", Type: new(TextFieldType)},
+			{Id: "foo.Body", Type: new(HTMLFieldType)},
+			{Id: "foo.Tags", Type: &ListFieldType{ElementType: new(TextFieldType)}},
+			{Id: "foo.Count", Type: new(IntegerFieldType)},
+		},
+		FieldMigrations: []FieldMigration{
+			{Field: "foo.Title", From: "foo.Name"},
+			{Field: "foo.Body", Conversion: "TextToHTML"},
+			{Field: "foo.Tags", Conversion: "ToList"},
+			{Field: "foo.Title", Conversion: "test.Upper"},
+			{Field: "foo.Count", Default: "3"},
+		},
+	}
+	getNodeType := func(id string) (*NodeType, error) { return &nodeType, nil }
+	data := []byte(`{"Type": "foo.Bar", "Fields": {"foo": {
+    "Name": "title", "Body": "a < b\nc", "Tags": "tag"}}}`)
+	node, err := dataToNode(data, getNodeType, nil, "")
+	if err != nil {
+		t.Fatalf("dataToNode returns error: %v", err)
+	}
+	if node.FieldsVersion != 5 {
+		t.Errorf("FieldsVersion should be 5, got %v", node.FieldsVersion)
+	}
+	tests := map[string]interface{}{
+		"foo.Title": "TITLE",
+		"foo.Body":  "a &lt; b<br>c",
+		"foo.Tags":  []interface{}{"tag"},
+		"foo.Count": 3,
+	}
+	for field, expected := range tests {
+		ret := node.Fields[field].Value()
+		if list, ok := ret.([]Field); ok {
+			var values []interface{}
+			for _, element := range list {
+				values = append(values, element.Value())
+			}
+			ret = values
+		}
+		if !reflect.DeepEqual(ret, expected) {
+			t.Errorf("Field %v = %#v, should be %#v", field, ret, expected)
+		}
+	}
+
+	// Migrated nodes get written in the new shape and don't get
+	// migrated again.
+	data, err = nodeToData(node, false)
+	if err != nil {
+		t.Fatalf("nodeToData returns error: %v", err)
+	}
+	node, err = dataToNode(data, getNodeType, nil, "")
+	if err != nil {
+		t.Fatalf("dataToNode returns error: %v", err)
+	}
+	if ret := node.Fields["foo.Body"].Value(); ret != "a &lt; b<br>c" {
+		t.Errorf("Field foo.Body should not be converted twice, got %q", ret)
+	}
+
+	// Conversions unknown to this process can't be applied without
+	// connection to Monsti.
+	nodeType.FieldMigrations = append(nodeType.FieldMigrations,
+		FieldMigration{Field: "foo.Title", Conversion: "test.Unknown"})
+	if _, err = dataToNode(data, getNodeType, nil, ""); err == nil {
+		t.Errorf("dataToNode should fail for unknown conversions")
+	}
+}
@@ -24,6 +24,7 @@ import (
 	"fmt"
 	"net/smtp"
 	"net/url"
+	"path"
 	"reflect"
 	"runtime/debug"
 	"strings"
@@ -153,6 +154,12 @@ func (s *MonstiClient) LoadSiteSettings(site string) (*Settings, error) {
 			Type:     new(TextFieldType),
 			Hidden:   true,
 		},
+		{
+			Id: "core.RequireTwoFactor",
+			Name: i18n.GenLanguageMap(G("Require two-factor authentication"),
+				[]string{"de", "en"}),
+			Type: new(BoolFieldType),
+		},
 		{
 			Id:     "core.CacheDisabled",
 			Hidden: true,
@@ -186,6 +193,12 @@ func (s *MonstiClient) LoadSiteSettings(site string) (*Settings, error) {
 					}},
 			},
 		},
+		{
+			Id:     "core.Locales",
+			Name:   i18n.GenLanguageMap(G("Locales"), []string{"de", "en"}),
+			Hidden: true,
+			Type:   &ListFieldType{ElementType: new(TextFieldType)},
+		},
 		{
 			// EXPERIMENTAL
 			Id:     "core.RegionBlocks",
@@ -206,6 +219,14 @@ func (s *MonstiClient) LoadSiteSettings(site string) (*Settings, error) {
 
 // WriteSiteSettings writes the given settings.
 func (s *MonstiClient) WriteSiteSettings(site string, settings *Settings) error {
+	return s.WriteSiteSettingsAs(site, settings, "")
+}
+
+// WriteSiteSettingsAs writes the given settings like
+// WriteSiteSettings, recording the given user login as author of the
+// change.
+func (s *MonstiClient) WriteSiteSettingsAs(site string, settings *Settings,
+	user string) error {
 	if s.Error != nil {
 		return s.Error
 	}
@@ -216,7 +237,8 @@ func (s *MonstiClient) WriteSiteSettings(site string, settings *Settings) error
 	args := struct {
 		Site     string
 		Settings []byte
-	}{site, data}
+		User     string
+	}{site, data, user}
 	err = s.RPCClient.Call("Monsti.WriteSiteSettings", &args, new(int))
 	if err != nil {
 		return fmt.Errorf("service: WriteSiteSettings error: %v", err)
@@ -238,11 +260,18 @@ func nodeToData(node *Node, indent bool) ([]byte, error) {
 	var outNode nodeJSON
 	outNode.Node = *node
 	outNode.Type = node.Type.Id
+	// Fields are always written in the shape of the current node type.
+	outNode.FieldsVersion = len(node.Type.FieldMigrations)
 
 	outNode.Fields, err = dumpFields(node.Fields, node.Type.Fields)
 	if err != nil {
 		return nil, err
 	}
+	outNode.Translations, err = dumpTranslations(node.Translations,
+		node.Type.Fields)
+	if err != nil {
+		return nil, err
+	}
 
 	if indent {
 		data, err = json.MarshalIndent(outNode, "", "  ")
@@ -278,17 +307,72 @@ func dumpFields(fields map[string]Field, configs []*FieldConfig) (
 }
 
 // WriteNode writes the given node.
+//
+// The previous content of the node will be kept as a revision (see
+// GetNodeRevisions).
 func (s *MonstiClient) WriteNode(site, path string, node *Node) error {
+	return s.writeNode(site, path, "node.json", "", node)
+}
+
+// WriteNodeDraft writes the given node as the draft (working copy) of
+// the node at the given path.
+//
+// The published node stays untouched until the draft gets published
+// using PublishNodeDraft.
+func (s *MonstiClient) WriteNodeDraft(site, path string, node *Node) error {
+	return s.writeNode(site, path, "node.draft.json", "", node)
+}
+
+// ConflictError is returned if a node has been changed by someone
+// else since it has been read.
+type ConflictError struct {
+	// Path is the path of the conflicting node.
+	Path string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("service: Node %v has been changed concurrently", e.Path)
+}
+
+// WriteNodeIfUnchanged writes the given node like WriteNode, but only
+// if the token of the stored node and its draft still matches the
+// given one (see NodeToken). Otherwise, it returns a *ConflictError.
+func (s *MonstiClient) WriteNodeIfUnchanged(site, path string, node *Node,
+	token string) error {
+	return s.writeNode(site, path, "node.json", token, node)
+}
+
+// WriteNodeDraftIfUnchanged writes the given draft like
+// WriteNodeDraft, but only if the token of the stored node and its
+// draft still matches the given one (see NodeToken). Otherwise, it
+// returns a *ConflictError.
+func (s *MonstiClient) WriteNodeDraftIfUnchanged(site, path string,
+	node *Node, token string) error {
+	return s.writeNode(site, path, "node.draft.json", token, node)
+}
+
+// writeNode writes the given node to the given node data file.
+//
+// If token is not empty, the node will only be written if the token
+// matches the stored node.
+func (s *MonstiClient) writeNode(site, path, file, token string,
+	node *Node) error {
 	if s.Error != nil {
 		return s.Error
 	}
 	node.Changed = time.Now().UTC()
+	if node.Id == "" {
+		node.Id = NewNodeId()
+	}
 	data, err := nodeToData(node, true)
 	if err != nil {
 		return fmt.Errorf("service: Could not convert node: %v", err)
 	}
-	err = s.WriteNodeData(site, path, "node.json", data)
+	err = s.writeNodeData(site, path, file, node.ChangedBy, token, data)
 	if err != nil {
+		if _, ok := err.(*ConflictError); ok {
+			return err
+		}
 		return fmt.Errorf(
 			"service: Could not write node: %v", err)
 	}
@@ -297,8 +381,73 @@ func (s *MonstiClient) WriteNode(site, path string, node *Node) error {
 
 type nodeJSON struct {
 	Node
-	Type   string
-	Fields map[string]map[string]*json.RawMessage
+	Type         string
+	Fields       map[string]map[string]*json.RawMessage
+	Translations map[string]map[string]map[string]*json.RawMessage `json:",omitempty"`
+}
+
+// dumpTranslations converts the given translations to JSON raw
+// messages per locale. Only translatable fields get dumped.
+func dumpTranslations(translations map[string]map[string]Field,
+	configs []*FieldConfig) (
+	map[string]map[string]map[string]*json.RawMessage, error) {
+	var out map[string]map[string]map[string]*json.RawMessage
+	for locale, fields := range translations {
+		var present []*FieldConfig
+		for _, config := range translatableFields(configs) {
+			if fields[config.Id] != nil {
+				present = append(present, config)
+			}
+		}
+		if len(present) == 0 {
+			continue
+		}
+		dump, err := dumpFields(fields, present)
+		if err != nil {
+			return nil, err
+		}
+		if out == nil {
+			out = make(map[string]map[string]map[string]*json.RawMessage)
+		}
+		out[locale] = dump
+	}
+	return out, nil
+}
+
+// restoreTranslations converts the given raw translations to fields.
+// Only translatable fields get restored.
+func restoreTranslations(
+	translations map[string]map[string]map[string]*json.RawMessage,
+	configs []*FieldConfig, m *MonstiClient, site string) (
+	map[string]map[string]Field, error) {
+	var out map[string]map[string]Field
+	for locale, fields := range translations {
+		for _, config := range translatableFields(configs) {
+			parts := strings.SplitN(config.Id, ".", 2)
+			value := fields[parts[0]][parts[1]]
+			if value == nil {
+				continue
+			}
+			field := config.Type.Field()
+			if err := field.Init(m, site); err != nil {
+				return nil, fmt.Errorf("Could not init field %q: %v", config.Id, err)
+			}
+			err := field.Load(func(in interface{}) error {
+				return json.Unmarshal(*value, in)
+			})
+			if err != nil {
+				return nil, err
+			}
+			if out == nil {
+				out = make(map[string]map[string]Field)
+			}
+			if out[locale] == nil {
+				out[locale] = make(map[string]Field)
+			}
+			out[locale][config.Id] = field
+		}
+	}
+	return out, nil
 }
 
 // restoreFields converts the given raw data to an array of already
@@ -344,12 +493,49 @@ func dataToNode(data []byte,
 	if err = ret.InitFields(m, site); err != nil {
 		return nil, fmt.Errorf("Could not init node fields (node: %q): %v", ret, err)
 	}
+	if pending := len(ret.Type.FieldMigrations) - ret.FieldsVersion; pending > 0 {
+		if node.Fields == nil {
+			node.Fields = make(map[string]map[string]*json.RawMessage)
+		}
+		err = migrateFields(m, node.Fields,
+			ret.Type.FieldMigrations[ret.FieldsVersion:])
+		if err != nil {
+			return nil, fmt.Errorf("Could not migrate fields of node %q: %v",
+				ret.Path, err)
+		}
+		for locale, fields := range node.Translations {
+			err = migrateFields(m, fields,
+				ret.Type.FieldMigrations[ret.FieldsVersion:])
+			if err != nil {
+				return nil, fmt.Errorf(
+					"Could not migrate %v translation of node %q: %v", locale,
+					ret.Path, err)
+			}
+		}
+		ret.FieldsVersion = len(ret.Type.FieldMigrations)
+	}
 	if err = restoreFields(node.Fields, ret.Type.Fields, ret.Fields); err != nil {
 		return nil, err
 	}
+	ret.Translations, err = restoreTranslations(node.Translations,
+		ret.Type.Fields, m, site)
+	if err != nil {
+		return nil, fmt.Errorf("Could not restore translations: %v", err)
+	}
 	return &ret, nil
 }
 
+// DecodeNode converts the content of a node file (e.g. node.json) to a
+// node, getting its type using getNodeType.
+//
+// This is useful for tools working directly on a site's data
+// directory. The client is used to initialize and migrate the node's
+// fields and may be nil.
+func DecodeNode(data []byte, getNodeType func(id string) (*NodeType, error),
+	m *MonstiClient, site string) (*Node, error) {
+	return dataToNode(data, getNodeType, m, site)
+}
+
 // GetNode reads the given node.
 //
 // If the node does not exist, it returns nil, nil.
@@ -370,6 +556,92 @@ func (s *MonstiClient) GetNode(site, path string) (*Node, error) {
 	return node, nil
 }
 
+// GetNodeByID reads the node with the given id (see Node.Id).
+//
+// If there is no such node, it returns nil, nil.
+func (s *MonstiClient) GetNodeByID(site, id string) (*Node, error) {
+	if s.Error != nil {
+		return nil, s.Error
+	}
+	args := struct{ Site, Id string }{site, id}
+	var reply []byte
+	err := s.RPCClient.Call("Monsti.GetNodeByID", args, &reply)
+	if err != nil {
+		return nil, fmt.Errorf("service: GetNodeByID error: %v", err)
+	}
+	node, err := dataToNode(reply, s.GetNodeType, s, site)
+	if err != nil {
+		return nil, fmt.Errorf("service: Could not convert node: %v", err)
+	}
+	return node, nil
+}
+
+// GetNodeDraft reads the draft (working copy) of the given node.
+//
+// If the node has no draft, it returns nil, nil.
+func (s *MonstiClient) GetNodeDraft(site, path string) (*Node, error) {
+	if s.Error != nil {
+		return nil, s.Error
+	}
+	args := struct{ Site, Path string }{site, path}
+	var reply []byte
+	err := s.RPCClient.Call("Monsti.GetNodeDraft", args, &reply)
+	if err != nil {
+		return nil, fmt.Errorf("service: GetNodeDraft error: %v", err)
+	}
+	node, err := dataToNode(reply, s.GetNodeType, s, site)
+	if err != nil {
+		return nil, fmt.Errorf("service: Could not convert node: %v", err)
+	}
+	return node, nil
+}
+
+// PublishNodeDraft replaces the given node and its draft data files
+// with the node's draft. If the draft renames the node (see
+// Node.Rename), the node gets renamed, too.
+//
+// The previously published content will be kept as a revision. It's
+// up to the caller to mark the node's cache dependencies.
+func (s *MonstiClient) PublishNodeDraft(site, path string) error {
+	return s.PublishNodeDraftAs(site, path, "")
+}
+
+// PublishNodeDraftAs publishes the draft of the given node like
+// PublishNodeDraft, recording the given user login as author of the
+// change.
+func (s *MonstiClient) PublishNodeDraftAs(site, path, user string) error {
+	if s.Error != nil {
+		return s.Error
+	}
+	args := struct{ Site, Path, User string }{site, path, user}
+	if err := s.RPCClient.Call("Monsti.PublishNodeDraft", &args,
+		new(int)); err != nil {
+		return fmt.Errorf("service: PublishNodeDraft error: %v", err)
+	}
+	return nil
+}
+
+// DiscardNodeDraft removes the draft of the given node and its draft
+// data files.
+func (s *MonstiClient) DiscardNodeDraft(site, path string) error {
+	return s.DiscardNodeDraftAs(site, path, "")
+}
+
+// DiscardNodeDraftAs removes the draft of the given node like
+// DiscardNodeDraft, recording the given user login as author of the
+// change.
+func (s *MonstiClient) DiscardNodeDraftAs(site, path, user string) error {
+	if s.Error != nil {
+		return s.Error
+	}
+	args := struct{ Site, Path, User string }{site, path, user}
+	if err := s.RPCClient.Call("Monsti.DiscardNodeDraft", &args,
+		new(int)); err != nil {
+		return fmt.Errorf("service: DiscardNodeDraft error: %v", err)
+	}
+	return nil
+}
+
 // GetChildren returns the children of the given node.
 func (s *MonstiClient) GetChildren(site, path string) ([]*Node, error) {
 	if s.Error != nil {
@@ -393,6 +665,165 @@ func (s *MonstiClient) GetChildren(site, path string) ([]*Node, error) {
 	return nodes, nil
 }
 
+// QueryNodesReply is the reply of the Monsti.QueryNodes RPC.
+type QueryNodesReply struct {
+	Nodes [][]byte
+	Total int
+}
+
+// QueryNodes returns the nodes of a subtree matching the given query.
+func (s *MonstiClient) QueryNodes(site string, query *NodeQuery) (
+	*NodeQueryResult, error) {
+	if s.Error != nil {
+		return nil, s.Error
+	}
+	// The query gets sent as JSON as gob can't encode arbitrary filter
+	// values.
+	data, err := json.Marshal(query)
+	if err != nil {
+		return nil, fmt.Errorf("service: Could not marshal query: %v", err)
+	}
+	args := struct {
+		Site  string
+		Query []byte
+	}{site, data}
+	var reply QueryNodesReply
+	if err := s.RPCClient.Call("Monsti.QueryNodes", args, &reply); err != nil {
+		return nil, fmt.Errorf("service: QueryNodes error: %v", err)
+	}
+	ret := &NodeQueryResult{
+		Nodes: make([]*Node, 0, len(reply.Nodes)),
+		Total: reply.Total,
+	}
+	for _, entry := range reply.Nodes {
+		node, err := dataToNode(entry, s.GetNodeType, s, site)
+		if err != nil {
+			return nil, fmt.Errorf("service: Could not convert node: %v", err)
+		}
+		ret.Nodes = append(ret.Nodes, node)
+	}
+	descend := query.Depth
+	if descend <= 0 {
+		descend = -1
+	}
+	ret.Deps = []CacheDep{{Node: path.Clean("/" + query.Path),
+		Descend: descend}}
+	return ret, nil
+}
+
+// NodeRevision is an earlier revision of a node.
+type NodeRevision struct {
+	// Id identifies the revision. Newer revisions have higher ids.
+	Id int
+	// Node holds the content of the node at this revision.
+	Node *Node
+}
+
+// GetNodeRevisions returns the earlier revisions of the given node,
+// newest first.
+//
+// Each call to WriteNode keeps the overwritten content as a new
+// revision.
+func (s *MonstiClient) GetNodeRevisions(site, path string) (
+	[]*NodeRevision, error) {
+	if s.Error != nil {
+		return nil, s.Error
+	}
+	args := struct{ Site, Path string }{site, path}
+	var reply []struct {
+		Id   int
+		Node []byte
+	}
+	err := s.RPCClient.Call("Monsti.GetNodeRevisions", args, &reply)
+	if err != nil {
+		return nil, fmt.Errorf("service: GetNodeRevisions error: %v", err)
+	}
+	revisions := make([]*NodeRevision, 0, len(reply))
+	for _, entry := range reply {
+		node, err := dataToNode(entry.Node, s.GetNodeType, s, site)
+		if err != nil {
+			return nil, fmt.Errorf("service: Could not convert node: %v", err)
+		}
+		revisions = append(revisions, &NodeRevision{entry.Id, node})
+	}
+	return revisions, nil
+}
+
+// GetNodeRevision returns the given revision of the node.
+//
+// If there is no such revision, it returns nil, nil.
+func (s *MonstiClient) GetNodeRevision(site, path string, revision int) (
+	*Node, error) {
+	if s.Error != nil {
+		return nil, s.Error
+	}
+	args := struct {
+		Site, Path string
+		Revision   int
+	}{site, path, revision}
+	var reply []byte
+	err := s.RPCClient.Call("Monsti.GetNodeRevision", args, &reply)
+	if err != nil {
+		return nil, fmt.Errorf("service: GetNodeRevision error: %v", err)
+	}
+	node, err := dataToNode(reply, s.GetNodeType, s, site)
+	if err != nil {
+		return nil, fmt.Errorf("service: Could not convert node: %v", err)
+	}
+	return node, nil
+}
+
+// Commit is a change of a site's data recorded in the site's git
+// repository.
+type Commit struct {
+	// Id is the commit hash.
+	Id string
+	// Author and Email identify the author of the change.
+	Author, Email string
+	// Time holds the time of the commit.
+	Time time.Time
+	// Message describes the change.
+	Message string
+}
+
+// GetNodeCommits returns the commits which changed the given node,
+// newest first.
+//
+// If the site's data is not kept in a git repository, it returns nil.
+func (s *MonstiClient) GetNodeCommits(site, path string) ([]*Commit, error) {
+	if s.Error != nil {
+		return nil, s.Error
+	}
+	args := struct{ Site, Path string }{site, path}
+	var reply []*Commit
+	err := s.RPCClient.Call("Monsti.GetNodeCommits", args, &reply)
+	if err != nil {
+		return nil, fmt.Errorf("service: GetNodeCommits error: %v", err)
+	}
+	return reply, nil
+}
+
+// GetNodeAtCommit returns the given node as of the given commit.
+//
+// If the node did not exist at this commit, it returns nil, nil.
+func (s *MonstiClient) GetNodeAtCommit(site, path, commit string) (
+	*Node, error) {
+	if s.Error != nil {
+		return nil, s.Error
+	}
+	args := struct{ Site, Path, Commit string }{site, path, commit}
+	var reply []byte
+	err := s.RPCClient.Call("Monsti.GetNodeAtCommit", args, &reply)
+	if err != nil {
+		return nil, fmt.Errorf("service: GetNodeAtCommit error: %v", err)
+	}
+	node, err := dataToNode(reply, s.GetNodeType, s, site)
+	if err != nil {
+		return nil, fmt.Errorf("service: Could not convert node: %v", err)
+	}
+	return node, nil
+}
+
 // GetNodeData requests data from some node.
 //
 // Returns a nil slice and nil error if the data does not exist.
@@ -414,16 +845,36 @@ func (s *MonstiClient) GetNodeData(site, path, file string) ([]byte, error) {
 
 // WriteNodeData writes data for some node.
 func (s *MonstiClient) WriteNodeData(site, path, file string,
+	content []byte) error {
+	return s.WriteNodeDataAs(site, path, file, "", content)
+}
+
+// WriteNodeDataAs writes data for some node, recording the given user
+// login as author of the change.
+func (s *MonstiClient) WriteNodeDataAs(site, path, file, user string,
+	content []byte) error {
+	return s.writeNodeData(site, path, file, user, "", content)
+}
+
+// writeNodeData writes data for some node.
+//
+// If token is not empty, the data will only be written if the token
+// matches the stored node. Otherwise, it returns a *ConflictError.
+func (s *MonstiClient) writeNodeData(site, path, file, user, token string,
 	content []byte) error {
 	if s.Error != nil {
 		return s.Error
 	}
 	args := struct {
-		Site, Path, File string
-		Content          []byte
+		Site, Path, File, User, Token string
+		Content                       []byte
 	}{
-		site, path, file, content}
+		site, path, file, user, token, content}
 	if err := s.RPCClient.Call("Monsti.WriteNodeData", &args, new(int)); err != nil {
+		conflict := &ConflictError{path}
+		if err.Error() == conflict.Error() {
+			return conflict
+		}
 		return fmt.Errorf("service: WriteNodeData error: %v", err)
 	}
 	return nil
@@ -431,12 +882,18 @@ func (s *MonstiClient) WriteNodeData(site, path, file string,
 
 // RemoveNodeData removes data of some node.
 func (s *MonstiClient) RemoveNodeData(site, path, file string) error {
+	return s.RemoveNodeDataAs(site, path, file, "")
+}
+
+// RemoveNodeDataAs removes data of some node like RemoveNodeData,
+// recording the given user login as author of the change.
+func (s *MonstiClient) RemoveNodeDataAs(site, path, file, user string) error {
 	if s.Error != nil {
 		return s.Error
 	}
 	args := struct {
-		Site, Path, File string
-	}{site, path, file}
+		Site, Path, File, User string
+	}{site, path, file, user}
 	if err := s.RPCClient.Call("Monsti.RemoveNodeData", &args, new(int)); err != nil {
 		return fmt.Errorf("service: RemoveNodeData error: %v", err)
 	}
@@ -445,31 +902,357 @@ func (s *MonstiClient) RemoveNodeData(site, path, file string) error {
 
 // RemoveNode removes the given site's node and all its descendants.
 //
-// All reverse cache dependencies of removed nodes will be marked.
+// The removed nodes will be moved to the site's trash (see
+// GetTrash). All reverse cache dependencies of removed nodes will be
+// marked.
 func (s *MonstiClient) RemoveNode(site string, node string) error {
+	return s.TrashNode(site, node, "")
+}
+
+// TrashNode moves the given site's node and all its descendants to
+// the site's trash, recording the given user login as remover.
+//
+// All reverse cache dependencies of removed nodes will be marked.
+func (s *MonstiClient) TrashNode(site, node, user string) error {
 	if s.Error != nil {
 		return s.Error
 	}
 	args := struct {
-		Site, Node string
-	}{site, node}
+		Site, Node, User string
+	}{site, node, user}
 	if err := s.RPCClient.Call("Monsti.RemoveNode", args, new(int)); err != nil {
 		return fmt.Errorf("service: RemoveNode error: %v", err)
 	}
 	return nil
 }
 
+// TrashEntry describes a removed node subtree in the site's trash.
+type TrashEntry struct {
+	// Id identifies the entry.
+	Id string
+	// Path is the original path of the removed node.
+	Path string
+	// Removed holds the time of removal.
+	Removed time.Time
+	// RemovedBy holds the login of the user who removed the node.
+	RemovedBy string
+}
+
+// GetTrash returns the entries of the site's trash, newest first.
+func (s *MonstiClient) GetTrash(site string) ([]*TrashEntry, error) {
+	if s.Error != nil {
+		return nil, s.Error
+	}
+	var reply []*TrashEntry
+	if err := s.RPCClient.Call("Monsti.GetTrash", site, &reply); err != nil {
+		return nil, fmt.Errorf("service: GetTrash error: %v", err)
+	}
+	return reply, nil
+}
+
+// RestoreTrash moves the given trash entry back to its original path.
+//
+// Fails if there is already a node at the original path. It's up to
+// the caller to mark the cache dependencies of the restored node.
+func (s *MonstiClient) RestoreTrash(site, id string) error {
+	return s.RestoreTrashAs(site, id, "")
+}
+
+// RestoreTrashAs restores the given trash entry like RestoreTrash,
+// recording the given user login as author of the change.
+func (s *MonstiClient) RestoreTrashAs(site, id, user string) error {
+	if s.Error != nil {
+		return s.Error
+	}
+	args := struct{ Site, Id, User string }{site, id, user}
+	if err := s.RPCClient.Call("Monsti.RestoreTrash", args, new(int)); err != nil {
+		return fmt.Errorf("service: RestoreTrash error: %v", err)
+	}
+	return nil
+}
+
+// PurgeTrash irrevocably deletes the given trash entry.
+func (s *MonstiClient) PurgeTrash(site, id string) error {
+	return s.PurgeTrashAs(site, id, "")
+}
+
+// PurgeTrashAs deletes the given trash entry like PurgeTrash,
+// recording the given user login as author of the change.
+func (s *MonstiClient) PurgeTrashAs(site, id, user string) error {
+	if s.Error != nil {
+		return s.Error
+	}
+	args := struct{ Site, Id, User string }{site, id, user}
+	if err := s.RPCClient.Call("Monsti.PurgeTrash", args, new(int)); err != nil {
+		return fmt.Errorf("service: PurgeTrash error: %v", err)
+	}
+	return nil
+}
+
 // RenameNode renames (moves) the given site's node.
 //
-// Source and target path must be absolute. TODO: All reverse cache
-// dependencies of moved nodes will be marked.
+// Source and target path must be absolute. All reverse cache
+// dependencies of moved nodes and of the old and new parents will be
+// marked. References by node id
+// (see Node.Id) stay valid.
 func (s *MonstiClient) RenameNode(site, source, target string) error {
+	return s.RenameNodeAs(site, source, target, "")
+}
+
+// CopyNode copies the given site's node including its data files to
+// the given target path. If recursive is true, all descendants are
+// copied, too.
+//
+// The copies get fresh ids and change times. Drafts and the history
+// are not copied. The cache dependencies of the target's parent will
+// be marked.
+func (s *MonstiClient) CopyNode(site, source, target string,
+	recursive bool) error {
+	return s.CopyNodeAs(site, source, target, "", recursive)
+}
+
+// CopyNodeAs copies the given site's node like CopyNode, recording the
+// given user login as author of the copies.
+func (s *MonstiClient) CopyNodeAs(site, source, target, user string,
+	recursive bool) error {
 	if s.Error != nil {
 		return s.Error
 	}
 	args := struct {
-		Site, Source, Target string
-	}{site, source, target}
+		Site, Source, Target, User string
+		Recursive                  bool
+	}{site, source, target, user, recursive}
+	if err := s.RPCClient.Call("Monsti.CopyNode", args, new(int)); err != nil {
+		return fmt.Errorf("service: CopyNode error: %v", err)
+	}
+	return nil
+}
+
+// GetMigrationLevels returns the numbers of the last applied
+// migrations of the given site by module.
+func (s *MonstiClient) GetMigrationLevels(site string) (map[string]int,
+	error) {
+	if s.Error != nil {
+		return nil, s.Error
+	}
+	args := struct{ Site string }{site}
+	var levels map[string]int
+	err := s.RPCClient.Call("Monsti.GetMigrationLevels", args, &levels)
+	if err != nil {
+		return nil, fmt.Errorf("service: GetMigrationLevels error: %v", err)
+	}
+	return levels, nil
+}
+
+// SetMigrationLevel records the number of the given module's last
+// applied migration of the given site.
+func (s *MonstiClient) SetMigrationLevel(site, module string,
+	level int) error {
+	if s.Error != nil {
+		return s.Error
+	}
+	args := struct {
+		Site, Module string
+		Level        int
+	}{site, module, level}
+	err := s.RPCClient.Call("Monsti.SetMigrationLevel", args, new(int))
+	if err != nil {
+		return fmt.Errorf("service: SetMigrationLevel error: %v", err)
+	}
+	return nil
+}
+
+// ResolveRedirect returns the location the given path of the site
+// gets redirected to, or an empty string if there is no redirect.
+//
+// Redirects get recorded by RenameNode and apply to the whole moved
+// subtree.
+func (s *MonstiClient) ResolveRedirect(site, path string) (string, error) {
+	if s.Error != nil {
+		return "", s.Error
+	}
+	args := struct{ Site, Path string }{site, path}
+	var reply string
+	if err := s.RPCClient.Call("Monsti.ResolveRedirect", args, &reply); err != nil {
+		return "", fmt.Errorf("service: ResolveRedirect error: %v", err)
+	}
+	return reply, nil
+}
+
+// GetRedirects returns the redirect table of the site which maps old
+// paths to the new location (a path or an absolute URL).
+func (s *MonstiClient) GetRedirects(site string) (map[string]string, error) {
+	if s.Error != nil {
+		return nil, s.Error
+	}
+	var reply map[string]string
+	if err := s.RPCClient.Call("Monsti.GetRedirects", site, &reply); err != nil {
+		return nil, fmt.Errorf("service: GetRedirects error: %v", err)
+	}
+	return reply, nil
+}
+
+// WriteRedirects replaces the redirect table of the site.
+func (s *MonstiClient) WriteRedirects(site string,
+	redirects map[string]string) error {
+	return s.WriteRedirectsAs(site, redirects, "")
+}
+
+// WriteRedirectsAs replaces the redirect table of the site like
+// WriteRedirects, recording the given user login as author of the
+// change.
+func (s *MonstiClient) WriteRedirectsAs(site string,
+	redirects map[string]string, user string) error {
+	if s.Error != nil {
+		return s.Error
+	}
+	args := struct {
+		Site      string
+		Redirects map[string]string
+		User      string
+	}{site, redirects, user}
+	if err := s.RPCClient.Call("Monsti.WriteRedirects", args, new(int)); err != nil {
+		return fmt.Errorf("service: WriteRedirects error: %v", err)
+	}
+	return nil
+}
+
+// GetGrants returns the grants of the given node, i.e. the roles
+// granted to users (by login) on the node's subtree.
+func (s *MonstiClient) GetGrants(site, path string) (map[string][]string,
+	error) {
+	if s.Error != nil {
+		return nil, s.Error
+	}
+	args := struct{ Site, Path string }{site, path}
+	var reply map[string][]string
+	if err := s.RPCClient.Call("Monsti.GetGrants", args, &reply); err != nil {
+		return nil, fmt.Errorf("service: GetGrants error: %v", err)
+	}
+	return reply, nil
+}
+
+// WriteGrants replaces the grants of the given node, recording the
+// given user login as author of the change.
+func (s *MonstiClient) WriteGrants(site, path, user string,
+	grants map[string][]string) error {
+	if s.Error != nil {
+		return s.Error
+	}
+	args := struct {
+		Site, Path, User string
+		Grants           map[string][]string
+	}{site, path, user, grants}
+	if err := s.RPCClient.Call("Monsti.WriteGrants", args, new(int)); err != nil {
+		return fmt.Errorf("service: WriteGrants error: %v", err)
+	}
+	return nil
+}
+
+// GetGrantedRoles returns the roles granted to the given user on the
+// given node and its ancestors.
+func (s *MonstiClient) GetGrantedRoles(site, path, login string) ([]string,
+	error) {
+	if s.Error != nil {
+		return nil, s.Error
+	}
+	args := struct{ Site, Path, Login string }{site, path, login}
+	var reply []string
+	if err := s.RPCClient.Call("Monsti.GetGrantedRoles", args, &reply); err != nil {
+		return nil, fmt.Errorf("service: GetGrantedRoles error: %v", err)
+	}
+	return reply, nil
+}
+
+// GetUsers returns the users of the site ordered by login. Password
+// hashes are omitted.
+func (s *MonstiClient) GetUsers(site string) ([]*User, error) {
+	if s.Error != nil {
+		return nil, s.Error
+	}
+	var reply []*User
+	if err := s.RPCClient.Call("Monsti.GetUsers", site, &reply); err != nil {
+		return nil, fmt.Errorf("service: GetUsers error: %v", err)
+	}
+	return reply, nil
+}
+
+// GetUser returns the user of the site with the given login or nil
+// if there is no such user. The password hash is omitted.
+func (s *MonstiClient) GetUser(site, login string) (*User, error) {
+	if s.Error != nil {
+		return nil, s.Error
+	}
+	args := struct{ Site, Login string }{site, login}
+	var reply User
+	if err := s.RPCClient.Call("Monsti.GetUser", args, &reply); err != nil {
+		return nil, fmt.Errorf("service: GetUser error: %v", err)
+	}
+	if reply.Login == "" {
+		return nil, nil
+	}
+	return &reply, nil
+}
+
+// WriteUser adds or updates the given user of the site. If password
+// is not empty, it will be hashed and set as the user's new password.
+// Otherwise, the user keeps the current password.
+func (s *MonstiClient) WriteUser(site string, user *User,
+	password string) error {
+	if s.Error != nil {
+		return s.Error
+	}
+	args := struct {
+		Site     string
+		User     User
+		Password string
+	}{site, *user, password}
+	if err := s.RPCClient.Call("Monsti.WriteUser", args, new(int)); err != nil {
+		return fmt.Errorf("service: WriteUser error: %v", err)
+	}
+	return nil
+}
+
+// RemoveUser removes the user of the site with the given login.
+func (s *MonstiClient) RemoveUser(site, login string) error {
+	if s.Error != nil {
+		return s.Error
+	}
+	args := struct{ Site, Login string }{site, login}
+	if err := s.RPCClient.Call("Monsti.RemoveUser", args, new(int)); err != nil {
+		return fmt.Errorf("service: RemoveUser error: %v", err)
+	}
+	return nil
+}
+
+// WriteUserTwoFactor replaces the second factor of the existing user
+// of the site with the given login. A nil factor disables two-factor
+// authentication for the user.
+func (s *MonstiClient) WriteUserTwoFactor(site, login string,
+	factor *TwoFactor) error {
+	if s.Error != nil {
+		return s.Error
+	}
+	args := struct {
+		Site, Login string
+		TwoFactor   *TwoFactor
+	}{site, login, factor}
+	if err := s.RPCClient.Call("Monsti.WriteUserTwoFactor", args,
+		new(int)); err != nil {
+		return fmt.Errorf("service: WriteUserTwoFactor error: %v", err)
+	}
+	return nil
+}
+
+// RenameNodeAs renames (moves) the given site's node, recording the
+// given user login as author of the change.
+func (s *MonstiClient) RenameNodeAs(site, source, target, user string) error {
+	if s.Error != nil {
+		return s.Error
+	}
+	args := struct {
+		Site, Source, Target, User string
+	}{site, source, target, user}
 	if err := s.RPCClient.Call("Monsti.RenameNode", args, new(int)); err != nil {
 		return fmt.Errorf("service: RenameNode error: %v", err)
 	}
@@ -589,6 +1372,17 @@ const (
 	ListAction
 	ChooserAction
 	SettingsAction
+	HistoryAction
+	PublishAction
+	DiscardAction
+	WorkflowAction
+	TrashAction
+	RedirectsAction
+	CopyAction
+	MoveAction
+	PermissionsAction
+	UsersAction
+	TwoFactorAction
 )
 
 // A request to be processed by a nodes service.
@@ -611,6 +1405,8 @@ type Request struct {
 	// PostForm stores the requests POST/PUT form data.
 	// See net/http's Request.PostForm
 	PostForm url.Values
+	// Locale of the requested content (see Node.Localized).
+	Locale string
 	/*
 			// The requested node.
 			Node *Node
@@ -695,6 +1491,43 @@ type User struct {
 	Password string
 	// PasswordChanged keeps the time of the last password change.
 	PasswordChanged time.Time
+	// Roles lists the roles of the user on the whole site, i.e.
+	// "viewer", "author", "editor", or "admin", and workflow roles like
+	// "reviewer". Further roles may be granted on subtrees.
+	Roles []string `json:",omitempty"`
+	// Locale is the preferred locale of the admin interface. If empty,
+	// the locale gets negotiated with the user's browser.
+	Locale string `json:",omitempty"`
+	// Disabled users can't log in.
+	Disabled bool `json:",omitempty"`
+	// TwoFactor is set if the user has enabled two-factor
+	// authentication. Service methods listing users leave its fields
+	// empty.
+	TwoFactor *TwoFactor `json:",omitempty"`
+}
+
+// TwoFactor holds the second factor of a user, i.e. a TOTP
+// authenticator and single-use recovery codes.
+type TwoFactor struct {
+	// TOTPSecret is the base32 encoded secret of the authenticator.
+	TOTPSecret string
+	// TOTPStep is the time step of the last accepted code. Codes of
+	// this or earlier steps are rejected.
+	TOTPStep int64
+	// RecoveryCodes holds the hashes of the unused recovery codes.
+	RecoveryCodes []string `json:",omitempty"`
+}
+
+// HasRole returns true if the user has any of the given roles.
+func (u *User) HasRole(roles ...string) bool {
+	for _, role := range roles {
+		for _, userRole := range u.Roles {
+			if role == userRole {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 // UserSession is a session of an authenticated or anonymous user.
@@ -703,6 +1536,10 @@ type UserSession struct {
 	User *User
 	// Locale used for this session.
 	Locale string
+	// CSRFToken must be sent with forms submitted in this session. Use
+	// it for forms rendered by modules, e.g. using the CSRFToken field
+	// of template.Renderer.
+	CSRFToken string
 }
 
 // SendMails sends the given mail.
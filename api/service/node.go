@@ -17,7 +17,11 @@
 package service
 
 import (
+	"crypto/rand"
+	"fmt"
+	"net/url"
 	"path"
+	"sort"
 	"strings"
 	"time"
 
@@ -31,6 +35,10 @@ var CoreFields = []*FieldConfig{
 	{Id: "core.Body"}}
 
 type Node struct {
+	// Id is a persistent unique identifier of the node which, unlike
+	// the path, does not change if the node gets moved. It's assigned
+	// on the first write of the node.
+	Id   string `json:",omitempty"`
 	Path string `json:",omitempty"`
 	// Content type of the node.
 	Type  *NodeType `json:"-"`
@@ -48,6 +56,21 @@ type Node struct {
 	// Changed is updated with the current time on every write to the
 	// database.
 	Changed time.Time
+	// ChangedBy holds the login of the user who made the last change.
+	ChangedBy string `json:",omitempty"`
+	// WorkflowState holds the state of the node's draft in the editorial
+	// workflow, e.g. "draft", "review", or "approved".
+	WorkflowState string `json:",omitempty"`
+	// Rename holds the new name of the node if its draft renames it.
+	// The node gets renamed when the draft gets published.
+	Rename string `json:",omitempty"`
+	// FieldsVersion is the number of applied field migrations of the
+	// node's type (see NodeType.FieldMigrations).
+	FieldsVersion int `json:",omitempty"`
+	// Translations holds the values of translatable fields (see
+	// FieldConfig.Translatable) per locale. Only translated fields are
+	// present.
+	Translations map[string]map[string]Field `json:"-"`
 }
 
 func (n *Node) InitFields(m *MonstiClient, site string) error {
@@ -55,6 +78,79 @@ func (n *Node) InitFields(m *MonstiClient, site string) error {
 	return initFields(n.Fields, n.Type.Fields, m, site)
 }
 
+// translatableFields returns the configurations of the translatable
+// fields of the given configurations.
+func translatableFields(configs []*FieldConfig) []*FieldConfig {
+	var ret []*FieldConfig
+	for _, config := range configs {
+		if config.Translatable {
+			ret = append(ret, config)
+		}
+	}
+	return ret
+}
+
+// InitTranslation adds all missing translatable fields to the
+// translation of the given locale. New fields get the values of the
+// untranslated fields.
+func (n *Node) InitTranslation(locale string, m *MonstiClient,
+	site string) error {
+	if n.Translations == nil {
+		n.Translations = make(map[string]map[string]Field)
+	}
+	translation := n.Translations[locale]
+	if translation == nil {
+		translation = make(map[string]Field)
+		n.Translations[locale] = translation
+	}
+	for _, config := range translatableFields(n.Type.Fields) {
+		if translation[config.Id] != nil {
+			continue
+		}
+		field := config.Type.Field()
+		if err := field.Init(m, site); err != nil {
+			return fmt.Errorf("Could not init field %q: %v", config.Id, err)
+		}
+		if n.Fields[config.Id] != nil {
+			field.FromFormData(n.Fields[config.Id].FormData())
+		}
+		translation[config.Id] = field
+	}
+	return nil
+}
+
+// Localized returns a copy of the node whose fields hold the
+// translations of the given locale. Untranslated fields keep their
+// values.
+func (n *Node) Localized(locale string) *Node {
+	ret := *n
+	translation := n.Translations[locale]
+	if len(translation) == 0 {
+		return &ret
+	}
+	ret.Fields = make(map[string]Field, len(n.Fields))
+	for id, field := range n.Fields {
+		ret.Fields[id] = field
+	}
+	for id, field := range translation {
+		ret.Fields[id] = field
+	}
+	return &ret
+}
+
+// TranslatedLocales returns the sorted locales of the node's
+// translations.
+func (n *Node) TranslatedLocales() []string {
+	var locales []string
+	for locale, translation := range n.Translations {
+		if len(translation) > 0 {
+			locales = append(locales, locale)
+		}
+	}
+	sort.Strings(locales)
+	return locales
+}
+
 // PathToID returns an ID for the given node based on it's path.
 //
 // The ID is simply the path of the node with all slashes replaced by two
@@ -70,6 +166,52 @@ func (n Node) PathToID() string {
 	return "node-" + strings.Replace(n.Path, "/", "__", -1)
 }
 
+// NewNodeId returns a new random node id (a version 4 UUID).
+func NewNodeId() string {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		panic(fmt.Sprintf("Could not read random bytes: %v", err))
+	}
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10],
+		id[10:])
+}
+
+// NodeURIScheme is the URI scheme to reference nodes by id, e.g.
+// "node:0b5ba3c4-cbd5-4ac6-9d2b-3e3b9b3a6e51?limit=5". Other than
+// paths, these references stay valid if the node gets moved.
+const NodeURIScheme = "node"
+
+// NodeURI returns the URI referencing the node by its id.
+func (n Node) NodeURI() string {
+	return NodeURIScheme + ":" + n.Id
+}
+
+// ParseNodeURI returns the node id of the given URI if it references a
+// node by id (see NodeURIScheme).
+func ParseNodeURI(uri *url.URL) (id string, ok bool) {
+	if uri.Scheme != NodeURIScheme || uri.Opaque == "" {
+		return "", false
+	}
+	return uri.Opaque, true
+}
+
+// NodeToken returns a token identifying the current revisions of the
+// given node and its draft (which may be nil).
+//
+// The token changes with every write to the node or its draft. It's
+// used to detect concurrent edits (see WriteNodeIfUnchanged).
+func NodeToken(node, draft *Node) string {
+	token := func(n *Node) string {
+		if n == nil {
+			return "none"
+		}
+		return n.Changed.UTC().Format(time.RFC3339Nano)
+	}
+	return token(node) + "/" + token(draft)
+}
+
 // DEPRECATED TypeToID returns an ID for the given node type.
 //
 // The ID is simply the type of the node with the namespace dot
@@ -116,8 +258,67 @@ type EmbedNode struct {
 	URI string
 }
 
+// NodeQuery describes a query for nodes of a subtree (see
+// MonstiClient.QueryNodes).
+//
+// Attributes of filters and sort keys are either node attributes
+// (e.g. `Type`, `Path`, `Order`, `Hide`, `Public`, `PublishTime`,
+// `Changed`, or `ChangedBy`) or field ids (e.g. `core.Title`).
 type NodeQuery struct {
-	Id string
+	// Path is the root of the queried subtree. The root itself is not
+	// part of the results.
+	Path string
+	// Depth limits the number of levels below Path, e.g. 1 for the
+	// children of Path only. Zero or less for the whole subtree.
+	Depth int
+	// Types restricts the results to nodes of the given node types.
+	Types []string
+	// Filters restricts the results to nodes matching all filters.
+	Filters []NodeFilter
+	// Sort lists the sort keys. Nodes with equal keys are sorted by
+	// path.
+	Sort []NodeSort
+	// Offset is the number of matching nodes to skip.
+	Offset int
+	// Limit is the maximum number of returned nodes. Zero or less for
+	// no limit.
+	Limit int
+}
+
+// NodeFilter compares an attribute of a node to a value.
+type NodeFilter struct {
+	// Attribute is the compared node attribute or field id.
+	Attribute string
+	// Op is one of "=", "!=", "<", "<=", ">", or ">=".
+	//
+	// Times (e.g. PublishTime) are compared chronologically, numbers
+	// numerically, and strings lexicographically. Nodes without the
+	// attribute only match the "!=" operator.
+	Op string
+	// Value is the value to compare with, e.g. a string, a number, a
+	// bool, or a time.Time.
+	Value interface{}
+}
+
+// NodeSort is a sort key of a node query.
+type NodeSort struct {
+	// Attribute is the node attribute or field id to sort by. Nodes
+	// without the attribute come first.
+	Attribute string
+	// Descending reverses the sort order.
+	Descending bool
+}
+
+// NodeQueryResult is the result of a node query.
+type NodeQueryResult struct {
+	// Nodes holds the matching nodes according to the query's offset and
+	// limit.
+	Nodes []*Node
+	// Total is the number of matching nodes ignoring offset and limit.
+	Total int
+	// Deps are the cache dependencies of the result. Data derived from
+	// the result should depend on these.
+	Deps []CacheDep
 }
 
 type NodeType struct {
@@ -147,4 +348,9 @@ type NodeType struct {
 	//
 	// Supported values: $year, $month, $day
 	PathPrefix string
+	// FieldMigrations describe the changes of Fields since the first
+	// version of the node type, oldest first. Append a migration
+	// whenever a field gets renamed, changes its type, or gets added
+	// with a default value.
+	FieldMigrations []FieldMigration
 }
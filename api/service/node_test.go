@@ -16,7 +16,9 @@
 package service
 
 import (
+	"net/url"
 	"reflect"
+	"regexp"
 	"testing"
 	"time"
 )
@@ -116,3 +118,135 @@ func TestNestedMap(t *testing.T) {
 		t.Errorf("Value is %q, should be 'hey'", ret)
 	}
 }
+
+func TestNodeToken(t *testing.T) {
+	older := &Node{Changed: time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)}
+	newer := &Node{Changed: older.Changed.Add(time.Nanosecond)}
+	tokens := map[string]bool{}
+	for _, pair := range [][2]*Node{
+		{older, nil}, {newer, nil}, {older, older}, {older, newer}} {
+		token := NodeToken(pair[0], pair[1])
+		if tokens[token] {
+			t.Errorf("NodeToken(%v, %v) = %q is not unique", pair[0], pair[1],
+				token)
+		}
+		tokens[token] = true
+	}
+	local := &Node{Changed: older.Changed.In(time.FixedZone("", 3600))}
+	if NodeToken(older, nil) != NodeToken(local, nil) {
+		t.Errorf("NodeToken should not depend on the time zone")
+	}
+}
+
+func TestNewNodeId(t *testing.T) {
+	idRegexp := regexp.MustCompile(
+		`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	ids := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		id := NewNodeId()
+		if !idRegexp.MatchString(id) {
+			t.Errorf("NewNodeId() = %q, should be a version 4 UUID", id)
+		}
+		if ids[id] {
+			t.Errorf("NewNodeId() returned %q twice", id)
+		}
+		ids[id] = true
+	}
+}
+
+func TestParseNodeURI(t *testing.T) {
+	tests := []struct {
+		URI, Id string
+		Ok      bool
+	}{
+		{"node:abc", "abc", true},
+		{"node:abc?limit=3", "abc", true},
+		{"/foo/bar", "", false},
+		{"node:", "", false},
+		{"http://example.com/node:abc", "", false},
+	}
+	for _, test := range tests {
+		uri, err := url.Parse(test.URI)
+		if err != nil {
+			t.Fatalf("Could not parse %q: %v", test.URI, err)
+		}
+		id, ok := ParseNodeURI(uri)
+		if id != test.Id || ok != test.Ok {
+			t.Errorf("ParseNodeURI(%q) = %q, %v, should be %q, %v", test.URI,
+				id, ok, test.Id, test.Ok)
+		}
+	}
+	if uri := (Node{Id: "abc"}).NodeURI(); uri != "node:abc" {
+		t.Errorf(`NodeURI() = %q, should be "node:abc"`, uri)
+	}
+}
+
+func TestNodeTranslations(t *testing.T) {
+	nodeType := NodeType{
+		Id: "foo.Bar",
+		Fields: []*FieldConfig{
+			{Id: "foo.Title", Type: new(TextFieldType), Translatable: true},
+			{Id: "foo.Body", Type: new(TextFieldType), Translatable: true},
+			{Id: "foo.Count", Type: new(IntegerFieldType)},
+		},
+	}
+	getNodeType := func(id string) (*NodeType, error) { return &nodeType, nil }
+	data := []byte(`{"Type": "foo.Bar",
+  "Fields": {"foo": {"Title": "Title", "Body": "Body", "Count": 3}},
+  "Translations": {
+    "de": {"foo": {"Title": "Titel", "Count": 4}},
+    "fr": {"foo": {}}}}`)
+	node, err := dataToNode(data, getNodeType, nil, "")
+	if err != nil {
+		t.Fatalf("dataToNode returns error: %v", err)
+	}
+	if locales := node.TranslatedLocales(); !reflect.DeepEqual(locales,
+		[]string{"de"}) {
+		t.Errorf(`TranslatedLocales() = %v, should be ["de"]`, locales)
+	}
+	tests := []struct {
+		Locale, Title, Body string
+	}{
+		{"en", "Title", "Body"},
+		{"de", "Titel", "Body"},
+	}
+	for _, test := range tests {
+		localized := node.Localized(test.Locale)
+		title := localized.Fields["foo.Title"].Value().(string)
+		body := localized.Fields["foo.Body"].Value().(string)
+		if title != test.Title || body != test.Body {
+			t.Errorf("Localized(%q) has title %q and body %q, should be %q and %q",
+				test.Locale, title, body, test.Title, test.Body)
+		}
+		if count := localized.Fields["foo.Count"].Value().(int); count != 3 {
+			t.Errorf("Localized(%q) has count %v, should be 3", test.Locale, count)
+		}
+	}
+	if title := node.Fields["foo.Title"].Value().(string); title != "Title" {
+		t.Errorf("Localized altered the node's title to %q", title)
+	}
+
+	if err := node.InitTranslation("fr", nil, ""); err != nil {
+		t.Fatalf("InitTranslation returns error: %v", err)
+	}
+	node.Translations["fr"]["foo.Body"].FromFormData("Corps")
+	out, err := nodeToData(node, false)
+	if err != nil {
+		t.Fatalf("nodeToData returns error: %v", err)
+	}
+	node, err = dataToNode(out, getNodeType, nil, "")
+	if err != nil {
+		t.Fatalf("dataToNode returns error: %v", err)
+	}
+	fr := node.Localized("fr")
+	if title := fr.Fields["foo.Title"].Value().(string); title != "Title" {
+		t.Errorf("French title is %q, should be \"Title\"", title)
+	}
+	if body := fr.Fields["foo.Body"].Value().(string); body != "Corps" {
+		t.Errorf("French body is %q, should be \"Corps\"", body)
+	}
+	de := node.Localized("de")
+	if title := de.Fields["foo.Title"].Value().(string); title != "Titel" {
+		t.Errorf("German title is %q, should be \"Titel\"", title)
+	}
+}
@@ -0,0 +1,74 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"fmt"
+	"html/template"
+)
+
+// SearchQuery is a query for the full-text search (see
+// MonstiClient.Search).
+type SearchQuery struct {
+	// Text holds the search terms. Nodes have to contain all terms. A
+	// term also matches words starting with the term.
+	Text string
+	// PublicOnly restricts the results to public nodes whose publish
+	// time has passed, i.e. nodes which may be viewed by anonymous
+	// users.
+	PublicOnly bool
+	// Offset is the number of hits to skip.
+	Offset int
+	// Limit is the maximum number of returned hits. Zero or less for no
+	// limit.
+	Limit int
+}
+
+// SearchHit is a node found by the full-text search.
+type SearchHit struct {
+	Path  string
+	Title string
+	// Snippet is an excerpt of the node's text with the matching words
+	// highlighted using mark elements.
+	Snippet template.HTML
+}
+
+// SearchResult is the result of a full-text search.
+type SearchResult struct {
+	// Hits holds the found nodes, best matches first, according to the
+	// query's offset and limit.
+	Hits []SearchHit
+	// Total is the number of found nodes ignoring offset and limit.
+	Total int
+}
+
+// Search searches the site's nodes using the full-text index.
+func (s *MonstiClient) Search(site string, query *SearchQuery) (
+	*SearchResult, error) {
+	if s.Error != nil {
+		return nil, s.Error
+	}
+	args := struct {
+		Site  string
+		Query SearchQuery
+	}{site, *query}
+	var reply SearchResult
+	if err := s.RPCClient.Call("Monsti.Search", args, &reply); err != nil {
+		return nil, fmt.Errorf("service: Search error: %v", err)
+	}
+	return &reply, nil
+}
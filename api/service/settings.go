@@ -32,6 +32,22 @@ func (n *Settings) StringValue(field string) string {
 	return n.Fields[field].Value().(string)
 }
 
+// Locales returns the locales of the site's content. The first one is
+// the default locale (core.Locale), followed by the locales of
+// translations (core.Locales).
+func (n *Settings) Locales() []string {
+	locale := n.StringValue("core.Locale")
+	locales := []string{locale}
+	if list, ok := n.Fields["core.Locales"].(*ListField); ok {
+		for _, field := range list.Fields {
+			if other := field.Value().(string); other != "" && other != locale {
+				locales = append(locales, other)
+			}
+		}
+	}
+	return locales
+}
+
 func (n *Settings) InitFields(m *MonstiClient, site string) error {
 	n.Fields = make(map[string]Field)
 	return initFields(n.Fields, n.FieldConfigs, m, site)
@@ -29,6 +29,8 @@ func init() {
 	gob.RegisterName("monsti.NodeContextRet", NodeContextRet{})
 	gob.RegisterName("monsti.RenderNodeArgs", RenderNodeArgs{})
 	gob.RegisterName("monsti.RenderNodeRet", RenderNodeRet{})
+	gob.RegisterName("monsti.ConvertFieldArgs", ConvertFieldArgs{})
+	gob.RegisterName("monsti.ConvertFieldRet", ConvertFieldRet{})
 	gob.Register(new(template.HTML))
 	gob.Register(new(htmlwidgets.RenderData))
 }
@@ -0,0 +1,397 @@
+// This file is part of Monsti.
+// Copyright 2012-2015 Christian Neumann
+
+// Monsti is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Lesser General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// Monsti is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// Lesser General Public License for more details.
+
+// You should have received a copy of the GNU Lesser General Public License
+// along with Monsti. If not, see <http://www.gnu.org/licenses/>.
+
+/*
+Package archive implements the archive format used to export and
+import whole Monsti sites.
+
+An archive is a gzip compressed tar file. Its first entry is the
+manifest (manifest.json), followed by the site's nodes, settings,
+users, site templates, and site statics as stored in the site's data
+directory.
+*/
+package archive
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ManifestName is the name of the manifest entry.
+const ManifestName = "manifest.json"
+
+// Entries lists the entries of a site's data directory which get
+// archived.
+var Entries = []string{"nodes", "settings.json", "users.json",
+	"templates", "site-static"}
+
+// Manifest describes an archive.
+type Manifest struct {
+	// MonstiVersion is the version of the site data.
+	MonstiVersion string
+	// Site is the name of the exported site.
+	Site string
+	// Created is the time of the export.
+	Created time.Time
+	// NodeTypes lists the ids of all node types used by the site's
+	// nodes.
+	NodeTypes []string
+}
+
+// walk calls fn for all files below the given directory, following
+// symbolic links. The paths are slash separated and relative to root.
+func walk(root, dir string, fn func(name string, info os.FileInfo) error) error {
+	infos, err := ioutil.ReadDir(filepath.Join(root, filepath.FromSlash(dir)))
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		name := path.Join(dir, info.Name())
+		// Skip temporary files of interrupted writes.
+		if strings.HasPrefix(info.Name(), ".tmp-") {
+			continue
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			info, err = os.Stat(filepath.Join(root, filepath.FromSlash(name)))
+			if err != nil {
+				return err
+			}
+		}
+		if info.IsDir() {
+			err = walk(root, name, fn)
+		} else {
+			err = fn(name, info)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nodeType returns the node type stored in the given node.json content.
+func nodeType(content []byte) (string, error) {
+	var node struct{ Type string }
+	if err := json.Unmarshal(content, &node); err != nil {
+		return "", err
+	}
+	return node.Type, nil
+}
+
+// siteFiles returns the archived files of the given site data
+// directory.
+func siteFiles(dataPath string) ([]string, error) {
+	var files []string
+	for _, entry := range Entries {
+		info, err := os.Stat(filepath.Join(dataPath, entry))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, entry)
+			continue
+		}
+		err = walk(dataPath, entry, func(name string, _ os.FileInfo) error {
+			files = append(files, name)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// Export writes an archive of the site with the given data directory.
+func Export(w io.Writer, dataPath, site string, now time.Time) (
+	*Manifest, error) {
+	files, err := siteFiles(dataPath)
+	if err != nil {
+		return nil, fmt.Errorf("archive: Could not list site files: %v", err)
+	}
+	manifest := Manifest{Site: site, Created: now, NodeTypes: []string{}}
+	version, err := ioutil.ReadFile(filepath.Join(dataPath, "version"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("archive: Could not read site version: %v", err)
+	}
+	manifest.MonstiVersion = strings.TrimSpace(string(version))
+	types := make(map[string]bool)
+	for _, file := range files {
+		if strings.HasPrefix(file, "nodes/") && path.Base(file) == "node.json" {
+			content, err := ioutil.ReadFile(filepath.Join(dataPath, file))
+			if err != nil {
+				return nil, fmt.Errorf("archive: Could not read node: %v", err)
+			}
+			nodeType, err := nodeType(content)
+			if err != nil {
+				return nil, fmt.Errorf("archive: Could not parse %v: %v", file, err)
+			}
+			if !types[nodeType] {
+				types[nodeType] = true
+				manifest.NodeTypes = append(manifest.NodeTypes, nodeType)
+			}
+		}
+	}
+	sort.Strings(manifest.NodeTypes)
+
+	gz := gzip.NewWriter(w)
+	archive := tar.NewWriter(gz)
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("archive: Could not encode manifest: %v", err)
+	}
+	if err := writeEntry(archive, ManifestName, content, now); err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		filePath := filepath.Join(dataPath, filepath.FromSlash(file))
+		content, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			return nil, fmt.Errorf("archive: Could not read %v: %v", file, err)
+		}
+		info, err := os.Stat(filePath)
+		if err != nil {
+			return nil, fmt.Errorf("archive: Could not stat %v: %v", file, err)
+		}
+		if err := writeEntry(archive, file, content, info.ModTime()); err != nil {
+			return nil, err
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return nil, fmt.Errorf("archive: Could not finish archive: %v", err)
+	}
+	if err := gz.Close(); err != nil {
+		return nil, fmt.Errorf("archive: Could not finish archive: %v", err)
+	}
+	return &manifest, nil
+}
+
+func writeEntry(archive *tar.Writer, name string, content []byte,
+	modTime time.Time) error {
+	header := &tar.Header{
+		Name:     name,
+		Mode:     0660,
+		Size:     int64(len(content)),
+		ModTime:  modTime,
+		Typeflag: tar.TypeReg,
+	}
+	if err := archive.WriteHeader(header); err != nil {
+		return fmt.Errorf("archive: Could not write header of %v: %v", name, err)
+	}
+	if _, err := archive.Write(content); err != nil {
+		return fmt.Errorf("archive: Could not write %v: %v", name, err)
+	}
+	return nil
+}
+
+// ImportOptions configures an import.
+type ImportOptions struct {
+	// Prefix is the node path to import the nodes to. If empty, a
+	// complete site including settings and users gets imported.
+	// Otherwise, only the nodes, site templates, and site statics get
+	// merged into the existing site. Existing templates and statics
+	// will not be overwritten.
+	Prefix string
+	// CheckManifest, if not nil, gets called with the archive's
+	// manifest before anything is written. Returning an error aborts
+	// the import.
+	CheckManifest func(*Manifest) error
+	// NodeTypes, if not nil, holds the known node types. Importing
+	// nodes of other types fails.
+	NodeTypes map[string]bool
+}
+
+// Import imports the given archive into the site with the given data
+// directory.
+//
+// The archive is extracted to a temporary directory first. The site
+// will only be modified if the whole archive could be read and
+// validated.
+func Import(r io.Reader, dataPath string, options ImportOptions) (
+	*Manifest, error) {
+	prefix := ""
+	if options.Prefix != "" {
+		prefix = strings.TrimPrefix(path.Clean("/"+options.Prefix), "/")
+	}
+	nodesTarget := filepath.Join(dataPath, "nodes", filepath.FromSlash(prefix))
+	if _, err := os.Stat(nodesTarget); err == nil {
+		return nil, fmt.Errorf("archive: Target %v does already exist",
+			nodesTarget)
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("archive: Could not stat target: %v", err)
+	}
+	version, err := ioutil.ReadFile(filepath.Join(dataPath, "version"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("archive: Could not read site version: %v", err)
+	}
+
+	if err := os.MkdirAll(dataPath, 0770); err != nil {
+		return nil, fmt.Errorf("archive: Could not create site directory: %v",
+			err)
+	}
+	tmp, err := ioutil.TempDir(dataPath, ".import-")
+	if err != nil {
+		return nil, fmt.Errorf("archive: Could not create temporary directory: %v",
+			err)
+	}
+	defer os.RemoveAll(tmp)
+	manifest, err := extract(r, tmp, options)
+	if err != nil {
+		return nil, err
+	}
+	if len(version) > 0 &&
+		strings.TrimSpace(string(version)) != manifest.MonstiVersion {
+		return nil, fmt.Errorf("archive: Archive has version %q, site has %q",
+			manifest.MonstiVersion, strings.TrimSpace(string(version)))
+	}
+
+	// Move the extracted files into place.
+	if prefix == "" {
+		for _, entry := range Entries {
+			err := os.Rename(filepath.Join(tmp, entry),
+				filepath.Join(dataPath, entry))
+			if err != nil && !os.IsNotExist(err) {
+				return nil, fmt.Errorf("archive: Could not move %v: %v", entry, err)
+			}
+		}
+		if len(version) == 0 && manifest.MonstiVersion != "" {
+			err := ioutil.WriteFile(filepath.Join(dataPath, "version"),
+				[]byte(manifest.MonstiVersion), 0660)
+			if err != nil {
+				return nil, fmt.Errorf("archive: Could not write version: %v", err)
+			}
+		}
+		return manifest, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(nodesTarget), 0770); err != nil {
+		return nil, fmt.Errorf("archive: Could not create parent node: %v", err)
+	}
+	err = os.Rename(filepath.Join(tmp, "nodes"), nodesTarget)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("archive: Could not move nodes: %v", err)
+	}
+	for _, entry := range []string{"templates", "site-static"} {
+		err := walk(tmp, entry, func(name string, _ os.FileInfo) error {
+			target := filepath.Join(dataPath, filepath.FromSlash(name))
+			if _, err := os.Stat(target); err == nil {
+				return nil
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0770); err != nil {
+				return err
+			}
+			return os.Rename(filepath.Join(tmp, filepath.FromSlash(name)), target)
+		})
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("archive: Could not merge %v: %v", entry, err)
+		}
+	}
+	return manifest, nil
+}
+
+// extract extracts the given archive to the given directory and
+// validates its content.
+func extract(r io.Reader, dir string, options ImportOptions) (*Manifest,
+	error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("archive: Could not open archive: %v", err)
+	}
+	defer gz.Close()
+	archive := tar.NewReader(gz)
+	var manifest *Manifest
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("archive: Could not read archive: %v", err)
+		}
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeRegA {
+			continue
+		}
+		content, err := ioutil.ReadAll(archive)
+		if err != nil {
+			return nil, fmt.Errorf("archive: Could not read %v: %v", header.Name,
+				err)
+		}
+		if manifest == nil {
+			if header.Name != ManifestName {
+				return nil, fmt.Errorf("archive: Missing manifest")
+			}
+			manifest = new(Manifest)
+			if err := json.Unmarshal(content, manifest); err != nil {
+				return nil, fmt.Errorf("archive: Could not decode manifest: %v", err)
+			}
+			if options.CheckManifest != nil {
+				if err := options.CheckManifest(manifest); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+		name := path.Clean(header.Name)
+		if !validName(name) {
+			return nil, fmt.Errorf("archive: Invalid entry %q", header.Name)
+		}
+		if options.NodeTypes != nil && strings.HasPrefix(name, "nodes/") &&
+			path.Base(name) == "node.json" {
+			nodeType, err := nodeType(content)
+			if err != nil {
+				return nil, fmt.Errorf("archive: Could not parse %v: %v", name, err)
+			}
+			if !options.NodeTypes[nodeType] {
+				return nil, fmt.Errorf("archive: Unknown node type %q of %v",
+					nodeType, name)
+			}
+		}
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(target), 0770); err != nil {
+			return nil, fmt.Errorf("archive: Could not create directory: %v", err)
+		}
+		if err := ioutil.WriteFile(target, content, 0660); err != nil {
+			return nil, fmt.Errorf("archive: Could not write %v: %v", name, err)
+		}
+	}
+	if manifest == nil {
+		return nil, fmt.Errorf("archive: Missing manifest")
+	}
+	return manifest, nil
+}
+
+// validName checks if the given cleaned entry name belongs to one of
+// the archived entries.
+func validName(name string) bool {
+	for _, entry := range Entries {
+		if name == entry || strings.HasPrefix(name, entry+"/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,129 @@
+// This file is part of Monsti.
+// Copyright 2012-2015 Christian Neumann
+
+// Monsti is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Lesser General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// Monsti is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// Lesser General Public License for more details.
+
+// You should have received a copy of the GNU Lesser General Public License
+// along with Monsti. If not, see <http://www.gnu.org/licenses/>.
+
+package archive
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	mtesting "pkg.monsti.org/monsti/api/util/testing"
+)
+
+func TestExportImport(t *testing.T) {
+	site := map[string]string{
+		"/version":                             "0.13.0",
+		"/nodes/node.json":                     `{"Type":"core.Document"}`,
+		"/nodes/foo/node.json":                 `{"Type":"core.Image"}`,
+		"/nodes/foo/__file_core.File":          "image",
+		"/nodes/foo/.tmp-node.json-123":        "partial",
+		"/settings.json":                       `{"Title":"site"}`,
+		"/users.json":                          `{}`,
+		"/templates/view/document.html":        "template",
+		"/site-static/logo.png":                "logo",
+		"/cache/foo/.data/foo.some_cache":      "cached",
+		"/history/foo/node.json.1":             "old",
+		"/trash/1/node.json":                   `{"Type":"core.Document"}`,
+		"/target/version":                      "0.13.0",
+		"/target/nodes/node.json":              `{"Type":"core.Document"}`,
+		"/target/templates/view/document.html": "existing",
+	}
+	root, cleanup, err := mtesting.CreateDirectoryTree(site, "TestExportImport")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	var buffer bytes.Buffer
+	now := time.Date(2016, 3, 1, 12, 0, 0, 0, time.UTC)
+	manifest, err := Export(&buffer, root, "site", now)
+	if err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+	expected := &Manifest{MonstiVersion: "0.13.0", Site: "site", Created: now,
+		NodeTypes: []string{"core.Document", "core.Image"}}
+	if !reflect.DeepEqual(manifest, expected) {
+		t.Errorf("Export returned manifest %v, should be %v", manifest, expected)
+	}
+	archive := buffer.Bytes()
+
+	// Import into a new site.
+	imported := filepath.Join(root, "imported")
+	_, err = Import(bytes.NewReader(archive), imported, ImportOptions{
+		NodeTypes: map[string]bool{"core.Document": true, "core.Image": true}})
+	if err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	for file, content := range map[string]string{
+		"version":                      "0.13.0",
+		"nodes/foo/__file_core.File":   "image",
+		"settings.json":                `{"Title":"site"}`,
+		"templates/view/document.html": "template",
+		"site-static/logo.png":         "logo",
+	} {
+		ret, err := ioutil.ReadFile(filepath.Join(imported, file))
+		if err != nil || string(ret) != content {
+			t.Errorf("Imported %v = %q, %v, should be %q", file, ret, err, content)
+		}
+	}
+	for _, file := range []string{"nodes/foo/.tmp-node.json-123",
+		"cache", "history", "trash"} {
+		if _, err := ioutil.ReadFile(filepath.Join(imported, file)); err == nil {
+			t.Errorf("%v should not have been imported", file)
+		}
+	}
+
+	// Merge into an existing site.
+	target := filepath.Join(root, "target")
+	_, err = Import(bytes.NewReader(archive), target, ImportOptions{
+		Prefix: "/sub/site"})
+	if err != nil {
+		t.Fatalf("Import with prefix failed: %v", err)
+	}
+	for file, content := range map[string]string{
+		"nodes/node.json":                     `{"Type":"core.Document"}`,
+		"nodes/sub/site/foo/__file_core.File": "image",
+		"templates/view/document.html":        "existing",
+		"site-static/logo.png":                "logo",
+	} {
+		ret, err := ioutil.ReadFile(filepath.Join(target, file))
+		if err != nil || string(ret) != content {
+			t.Errorf("Merged %v = %q, %v, should be %q", file, ret, err, content)
+		}
+	}
+	if _, err := ioutil.ReadFile(filepath.Join(target, "users.json")); err == nil {
+		t.Errorf("Merging should not import users")
+	}
+	_, err = Import(bytes.NewReader(archive), target, ImportOptions{
+		Prefix: "/sub/site"})
+	if err == nil || !strings.Contains(err.Error(), "already exist") {
+		t.Errorf("Import to existing path should fail, got %v", err)
+	}
+
+	// Unknown node types
+	_, err = Import(bytes.NewReader(archive), filepath.Join(root, "unknown"),
+		ImportOptions{NodeTypes: map[string]bool{"core.Document": true}})
+	if err == nil || !strings.Contains(err.Error(), "core.Image") {
+		t.Errorf("Import of unknown node types should fail, got %v", err)
+	}
+	if _, err := ioutil.ReadDir(filepath.Join(root, "unknown", "nodes")); err == nil {
+		t.Errorf("Failed import should not write any nodes")
+	}
+}
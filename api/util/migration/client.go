@@ -0,0 +1,58 @@
+// This file is part of Monsti.
+// Copyright 2012-2015 Christian Neumann
+
+// Monsti is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Lesser General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// Monsti is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// Lesser General Public License for more details.
+
+// You should have received a copy of the GNU Lesser General Public License
+// along with Monsti. If not, see <http://www.gnu.org/licenses/>.
+
+package migration
+
+import (
+	"fmt"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+// clientSite accesses a site through the Monsti service.
+type clientSite struct {
+	monsti *service.MonstiClient
+	site   string
+}
+
+// NewClientSite returns a Site which accesses the given site through
+// the Monsti service, e.g. to run migrations of modules.
+func NewClientSite(monsti *service.MonstiClient, site string) Site {
+	return &clientSite{monsti, site}
+}
+
+func (s *clientSite) Nodes() ([]string, error) {
+	nodes := []string{"/"}
+	for i := 0; i < len(nodes); i++ {
+		children, err := s.monsti.GetChildren(s.site, nodes[i])
+		if err != nil {
+			return nil, fmt.Errorf("Could not get children of %v: %v", nodes[i],
+				err)
+		}
+		for _, child := range children {
+			nodes = append(nodes, child.Path)
+		}
+	}
+	return nodes, nil
+}
+
+func (s *clientSite) ReadNodeFile(node, file string) ([]byte, error) {
+	return s.monsti.GetNodeData(s.site, node, file)
+}
+
+func (s *clientSite) WriteNodeFile(node, file string, content []byte) error {
+	return s.monsti.WriteNodeData(s.site, node, file, content)
+}
@@ -0,0 +1,196 @@
+// This file is part of Monsti.
+// Copyright 2012-2015 Christian Neumann
+
+// Monsti is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Lesser General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// Monsti is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// Lesser General Public License for more details.
+
+// You should have received a copy of the GNU Lesser General Public License
+// along with Monsti. If not, see <http://www.gnu.org/licenses/>.
+
+/*
+Package migration implements versioned migrations of site data.
+
+Migrations are numbered per module and registered by the core and by
+modules. Pending migrations get applied in order. The levels (i.e.
+the numbers of the last applied migrations) of all modules are stored
+in the `version` file of the site's data directory.
+*/
+package migration
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Site gives access to the data of a site to be migrated.
+type Site interface {
+	// Nodes returns the paths of all nodes of the site.
+	Nodes() ([]string, error)
+	// ReadNodeFile returns the content of the given node's file or a
+	// nil slice if it does not exist.
+	ReadNodeFile(node, file string) ([]byte, error)
+	// WriteNodeFile writes the given node's file.
+	WriteNodeFile(node, file string, content []byte) error
+}
+
+// Migration changes the data of sites.
+type Migration struct {
+	// Number orders the migrations of a module. Numbers start at 1 and
+	// must not be reused.
+	Number int
+	// Description tells what the migration does.
+	Description string
+	// Apply applies the migration to the given site. If dryRun is true,
+	// nothing must be changed. It returns descriptions of the (possibly
+	// only simulated) changes.
+	Apply func(site Site, dryRun bool) ([]string, error)
+}
+
+var (
+	registry      = make(map[string][]Migration)
+	registryMutex sync.RWMutex
+)
+
+// Register registers migrations of the given module, e.g. "core" or
+// the name of a module.
+func Register(module string, migrations ...Migration) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	registry[module] = append(registry[module], migrations...)
+}
+
+type byNumber []Migration
+
+func (n byNumber) Len() int           { return len(n) }
+func (n byNumber) Swap(i, j int)      { n[i], n[j] = n[j], n[i] }
+func (n byNumber) Less(i, j int) bool { return n[i].Number < n[j].Number }
+
+// Migrations returns the registered migrations of the given module
+// ordered by number.
+func Migrations(module string) []Migration {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+	migrations := append([]Migration(nil), registry[module]...)
+	sort.Sort(byNumber(migrations))
+	return migrations
+}
+
+// Levels maps modules to the number of their last applied migration.
+type Levels map[string]int
+
+// ParseVersion parses the content of a site's version file.
+//
+// Version files of Monsti 0.13 and earlier contain the plain Monsti
+// version. These are treated as sites without any applied migrations.
+func ParseVersion(content []byte) (Levels, error) {
+	content = []byte(strings.TrimSpace(string(content)))
+	levels := make(Levels)
+	if len(content) == 0 || content[0] != '{' {
+		return levels, nil
+	}
+	if err := json.Unmarshal(content, &levels); err != nil {
+		return nil, fmt.Errorf("migration: Could not parse version: %v", err)
+	}
+	return levels, nil
+}
+
+// FormatVersion returns the content of a version file holding the
+// given levels.
+func FormatVersion(levels Levels) []byte {
+	content, _ := json.Marshal(levels)
+	return content
+}
+
+// Run applies the given module's pending migrations in order.
+//
+// The levels get updated for each applied migration, even if a later
+// migration fails. In dry-run mode, nothing gets changed. The returned
+// report lists the migrations and their changes.
+func Run(site Site, levels Levels, module string, dryRun bool) (
+	[]string, error) {
+	var report []string
+	for _, migration := range Migrations(module) {
+		if migration.Number <= levels[module] {
+			continue
+		}
+		report = append(report, fmt.Sprintf("%v #%d: %v", module,
+			migration.Number, migration.Description))
+		changes, err := migration.Apply(site, dryRun)
+		for _, change := range changes {
+			report = append(report, "  "+change)
+		}
+		if err != nil {
+			return report, fmt.Errorf("migration: %v #%d failed: %v", module,
+				migration.Number, err)
+		}
+		if !dryRun {
+			levels[module] = migration.Number
+		}
+	}
+	return report, nil
+}
+
+// NodeFiles lists the node files EachNode works on.
+var NodeFiles = []string{"node.json", "node.draft.json"}
+
+// EachNode calls fn for the decoded data of all nodes and drafts of the
+// site. If fn returns true, the data gets written back unless dryRun
+// is true.
+func EachNode(site Site, dryRun bool,
+	fn func(node string, data map[string]interface{}) (bool, error)) (
+	[]string, error) {
+	nodes, err := site.Nodes()
+	if err != nil {
+		return nil, fmt.Errorf("Could not get nodes: %v", err)
+	}
+	var changes []string
+	for _, node := range nodes {
+		for _, file := range NodeFiles {
+			content, err := site.ReadNodeFile(node, file)
+			if err != nil {
+				return changes, fmt.Errorf("Could not read %v of %v: %v", file, node,
+					err)
+			}
+			if content == nil {
+				continue
+			}
+			var data map[string]interface{}
+			if err := json.Unmarshal(content, &data); err != nil {
+				return changes, fmt.Errorf("Could not decode %v of %v: %v", file,
+					node, err)
+			}
+			changed, err := fn(node, data)
+			if err != nil {
+				return changes, fmt.Errorf("Could not migrate %v of %v: %v", file,
+					node, err)
+			}
+			if !changed {
+				continue
+			}
+			changes = append(changes, fmt.Sprintf("%v of %v", file, node))
+			if dryRun {
+				continue
+			}
+			content, err = json.MarshalIndent(data, "", "  ")
+			if err != nil {
+				return changes, fmt.Errorf("Could not encode %v of %v: %v", file,
+					node, err)
+			}
+			if err := site.WriteNodeFile(node, file, content); err != nil {
+				return changes, fmt.Errorf("Could not write %v of %v: %v", file,
+					node, err)
+			}
+		}
+	}
+	return changes, nil
+}
@@ -0,0 +1,147 @@
+// This file is part of Monsti.
+// Copyright 2012-2015 Christian Neumann
+
+// Monsti is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Lesser General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// Monsti is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// Lesser General Public License for more details.
+
+// You should have received a copy of the GNU Lesser General Public License
+// along with Monsti. If not, see <http://www.gnu.org/licenses/>.
+
+package migration
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// testSite is a Site keeping node files in memory.
+type testSite map[string]map[string][]byte
+
+func (s testSite) Nodes() ([]string, error) {
+	var nodes []string
+	for _, node := range []string{"/", "/foo", "/bar"} {
+		if _, ok := s[node]; ok {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes, nil
+}
+
+func (s testSite) ReadNodeFile(node, file string) ([]byte, error) {
+	return s[node][file], nil
+}
+
+func (s testSite) WriteNodeFile(node, file string, content []byte) error {
+	s[node][file] = content
+	return nil
+}
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		Content string
+		Levels  Levels
+	}{
+		{"0.13.0\n", Levels{}},
+		{"", Levels{}},
+		{`{"core":2,"foo":1}`, Levels{"core": 2, "foo": 1}},
+	}
+	for _, test := range tests {
+		ret, err := ParseVersion([]byte(test.Content))
+		if err != nil || !reflect.DeepEqual(ret, test.Levels) {
+			t.Errorf("ParseVersion(%q) = %v, %v, should be %v, nil", test.Content,
+				ret, err, test.Levels)
+		}
+	}
+	if ret := string(FormatVersion(Levels{"foo": 1, "core": 2})); ret !=
+		`{"core":2,"foo":1}` {
+		t.Errorf("FormatVersion returned %q", ret)
+	}
+}
+
+func TestRun(t *testing.T) {
+	site := testSite{
+		"/": {"node.json": []byte(`{"Type":"core.Document"}`)},
+		"/foo": {"node.json": []byte(`{"Type":"test.Foo","Title":"foo"}`),
+			"node.draft.json": []byte(`{"Type":"test.Foo","Title":"draft"}`)},
+	}
+	var applied []int
+	rename := func(number int, from, to string) Migration {
+		return Migration{Number: number,
+			Description: fmt.Sprintf("Rename %v to %v", from, to),
+			Apply: func(site Site, dryRun bool) ([]string, error) {
+				applied = append(applied, number)
+				return EachNode(site, dryRun,
+					func(node string, data map[string]interface{}) (bool, error) {
+						value, ok := data[from]
+						if !ok {
+							return false, nil
+						}
+						delete(data, from)
+						data[to] = value
+						return true, nil
+					})
+			}}
+	}
+	// Registered out of order.
+	Register("test", rename(3, "Name", "Label"), rename(1, "Title", "Heading"),
+		rename(2, "Heading", "Name"))
+
+	levels := Levels{"test": 1}
+	report, err := Run(site, levels, "test", true)
+	if err != nil {
+		t.Fatalf("Dry run failed: %v", err)
+	}
+	expected := []string{"test #2: Rename Heading to Name",
+		"test #3: Rename Name to Label"}
+	if !reflect.DeepEqual(report, expected) {
+		t.Errorf("Dry run reported %v, should be %v", report, expected)
+	}
+	if levels["test"] != 1 || string(site["/foo"]["node.json"]) !=
+		`{"Type":"test.Foo","Title":"foo"}` {
+		t.Errorf("Dry run should not change anything")
+	}
+
+	applied = nil
+	levels = Levels{}
+	report, err = Run(site, levels, "test", false)
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if !reflect.DeepEqual(applied, []int{1, 2, 3}) || levels["test"] != 3 {
+		t.Errorf("Run applied %v up to level %v, should be [1 2 3] up to 3",
+			applied, levels["test"])
+	}
+	expected = []string{"test #1: Rename Title to Heading",
+		"  node.json of /foo", "  node.draft.json of /foo",
+		"test #2: Rename Heading to Name",
+		"  node.json of /foo", "  node.draft.json of /foo",
+		"test #3: Rename Name to Label",
+		"  node.json of /foo", "  node.draft.json of /foo"}
+	if !reflect.DeepEqual(report, expected) {
+		t.Errorf("Run reported %v, should be %v", report, expected)
+	}
+	for file, label := range map[string]string{"node.json": "foo",
+		"node.draft.json": "draft"} {
+		var data map[string]string
+		if err := json.Unmarshal(site["/foo"][file], &data); err != nil ||
+			data["Label"] != label || data["Title"] != "" {
+			t.Errorf("%v of /foo should have been migrated, got %s", file,
+				site["/foo"][file])
+		}
+	}
+
+	applied = nil
+	if _, err := Run(site, levels, "test", false); err != nil ||
+		len(applied) > 0 {
+		t.Errorf("Run should not apply migrations again (%v, %v)", applied, err)
+	}
+}
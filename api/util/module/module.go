@@ -27,6 +27,7 @@ import (
 
 	"pkg.monsti.org/gettext"
 	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util/migration"
 	"pkg.monsti.org/monsti/api/util/settings"
 	mtemplate "pkg.monsti.org/monsti/api/util/template"
 )
@@ -43,9 +44,21 @@ type ModuleContext struct {
 	Renderer *mtemplate.Renderer
 }
 
+// RequestRenderer returns a copy of the module's renderer which puts
+// the CSRF token of the given request's session into forms.
+func (c *ModuleContext) RequestRenderer(req *service.Request) *mtemplate.Renderer {
+	renderer := *c.Renderer
+	if req.Session != nil {
+		renderer.CSRFToken = req.Session.CSRFToken
+	}
+	return &renderer
+}
+
 // StartModule sets up the module with the given name.
 func StartModule(name string, setup func(context *ModuleContext) error) {
 	logger := log.New(os.Stderr, name+" ", log.LstdFlags)
+	dryRun := flag.Bool("dry-run", false,
+		"only report pending migrations of all sites and exit")
 	// Load configuration
 	flag.Parse()
 	if flag.NArg() != 1 {
@@ -69,11 +82,25 @@ func StartModule(name string, setup func(context *ModuleContext) error) {
 		logger.Fatalf("Could not get session: %v", err)
 	}
 	defer sessions.Free(session)
+	if err := migrateSites(name, settings, session.Monsti(), *dryRun,
+		logger); err != nil {
+		logger.Fatalf("Could not migrate sites: %v", err)
+	}
+	if *dryRun {
+		return
+	}
 	if err := setup(&ModuleContext{
 		settings, sessions, session, logger, &renderer,
 	}); err != nil {
 		logger.Fatalf("Could not setup module: %v", err)
 	}
+	// Let others use the module's field conversions.
+	if len(service.RegisteredFieldConversions()) > 0 {
+		err := session.Monsti().AddSignalHandler(service.NewConvertFieldHandler())
+		if err != nil {
+			logger.Fatalf("Could not add signal handler: %v", err)
+		}
+	}
 	if err := session.Monsti().ModuleInitDone(name); err != nil {
 		logger.Fatalf("Could not finish initialization: %v", err)
 	}
@@ -83,3 +110,41 @@ func StartModule(name string, setup func(context *ModuleContext) error) {
 		}
 	}
 }
+
+// migrateSites applies the module's pending migrations (see package
+// migration) to all sites.
+func migrateSites(name string, settings *settings.Monsti,
+	monsti *service.MonstiClient, dryRun bool, logger *log.Logger) error {
+	if len(migration.Migrations(name)) == 0 {
+		return nil
+	}
+	sites, err := settings.GetSites()
+	if err != nil {
+		return err
+	}
+	for _, site := range sites {
+		if _, err := monsti.InitSite(site); err != nil {
+			return err
+		}
+		levels, err := monsti.GetMigrationLevels(site)
+		if err != nil {
+			return err
+		}
+		before := levels[name]
+		report, err := migration.Run(migration.NewClientSite(monsti, site),
+			levels, name, dryRun)
+		for _, line := range report {
+			logger.Printf("Migrating site %v: %v", site, line)
+		}
+		if levels[name] != before {
+			if err := monsti.SetMigrationLevel(site, name,
+				levels[name]); err != nil {
+				return err
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
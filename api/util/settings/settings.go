@@ -20,6 +20,7 @@ package settings
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -112,6 +113,18 @@ func (s Monsti) GetSiteCachePath(site string) string {
 	return filepath.Join(s.Directories.Data, site, "cache")
 }
 
+// GetSiteHistoryPath returns the path to the given site's node
+// history directory.
+func (s Monsti) GetSiteHistoryPath(site string) string {
+	return filepath.Join(s.Directories.Data, site, "history")
+}
+
+// GetSiteTrashPath returns the path to the given site's trash
+// directory holding removed nodes.
+func (s Monsti) GetSiteTrashPath(site string) string {
+	return filepath.Join(s.Directories.Data, site, "trash")
+}
+
 // GetSiteNodesPath returns the path to the given site's node directory.
 func (s Monsti) GetSiteNodesPath(site string) string {
 	return filepath.Join(s.Directories.Data, site, "nodes")
@@ -129,6 +142,23 @@ func (s Monsti) GetSiteDataPath(site string) string {
 	return filepath.Join(s.Directories.Data, site)
 }
 
+// GetSites returns the names of all sites, i.e. the directories of
+// the data directory which hold a version file.
+func (s Monsti) GetSites() ([]string, error) {
+	dirs, err := ioutil.ReadDir(s.Directories.Data)
+	if err != nil {
+		return nil, err
+	}
+	var sites []string
+	for _, dir := range dirs {
+		version := filepath.Join(s.GetSiteDataPath(dir.Name()), "version")
+		if _, err := os.Stat(version); err == nil {
+			sites = append(sites, dir.Name())
+		}
+	}
+	return sites, nil
+}
+
 // GetSiteTemplatesPath returns the path to the given site's templates
 // directory.
 func (s Monsti) GetSiteTemplatesPath(site string) string {
@@ -36,10 +36,25 @@ import (
 // Context can be used to define a context for Render.
 type Context map[string]interface{}
 
+// CSRFFieldName is the name of the form field holding the CSRF token.
+const CSRFFieldName = "CSRFToken"
+
 // A Renderer for mustache templates.
 type Renderer struct {
 	// Root is the absolute path to the template directory.
 	Root string
+	// CSRFToken is the token put into forms using the csrfField
+	// template function. If it's empty, no field will be rendered.
+	CSRFToken string
+}
+
+// CSRFField returns a hidden form field holding the given CSRF token.
+func CSRFField(token string) template.HTML {
+	if token == "" {
+		return ""
+	}
+	return template.HTML(fmt.Sprintf(`<input type="hidden" name="%v" value="%v">`,
+		CSRFFieldName, template.HTMLEscapeString(token)))
 }
 
 // getIncludes searches for include and template.include files.
@@ -101,6 +116,9 @@ func IdToClass(id string) string {
 // <dir_of_template>/include
 // <any_parent_dir_of_template>/include
 //
+// Forms should call the csrfField function to include the
+// renderer's CSRF token.
+//
 // Returns the rendered template.
 func (r Renderer) Render(name string, context interface{},
 	locale string, siteTemplates string) ([]byte, error) {
@@ -119,6 +137,9 @@ func (r Renderer) Render(name string, context interface{},
 		"RawHTML": func(in interface{}) template.HTML {
 			return template.HTML(fmt.Sprintf("%s", in))
 		},
+		"csrfField": func() template.HTML {
+			return CSRFField(r.CSRFToken)
+		},
 	}
 	tmpl.Funcs(funcs)
 	err := parseSiteTemplate(name, tmpl, r.Root, siteTemplates)
@@ -33,3 +33,30 @@ func TestGetIncludes(t *testing.T) {
 			includes, err, expected)
 	}
 }
+
+func TestRenderCSRFField(t *testing.T) {
+	root, cleanup, err := mtesting.CreateDirectoryTree(map[string]string{
+		"/form.html": `<form>{{csrfField}}</form>`}, "TestRenderCSRFField")
+	if err != nil {
+		t.Fatalf("Could not create test directory tree: %v", err)
+	}
+	defer cleanup()
+	tests := []struct {
+		Token, Expected string
+	}{
+		{"", `<form></form>`},
+		{"foo\"bar", `<form><input type="hidden" name="CSRFToken" value="foo&#34;bar"></form>`},
+	}
+	for _, test := range tests {
+		renderer := Renderer{Root: root, CSRFToken: test.Token}
+		rendered, err := renderer.Render("form", nil, "", "")
+		if err != nil {
+			t.Errorf("Render with token %q returned error: %v", test.Token, err)
+			continue
+		}
+		if string(rendered) != test.Expected {
+			t.Errorf("Render with token %q returned %q, should be %q",
+				test.Token, rendered, test.Expected)
+		}
+	}
+}
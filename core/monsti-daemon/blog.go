@@ -25,40 +25,26 @@ import (
 	"fmt"
 	"log"
 	"net/url"
-
-	"sort"
 	"strconv"
+
 	"pkg.monsti.org/monsti/api/service"
 	"pkg.monsti.org/monsti/api/util/i18n"
-	"pkg.monsti.org/monsti/api/util/nodes"
 	mtemplate "pkg.monsti.org/monsti/api/util/template"
 )
 
+// getBlogPosts returns the posts of the given blog, newest first.
+//
+// Posts are stored below year and month nodes. If limit is positive,
+// at most limit posts will be returned.
 func getBlogPosts(req *service.Request, blogPath string, s *service.Session,
-	limit int) ([]*service.Node, error) {
-	var posts []*service.Node
-	years, err := s.Monsti().GetChildren(req.Site, blogPath)
-	if err != nil {
-		return nil, fmt.Errorf("Could not fetch year children: %v", err)
-	}
-	for _, year := range years {
-		months, err := s.Monsti().GetChildren(req.Site, year.Path)
-		if err != nil {
-			return nil, fmt.Errorf("Could not fetch month children: %v", err)
-		}
-		for _, month := range months {
-			monthPosts, err := s.Monsti().GetChildren(req.Site, month.Path)
-			if err != nil {
-				return nil, fmt.Errorf("Could not fetch month children: %v", err)
-			}
-			posts = append(posts, monthPosts...)
-		}
-	}
-	order := func(left, right *service.Node) bool {
-		return left.PublishTime.Before(right.PublishTime)
-	}
-	sort.Sort(sort.Reverse(&nodes.Sorter{posts, order}))
-	return posts, nil
+	limit int) (*service.NodeQueryResult, error) {
+	return s.Monsti().QueryNodes(req.Site, &service.NodeQuery{
+		Path:  blogPath,
+		Depth: 3,
+		Types: []string{"core.BlogPost"},
+		Sort:  []service.NodeSort{{Attribute: "PublishTime", Descending: true}},
+		Limit: limit,
+	})
 }
 
 func getBlogContext(reqId uint, embed *service.EmbedNode,
@@ -71,7 +57,11 @@ func getBlogContext(reqId uint, embed *service.EmbedNode,
 	query := req.Query
 	blogPath := req.NodePath
 	if embed != nil {
-		embedUrl, err := url.Parse(embed.URI)
+		embedURI, err := resolveNodeURI(s.Monsti(), req.Site, embed.URI)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Could not resolve embed URI: %v", err)
+		}
+		embedUrl, err := url.Parse(embedURI)
 		if err != nil {
 			return nil, nil, fmt.Errorf("Could not parse embed URI")
 		}
@@ -87,18 +77,17 @@ func getBlogContext(reqId uint, embed *service.EmbedNode,
 	}
 	context := mtemplate.Context{}
 	context["Embedded"] = embed
-	context["Posts"], err = getBlogPosts(req, blogPath, s, limit)
+	posts, err := getBlogPosts(req, blogPath, s, limit)
 	if err != nil {
 		return nil, nil, fmt.Errorf("Could not retrieve blog posts: %v", err)
 	}
+	context["Posts"] = posts.Nodes
 	rendered, err := renderer.Render("core/blogpost-list", context,
-		req.Session.Locale, settings.Monsti.GetSiteTemplatesPath(req.Site))
+		req.Locale, settings.Monsti.GetSiteTemplatesPath(req.Site))
 	if err != nil {
 		return nil, nil, fmt.Errorf("Could not render template: %v", err)
 	}
-	mods := &service.CacheMods{
-		Deps: []service.CacheDep{{Node: req.NodePath, Descend: 1}},
-	}
+	mods := &service.CacheMods{Deps: posts.Deps}
 	return map[string][]byte{"BlogPosts": rendered}, mods, nil
 }
 
@@ -0,0 +1,289 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/chrneumann/htmlwidgets"
+	"pkg.monsti.org/gettext"
+	"pkg.monsti.org/monsti/api/service"
+	mtemplate "pkg.monsti.org/monsti/api/util/template"
+)
+
+// renewNodeIdentity gives the given node data a fresh id and change
+// time, recording the given user as author.
+//
+// Any workflow state gets dropped as drafts are not copied.
+func renewNodeIdentity(content []byte, user string, now time.Time) (
+	[]byte, error) {
+	var node map[string]*json.RawMessage
+	if err := json.Unmarshal(content, &node); err != nil {
+		return nil, fmt.Errorf("Could not unmarshal node: %v", err)
+	}
+	set := func(key string, value interface{}) error {
+		raw, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		node[key] = (*json.RawMessage)(&raw)
+		return nil
+	}
+	if err := set("Id", service.NewNodeId()); err != nil {
+		return nil, err
+	}
+	if err := set("Changed", now); err != nil {
+		return nil, err
+	}
+	delete(node, "ChangedBy")
+	if user != "" {
+		if err := set("ChangedBy", user); err != nil {
+			return nil, err
+		}
+	}
+	delete(node, "WorkflowState")
+	return json.MarshalIndent(node, "", "  ")
+}
+
+// copyNode copies the given node including its data files to the
+// given target. If recursive is true, all descendants are copied,
+// too.
+//
+// Drafts and the history are not copied. The copies get fresh ids.
+func copyNode(nodes storage, source, target string, recursive bool,
+	user string, now time.Time) error {
+	source, target = path.Clean(source), path.Clean(target)
+	if _, err := nodes.Stat(source); err != nil {
+		return fmt.Errorf("Could not stat source: %v", err)
+	}
+	if _, err := nodes.Stat(target); err == nil {
+		return fmt.Errorf("Target %v does already exist", target)
+	}
+	if recursive && strings.HasPrefix(target+"/", source+"/") {
+		return fmt.Errorf("Can't copy %v into itself", source)
+	}
+	var copyDir func(source, target string) error
+	copyDir = func(source, target string) error {
+		entries, err := nodes.ReadDir(source)
+		if err != nil {
+			return err
+		}
+		if err := nodes.MkdirAll(target); err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			sourceFile := path.Join(source, entry.Name)
+			targetFile := path.Join(target, entry.Name)
+			switch {
+			case entry.IsDir:
+				if recursive {
+					if err := copyDir(sourceFile, targetFile); err != nil {
+						return err
+					}
+				}
+			case entry.Name == "node.json" ||
+				strings.HasPrefix(entry.Name, "__file_"):
+				content, err := nodes.ReadFile(sourceFile)
+				if err != nil {
+					return err
+				}
+				if entry.Name == "node.json" {
+					content, err = renewNodeIdentity(content, user, now)
+					if err != nil {
+						return fmt.Errorf("Could not copy %v: %v", sourceFile, err)
+					}
+				}
+				if err := nodes.WriteFile(targetFile, content); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	return copyDir(source, target)
+}
+
+// nodeTypeOf returns the type of the given node.
+func nodeTypeOf(nodes storage, node string) (string, error) {
+	content, err := nodes.ReadFile(path.Join(node, "node.json"))
+	if err != nil {
+		return "", fmt.Errorf("Could not read node: %v", err)
+	}
+	var data struct{ Type string }
+	if err := json.Unmarshal(content, &data); err != nil {
+		return "", fmt.Errorf("Could not decode node: %v", err)
+	}
+	return data.Type, nil
+}
+
+// isAddableTo checks if the type of the given node may be added to the
+// given parent node (see service.NodeType.AddableTo).
+func (i *MonstiService) isAddableTo(nodes storage, node, parent string) (
+	bool, error) {
+	nodeType, err := nodeTypeOf(nodes, node)
+	if err != nil {
+		return false, err
+	}
+	parentType, err := nodeTypeOf(nodes, parent)
+	if err != nil {
+		return false, err
+	}
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+	for _, addable := range findAddableNodeTypes(parentType,
+		i.Settings.Config.NodeTypes) {
+		if addable == nodeType {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+type CopyNodeArgs struct {
+	Site, Source, Target, User string
+	Recursive                  bool
+}
+
+func (i *MonstiService) CopyNode(args *CopyNodeArgs, reply *int) error {
+	i.siteMutexes[args.Site].Lock()
+	defer i.siteMutexes[args.Site].Unlock()
+	nodes := i.nodesStorage(args.Site)
+	parent := path.Dir(path.Clean(args.Target))
+	if _, err := nodes.Stat(path.Join(parent, "node.json")); err != nil {
+		return fmt.Errorf("Can't copy node: Parent %v does not exist", parent)
+	}
+	addable, err := i.isAddableTo(nodes, args.Source, parent)
+	if err != nil {
+		return fmt.Errorf("Could not check node type: %v", err)
+	}
+	if !addable {
+		return fmt.Errorf("Can't copy node: Its type may not be added to %v",
+			parent)
+	}
+	err = copyNode(nodes, args.Source, args.Target, args.Recursive,
+		args.User, time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("Can't copy node: %v", err)
+	}
+	if i.Settings.Workflow.Enabled {
+		err := unpublishNodes(nodes, args.Target)
+		if err != nil {
+			return fmt.Errorf("Could not unpublish copy: %v", err)
+		}
+	}
+	err = markDep(i.cacheStorage(args.Site),
+		service.CacheDep{Node: path.Dir(path.Clean(args.Target))}, 0)
+	if err != nil {
+		return fmt.Errorf("Could not mark parent of copy: %v", err)
+	}
+	i.reindexNodes(args.Site, path.Clean(args.Target), args.Recursive)
+	i.commitSite(args.Site, args.User,
+		fmt.Sprintf("Copy %v to %v", args.Source, args.Target))
+	return nil
+}
+
+type copyFormData struct {
+	Target    string
+	Recursive bool
+}
+
+// Copy handles copy requests.
+func (h *nodeHandler) Copy(c *reqContext) error {
+	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	m := c.Serv.Monsti()
+	data := copyFormData{Target: c.Node.Path + "-copy", Recursive: true}
+	form := htmlwidgets.NewForm(&data)
+	form.AddWidget(&htmlwidgets.TextWidget{
+		Regexp:          `^/[-\w./]*$`,
+		ValidationError: G("Please enter an absolute path.")},
+		"Target", G("Target"), G("The path of the copy."))
+	form.AddWidget(new(htmlwidgets.BoolWidget), "Recursive", G("Recursive"),
+		G("Copy all child nodes, too."))
+	switch c.Req.Method {
+	case "GET":
+	case "POST":
+		if form.Fill(c.Req.Form) {
+			target := path.Clean(data.Target)
+			existing, err := m.GetNode(c.Site, target)
+			if err != nil {
+				return fmt.Errorf("Could not fetch possibly existing node: %v", err)
+			}
+			if existing != nil {
+				form.AddError("Target", G("A node with this path does already exist."))
+				break
+			}
+			if data.Recursive &&
+				strings.HasPrefix(target+"/", path.Clean(c.Node.Path)+"/") {
+				form.AddError("Target",
+					G("A node can't be copied recursively into itself."))
+				break
+			}
+			parentPath := path.Dir(target)
+			parent, err := m.GetNode(c.Site, parentPath)
+			if err != nil {
+				return fmt.Errorf("Could not get parent of copy: %v", err)
+			}
+			if parent == nil {
+				form.AddError("Target", G("There is no parent node with this path."))
+				break
+			}
+			permitted, err := h.mayPerform(c, service.AddAction, parentPath)
+			if err != nil {
+				return fmt.Errorf("Could not check permission: %v", err)
+			}
+			if !permitted {
+				form.AddError("Target",
+					G("You are not allowed to add nodes to the chosen parent."))
+				break
+			}
+			addable, err := isAddable(m, c.Site, c.Node.Type.Id, parent.Type.Id)
+			if err != nil {
+				return err
+			}
+			if !addable {
+				form.AddError("Target",
+					G("Nodes of this type can't be added to the chosen parent."))
+				break
+			}
+			if err := m.CopyNodeAs(c.Site, c.Node.Path, target,
+				c.UserSession.User.Login, data.Recursive); err != nil {
+				return fmt.Errorf("Could not copy node: %v", err)
+			}
+			http.Redirect(c.Res, c.Req, target+"/", http.StatusSeeOther)
+			return nil
+		}
+	default:
+		return fmt.Errorf("Request method not supported: %v", c.Req.Method)
+	}
+	body, err := c.Renderer.Render("actions/copy", mtemplate.Context{
+		"Form": form.RenderData(), "Node": c.Node},
+		c.UserSession.Locale, h.Settings.Monsti.GetSiteTemplatesPath(c.Site))
+	if err != nil {
+		return fmt.Errorf("Can't render copy form: %v", err)
+	}
+	env := masterTmplEnv{Node: c.Node, Session: c.UserSession,
+		Flags: EDIT_VIEW, Title: G("Copy node")}
+	rendered, _ := renderInMaster(c.Renderer, []byte(body), env, h.Settings,
+		c.Site, c.SiteSettings, c.UserSession.Locale, c.Serv)
+	c.Res.Write(rendered)
+	return nil
+}
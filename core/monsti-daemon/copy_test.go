@@ -0,0 +1,148 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"pkg.monsti.org/monsti/api/service"
+	utesting "pkg.monsti.org/monsti/api/util/testing"
+)
+
+func TestCopyNode(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/foo/node.json":            `{"Id":"foo-id","Type":"core.Document","Changed":"2015-01-01T00:00:00Z","ChangedBy":"alice","WorkflowState":"review"}`,
+		"/foo/__file_body":          "body",
+		"/foo/node.draft.json":      `{"Id":"foo-id","Type":"core.Document"}`,
+		"/foo/child/node.json":      `{"Id":"child-id","Type":"core.Document"}`,
+		"/foo/child/__file_image":   "image",
+		"/foo/child/deep/node.json": `{"Id":"deep-id","Type":"core.Document"}`,
+	}, "TestCopyNode")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	nodes := newFSStorage(root)
+	now := time.Date(2016, 3, 1, 12, 0, 0, 0, time.UTC)
+	if err := copyNode(nodes, "/foo", "/bar", true, "bob", now); err != nil {
+		t.Fatalf("copyNode failed: %v", err)
+	}
+	ids := make(map[string]bool)
+	for _, dir := range []string{"/bar", "/bar/child", "/bar/child/deep"} {
+		content, err := nodes.ReadFile(dir + "/node.json")
+		if err != nil {
+			t.Fatalf("Could not read copy of %v: %v", dir, err)
+		}
+		var node struct {
+			Id, ChangedBy, WorkflowState string
+			Changed                      time.Time
+		}
+		if err := json.Unmarshal(content, &node); err != nil {
+			t.Fatalf("Could not unmarshal copy of %v: %v", dir, err)
+		}
+		if node.Id == "" || node.Id == "foo-id" || node.Id == "child-id" ||
+			node.Id == "deep-id" || ids[node.Id] {
+			t.Errorf("Copy of %v should get a fresh id, got %q", dir, node.Id)
+		}
+		ids[node.Id] = true
+		if !node.Changed.Equal(now) || node.ChangedBy != "bob" {
+			t.Errorf("Copy of %v should be changed by bob at %v, got %v at %v",
+				dir, now, node.ChangedBy, node.Changed)
+		}
+		if node.WorkflowState != "" {
+			t.Errorf("Copy of %v should have no workflow state, got %q", dir,
+				node.WorkflowState)
+		}
+	}
+	for file, expected := range map[string]string{
+		"/bar/__file_body":        "body",
+		"/bar/child/__file_image": "image",
+	} {
+		if ret, err := nodes.ReadFile(file); err != nil ||
+			string(ret) != expected {
+			t.Errorf("Copied file %v = %q, %v, should be %q", file, ret, err,
+				expected)
+		}
+	}
+	if _, err := nodes.Stat("/bar/node.draft.json"); !os.IsNotExist(err) {
+		t.Errorf("Drafts should not be copied: %v", err)
+	}
+	content, err := nodes.ReadFile("/foo/node.json")
+	if err != nil || nodeIdOf(content) != "foo-id" {
+		t.Errorf("Source should not be modified, got %s, %v", content, err)
+	}
+
+	if err := copyNode(nodes, "/foo", "/single", false, "", now); err != nil {
+		t.Fatalf("copyNode (non-recursive) failed: %v", err)
+	}
+	if _, err := nodes.Stat("/single/node.json"); err != nil {
+		t.Errorf("Non-recursive copy should copy the node: %v", err)
+	}
+	if _, err := nodes.Stat("/single/child"); !os.IsNotExist(err) {
+		t.Errorf("Non-recursive copy should not copy children: %v", err)
+	}
+
+	if err := copyNode(nodes, "/foo", "/bar", true, "", now); err == nil {
+		t.Errorf("copyNode to existing target should fail")
+	}
+	if err := copyNode(nodes, "/foo", "/foo/child/copy", true, "",
+		now); err == nil {
+		t.Errorf("copyNode into itself should fail")
+	}
+}
+
+func TestCopyNodeTarget(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/nodes/node.json":     `{"Type":"core.Folder"}`,
+		"/nodes/foo/node.json": `{"Type":"core.Document"}`,
+		"/nodes/img/node.json": `{"Type":"core.Image"}`,
+	}, "TestCopyNodeTarget")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	monsti := &MonstiService{
+		Settings:    new(settings),
+		siteMutexes: map[string]*sync.RWMutex{"site": new(sync.RWMutex)},
+		storages:    map[string]storage{"site": newFSStorage(root)},
+	}
+	monsti.Settings.Config.NodeTypes = map[string]*service.NodeType{
+		"core.Folder":   {Id: "core.Folder", AddableTo: []string{"."}},
+		"core.Document": {Id: "core.Document", AddableTo: []string{"core.Folder"}},
+		"core.Image":    {Id: "core.Image", AddableTo: []string{"."}},
+	}
+	copyTo := func(target string) error {
+		return monsti.CopyNode(&CopyNodeArgs{Site: "site", Source: "/foo",
+			Target: target}, new(int))
+	}
+	if err := copyTo("/missing/foo"); err == nil {
+		t.Errorf("Copying to a missing parent should fail")
+	}
+	if _, err := monsti.nodesStorage("site").Stat("missing"); !os.IsNotExist(err) {
+		t.Errorf("Failed copy should not create the target: %v", err)
+	}
+	if err := copyTo("/img/foo"); err == nil {
+		t.Errorf("Copying to a parent the type may not be added to should fail")
+	}
+	if err := copyTo("/bar"); err != nil {
+		t.Errorf("Could not copy node: %v", err)
+	}
+}
@@ -0,0 +1,89 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/sessions"
+	mtemplate "pkg.monsti.org/monsti/api/util/template"
+)
+
+// csrfPlaceholder is put into forms of possibly cached pages instead
+// of the session's CSRF token.
+const csrfPlaceholder = "@@csrf-token@@"
+
+// csrfHeader may be used instead of the form field to send the CSRF
+// token, e.g. by scripts.
+const csrfHeader = "X-CSRF-Token"
+
+// csrfToken returns the CSRF token of the request's session. If the
+// session does not have a token yet, a new one will be generated and
+// saved.
+func (c *reqContext) csrfToken() (string, error) {
+	if token, ok := c.Session.Values["csrf"].(string); ok && token != "" {
+		return token, nil
+	}
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("Could not generate token: %v", err)
+	}
+	token := base64.URLEncoding.EncodeToString(buf)
+	c.Session.Values["csrf"] = token
+	if err := c.Session.Save(c.Req, c.Res); err != nil {
+		return "", fmt.Errorf("Could not save session: %v", err)
+	}
+	return token, nil
+}
+
+// insertCSRFToken replaces the CSRF token placeholders of the given
+// page by the session's token.
+func (c *reqContext) insertCSRFToken(content []byte) ([]byte, error) {
+	if !bytes.Contains(content, []byte(csrfPlaceholder)) {
+		return content, nil
+	}
+	token, err := c.csrfToken()
+	if err != nil {
+		return nil, err
+	}
+	return bytes.Replace(content, []byte(csrfPlaceholder), []byte(token), -1),
+		nil
+}
+
+// checkCSRFToken checks if the request carries the CSRF token of the
+// given session, either as form field or as header.
+func checkCSRFToken(req *http.Request, session *sessions.Session) bool {
+	token, ok := session.Values["csrf"].(string)
+	if !ok || token == "" {
+		return false
+	}
+	sent := req.Header.Get(csrfHeader)
+	if sent == "" {
+		// Use the same memory limit as the edit action for file uploads.
+		err := req.ParseMultipartForm(1024 * 1024)
+		if err != nil && err != http.ErrNotMultipart {
+			return false
+		}
+		sent = req.PostFormValue(mtemplate.CSRFFieldName)
+	}
+	return subtle.ConstantTimeCompare([]byte(sent), []byte(token)) == 1
+}
@@ -0,0 +1,98 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCheckCSRFToken(t *testing.T) {
+	tests := []struct {
+		Session, Field, Header string
+		Valid                  bool
+	}{
+		{"", "", "", false},
+		{"foo", "", "", false},
+		{"foo", "bar", "", false},
+		{"foo", "foo", "", true},
+		{"foo", "", "foo", true},
+		{"foo", "foo", "bar", false},
+	}
+	for i, test := range tests {
+		form := url.Values{"CSRFToken": {test.Field}}
+		req, _ := http.NewRequest("POST", "http://example.com/foo",
+			strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if test.Header != "" {
+			req.Header.Set("X-CSRF-Token", test.Header)
+		}
+		session, err := getSession(req, "secret")
+		if err != nil {
+			t.Fatalf("Could not get session: %v", err)
+		}
+		if test.Session != "" {
+			session.Values["csrf"] = test.Session
+		}
+		if valid := checkCSRFToken(req, session); valid != test.Valid {
+			t.Errorf("Test %v: checkCSRFToken returned %v, should be %v",
+				i, valid, test.Valid)
+		}
+	}
+}
+
+func TestInsertCSRFToken(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://example.com/foo", nil)
+	res := httptest.NewRecorder()
+	session, err := getSession(req, "secret")
+	if err != nil {
+		t.Fatalf("Could not get session: %v", err)
+	}
+	c := reqContext{Req: req, Res: res, Session: session}
+
+	content, err := c.insertCSRFToken([]byte("<p>foo</p>"))
+	if err != nil || string(content) != "<p>foo</p>" {
+		t.Errorf(`insertCSRFToken returned %q, %v, should be "<p>foo</p>", nil`,
+			content, err)
+	}
+	if _, ok := session.Values["csrf"]; ok {
+		t.Errorf("insertCSRFToken should not create tokens for pages without forms")
+	}
+
+	content, err = c.insertCSRFToken([]byte(
+		`<input value="@@csrf-token@@"><input value="@@csrf-token@@">`))
+	if err != nil {
+		t.Fatalf("insertCSRFToken returned error: %v", err)
+	}
+	token, _ := session.Values["csrf"].(string)
+	if len(token) == 0 {
+		t.Fatalf("insertCSRFToken should create a token")
+	}
+	expected := `<input value="` + token + `"><input value="` + token + `">`
+	if string(content) != expected {
+		t.Errorf("insertCSRFToken returned %q, should be %q", content, expected)
+	}
+	if res.Header().Get("Set-Cookie") == "" {
+		t.Errorf("insertCSRFToken should save the session")
+	}
+	if other, _ := c.csrfToken(); other != token {
+		t.Errorf("csrfToken returned %q, should keep token %q", other, token)
+	}
+}
@@ -59,6 +59,25 @@ type settings struct {
 		Password string
 		Debug    bool
 	}
+	Storage struct {
+		// Backend selects the storage of nodes, node data, site
+		// settings, and the cache. Either "filesystem" (default) or
+		// "bolt".
+		Backend string
+		// Git enables keeping the site data directories in git
+		// repositories with a commit for each change. Requires the
+		// filesystem backend.
+		Git bool
+	}
+	// Workflow configures the editorial workflow for drafts.
+	Workflow workflowSettings
+	Trash    struct {
+		// Retention is the number of days removed nodes are kept in the
+		// trash. Zero keeps them forever.
+		Retention int
+	}
+	// Throttle limits failed logins and password requests.
+	Throttle throttleSettings
 }
 
 // moduleLog is a Writer used to log module messages on stderr.
@@ -79,6 +98,12 @@ func (s moduleLog) Write(p []byte) (int, error) {
 
 func main() {
 	useSyslog := flag.Bool("syslog", false, "use syslog")
+	migrate := flag.Bool("migrate", false,
+		"apply pending migrations of all sites and exit")
+	migrateFields := flag.Bool("migrate-fields", false,
+		"apply pending field migrations of all nodes after startup")
+	dryRun := flag.Bool("dry-run", false,
+		"with -migrate or -migrate-fields, only report pending migrations")
 
 	flag.Parse()
 
@@ -105,6 +130,13 @@ func main() {
 		logger.Fatal("Could not load settings: ", err)
 	}
 
+	if *migrate {
+		if err := migrateSites(&settings, *dryRun, logger); err != nil {
+			logger.Fatal("Could not migrate sites: ", err)
+		}
+		return
+	}
+
 	gettext.DefaultLocales.Domain = "monsti-daemon"
 	gettext.DefaultLocales.LocaleDir = settings.Monsti.Directories.Locale
 
@@ -143,6 +175,10 @@ func main() {
 		&renderer); err != nil {
 		logger.Fatalf("Could not init blog: %v", err)
 	}
+	if err := initSearch(&settings, session, sessions, logger,
+		&renderer); err != nil {
+		logger.Fatalf("Could not init search: %v", err)
+	}
 
 	// Wait for signals
 	go func() {
@@ -153,6 +189,19 @@ func main() {
 		}
 	}()
 
+	// Init sites, applying pending migrations before modules may
+	// access them.
+	monsti.siteMutexes = make(map[string]*sync.RWMutex)
+	sites, err := settings.Monsti.GetSites()
+	if err != nil {
+		logger.Fatalf("Could not get sites: %v", err)
+	}
+	for _, site := range sites {
+		if err := monsti.InitSite(&site, new(bool)); err != nil {
+			logger.Fatalf("Could not init site %v: %v", site, err)
+		}
+	}
+
 	// Start modules
 	monsti.moduleInit = make(map[string]chan bool)
 	modules := append([]string{"base"}, settings.Modules...)
@@ -175,15 +224,28 @@ func main() {
 		<-monsti.moduleInit[module]
 	}
 
+	if *migrateFields {
+		err := migrateSitesFields(&settings, sessions, *dryRun, logger)
+		if err != nil {
+			logger.Fatalf("Could not migrate fields: %v", err)
+		}
+	}
+
 	// Setup up httpd
+	adminLocales, err := findCatalogs(settings.Monsti.Directories.Locale,
+		gettext.DefaultLocales.Domain)
+	if err != nil {
+		logger.Fatalf("Could not find locales: %v", err)
+	}
 	handler := nodeHandler{
-		Renderer: renderer,
-		Settings: &settings,
-		Log:      logger,
-		Sessions: sessions,
+		Renderer:     renderer,
+		Settings:     &settings,
+		Log:          logger,
+		Sessions:     sessions,
+		AdminLocales: adminLocales,
+		Throttle:     newThrottle(settings.Throttle),
 	}
 	monsti.Handler = &handler
-	monsti.siteMutexes = make(map[string]*sync.RWMutex)
 
 	http.Handle("/static/", http.FileServer(http.Dir(
 		filepath.Dir(settings.Monsti.GetStaticsPath()))))
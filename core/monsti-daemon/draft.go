@@ -0,0 +1,121 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+
+	"github.com/chrneumann/htmlwidgets"
+	"pkg.monsti.org/gettext"
+	"pkg.monsti.org/monsti/api/service"
+	mtemplate "pkg.monsti.org/monsti/api/util/template"
+)
+
+type draftFormData struct {
+	Confirm string
+}
+
+// Publish replaces the published node with its draft.
+func (h *nodeHandler) Publish(c *reqContext) error {
+	return h.handleDraft(c, true)
+}
+
+// Discard removes the draft of a node.
+func (h *nodeHandler) Discard(c *reqContext) error {
+	return h.handleDraft(c, false)
+}
+
+// handleDraft shows the changes of the node's draft and publishes or
+// discards it on confirmation.
+func (h *nodeHandler) handleDraft(c *reqContext, publish bool) error {
+	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	m := c.Serv.Monsti()
+	draft, err := m.GetNodeDraft(c.Site, c.Node.Path)
+	if err != nil {
+		return fmt.Errorf("Could not get draft: %v", err)
+	}
+	data := draftFormData{}
+	form := htmlwidgets.NewForm(&data)
+	form.AddWidget(new(htmlwidgets.HiddenWidget), "Confirm", "", "")
+	switch c.Req.Method {
+	case "GET":
+		data.Confirm = "ok"
+	case "POST":
+		if form.Fill(c.Req.Form) && data.Confirm == "ok" && draft != nil {
+			if publish && !h.Settings.Workflow.mayPublish(c.UserSession.User,
+				draft) {
+				form.AddError("", G("The draft has to pass the workflow before it can be published."))
+				break
+			}
+			if publish {
+				err := m.PublishNodeDraftAs(c.Site, c.Node.Path,
+					c.UserSession.User.Login)
+				if err != nil {
+					return fmt.Errorf("Could not publish draft: %v", err)
+				}
+				nodePath := publishedPath(c.Node.Path, draft)
+				err = m.MarkDep(c.Site, service.CacheDep{Node: nodePath})
+				if err != nil {
+					return fmt.Errorf("Could not mark node: %v", err)
+				}
+				http.Redirect(c.Res, c.Req, nodePath+"/", http.StatusSeeOther)
+				return nil
+			}
+			err := m.DiscardNodeDraftAs(c.Site, c.Node.Path,
+				c.UserSession.User.Login)
+			if err != nil {
+				return fmt.Errorf("Could not discard draft: %v", err)
+			}
+			http.Redirect(c.Res, c.Req, path.Join(c.Node.Path, "@@edit"),
+				http.StatusSeeOther)
+			return nil
+		}
+	default:
+		return fmt.Errorf("Request method not supported: %v", c.Req.Method)
+	}
+	context := mtemplate.Context{"Node": c.Node, "Form": form.RenderData(),
+		"Publish": publish}
+	if draft != nil {
+		context["Diff"] = diffNodes(c.Node, draft, c.UserSession.Locale)
+	}
+	body, err := c.Renderer.Render("actions/draft", context,
+		c.UserSession.Locale, h.Settings.Monsti.GetSiteTemplatesPath(c.Site))
+	if err != nil {
+		return fmt.Errorf("Can't render draft form: %v", err)
+	}
+	env := masterTmplEnv{Node: c.Node, Session: c.UserSession,
+		Flags: EDIT_VIEW, Title: G("Discard draft")}
+	if publish {
+		env.Title = G("Publish draft")
+	}
+	rendered, _ := renderInMaster(c.Renderer, []byte(body), env, h.Settings,
+		c.Site, c.SiteSettings, c.UserSession.Locale, c.Serv)
+	c.Res.Write(rendered)
+	return nil
+}
+
+// publishedPath returns the path of the node at the given path after
+// the given draft has been published.
+func publishedPath(nodePath string, draft *service.Node) string {
+	nodePath = path.Clean(nodePath)
+	if draft.Rename == "" {
+		return nodePath
+	}
+	return path.Join(path.Dir(nodePath), draft.Rename)
+}
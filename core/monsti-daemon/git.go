@@ -0,0 +1,282 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+// gitIgnore lists the files of a site's data directory which will not
+// be kept in the git repository.
+//
+// The user database and the site settings are left out to not spread
+// password hashes and the session key. Trash and history would keep
+// removed content forever, the quarantine and temporary files are
+// left over by failed writes, and the version file is local to the
+// installation.
+const gitIgnore = `/cache/
+/users.json
+/settings.json
+/trash/
+/history/
+/quarantine/
+/version
+.tmp-*
+`
+
+// gitRepo is a git repository in a site's data directory.
+//
+// It uses the git command line client.
+type gitRepo struct {
+	// Dir is the root directory of the repository.
+	Dir string
+}
+
+// run runs git with the given arguments and returns its output.
+func (g *gitRepo) run(args ...string) ([]byte, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = g.Dir
+	cmd.Env = append(os.Environ(),
+		"GIT_COMMITTER_NAME=Monsti", "GIT_COMMITTER_EMAIL=monsti@localhost")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %v: %v: %v", args[0], err,
+			strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// openGitRepo opens the git repository in the given directory.
+//
+// If there is none, a new repository will be initialized and the
+// current content of the directory committed.
+func openGitRepo(dir string) (*gitRepo, error) {
+	repo := &gitRepo{dir}
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+		return repo, repo.updateIgnore()
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if _, err := repo.run("init", "-q"); err != nil {
+		return nil, err
+	}
+	err := ioutil.WriteFile(filepath.Join(dir, ".gitignore"),
+		[]byte(gitIgnore), 0660)
+	if err != nil {
+		return nil, fmt.Errorf("Could not write .gitignore: %v", err)
+	}
+	if err := repo.commit("Monsti", "monsti@localhost",
+		"Initial commit"); err != nil {
+		return nil, err
+	}
+	return repo, nil
+}
+
+// updateIgnore replaces an outdated .gitignore of the repository and
+// stops tracking the files ignored by now. These stay in the
+// repository's history.
+func (g *gitRepo) updateIgnore() error {
+	file := filepath.Join(g.Dir, ".gitignore")
+	content, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Could not read .gitignore: %v", err)
+	}
+	if string(content) == gitIgnore {
+		return nil
+	}
+	if err := ioutil.WriteFile(file, []byte(gitIgnore), 0660); err != nil {
+		return fmt.Errorf("Could not write .gitignore: %v", err)
+	}
+	ignored, err := g.run("ls-files", "-z", "--cached", "--ignored",
+		"--exclude-standard")
+	if err != nil {
+		return err
+	}
+	args := []string{"rm", "-q", "--cached", "--"}
+	for _, name := range strings.Split(string(ignored), "\x00") {
+		if name != "" {
+			args = append(args, name)
+		}
+	}
+	if len(args) > 4 {
+		if _, err := g.run(args...); err != nil {
+			return err
+		}
+	}
+	return g.commit("Monsti", "monsti@localhost", "Update .gitignore")
+}
+
+// commit commits all changes of the working tree using the given
+// author and message.
+//
+// Does nothing if there are no changes.
+func (g *gitRepo) commit(name, email, message string) error {
+	if _, err := g.run("add", "-A", "."); err != nil {
+		return err
+	}
+	status, err := g.run("status", "--porcelain")
+	if err != nil {
+		return err
+	}
+	if len(bytes.TrimSpace(status)) == 0 {
+		return nil
+	}
+	_, err = g.run("commit", "-q", "-m", message,
+		"--author", fmt.Sprintf("%v <%v>", name, email))
+	return err
+}
+
+// log returns the commits which touched the given path, newest first.
+func (g *gitRepo) log(p string) ([]*service.Commit, error) {
+	out, err := g.run("log", "--format=%H%x00%an%x00%ae%x00%at%x00%s",
+		"--", cleanStoragePath(p))
+	if err != nil {
+		return nil, err
+	}
+	var commits []*service.Commit
+	for _, line := range strings.Split(string(out), "\n") {
+		parts := strings.Split(line, "\x00")
+		if len(parts) != 5 {
+			continue
+		}
+		timestamp, err := strconv.ParseInt(parts[3], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse commit time: %v", err)
+		}
+		commits = append(commits, &service.Commit{
+			Id:      parts[0],
+			Author:  parts[1],
+			Email:   parts[2],
+			Time:    time.Unix(timestamp, 0).UTC(),
+			Message: parts[4],
+		})
+	}
+	return commits, nil
+}
+
+// validCommitId checks if the given string is a full commit hash.
+func validCommitId(id string) bool {
+	if len(id) != 40 {
+		return false
+	}
+	for _, c := range id {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// show returns the content of the given file at the given commit.
+//
+// If the file does not exist at this commit, it returns nil.
+func (g *gitRepo) show(commit, file string) ([]byte, error) {
+	if !validCommitId(commit) {
+		return nil, fmt.Errorf("Invalid commit %q", commit)
+	}
+	object := commit + ":" + cleanStoragePath(file)
+	if _, err := g.run("cat-file", "-e", object); err != nil {
+		return nil, nil
+	}
+	return g.run("show", object)
+}
+
+// commitSite commits the changes of the given site's data if the
+// site's data is kept in a git repository.
+//
+// The commit's author is the user with the given login. Failures are
+// logged as the change itself already succeeded.
+func (i *MonstiService) commitSite(site, login, message string) {
+	repo, ok := i.gitRepos[site]
+	if !ok {
+		return
+	}
+	name, email := "Monsti", "monsti@localhost"
+	if login != "" {
+		name, email = login, login+"@"+site
+		user, err := getUser(login, i.Settings.Monsti.GetSiteDataPath(site))
+		if err != nil {
+			i.Logger.Printf("Could not get author of commit: %v", err)
+		} else if user != nil {
+			if user.Name != "" {
+				name = user.Name
+			}
+			if user.Email != "" {
+				email = user.Email
+			}
+		}
+	}
+	if err := repo.commit(name, email, message); err != nil {
+		i.Logger.Printf("Could not commit changes of site %q: %v", site, err)
+	}
+}
+
+type GetNodeCommitsArgs struct {
+	Site, Path string
+}
+
+func (i *MonstiService) GetNodeCommits(args *GetNodeCommitsArgs,
+	reply *[]*service.Commit) error {
+	i.siteMutexes[args.Site].RLock()
+	defer i.siteMutexes[args.Site].RUnlock()
+	repo, ok := i.gitRepos[args.Site]
+	if !ok {
+		return nil
+	}
+	commits, err := repo.log(path.Join("nodes", args.Path, "node.json"))
+	if err != nil {
+		return fmt.Errorf("Could not get commits: %v", err)
+	}
+	*reply = commits
+	return nil
+}
+
+type GetNodeAtCommitArgs struct {
+	Site, Path, Commit string
+}
+
+func (i *MonstiService) GetNodeAtCommit(args *GetNodeAtCommitArgs,
+	reply *[]byte) error {
+	i.siteMutexes[args.Site].RLock()
+	defer i.siteMutexes[args.Site].RUnlock()
+	repo, ok := i.gitRepos[args.Site]
+	if !ok {
+		return nil
+	}
+	content, err := repo.show(args.Commit,
+		path.Join("nodes", args.Path, "node.json"))
+	if err != nil {
+		return fmt.Errorf("Could not read node at commit: %v", err)
+	}
+	if content != nil {
+		*reply = addNodePath(content, args.Path)
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	utesting "pkg.monsti.org/monsti/api/util/testing"
+)
+
+func TestGitRepo(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/nodes/foo/node.json":      `{"Type":"core.Foo"}`,
+		"/nodes/foo/.tmp-node.json": "partial",
+		"/cache/foo/data":           "cached",
+		"/trash/1/node.json":        `{"Type":"core.Foo"}`,
+		"/history/foo/node.json.1":  `{"Type":"core.Foo"}`,
+		"/settings.json":            `{"core":{"SessionAuthKey":"secret"}}`,
+		"/version":                  "core:1",
+		"/users.json":               "{}"},
+		"TestGitRepo")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	repo, err := openGitRepo(root)
+	if err != nil {
+		t.Fatalf("Could not open git repository: %v", err)
+	}
+	if err := repo.commit("Foo", "foo@example.com", "Nothing"); err != nil {
+		t.Fatalf("Could not commit: %v", err)
+	}
+	err = ioutil.WriteFile(filepath.Join(root, "nodes", "foo", "node.json"),
+		[]byte(`{"Type":"core.Bar"}`), 0660)
+	if err != nil {
+		t.Fatalf("Could not write node: %v", err)
+	}
+	if err := repo.commit("Foo", "foo@example.com", "Change"); err != nil {
+		t.Fatalf("Could not commit: %v", err)
+	}
+	commits, err := repo.log("/nodes/foo/node.json")
+	if err != nil || len(commits) != 2 {
+		t.Fatalf("log = %v, %v, should contain two commits", commits, err)
+	}
+	if commits[0].Author != "Foo" || commits[0].Email != "foo@example.com" ||
+		commits[0].Message != "Change" || commits[1].Message != "Initial commit" {
+		t.Errorf("log returned unexpected commits: %v, %v",
+			commits[0], commits[1])
+	}
+	ret, err := repo.show(commits[1].Id, "/nodes/foo/node.json")
+	if err != nil || string(ret) != `{"Type":"core.Foo"}` {
+		t.Errorf("show = %s, %v, should be the initial node", ret, err)
+	}
+	ret, err = repo.show(commits[1].Id, "/nodes/unknown/node.json")
+	if err != nil || ret != nil {
+		t.Errorf("show of unknown file = %s, %v, should be nil, nil", ret, err)
+	}
+	if _, err := repo.show("HEAD~1", "/nodes/foo/node.json"); err == nil {
+		t.Errorf("show should only accept commit hashes")
+	}
+	for _, file := range []string{"cache/foo/data", "users.json",
+		"nodes/foo/.tmp-node.json", "trash/1/node.json",
+		"history/foo/node.json.1", "settings.json", "version"} {
+		if commits, _ := repo.log(file); len(commits) != 0 {
+			t.Errorf("%v should not be committed", file)
+		}
+	}
+}
+
+func TestGitRepoUpdateIgnore(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/nodes/foo/node.json": `{"Type":"core.Foo"}`,
+		"/settings.json":       "{}",
+		"/trash/1/node.json":   `{"Type":"core.Foo"}`,
+		"/.gitignore":          "/cache/\n/users.json\n"},
+		"TestGitRepoUpdateIgnore")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	repo := &gitRepo{root}
+	if _, err := repo.run("init", "-q"); err != nil {
+		t.Fatalf("Could not init repository: %v", err)
+	}
+	if err := repo.commit("Foo", "foo@example.com", "Old"); err != nil {
+		t.Fatalf("Could not commit: %v", err)
+	}
+	if _, err := openGitRepo(root); err != nil {
+		t.Fatalf("Could not open git repository: %v", err)
+	}
+	tracked, err := repo.run("ls-files")
+	if err != nil {
+		t.Fatalf("Could not list files: %v", err)
+	}
+	expected := ".gitignore\nnodes/foo/node.json\n"
+	if string(tracked) != expected {
+		t.Errorf("Tracked files are %q, should be %q", tracked, expected)
+	}
+	if _, err := os.Stat(filepath.Join(root, "settings.json")); err != nil {
+		t.Errorf("Untracked files should be kept: %v", err)
+	}
+}
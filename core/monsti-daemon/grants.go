@@ -0,0 +1,355 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"pkg.monsti.org/gettext"
+	"pkg.monsti.org/monsti/api/service"
+	mtemplate "pkg.monsti.org/monsti/api/util/template"
+)
+
+// Grants give users roles within a subtree, e.g. the editor role
+// for /news. They are stored as grants.json in the directory of the
+// subtree's root node and map user logins to the granted roles.
+
+// grantsFile is the name of the grants file of a node.
+const grantsFile = "grants.json"
+
+// userRoles lists the roles which may be given to users, ordered by
+// their permissions.
+var userRoles = []string{"viewer", "author", "editor", "admin"}
+
+// rolePermissions lists the actions the users of each role may
+// perform. Anybody may view nodes, log in, and change passwords using
+// tokens.
+var rolePermissions = map[string][]service.Action{
+	"viewer": {service.ListAction, service.ChooserAction,
+		service.HistoryAction},
+	"author": {service.ListAction, service.ChooserAction,
+		service.HistoryAction, service.EditAction, service.AddAction,
+		service.DiscardAction, service.WorkflowAction},
+	"editor": {service.ListAction, service.ChooserAction,
+		service.HistoryAction, service.EditAction, service.AddAction,
+		service.DiscardAction, service.WorkflowAction, service.PublishAction,
+		service.RemoveAction, service.CopyAction, service.MoveAction,
+		service.RedirectsAction, service.TrashAction},
+	"admin": {service.ListAction, service.ChooserAction,
+		service.HistoryAction, service.EditAction, service.AddAction,
+		service.DiscardAction, service.WorkflowAction, service.PublishAction,
+		service.RemoveAction, service.CopyAction, service.MoveAction,
+		service.RedirectsAction, service.TrashAction, service.SettingsAction,
+		service.PermissionsAction, service.UsersAction},
+}
+
+// siteActions affect the whole site. Only roles granted on the root
+// node allow to perform them.
+var siteActions = map[service.Action]bool{
+	service.SettingsAction:  true,
+	service.RedirectsAction: true,
+	service.TrashAction:     true,
+	service.UsersAction:     true,
+}
+
+// readGrants reads the grants of the given node.
+func readGrants(nodes storage, nodePath string) (map[string][]string, error) {
+	grants := make(map[string][]string)
+	content, err := nodes.ReadFile(path.Join(nodePath, grantsFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return grants, nil
+		}
+		return nil, fmt.Errorf("Could not read grants: %v", err)
+	}
+	if err := json.Unmarshal(content, &grants); err != nil {
+		return nil, fmt.Errorf("Could not unmarshal grants: %v", err)
+	}
+	return grants, nil
+}
+
+// writeGrants writes the grants of the given node. Users without
+// roles get removed. If no grants are left, the grants file gets
+// removed.
+func writeGrants(nodes storage, nodePath string,
+	grants map[string][]string) error {
+	for login, roles := range grants {
+		if len(roles) == 0 {
+			delete(grants, login)
+		}
+	}
+	file := path.Join(nodePath, grantsFile)
+	if len(grants) == 0 {
+		if err := nodes.Remove(file); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Could not remove grants: %v", err)
+		}
+		return nil
+	}
+	content, err := json.MarshalIndent(grants, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Could not marshal grants: %v", err)
+	}
+	if err := nodes.WriteFile(file, content); err != nil {
+		return fmt.Errorf("Could not write grants: %v", err)
+	}
+	return nil
+}
+
+// grantedRoles returns the roles granted to the given user on the
+// given node and its ancestors.
+func grantedRoles(nodes storage, nodePath, login string) ([]string, error) {
+	var roles []string
+	nodePath = path.Clean("/" + nodePath)
+	for {
+		grants, err := readGrants(nodes, nodePath)
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, grants[login]...)
+		if nodePath == "/" {
+			return roles, nil
+		}
+		nodePath = path.Dir(nodePath)
+	}
+}
+
+type GetGrantsArgs struct {
+	Site, Path string
+}
+
+func (i *MonstiService) GetGrants(args *GetGrantsArgs,
+	reply *map[string][]string) error {
+	i.siteMutexes[args.Site].RLock()
+	defer i.siteMutexes[args.Site].RUnlock()
+	grants, err := readGrants(i.nodesStorage(args.Site), args.Path)
+	if err != nil {
+		return err
+	}
+	*reply = grants
+	return nil
+}
+
+type WriteGrantsArgs struct {
+	Site, Path, User string
+	Grants           map[string][]string
+}
+
+func (i *MonstiService) WriteGrants(args *WriteGrantsArgs, reply *int) error {
+	i.siteMutexes[args.Site].Lock()
+	defer i.siteMutexes[args.Site].Unlock()
+	err := writeGrants(i.nodesStorage(args.Site), args.Path, args.Grants)
+	if err != nil {
+		return err
+	}
+	i.commitSite(args.Site, args.User, fmt.Sprintf("Write grants of %v",
+		path.Clean("/"+args.Path)))
+	return nil
+}
+
+type GetGrantedRolesArgs struct {
+	Site, Path, Login string
+}
+
+func (i *MonstiService) GetGrantedRoles(args *GetGrantedRolesArgs,
+	reply *[]string) error {
+	i.siteMutexes[args.Site].RLock()
+	defer i.siteMutexes[args.Site].RUnlock()
+	roles, err := grantedRoles(i.nodesStorage(args.Site), args.Path,
+		args.Login)
+	if err != nil {
+		return err
+	}
+	*reply = roles
+	return nil
+}
+
+// getGrantedRolesFunc returns the roles granted to the given user on
+// the given node and its ancestors.
+type getGrantedRolesFunc func(nodePath, login string) ([]string, error)
+
+// effectiveRoles returns the global roles of the given user and the
+// ones granted on the given node or its ancestors.
+func effectiveRoles(user *service.User, nodePath string,
+	getGrantedRoles getGrantedRolesFunc) ([]string, error) {
+	granted, err := getGrantedRoles(nodePath, user.Login)
+	if err != nil {
+		return nil, fmt.Errorf("Could not get granted roles: %v", err)
+	}
+	return append(append([]string{}, user.Roles...), granted...), nil
+}
+
+// checkPermission checks if the session's user might perform the
+// given action on the given node.
+func checkPermission(action service.Action, session *service.UserSession,
+	nodePath string, getGrantedRoles getGrantedRolesFunc) (bool, error) {
+	switch action {
+	case service.ViewAction, service.LoginAction,
+		service.RequestPasswordTokenAction, service.ChangePasswordAction:
+		return true, nil
+	case service.LogoutAction, service.TwoFactorAction:
+		return session.User != nil, nil
+	}
+	if session.User == nil {
+		return false, nil
+	}
+	if siteActions[action] {
+		nodePath = "/"
+	}
+	roles, err := effectiveRoles(session.User, nodePath, getGrantedRoles)
+	if err != nil {
+		return false, err
+	}
+	for _, role := range roles {
+		for _, permitted := range rolePermissions[role] {
+			if permitted == action {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// hasRole returns true if the given roles contain the given role.
+func hasRole(roles []string, role string) bool {
+	for _, other := range roles {
+		if other == role {
+			return true
+		}
+	}
+	return false
+}
+
+// mayPerform checks if the request's user might perform the given
+// action on the given node.
+func (h *nodeHandler) mayPerform(c *reqContext, action service.Action,
+	nodePath string) (bool, error) {
+	return checkPermission(action, c.UserSession, nodePath,
+		func(nodePath, login string) ([]string, error) {
+			return c.Serv.Monsti().GetGrantedRoles(c.Site, nodePath, login)
+		})
+}
+
+// grantEntry is a row of the permissions page.
+type grantEntry struct {
+	Login string
+	Roles []string
+}
+
+type grantEntries []grantEntry
+
+func (g grantEntries) Len() int {
+	return len(g)
+}
+
+func (g grantEntries) Less(i, j int) bool {
+	return g[i].Login < g[j].Login
+}
+
+func (g grantEntries) Swap(i, j int) {
+	g[i], g[j] = g[j], g[i]
+}
+
+// Permissions lists the grants of the node and allows to add and
+// remove them.
+func (h *nodeHandler) Permissions(c *reqContext) error {
+	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	m := c.Serv.Monsti()
+	grants, err := m.GetGrants(c.Site, c.Node.Path)
+	if err != nil {
+		return fmt.Errorf("Could not get grants: %v", err)
+	}
+	context := mtemplate.Context{"Node": c.Node, "Roles": userRoles,
+		"Login": "", "Role": ""}
+	switch c.Req.Method {
+	case "GET":
+	case "POST":
+		login := strings.TrimSpace(c.Req.FormValue("Login"))
+		role := c.Req.FormValue("Role")
+		switch c.Req.FormValue("Do") {
+		case "add":
+			context["Login"], context["Role"] = login, role
+			if _, ok := rolePermissions[role]; !ok {
+				context["Error"] = G("Unknown role.")
+				break
+			}
+			user, err := getUser(login,
+				h.Settings.Monsti.GetSiteDataPath(c.Site))
+			if err != nil {
+				return fmt.Errorf("Could not get user: %v", err)
+			}
+			if user == nil {
+				context["Error"] = G("Unknown user.")
+				break
+			}
+			if hasRole(grants[login], role) {
+				context["Error"] = G("The role has already been granted to the user.")
+				break
+			}
+			grants[login] = append(grants[login], role)
+		case "remove":
+			found := false
+			for i, granted := range grants[login] {
+				if granted == role {
+					grants[login] = append(grants[login][:i], grants[login][i+1:]...)
+					found = true
+					break
+				}
+			}
+			if !found {
+				context["Error"] = G("Unknown grant.")
+			}
+		default:
+			context["Error"] = G("Unknown action.")
+		}
+		if context["Error"] != nil {
+			break
+		}
+		err := m.WriteGrants(c.Site, c.Node.Path, c.UserSession.User.Login,
+			grants)
+		if err != nil {
+			return fmt.Errorf("Could not write grants: %v", err)
+		}
+		http.Redirect(c.Res, c.Req, path.Join(c.Node.Path, "@@permissions"),
+			http.StatusSeeOther)
+		return nil
+	default:
+		return fmt.Errorf("Request method not supported: %v", c.Req.Method)
+	}
+	entries := make(grantEntries, 0, len(grants))
+	for login, roles := range grants {
+		entries = append(entries, grantEntry{login, roles})
+	}
+	sort.Sort(entries)
+	context["Grants"] = entries
+	body, err := c.Renderer.Render("actions/permissions", context,
+		c.UserSession.Locale, h.Settings.Monsti.GetSiteTemplatesPath(c.Site))
+	if err != nil {
+		return fmt.Errorf("Can't render permissions: %v", err)
+	}
+	env := masterTmplEnv{Node: c.Node, Session: c.UserSession,
+		Flags: EDIT_VIEW, Title: G("Permissions")}
+	rendered, _ := renderInMaster(c.Renderer, []byte(body), env, h.Settings,
+		c.Site, c.SiteSettings, c.UserSession.Locale, c.Serv)
+	c.Res.Write(rendered)
+	return nil
+}
@@ -0,0 +1,141 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"pkg.monsti.org/monsti/api/service"
+	utesting "pkg.monsti.org/monsti/api/util/testing"
+)
+
+func TestGrants(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/node.json":      "{}",
+		"/news/node.json": "{}",
+	}, "TestGrants")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	nodes := newFSStorage(root)
+	grants := map[string][]string{"intern": {"editor"}, "nobody": {}}
+	if err := writeGrants(nodes, "/news", grants); err != nil {
+		t.Fatalf("writeGrants returns error: %v", err)
+	}
+	err = writeGrants(nodes, "/", map[string][]string{
+		"intern": {"viewer"}, "bob": {"admin"}})
+	if err != nil {
+		t.Fatalf("writeGrants returns error: %v", err)
+	}
+	ret, err := readGrants(nodes, "/news")
+	if err != nil {
+		t.Fatalf("readGrants returns error: %v", err)
+	}
+	expected := map[string][]string{"intern": {"editor"}}
+	if !reflect.DeepEqual(ret, expected) {
+		t.Errorf("readGrants(...) = %v, should be %v", ret, expected)
+	}
+	tests := []struct {
+		Path, Login string
+		Roles       []string
+	}{
+		{"/", "intern", []string{"viewer"}},
+		{"/about", "intern", []string{"viewer"}},
+		{"/news", "intern", []string{"editor", "viewer"}},
+		{"/news/2016/foo/", "intern", []string{"editor", "viewer"}},
+		{"/news", "bob", []string{"admin"}},
+		{"/news", "alice", nil},
+	}
+	for _, test := range tests {
+		roles, err := grantedRoles(nodes, test.Path, test.Login)
+		if err != nil {
+			t.Fatalf("grantedRoles returns error: %v", err)
+		}
+		if !reflect.DeepEqual(roles, test.Roles) {
+			t.Errorf("grantedRoles(%q, %q) = %v, should be %v", test.Path,
+				test.Login, roles, test.Roles)
+		}
+	}
+	if err := writeGrants(nodes, "/news", map[string][]string{}); err != nil {
+		t.Fatalf("writeGrants returns error: %v", err)
+	}
+	if _, err := nodes.Stat("/news/grants.json"); err == nil {
+		t.Errorf("Empty grants should be removed")
+	}
+}
+
+func TestCheckPermissionRoles(t *testing.T) {
+	getGrantedRoles := func(nodePath, login string) ([]string, error) {
+		if login == "intern" && (nodePath == "/news" || nodePath == "/news/foo") {
+			return []string{"editor"}, nil
+		}
+		return nil, nil
+	}
+	users := map[string]*service.User{
+		"legacy": {Login: "legacy"},
+		"review": {Login: "review", Roles: []string{"reviewer"}},
+		"admin":  {Login: "admin", Roles: []string{"admin"}},
+		"author": {Login: "author", Roles: []string{"author", "reviewer"}},
+		"viewer": {Login: "viewer", Roles: []string{"viewer"}},
+		"intern": {Login: "intern", Roles: []string{"viewer"}},
+	}
+	tests := []struct {
+		User   string
+		Action service.Action
+		Path   string
+		Grant  bool
+	}{
+		{"", service.ViewAction, "/", true},
+		{"", service.EditAction, "/", false},
+		{"", service.LogoutAction, "/", false},
+		{"legacy", service.SettingsAction, "/", false},
+		{"legacy", service.ListAction, "/", false},
+		{"review", service.RemoveAction, "/about", false},
+		{"review", service.SettingsAction, "/", false},
+		{"review", service.LogoutAction, "/about", true},
+		{"admin", service.PermissionsAction, "/news", true},
+		{"admin", service.SettingsAction, "/", true},
+		{"author", service.EditAction, "/about", true},
+		{"author", service.PublishAction, "/about", false},
+		{"author", service.RemoveAction, "/about", false},
+		{"viewer", service.ListAction, "/about", true},
+		{"viewer", service.EditAction, "/about", false},
+		{"viewer", service.LogoutAction, "/about", true},
+		{"intern", service.EditAction, "/about", false},
+		{"intern", service.EditAction, "/news", true},
+		{"intern", service.RemoveAction, "/news/foo", true},
+		{"intern", service.PublishAction, "/news/foo", true},
+		{"intern", service.TrashAction, "/news", false},
+		{"intern", service.PermissionsAction, "/news", false},
+		{"intern", service.UsersAction, "/news", false},
+		{"admin", service.UsersAction, "/news", true},
+	}
+	for _, test := range tests {
+		session := &service.UserSession{User: users[test.User]}
+		ret, err := checkPermission(test.Action, session, test.Path,
+			getGrantedRoles)
+		if err != nil {
+			t.Fatalf("checkPermission returns error: %v", err)
+		}
+		if ret != test.Grant {
+			t.Errorf("checkPermission(%v, %q, %q) = %v, should be %v",
+				test.Action, test.User, test.Path, ret, test.Grant)
+		}
+	}
+}
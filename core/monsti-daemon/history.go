@@ -0,0 +1,207 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/chrneumann/htmlwidgets"
+	"pkg.monsti.org/gettext"
+	"pkg.monsti.org/monsti/api/service"
+	mtemplate "pkg.monsti.org/monsti/api/util/template"
+)
+
+// fieldDiff describes the difference of a single node attribute or
+// field between two revisions.
+type fieldDiff struct {
+	Name     string
+	Old, New string
+	Changed  bool
+}
+
+// fieldString returns a printable representation of the given field.
+func fieldString(field service.Field) string {
+	if field == nil {
+		return ""
+	}
+	if value, ok := field.Value().(string); ok {
+		return value
+	}
+	dump, err := json.Marshal(field.Dump())
+	if err != nil {
+		return fmt.Sprint(field.Value())
+	}
+	return string(dump)
+}
+
+// diffNodes compares the attributes and fields of the given nodes.
+//
+// The fields are taken from the node type of the newer node.
+func diffNodes(old, new *service.Node, locale string) []fieldDiff {
+	G, _, _, _ := gettext.DefaultLocales.Use("", locale)
+	diffs := []fieldDiff{
+		{Name: G("Public"), Old: fmt.Sprint(old.Public),
+			New: fmt.Sprint(new.Public)},
+		{Name: G("Hide"), Old: fmt.Sprint(old.Hide), New: fmt.Sprint(new.Hide)},
+		{Name: G("Order"), Old: fmt.Sprint(old.Order),
+			New: fmt.Sprint(new.Order)},
+		{Name: G("Publish time"), Old: old.PublishTime.Format(time.RFC3339),
+			New: new.PublishTime.Format(time.RFC3339)},
+	}
+	// Only drafts may rename nodes.
+	if old.Rename != "" || new.Rename != "" {
+		diffs = append(diffs, fieldDiff{Name: G("Name"),
+			Old: draftName(old), New: draftName(new)})
+	}
+	for _, field := range new.Type.Fields {
+		name := field.Name.Get(locale)
+		if name == "" {
+			name = field.Id
+		}
+		diffs = append(diffs, fieldDiff{
+			Name: name,
+			Old:  fieldString(old.Fields[field.Id]),
+			New:  fieldString(new.Fields[field.Id]),
+		})
+	}
+	for i := range diffs {
+		diffs[i].Changed = diffs[i].Old != diffs[i].New
+	}
+	return diffs
+}
+
+// draftName returns the name the node will have once the given draft
+// gets published.
+func draftName(draft *service.Node) string {
+	if draft.Rename != "" {
+		return draft.Rename
+	}
+	return draft.Name()
+}
+
+type restoreFormData struct {
+	Revision int
+	Commit   string
+}
+
+// getOldNode returns the node at the given commit or, if commit is
+// empty, at the given revision.
+func getOldNode(c *reqContext, revision int, commit string) (
+	*service.Node, error) {
+	if commit != "" {
+		return c.Serv.Monsti().GetNodeAtCommit(c.Site, c.Node.Path, commit)
+	}
+	return c.Serv.Monsti().GetNodeRevision(c.Site, c.Node.Path, revision)
+}
+
+// History lists the revisions of a node and allows to compare and
+// restore them.
+//
+// If the site's data is kept in git, the commits of the node are
+// listed, too.
+func (h *nodeHandler) History(c *reqContext) error {
+	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	m := c.Serv.Monsti()
+	data := restoreFormData{}
+	form := htmlwidgets.NewForm(&data)
+	form.AddWidget(new(htmlwidgets.HiddenWidget), "Revision", "", "")
+	form.AddWidget(new(htmlwidgets.HiddenWidget), "Commit", "", "")
+	context := mtemplate.Context{"Node": c.Node}
+	switch c.Req.Method {
+	case "GET":
+		revision, err := strconv.Atoi(c.Req.FormValue("revision"))
+		commit := c.Req.FormValue("commit")
+		if err == nil || commit != "" {
+			old, err := getOldNode(c, revision, commit)
+			if err != nil {
+				return fmt.Errorf("Could not get revision: %v", err)
+			}
+			if old != nil {
+				data.Revision = revision
+				data.Commit = commit
+				context["Revision"] = old
+				context["Diff"] = diffNodes(old, c.Node, c.UserSession.Locale)
+			}
+		}
+		context["Restored"] = c.Req.FormValue("restored")
+	case "POST":
+		if form.Fill(c.Req.Form) {
+			old, err := getOldNode(c, data.Revision, data.Commit)
+			if err != nil {
+				return fmt.Errorf("Could not get revision: %v", err)
+			}
+			if old != nil {
+				old.Path = c.Node.Path
+				// Keep the id, older revisions might not have one.
+				old.Id = c.Node.Id
+				old.ChangedBy = c.UserSession.User.Login
+				// Restored revisions have to pass the workflow, too.
+				if h.Settings.Workflow.Enabled {
+					old.WorkflowState = stateDraft
+					if err := m.WriteNodeDraft(c.Site, old.Path, old); err != nil {
+						return fmt.Errorf("Could not restore revision: %v", err)
+					}
+					http.Redirect(c.Res, c.Req, path.Join(c.Node.Path, "@@workflow"),
+						http.StatusSeeOther)
+					return nil
+				}
+				if err := m.WriteNode(c.Site, old.Path, old); err != nil {
+					return fmt.Errorf("Could not restore revision: %v", err)
+				}
+				err = m.MarkDep(c.Site, service.CacheDep{Node: path.Clean(old.Path)})
+				if err != nil {
+					return fmt.Errorf("Could not mark node: %v", err)
+				}
+				http.Redirect(c.Res, c.Req, path.Join(c.Node.Path,
+					"@@history?restored="+strconv.Itoa(data.Revision)),
+					http.StatusSeeOther)
+				return nil
+			}
+			form.AddError("", G("Unknown revision."))
+		}
+	default:
+		return fmt.Errorf("Request method not supported: %v", c.Req.Method)
+	}
+	revisions, err := m.GetNodeRevisions(c.Site, c.Node.Path)
+	if err != nil {
+		return fmt.Errorf("Could not get revisions: %v", err)
+	}
+	context["Revisions"] = revisions
+	commits, err := m.GetNodeCommits(c.Site, c.Node.Path)
+	if err != nil {
+		return fmt.Errorf("Could not get commits: %v", err)
+	}
+	context["Commits"] = commits
+	context["Git"] = h.Settings.Storage.Git
+	context["Form"] = form.RenderData()
+	body, err := c.Renderer.Render("actions/history", context,
+		c.UserSession.Locale, h.Settings.Monsti.GetSiteTemplatesPath(c.Site))
+	if err != nil {
+		return fmt.Errorf("Can't render history: %v", err)
+	}
+	env := masterTmplEnv{Node: c.Node, Session: c.UserSession,
+		Flags: EDIT_VIEW, Title: G("History")}
+	rendered, _ := renderInMaster(c.Renderer, []byte(body), env, h.Settings,
+		c.Site, c.SiteSettings, c.UserSession.Locale, c.Serv)
+	c.Res.Write(rendered)
+	return nil
+}
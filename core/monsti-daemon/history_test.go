@@ -0,0 +1,72 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+func TestDiffNodes(t *testing.T) {
+	nodeType := &service.NodeType{
+		Fields: []*service.FieldConfig{
+			{Id: "core.Title", Type: new(service.TextFieldType)},
+			{Id: "core.Body", Type: new(service.HTMLFieldType)},
+		},
+	}
+	newNode := func(title, body string, public bool) *service.Node {
+		node := &service.Node{Type: nodeType, Public: public}
+		if err := node.InitFields(nil, ""); err != nil {
+			t.Fatalf("Could not init fields: %v", err)
+		}
+		node.Fields["core.Title"].FromFormData(title)
+		node.Fields["core.Body"].FromFormData(body)
+		return node
+	}
+	old := newNode("Foo", "<p>Bar</p>", false)
+	current := newNode("Foo", "<p>Cruz</p>", true)
+	changed := make(map[string]fieldDiff)
+	for _, diff := range diffNodes(old, current, "en") {
+		if diff.Changed {
+			changed[diff.Name] = diff
+		}
+	}
+	if len(changed) != 2 {
+		t.Fatalf("diffNodes should find two changes, got %v", changed)
+	}
+	if diff := changed["core.Body"]; diff.Old != "<p>Bar</p>" ||
+		diff.New != "<p>Cruz</p>" {
+		t.Errorf("Wrong diff for core.Body: %v", diff)
+	}
+	if diff := changed["Public"]; diff.Old != "false" || diff.New != "true" {
+		t.Errorf("Wrong diff for Public: %v", diff)
+	}
+	current.Path = "/foo"
+	renamed := *current
+	renamed.Rename = "bar"
+	changed = make(map[string]fieldDiff)
+	for _, diff := range diffNodes(current, &renamed, "en") {
+		if diff.Changed {
+			changed[diff.Name] = diff
+		}
+	}
+	if diff := changed["Name"]; len(changed) != 1 || diff.Old != "foo" ||
+		diff.New != "bar" {
+		t.Errorf("diffNodes should find the new name, got %v", changed)
+	}
+}
@@ -0,0 +1,141 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// sourceLocale is the locale of the untranslated messages.
+const sourceLocale = "en"
+
+// findCatalogs returns the locales having a gettext catalog of the
+// given domain in the given locale directory. The source locale is
+// always available.
+func findCatalogs(dir, domain string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{sourceLocale}, nil
+		}
+		return nil, fmt.Errorf("Could not read locale directory: %v", err)
+	}
+	locales := []string{sourceLocale}
+	for _, entry := range entries {
+		if !entry.IsDir() || entry.Name() == sourceLocale {
+			continue
+		}
+		catalog := filepath.Join(dir, entry.Name(), "LC_MESSAGES", domain+".mo")
+		if _, err := os.Stat(catalog); err == nil {
+			locales = append(locales, entry.Name())
+		}
+	}
+	sort.Strings(locales)
+	return locales, nil
+}
+
+// acceptedLanguage is a language range of an Accept-Language header.
+type acceptedLanguage struct {
+	Tag     string
+	Quality float64
+}
+
+type acceptedLanguages []acceptedLanguage
+
+func (a acceptedLanguages) Len() int           { return len(a) }
+func (a acceptedLanguages) Less(i, j int) bool { return a[i].Quality > a[j].Quality }
+func (a acceptedLanguages) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+// parseAcceptLanguage returns the language tags of the given
+// Accept-Language header value ordered by their quality. Tags with a
+// quality of zero are omitted.
+func parseAcceptLanguage(header string) []string {
+	var languages acceptedLanguages
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		tag := strings.ToLower(strings.TrimSpace(params[0]))
+		if tag == "" {
+			continue
+		}
+		quality := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[2:], 64)
+				if err == nil {
+					quality = q
+				}
+			}
+		}
+		if quality > 0 {
+			languages = append(languages, acceptedLanguage{tag, quality})
+		}
+	}
+	sort.Stable(languages)
+	tags := make([]string, len(languages))
+	for i, language := range languages {
+		tags[i] = language.Tag
+	}
+	return tags
+}
+
+// negotiateLocale returns the first of the available locales matching
+// the given Accept-Language header value. A language tag matches a
+// locale if it equals the locale or if its primary language does,
+// e.g. "de-AT" matches "de". Returns an empty string if no locale
+// matches.
+func negotiateLocale(header string, available []string) string {
+	for _, tag := range parseAcceptLanguage(header) {
+		primary := strings.SplitN(tag, "-", 2)[0]
+		for _, candidate := range []string{tag, primary} {
+			for _, locale := range available {
+				normalized := strings.Replace(strings.ToLower(locale), "_", "-", -1)
+				if candidate == normalized {
+					return locale
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// adminLocale returns the locale of the admin interface for the
+// given request: The preferred locale of the user if set and
+// available, otherwise the negotiated locale of the client, falling
+// back to the site's locale.
+func (h *nodeHandler) adminLocale(c *reqContext) string {
+	if user := c.UserSession.User; user != nil && user.Locale != "" {
+		for _, locale := range h.AdminLocales {
+			if locale == user.Locale {
+				return locale
+			}
+		}
+	}
+	c.Res.Header().Add("Vary", "Accept-Language")
+	locale := negotiateLocale(c.Req.Header.Get("Accept-Language"),
+		h.AdminLocales)
+	if locale == "" {
+		locale = c.SiteSettings.StringValue("core.Locale")
+	}
+	return locale
+}
@@ -0,0 +1,85 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	utesting "pkg.monsti.org/monsti/api/util/testing"
+)
+
+func TestFindCatalogs(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/de/LC_MESSAGES/monsti-daemon.mo": "",
+		"/nl/LC_MESSAGES/monsti-daemon.mo": "",
+		"/fr/LC_MESSAGES/monsti-other.mo":  "",
+		"/monsti-daemon.pot":               "",
+	}, "TestFindCatalogs")
+	if err != nil {
+		t.Fatalf("Could not create locale directory: %v", err)
+	}
+	defer cleanup()
+	locales, err := findCatalogs(root, "monsti-daemon")
+	if err != nil {
+		t.Fatalf("findCatalogs returns error: %v", err)
+	}
+	expected := []string{"de", "en", "nl"}
+	if !reflect.DeepEqual(locales, expected) {
+		t.Errorf("findCatalogs(...) = %v, should be %v", locales, expected)
+	}
+}
+
+func TestParseAcceptLanguage(t *testing.T) {
+	tests := []struct {
+		Header string
+		Tags   []string
+	}{
+		{"", []string{}},
+		{"de", []string{"de"}},
+		{"de-DE,de;q=0.9,en;q=0.8", []string{"de-de", "de", "en"}},
+		{"en;q=0.5, nl, fr;q=0, DE;q=0.7", []string{"nl", "de", "en"}},
+		{"*", []string{"*"}},
+	}
+	for _, test := range tests {
+		ret := parseAcceptLanguage(test.Header)
+		if !reflect.DeepEqual(ret, test.Tags) {
+			t.Errorf("parseAcceptLanguage(%q) = %v, should be %v", test.Header,
+				ret, test.Tags)
+		}
+	}
+}
+
+func TestNegotiateLocale(t *testing.T) {
+	available := []string{"de", "en", "pt_BR"}
+	tests := []struct {
+		Header, Locale string
+	}{
+		{"", ""},
+		{"fr", ""},
+		{"de-AT,en;q=0.5", "de"},
+		{"fr,en;q=0.5,de;q=0.4", "en"},
+		{"pt-br", "pt_BR"},
+	}
+	for _, test := range tests {
+		ret := negotiateLocale(test.Header, available)
+		if ret != test.Locale {
+			t.Errorf("negotiateLocale(%q, %v) = %q, should be %q", test.Header,
+				available, ret, test.Locale)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util/migration"
+)
+
+func init() {
+	migration.Register("core", coreMigrations...)
+}
+
+// coreMigrations are the migrations of Monsti's core data.
+//
+// Never change or remove migrations which have been released. Append
+// new ones with the next number.
+var coreMigrations = []migration.Migration{
+	{Number: 1, Description: "Set missing publish and change times of nodes",
+		Apply: func(site migration.Site, dryRun bool) ([]string, error) {
+			now := time.Now().UTC()
+			return migration.EachNode(site, dryRun,
+				func(node string, data map[string]interface{}) (bool, error) {
+					changed := false
+					if _, ok := data["PublishTime"]; !ok {
+						data["PublishTime"] = now
+						data["Public"] = true
+						changed = true
+					}
+					if _, ok := data["Changed"]; !ok {
+						data["Changed"] = now
+						changed = true
+					}
+					return changed, nil
+				})
+		}},
+	{Number: 2, Description: "Give nodes without id a persistent id",
+		Apply: func(site migration.Site, dryRun bool) ([]string, error) {
+			// Drafts get the id of their node.
+			ids := make(map[string]string)
+			return migration.EachNode(site, dryRun,
+				func(node string, data map[string]interface{}) (bool, error) {
+					if id, _ := data["Id"].(string); id != "" {
+						ids[node] = id
+						return false, nil
+					}
+					if ids[node] == "" {
+						ids[node] = service.NewNodeId()
+					}
+					data["Id"] = ids[node]
+					return true, nil
+				})
+		}},
+	{Number: 3, Description: "Make users without roles administrators",
+		Apply: func(site migration.Site, dryRun bool) ([]string, error) {
+			// Before the introduction of roles, all users were allowed to
+			// do anything.
+			root := site.(*storageSite).root
+			if _, err := os.Stat(filepath.Join(root, "users.json")); os.IsNotExist(err) {
+				return nil, nil
+			}
+			users, err := getUserDatabase(root)
+			if err != nil {
+				return nil, err
+			}
+			var report []string
+			for login, user := range users {
+				if len(user.Roles) > 0 {
+					continue
+				}
+				user.Roles = []string{"admin"}
+				users[login] = user
+				report = append(report, fmt.Sprintf("users.json: %v", login))
+			}
+			if len(report) == 0 || dryRun {
+				return report, nil
+			}
+			return report, writeUserDatabase(users, root)
+		}},
+}
+
+// storageSite gives migrations access to the nodes of a site storage.
+type storageSite struct {
+	nodes storage
+	// root is the site's data directory.
+	root string
+}
+
+func (s *storageSite) Nodes() ([]string, error) {
+	var nodes []string
+	err := walkStorage(s.nodes, "/", func(file string, isDir bool) error {
+		if isDir {
+			nodes = append(nodes, file)
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return nodes, err
+}
+
+func (s *storageSite) ReadNodeFile(node, file string) ([]byte, error) {
+	content, err := s.nodes.ReadFile(path.Join(node, file))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return content, err
+}
+
+func (s *storageSite) WriteNodeFile(node, file string, content []byte) error {
+	return s.nodes.WriteFile(path.Join(node, file), content)
+}
+
+// readMigrationLevels reads the migration levels of the site with the
+// given data directory.
+func readMigrationLevels(root string) (migration.Levels, error) {
+	content, err := ioutil.ReadFile(filepath.Join(root, "version"))
+	if err != nil {
+		return nil, fmt.Errorf("Could not read version: %v", err)
+	}
+	version := strings.TrimSpace(string(content))
+	if !strings.HasPrefix(version, "{") && version != monstiVersion {
+		return nil, fmt.Errorf("Unsupported data version %v, expected %v",
+			version, monstiVersion)
+	}
+	return migration.ParseVersion(content)
+}
+
+// writeMigrationLevels writes the migration levels of the site with
+// the given data directory.
+func writeMigrationLevels(root string, levels migration.Levels) error {
+	err := writeFileAtomic(filepath.Join(root, "version"),
+		migration.FormatVersion(levels), 0660)
+	if err != nil {
+		return fmt.Errorf("Could not write version: %v", err)
+	}
+	return nil
+}
+
+// migrateSite applies the pending core migrations to the given site
+// storage and data directory.
+//
+// If any migration has been applied, the cache gets cleared. Returns
+// a report of the applied migrations and their changes.
+func migrateSite(site storage, root string, dryRun bool) ([]string, error) {
+	levels, err := readMigrationLevels(root)
+	if err != nil {
+		return nil, err
+	}
+	before := levels["core"]
+	report, err := migration.Run(&storageSite{storageDir(site, "nodes"), root},
+		levels, "core", dryRun)
+	if levels["core"] != before {
+		if err := writeMigrationLevels(root, levels); err != nil {
+			return report, err
+		}
+		if err := site.RemoveAll("cache"); err != nil {
+			return report, fmt.Errorf("Could not clear cache: %v", err)
+		}
+	}
+	return report, err
+}
+
+type GetMigrationLevelsArgs struct {
+	Site string
+}
+
+func (i *MonstiService) GetMigrationLevels(args *GetMigrationLevelsArgs,
+	reply *migration.Levels) error {
+	i.siteMutexes[args.Site].RLock()
+	defer i.siteMutexes[args.Site].RUnlock()
+	levels, err := readMigrationLevels(
+		i.Settings.Monsti.GetSiteDataPath(args.Site))
+	if err != nil {
+		return err
+	}
+	*reply = levels
+	return nil
+}
+
+type SetMigrationLevelArgs struct {
+	Site, Module string
+	Level        int
+}
+
+func (i *MonstiService) SetMigrationLevel(args *SetMigrationLevelArgs,
+	reply *int) error {
+	i.siteMutexes[args.Site].Lock()
+	defer i.siteMutexes[args.Site].Unlock()
+	root := i.Settings.Monsti.GetSiteDataPath(args.Site)
+	levels, err := readMigrationLevels(root)
+	if err != nil {
+		return err
+	}
+	levels[args.Module] = args.Level
+	if err := writeMigrationLevels(root, levels); err != nil {
+		return err
+	}
+	i.commitSite(args.Site, "",
+		fmt.Sprintf("Migrate %v to level %v", args.Module, args.Level))
+	return nil
+}
+
+// migrateSites applies the pending core migrations of all sites.
+func migrateSites(settings *settings, dryRun bool, logger *log.Logger) error {
+	sites, err := settings.Monsti.GetSites()
+	if err != nil {
+		return fmt.Errorf("Could not get sites: %v", err)
+	}
+	for _, site := range sites {
+		store, err := openStorage(settings, site)
+		if err != nil {
+			return fmt.Errorf("Could not open storage of %v: %v", site, err)
+		}
+		report, err := migrateSite(store, settings.Monsti.GetSiteDataPath(site),
+			dryRun)
+		if closeErr := closeStorage(store); closeErr != nil {
+			logger.Printf("Could not close storage of %v: %v", site, closeErr)
+		}
+		if len(report) == 0 && err == nil {
+			logger.Printf("Site %v is up to date", site)
+		}
+		for _, line := range report {
+			logger.Printf("Migrating site %v: %v", site, line)
+		}
+		if err != nil {
+			return fmt.Errorf("Could not migrate %v: %v", site, err)
+		}
+	}
+	return nil
+}
+
+// migrateSitesFields applies the pending field migrations (see
+// service.FieldMigration) of all nodes of all sites.
+//
+// Nodes which can't be migrated are logged and skipped.
+func migrateSitesFields(settings *settings, sessions *service.SessionPool,
+	dryRun bool, logger *log.Logger) error {
+	session, err := sessions.New()
+	if err != nil {
+		return fmt.Errorf("Could not get session: %v", err)
+	}
+	defer sessions.Free(session)
+	m := session.Monsti()
+	sites, err := settings.Monsti.GetSites()
+	if err != nil {
+		return fmt.Errorf("Could not get sites: %v", err)
+	}
+	for _, site := range sites {
+		nodes, err := migration.NewClientSite(m, site).Nodes()
+		if err != nil {
+			return fmt.Errorf("Could not get nodes of %v: %v", site, err)
+		}
+		for _, node := range nodes {
+			files, err := m.MigrateNodeFields(site, node, dryRun)
+			if err != nil {
+				logger.Printf("Could not migrate fields of %v on site %v: %v",
+					node, site, err)
+			}
+			for _, file := range files {
+				logger.Printf("Migrating fields of site %v: %v of %v", site, file,
+					node)
+			}
+		}
+	}
+	return nil
+}
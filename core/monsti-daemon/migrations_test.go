@@ -0,0 +1,107 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	utesting "pkg.monsti.org/monsti/api/util/testing"
+)
+
+func TestMigrateSite(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/site/version":                   "0.13.0\n",
+		"/site/nodes/node.json":           `{"Type":"core.Document","PublishTime":"2015-01-01T00:00:00Z","Changed":"2015-01-01T00:00:00Z"}`,
+		"/site/nodes/foo/node.json":       `{"Type":"core.Document","Id":"foo"}`,
+		"/site/nodes/foo/node.draft.json": `{"Type":"core.Document"}`,
+		"/site/cache/foo/.data/foo.some":  "cached",
+		"/site/users.json":                `{"legacy":{"Login":"legacy"},"bar":{"Login":"bar","Roles":["viewer"]}}`,
+		"/old/version":                    "0.12.0",
+	}, "TestMigrateSite")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	siteRoot := filepath.Join(root, "site")
+	site := newFSStorage(siteRoot)
+
+	report, err := migrateSite(site, siteRoot, true)
+	if err != nil || len(report) == 0 {
+		t.Fatalf("Dry run failed: %v, %v", report, err)
+	}
+	if content, _ := ioutil.ReadFile(filepath.Join(siteRoot,
+		"version")); string(content) != "0.13.0\n" {
+		t.Errorf("Dry run should not change the version, got %q", content)
+	}
+
+	if _, err = migrateSite(site, siteRoot, false); err != nil {
+		t.Fatalf("migrateSite failed: %v", err)
+	}
+	levels, err := readMigrationLevels(siteRoot)
+	if err != nil || levels["core"] != len(coreMigrations) {
+		t.Errorf("Site should be migrated to level %v, got %v, %v",
+			len(coreMigrations), levels, err)
+	}
+	var nodes [3]struct {
+		Id, PublishTime string
+		Public          bool
+	}
+	for i, file := range []string{"nodes/node.json", "nodes/foo/node.json",
+		"nodes/foo/node.draft.json"} {
+		content, err := site.ReadFile(file)
+		if err == nil {
+			err = json.Unmarshal(content, &nodes[i])
+		}
+		if err != nil {
+			t.Fatalf("Could not read %v: %v", file, err)
+		}
+	}
+	if nodes[0].Id == "" || nodes[0].PublishTime != "2015-01-01T00:00:00Z" ||
+		nodes[0].Public {
+		t.Errorf("Root node should only get an id, got %v", nodes[0])
+	}
+	if nodes[1].Id != "foo" || nodes[2].Id != "foo" || !nodes[1].Public {
+		t.Errorf("Draft should get the id of its node, got %v and %v", nodes[1],
+			nodes[2])
+	}
+	users, err := getUserDatabase(siteRoot)
+	if err != nil {
+		t.Fatalf("Could not read users: %v", err)
+	}
+	if roles := users["legacy"].Roles; len(roles) != 1 || roles[0] != "admin" {
+		t.Errorf("Users without roles should become admins, got %v", roles)
+	}
+	if roles := users["bar"].Roles; len(roles) != 1 || roles[0] != "viewer" {
+		t.Errorf("Roles of other users should be kept, got %v", roles)
+	}
+	if _, err := site.Stat("cache"); !os.IsNotExist(err) {
+		t.Errorf("Cache should be cleared after migrations: %v", err)
+	}
+	if report, err := migrateSite(site, siteRoot, false); err != nil ||
+		len(report) > 0 {
+		t.Errorf("Migrated site should be up to date, got %v, %v", report, err)
+	}
+
+	oldRoot := filepath.Join(root, "old")
+	if _, err := migrateSite(newFSStorage(oldRoot), oldRoot, false); err == nil {
+		t.Errorf("Sites with unsupported data versions should fail")
+	}
+}
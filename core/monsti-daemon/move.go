@@ -0,0 +1,143 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/chrneumann/htmlwidgets"
+	"pkg.monsti.org/gettext"
+	"pkg.monsti.org/monsti/api/service"
+	mtemplate "pkg.monsti.org/monsti/api/util/template"
+)
+
+// isAddable checks if nodes of the given type may be added to nodes of
+// the given parent type.
+func isAddable(m *service.MonstiClient, site, nodeType, parentType string) (
+	bool, error) {
+	types, err := m.GetAddableNodeTypes(site, parentType)
+	if err != nil {
+		return false, fmt.Errorf("Could not get addable node types: %v", err)
+	}
+	for _, addable := range types {
+		if addable == nodeType {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+type moveFormData struct {
+	Parent string
+}
+
+// Move handles requests to move a node to another parent.
+func (h *nodeHandler) Move(c *reqContext) error {
+	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	m := c.Serv.Monsti()
+	source := path.Clean(c.Node.Path)
+	data := moveFormData{Parent: path.Dir(source)}
+	if parent := c.Req.FormValue("parent"); parent != "" {
+		data.Parent = parent
+	}
+	form := htmlwidgets.NewForm(&data)
+	form.AddWidget(&htmlwidgets.TextWidget{
+		Regexp:          `^/[-\w./]*$`,
+		ValidationError: G("Please enter an absolute path.")},
+		"Parent", G("New parent"), G("The path of the node to move this node to."))
+	switch c.Req.Method {
+	case "GET":
+	case "POST":
+		if !form.Fill(c.Req.Form) {
+			break
+		}
+		parentPath := path.Clean(data.Parent)
+		target := path.Join(parentPath, path.Base(source))
+		if source == "/" {
+			form.AddError("Parent", G("The root node can't be moved."))
+			break
+		}
+		if target == source {
+			form.AddError("Parent", G("The node is already a child of this parent."))
+			break
+		}
+		if strings.HasPrefix(parentPath+"/", source+"/") {
+			form.AddError("Parent", G("A node can't be moved into itself."))
+			break
+		}
+		parent, err := m.GetNode(c.Site, parentPath)
+		if err != nil {
+			return fmt.Errorf("Could not get new parent: %v", err)
+		}
+		if parent == nil {
+			form.AddError("Parent", G("There is no node with this path."))
+			break
+		}
+		permitted, err := h.mayPerform(c, service.AddAction, parentPath)
+		if err != nil {
+			return fmt.Errorf("Could not check permission: %v", err)
+		}
+		if !permitted {
+			form.AddError("Parent",
+				G("You are not allowed to add nodes to the chosen parent."))
+			break
+		}
+		addable, err := isAddable(m, c.Site, c.Node.Type.Id, parent.Type.Id)
+		if err != nil {
+			return err
+		}
+		if !addable {
+			form.AddError("Parent",
+				G("Nodes of this type can't be added to the chosen parent."))
+			break
+		}
+		existing, err := m.GetNode(c.Site, target)
+		if err != nil {
+			return fmt.Errorf("Could not fetch possibly existing node: %v", err)
+		}
+		if existing != nil {
+			form.AddError("Parent",
+				G("The chosen parent already has a child with this name."))
+			break
+		}
+		err = m.RenameNodeAs(c.Site, source, target, c.UserSession.User.Login)
+		if err != nil {
+			return fmt.Errorf("Could not move node: %v", err)
+		}
+		http.Redirect(c.Res, c.Req, target+"/", http.StatusSeeOther)
+		return nil
+	default:
+		return fmt.Errorf("Request method not supported: %v", c.Req.Method)
+	}
+	body, err := c.Renderer.Render("actions/move", mtemplate.Context{
+		"Form":   form.RenderData(),
+		"Node":   c.Node,
+		"Parent": path.Dir(source)},
+		c.UserSession.Locale, h.Settings.Monsti.GetSiteTemplatesPath(c.Site))
+	if err != nil {
+		return fmt.Errorf("Can't render move form: %v", err)
+	}
+	env := masterTmplEnv{Node: c.Node, Session: c.UserSession,
+		Flags: EDIT_VIEW, Title: G("Move node")}
+	rendered, _ := renderInMaster(c.Renderer, []byte(body), env, h.Settings,
+		c.Site, c.SiteSettings, c.UserSession.Locale, c.Serv)
+	c.Res.Write(rendered)
+	return nil
+}
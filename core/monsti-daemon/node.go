@@ -68,6 +68,18 @@ func (nav *navigation) MakeAbsolute(root string) {
 	}
 }
 
+// AddPrefix adds the given prefix to the targets of the navigation
+// and its children.
+func (nav navigation) AddPrefix(prefix string) {
+	if prefix == "" {
+		return
+	}
+	for i := range nav {
+		nav[i].Target = prefix + nav[i].Target
+		nav[i].Children.AddPrefix(prefix)
+	}
+}
+
 // getNodeTitle tries to get a title of a node
 func getNodeTitle(node *service.Node) string {
 	title := "Untitled"
@@ -216,7 +228,7 @@ func (h *nodeHandler) Add(c *reqContext) error {
 		}
 		nodeTypes = append(nodeTypes, nodeType)
 	}
-	body, err := h.Renderer.Render("actions/add", mtemplate.Context{
+	body, err := c.Renderer.Render("actions/add", mtemplate.Context{
 		"Session":   c.UserSession,
 		"NodeTypes": nodeTypes}, c.UserSession.Locale,
 		h.Settings.Monsti.GetSiteTemplatesPath(c.Site))
@@ -225,7 +237,7 @@ func (h *nodeHandler) Add(c *reqContext) error {
 	}
 	env := masterTmplEnv{Node: c.Node, Session: c.UserSession,
 		Flags: EDIT_VIEW, Title: G("New child node")}
-	rendered, _ := renderInMaster(h.Renderer, []byte(body), env, h.Settings,
+	rendered, _ := renderInMaster(c.Renderer, []byte(body), env, h.Settings,
 		c.Site, c.SiteSettings, c.UserSession.Locale, c.Serv)
 	c.Res.Write(rendered)
 	return nil
@@ -246,7 +258,8 @@ func (h *nodeHandler) Remove(c *reqContext) error {
 		data.Confirm = "ok"
 	case "POST":
 		if form.Fill(c.Req.Form) && data.Confirm == "ok" {
-			if err := c.Serv.Monsti().RemoveNode(c.Site, c.Node.Path); err != nil {
+			if err := c.Serv.Monsti().TrashNode(c.Site, c.Node.Path,
+				c.UserSession.User.Login); err != nil {
 				return fmt.Errorf("Could not remove node: %v", err)
 			}
 			http.Redirect(c.Res, c.Req, path.Dir(c.Node.Path), http.StatusSeeOther)
@@ -255,7 +268,7 @@ func (h *nodeHandler) Remove(c *reqContext) error {
 	default:
 		return fmt.Errorf("Request method not supported: %v", c.Req.Method)
 	}
-	body, err := h.Renderer.Render("actions/removeform", mtemplate.Context{
+	body, err := c.Renderer.Render("actions/removeform", mtemplate.Context{
 		"Form": form.RenderData(), "Node": c.Node},
 		c.UserSession.Locale, h.Settings.Monsti.GetSiteTemplatesPath(c.Site))
 	if err != nil {
@@ -263,7 +276,7 @@ func (h *nodeHandler) Remove(c *reqContext) error {
 	}
 	env := masterTmplEnv{Node: c.Node, Session: c.UserSession,
 		Flags: EDIT_VIEW, Title: G("Remove node")}
-	rendered, _ := renderInMaster(h.Renderer, []byte(body), env, h.Settings,
+	rendered, _ := renderInMaster(c.Renderer, []byte(body), env, h.Settings,
 		c.Site, c.SiteSettings, c.UserSession.Locale, c.Serv)
 	c.Res.Write(rendered)
 	return nil
@@ -375,7 +388,7 @@ func (h *nodeHandler) View(c *reqContext) error {
 			}
 			c.Res.Write(content)
 		} else {
-			newPath, err := url.Parse(c.Node.Path + "/")
+			newPath, err := url.Parse(c.localePrefix() + c.Node.Path + "/")
 			if err != nil {
 				serveError("Could not parse request URL: %v", err)
 			}
@@ -385,12 +398,25 @@ func (h *nodeHandler) View(c *reqContext) error {
 		return nil
 	}
 
+	// Show the draft of the node to authenticated users if requested.
+	if _, ok := c.Req.Form["preview"]; ok && c.UserSession.User != nil {
+		draft, err := c.Serv.Monsti().GetNodeDraft(c.Site, c.Node.Path)
+		if err != nil {
+			return fmt.Errorf("Could not get draft: %v", err)
+		}
+		if draft != nil {
+			draft.Path = c.Node.Path
+			c.Node = draft
+		}
+	}
+	c.Node = c.Node.Localized(c.Locale)
+
 	var rendered []byte
 	var err error
 	mods := new(service.CacheMods)
 	if c.UserSession.User == nil && len(c.Req.Form) == 0 {
 		rendered, mods, err = c.Serv.Monsti().FromCache(c.Site, c.Node.Path,
-			"core.page.partial")
+			c.pageCacheId("core.page.partial"))
 		if err != nil {
 			return fmt.Errorf("Could not get partial cache: %v", err)
 		}
@@ -406,25 +432,51 @@ func (h *nodeHandler) View(c *reqContext) error {
 		}
 		if c.UserSession.User == nil && len(c.Req.Form) == 0 {
 			if err := c.Serv.Monsti().ToCache(c.Site, c.Node.Path,
-				"core.page.partial", rendered, mods); err != nil {
+				c.pageCacheId("core.page.partial"), rendered, mods); err != nil {
 				return fmt.Errorf("Could not cache page: %v", err)
 			}
 		}
 	}
-	env := masterTmplEnv{Node: c.Node, Session: c.UserSession}
-	content, renderMods := renderInMaster(h.Renderer, rendered, env, h.Settings,
+	env := masterTmplEnv{Node: c.Node, Session: c.UserSession, Locale: c.Locale}
+	content, renderMods := renderInMaster(c.Renderer, rendered, env, h.Settings,
 		c.Site, c.SiteSettings, c.UserSession.Locale, c.Serv)
 	mods.Join(renderMods)
 	if c.UserSession.User == nil && len(c.Req.Form) == 0 {
 		if err := c.Serv.Monsti().ToCache(c.Site, c.Node.Path,
-			"core.page.full", content, mods); err != nil {
+			c.pageCacheId("core.page.full"), content, mods); err != nil {
 			return fmt.Errorf("Could not cache page: %v", err)
 		}
 	}
+	content, err = c.insertCSRFToken(content)
+	if err != nil {
+		return fmt.Errorf("Could not insert CSRF token: %v", err)
+	}
 	c.Res.Write(content)
 	return nil
 }
 
+// resolveNodeURI replaces a URI referencing a node by id (see
+// service.NodeURIScheme) by the node's path, keeping the query. Other
+// URIs are returned unchanged.
+func resolveNodeURI(m *service.MonstiClient, site, uri string) (string, error) {
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return "", fmt.Errorf("Could not parse URI: %v", err)
+	}
+	id, ok := service.ParseNodeURI(parsed)
+	if !ok {
+		return uri, nil
+	}
+	node, err := m.GetNodeByID(site, id)
+	if err != nil {
+		return "", fmt.Errorf("Could not get node: %v", err)
+	}
+	if node == nil {
+		return "", fmt.Errorf("There is no node with id %q", id)
+	}
+	return (&url.URL{Path: node.Path, RawQuery: parsed.RawQuery}).String(), nil
+}
+
 // calcEmbedPath calculates the embed path for the given node path and
 // embed URI.
 func calcEmbedPath(nodePath, embedURI string) (string, error) {
@@ -447,7 +499,11 @@ func (h *nodeHandler) RenderNode(c *reqContext, embedNode *service.EmbedNode) (
 	mods := &service.CacheMods{Deps: []service.CacheDep{{Node: c.Node.Path}}}
 	reqNode := c.Node
 	if embedNode != nil {
-		embedPath, err := calcEmbedPath(reqNode.Path, embedNode.URI)
+		embedURI, err := resolveNodeURI(c.Serv.Monsti(), c.Site, embedNode.URI)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Could not resolve embed URI: %v", err)
+		}
+		embedPath, err := calcEmbedPath(reqNode.Path, embedURI)
 		if err != nil {
 			return nil, nil, fmt.Errorf("Could not get calculate path: %v", err)
 		}
@@ -456,6 +512,7 @@ func (h *nodeHandler) RenderNode(c *reqContext, embedNode *service.EmbedNode) (
 			return nil, nil, fmt.Errorf("Could not find node %q to embed: %v",
 				embedPath, err)
 		}
+		reqNode = reqNode.Localized(c.Locale)
 	}
 	context := make(mtemplate.Context)
 
@@ -506,8 +563,8 @@ func (h *nodeHandler) RenderNode(c *reqContext, embedNode *service.EmbedNode) (
 	template := strings.Replace(reqNode.Type.Id, ".", "/", 1) + "-view"
 
 	context["Site"] = c.Site
-	rendered, err := h.Renderer.Render(template, context,
-		c.UserSession.Locale, h.Settings.Monsti.GetSiteTemplatesPath(c.Site))
+	rendered, err := c.Renderer.Render(template, context,
+		c.Locale, h.Settings.Monsti.GetSiteTemplatesPath(c.Site))
 	if err != nil {
 		return nil, nil, fmt.Errorf("Could not render template: %v", err)
 	}
@@ -519,6 +576,9 @@ type editFormData struct {
 	Name     string
 	Node     service.Node
 	Fields   service.NestedMap
+	// Token identifies the revision of the node and its draft the
+	// edit is based on.
+	Token string
 }
 
 // EditNode handles node edits.
@@ -543,18 +603,63 @@ func (h *nodeHandler) Edit(c *reqContext) error {
 		// TODO Check if node type may be added to this node
 	}
 
-	env := masterTmplEnv{Node: c.Node, Session: c.UserSession}
+	env := masterTmplEnv{Node: c.Node, Session: c.UserSession, Locale: c.Locale}
+
+	// Translatable fields of existing nodes requested with a locale
+	// prefix get edited in the node's translation.
+	var translation string
+	if !newNode && c.localePrefix() != "" {
+		translation = c.Locale
+	}
 
 	if c.Action == service.EditAction {
 		if newNode {
 			env.Title = G("Add a new node")
+		} else if translation != "" {
+			env.Title = fmt.Sprintf(G("Edit node (%v)"), translation)
 		} else {
 			env.Title = G("Edit node")
 		}
 		env.Flags = EDIT_VIEW
 	}
 
+	// Users who may not publish the node only save drafts.
+	mayPublish, err := h.mayPerform(c, service.PublishAction, c.Node.Path)
+	if err != nil {
+		return fmt.Errorf("Could not check permission: %v", err)
+	}
+
 	formData := editFormData{}
+	hasDraft := false
+	// The currently stored version (draft or published node) and its
+	// token to detect concurrent edits.
+	var current *service.Node
+	var currentToken string
+	loadCurrent := func(nodePath string) error {
+		stored, err := c.Serv.Monsti().GetNode(c.Site, nodePath)
+		if err != nil {
+			return fmt.Errorf("Could not get node: %v", err)
+		}
+		if stored == nil {
+			return fmt.Errorf("Node %v has been removed", nodePath)
+		}
+		draft, err := c.Serv.Monsti().GetNodeDraft(c.Site, nodePath)
+		if err != nil {
+			return fmt.Errorf("Could not get draft: %v", err)
+		}
+		hasDraft = draft != nil
+		current = stored
+		if hasDraft {
+			draft.Path = nodePath
+			// Drafts saved before nodes got ids don't have one.
+			if draft.Id == "" {
+				draft.Id = stored.Id
+			}
+			current = draft
+		}
+		currentToken = service.NodeToken(stored, draft)
+		return nil
+	}
 	formData.Fields = make(service.NestedMap)
 	if newNode {
 		formData.NodeType = nodeType.Id
@@ -566,10 +671,38 @@ func (h *nodeHandler) Edit(c *reqContext) error {
 		formData.Node.PublishTime = time.Now().UTC()
 		formData.Node.Public = true
 	} else {
-		formData.Node = *c.Node
+		if err := loadCurrent(c.Node.Path); err != nil {
+			return err
+		}
+		formData.Node = *current
+		formData.Token = currentToken
+		if translation != "" {
+			err := formData.Node.InitTranslation(translation, c.Serv.Monsti(),
+				c.Site)
+			if err != nil {
+				return fmt.Errorf("Could not init translation: %v", err)
+			}
+		}
+	}
+	// editField returns the field of the given node to edit.
+	editField := func(node *service.Node, id string) service.Field {
+		if field := node.Translations[translation][id]; field != nil {
+			return field
+		}
+		return node.Fields[id]
 	}
 	form := htmlwidgets.NewForm(&formData)
 	form.AddWidget(new(htmlwidgets.HiddenWidget), "NodeType", "", "")
+	if !newNode {
+		form.AddWidget(new(htmlwidgets.HiddenWidget), "Token", "", "")
+	}
+	// conflict lists the changes made by someone else since the form
+	// has been loaded. Submitting the form again will overwrite them.
+	var conflict []fieldDiff
+	setConflict := func(node *service.Node) {
+		conflict = diffNodes(current, node, c.UserSession.Locale)
+		formData.Token = currentToken
+	}
 	if !nodeType.Hide {
 		form.AddWidget(new(htmlwidgets.BoolWidget), "Node.Hide", G("Hide"),
 			G("Don't show node in navigation."))
@@ -591,6 +724,10 @@ func (h *nodeHandler) Edit(c *reqContext) error {
 	}
 	if !newNode {
 		formData.Name = c.Node.Name()
+		// Drafts may rename the node once they get published.
+		if current.Rename != "" {
+			formData.Name = current.Rename
+		}
 	}
 
 	fileFields := make([]string, 0)
@@ -598,8 +735,9 @@ func (h *nodeHandler) Edit(c *reqContext) error {
 		if field.Hidden {
 			continue
 		}
-		formData.Fields.Set(field.Id, formData.Node.Fields[field.Id].FormData())
-		widget := formData.Node.Fields[field.Id].FormWidget(
+		formData.Fields.Set(field.Id, editField(&formData.Node,
+			field.Id).FormData())
+		widget := editField(&formData.Node, field.Id).FormWidget(
 			c.UserSession.Locale, field)
 		form.AddWidget(widget, "Fields."+field.Id,
 			field.Name.Get(c.UserSession.Locale), "")
@@ -622,6 +760,12 @@ func (h *nodeHandler) Edit(c *reqContext) error {
 			}
 			node.Path = path.Join(parentPath, pathPrefix, formData.Name)
 			renamed := !newNode && c.Node.Name() != "" && oldPath != node.Path
+			// Renamed nodes are written at their old path. The rename
+			// takes effect when the changes get published.
+			writePath := node.Path
+			if renamed {
+				writePath = oldPath
+			}
 			writeNode := true
 			if newNode || renamed {
 				existing, err := c.Serv.Monsti().GetNode(c.Site, node.Path)
@@ -655,20 +799,86 @@ func (h *nodeHandler) Edit(c *reqContext) error {
 			}
 
 			if writeNode {
-				if renamed {
-					err := c.Serv.Monsti().RenameNode(c.Site, c.Node.Path, node.Path)
-					if err != nil {
-						return fmt.Errorf("Could not move node: %v", err)
-					}
-				}
 				for _, field := range nodeType.Fields {
 					if !field.Hidden {
-						node.Fields[field.Id].FromFormData(formData.Fields.Get(field.Id))
+						editField(&node, field.Id).FromFormData(
+							formData.Fields.Get(field.Id))
 					}
 				}
-				err := c.Serv.Monsti().WriteNode(c.Site, node.Path, &node)
-				if err != nil {
-					return fmt.Errorf("Could not update node: %v", err)
+			}
+
+			// Refuse to overwrite changes made by someone else since the
+			// form has been loaded.
+			if writeNode && !newNode && formData.Token != currentToken {
+				setConflict(&node)
+				writeNode = false
+			}
+
+			if writeNode {
+				node.ChangedBy = c.UserSession.User.Login
+				// Changes to existing nodes are saved as draft unless the
+				// user chose to publish them at once. If the workflow is
+				// enabled, all changes have to pass the workflow.
+				publish := newNode || c.Req.Form.Get("Publish") != ""
+				if !mayPublish {
+					publish = false
+				}
+				if h.Settings.Workflow.Enabled {
+					publish = false
+					node.WorkflowState = stateDraft
+				}
+				filePrefix := "__file_"
+				if publish {
+					node.Rename = ""
+					err := c.Serv.Monsti().WriteNodeIfUnchanged(c.Site, writePath,
+						&node, formData.Token)
+					if err != nil {
+						if _, ok := err.(*service.ConflictError); ok {
+							if err := loadCurrent(writePath); err != nil {
+								return err
+							}
+							setConflict(&node)
+							break
+						}
+						return fmt.Errorf("Could not update node: %v", err)
+					}
+					if hasDraft {
+						err := c.Serv.Monsti().DiscardNodeDraftAs(c.Site, writePath,
+							c.UserSession.User.Login)
+						if err != nil {
+							return fmt.Errorf("Could not discard draft: %v", err)
+						}
+					}
+				} else {
+					if newNode {
+						// The node and its draft have to share the id.
+						node.Id = service.NewNodeId()
+						// Hide the new node from the public until its draft
+						// gets published.
+						hidden := node
+						hidden.Public = false
+						err := c.Serv.Monsti().WriteNode(c.Site, node.Path, &hidden)
+						if err != nil {
+							return fmt.Errorf("Could not add node: %v", err)
+						}
+					}
+					filePrefix = "draft.__file_"
+					node.Rename = ""
+					if renamed {
+						node.Rename = formData.Name
+					}
+					err := c.Serv.Monsti().WriteNodeDraftIfUnchanged(c.Site,
+						writePath, &node, formData.Token)
+					if err != nil {
+						if _, ok := err.(*service.ConflictError); ok {
+							if err := loadCurrent(writePath); err != nil {
+								return err
+							}
+							setConflict(&node)
+							break
+						}
+						return fmt.Errorf("Could not save draft: %v", err)
+					}
 				}
 
 				// Save any attached files
@@ -680,18 +890,35 @@ func (h *nodeHandler) Edit(c *reqContext) error {
 							if err != nil {
 								return fmt.Errorf("Could not read multipart file: %v", err)
 							}
-							if err = c.Serv.Monsti().WriteNodeData(c.Site, node.Path,
-								"__file_"+name, content); err != nil {
+							if err = c.Serv.Monsti().WriteNodeDataAs(c.Site, writePath,
+								filePrefix+name, c.UserSession.User.Login,
+								content); err != nil {
 								return fmt.Errorf("Could not save file: %v", err)
 							}
 						}
 					}
 				}
-				http.Redirect(c.Res, c.Req, node.Path+"/", http.StatusSeeOther)
-				err = c.Serv.Monsti().MarkDep(
-					c.Site, service.CacheDep{Node: path.Clean(node.Path)})
-				if err != nil {
-					return fmt.Errorf("Could not mark node: %v", err)
+				if publish && renamed {
+					err := c.Serv.Monsti().RenameNodeAs(c.Site, writePath,
+						node.Path, c.UserSession.User.Login)
+					if err != nil {
+						return fmt.Errorf("Could not move node: %v", err)
+					}
+				}
+				if publish {
+					http.Redirect(c.Res, c.Req, c.localePrefix()+node.Path+"/",
+						http.StatusSeeOther)
+				} else {
+					http.Redirect(c.Res, c.Req,
+						c.localePrefix()+writePath+"/?preview", http.StatusSeeOther)
+				}
+				// Drafts of existing nodes don't affect the published pages.
+				if publish || newNode {
+					err := c.Serv.Monsti().MarkDep(
+						c.Site, service.CacheDep{Node: path.Clean(node.Path)})
+					if err != nil {
+						return fmt.Errorf("Could not mark node: %v", err)
+					}
 				}
 				return nil
 			}
@@ -699,15 +926,17 @@ func (h *nodeHandler) Edit(c *reqContext) error {
 	default:
 		return fmt.Errorf("Request method not supported: %v", c.Req.Method)
 	}
-	rendered, err := h.Renderer.Render("edit",
-		mtemplate.Context{"Form": form.RenderData()},
+	rendered, err := c.Renderer.Render("edit",
+		mtemplate.Context{"Form": form.RenderData(), "Node": c.Node,
+			"NewNode": newNode, "HasDraft": hasDraft, "Conflict": conflict,
+			"Workflow": h.Settings.Workflow.Enabled, "MayPublish": mayPublish},
 		c.UserSession.Locale, h.Settings.Monsti.GetSiteTemplatesPath(c.Site))
 
 	if err != nil {
 		return fmt.Errorf("Could not render template: %v", err)
 	}
 
-	content, _ := renderInMaster(h.Renderer, []byte(rendered), env, h.Settings,
+	content, _ := renderInMaster(c.Renderer, []byte(rendered), env, h.Settings,
 		c.Site, c.SiteSettings, c.UserSession.Locale, c.Serv)
 
 	c.Res.Write(content)
@@ -746,6 +975,7 @@ func (h *nodeHandler) List(c *reqContext) error {
 					child.Order = order
 				}
 				if oldOrder != child.Order {
+					child.ChangedBy = c.UserSession.User.Login
 					err := c.Serv.Monsti().WriteNode(c.Site, child.Path, child)
 					if err != nil {
 						return fmt.Errorf("Could not update node: %v", err)
@@ -766,7 +996,7 @@ func (h *nodeHandler) List(c *reqContext) error {
 		}
 	}
 	sort.Sort(orderedNodes(children))
-	body, err := h.Renderer.Render("actions/list", mtemplate.Context{
+	body, err := c.Renderer.Render("actions/list", mtemplate.Context{
 		"Parent":   parent,
 		"Children": children,
 		"Node":     c.Node},
@@ -776,7 +1006,7 @@ func (h *nodeHandler) List(c *reqContext) error {
 	}
 	env := masterTmplEnv{Node: c.Node, Session: c.UserSession,
 		Flags: EDIT_VIEW, Title: G("List child nodes")}
-	rendered, _ := renderInMaster(h.Renderer, []byte(body), env, h.Settings,
+	rendered, _ := renderInMaster(c.Renderer, []byte(body), env, h.Settings,
 		c.Site, c.SiteSettings, c.UserSession.Locale, c.Serv)
 	c.Res.Write(rendered)
 	return nil
@@ -834,6 +1064,13 @@ func (h *nodeHandler) Chooser(c *reqContext) error {
 		"Children":     children,
 		"Node":         c.Node}
 
+	// Choosing the new parent of a node to be moved.
+	if chooseType == "move" {
+		move := path.Clean(c.Req.FormValue("move"))
+		context["Move"] = move
+		context["Query"] = "&move=" + url.QueryEscape(move)
+	}
+
 	if chooseType == "image" {
 		images := make([]*service.Node, 0)
 		for _, node := range children {
@@ -844,7 +1081,7 @@ func (h *nodeHandler) Chooser(c *reqContext) error {
 		context["Images"] = images
 	}
 
-	body, err := h.Renderer.Render("actions/chooser", context,
+	body, err := c.Renderer.Render("actions/chooser", context,
 		c.UserSession.Locale, h.Settings.Monsti.GetSiteTemplatesPath(c.Site))
 	if err != nil {
 		return fmt.Errorf("Can't render node chooser: %v", err)
@@ -852,7 +1089,7 @@ func (h *nodeHandler) Chooser(c *reqContext) error {
 	env := masterTmplEnv{Node: c.Node, Session: c.UserSession,
 		Flags: EDIT_VIEW | SLIM_VIEW,
 		Title: G("Node chooser")}
-	rendered, _ := renderInMaster(h.Renderer, []byte(body), env, h.Settings,
+	rendered, _ := renderInMaster(c.Renderer, []byte(body), env, h.Settings,
 		c.Site, c.SiteSettings, c.UserSession.Locale, c.Serv)
 	c.Res.Write(rendered)
 	return nil
@@ -147,6 +147,20 @@ func TestNavigationMakeAbsolute(t *testing.T) {
 	}
 }
 
+func TestNavigationAddPrefix(t *testing.T) {
+	nav := navigation{
+		{Target: "/"},
+		{Target: "/foo/", Children: navigation{{Target: "/foo/bar/"}}}}
+	nav.AddPrefix("/de")
+	expected := navigation{
+		{Target: "/de/"},
+		{Target: "/de/foo/", Children: navigation{{Target: "/de/foo/bar/"}}}}
+	if !(reflect.DeepEqual(nav, expected)) {
+		t.Errorf(`navigation.AddPrefix("/de") = %v, should be %v`,
+			nav, expected)
+	}
+}
+
 func TestCalcEmbedPath(t *testing.T) {
 	tests := []struct {
 		Path, URI, Expected string
@@ -0,0 +1,157 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// nodeIdOf returns the id of the given node data, or an empty string
+// if the node has no id.
+func nodeIdOf(content []byte) string {
+	var node struct{ Id string }
+	if err := json.Unmarshal(content, &node); err != nil {
+		return ""
+	}
+	return node.Id
+}
+
+// buildNodeIndex maps the ids of all nodes in the given storage to
+// their paths.
+func buildNodeIndex(nodes storage) (map[string]string, error) {
+	index := make(map[string]string)
+	walker := func(file string, isDir bool) error {
+		if isDir || path.Base(file) != "node.json" {
+			return nil
+		}
+		content, err := nodes.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		if id := nodeIdOf(content); id != "" {
+			index[id] = path.Dir(file)
+		}
+		return nil
+	}
+	if err := walkStorage(nodes, "/", walker); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// nodePathByID returns the path of the site's node with the given id,
+// or an empty string if there is no such node.
+//
+// The index of node ids gets built on first use. Callers must hold
+// the site's mutex.
+func (i *MonstiService) nodePathByID(site, id string) (string, error) {
+	i.nodeIndexMutex.Lock()
+	defer i.nodeIndexMutex.Unlock()
+	if i.nodeIndex == nil {
+		i.nodeIndex = make(map[string]map[string]string)
+	}
+	index, ok := i.nodeIndex[site]
+	if !ok {
+		var err error
+		index, err = buildNodeIndex(i.nodesStorage(site))
+		if err != nil {
+			return "", fmt.Errorf("Could not build node index: %v", err)
+		}
+		i.nodeIndex[site] = index
+	}
+	return index[id], nil
+}
+
+// indexNode updates the index of node ids for the given written node
+// data.
+func (i *MonstiService) indexNode(site, nodePath string, content []byte) {
+	i.nodeIndexMutex.Lock()
+	defer i.nodeIndexMutex.Unlock()
+	if index, ok := i.nodeIndex[site]; ok {
+		if id := nodeIdOf(content); id != "" {
+			index[id] = nodePath
+		}
+	}
+}
+
+// updateNodeIndex calls fn with the site's index of node ids if it has
+// already been built.
+func (i *MonstiService) updateNodeIndex(site string,
+	fn func(index map[string]string)) {
+	i.nodeIndexMutex.Lock()
+	defer i.nodeIndexMutex.Unlock()
+	if index, ok := i.nodeIndex[site]; ok {
+		fn(index)
+	}
+}
+
+// removeIdsOfSubtree removes the ids of the given node and its
+// descendants from the given index.
+func removeIdsOfSubtree(index map[string]string, root string) {
+	for id, nodePath := range index {
+		if inSubtree(root, nodePath) {
+			delete(index, id)
+		}
+	}
+}
+
+// renameIdsOfSubtree updates the paths of the given node and its
+// descendants in the given index.
+func renameIdsOfSubtree(index map[string]string, source, target string) {
+	for id, nodePath := range index {
+		if inSubtree(source, nodePath) {
+			index[id] = path.Join(target, strings.TrimPrefix(nodePath, source))
+		}
+	}
+}
+
+// dropNodeIndex drops the site's index of node ids, e.g. if it could
+// not be updated. It will be rebuilt on next use.
+func (i *MonstiService) dropNodeIndex(site string) {
+	i.nodeIndexMutex.Lock()
+	defer i.nodeIndexMutex.Unlock()
+	delete(i.nodeIndex, site)
+}
+
+type GetNodeByIDArgs struct {
+	Site, Id string
+}
+
+func (i *MonstiService) GetNodeByID(args *GetNodeByIDArgs,
+	reply *[]byte) error {
+	i.siteMutexes[args.Site].RLock()
+	defer i.siteMutexes[args.Site].RUnlock()
+	if args.Id == "" {
+		return nil
+	}
+	nodePath, err := i.nodePathByID(args.Site, args.Id)
+	if err != nil {
+		return err
+	}
+	if nodePath == "" {
+		return nil
+	}
+	ret, err := getNode(i.nodesStorage(args.Site), nodePath)
+	if err != nil {
+		return fmt.Errorf("Could not read node: %v", err)
+	}
+	*reply = ret
+	return nil
+}
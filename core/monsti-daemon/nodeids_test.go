@@ -0,0 +1,160 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"sync"
+	"testing"
+
+	"pkg.monsti.org/monsti/api/service"
+	utesting "pkg.monsti.org/monsti/api/util/testing"
+)
+
+func TestGetNodeByID(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/nodes/node.json":         `{"Id":"root","Type":"core.Foo"}`,
+		"/nodes/foo/node.json":     `{"Id":"foo","Type":"core.Foo"}`,
+		"/nodes/foo/bar/node.json": `{"Id":"bar","Type":"core.Foo"}`,
+		"/nodes/baz/node.json":     `{"Type":"core.Foo"}`},
+		"TestGetNodeByID")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	monsti := &MonstiService{
+		siteMutexes: map[string]*sync.RWMutex{"site": new(sync.RWMutex)},
+		storages:    map[string]storage{"site": newFSStorage(root)},
+	}
+	get := func(id string) string {
+		var reply []byte
+		err := monsti.GetNodeByID(&GetNodeByIDArgs{"site", id}, &reply)
+		if err != nil {
+			t.Fatalf("GetNodeByID(%q) failed: %v", id, err)
+		}
+		return string(reply)
+	}
+	tests := []struct{ Id, Node string }{
+		{"root", `{"Path":"/","Id":"root","Type":"core.Foo"}`},
+		{"bar", `{"Path":"/foo/bar","Id":"bar","Type":"core.Foo"}`},
+		{"unknown", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if ret := get(test.Id); ret != test.Node {
+			t.Errorf("GetNodeByID(%q) = %q, should be %q", test.Id, ret, test.Node)
+		}
+	}
+	err = monsti.WriteNodeData(&WriteNodeDataArgs{Site: "site", Path: "/baz",
+		File: "node.json", Content: []byte(`{"Id":"baz","Type":"core.Foo"}`)},
+		new(int))
+	if err != nil {
+		t.Fatalf("Could not write node: %v", err)
+	}
+	if ret := get("baz"); ret != `{"Path":"/baz","Id":"baz","Type":"core.Foo"}` {
+		t.Errorf("GetNodeByID should find written nodes, got %q", ret)
+	}
+	err = monsti.RenameNode(&RenameNodeArgs{Site: "site", Source: "/foo",
+		Target: "/moved/foo"}, new(int))
+	if err != nil {
+		t.Fatalf("Could not rename node: %v", err)
+	}
+	if ret := get("bar"); ret != `{"Path":"/moved/foo/bar","Id":"bar","Type":"core.Foo"}` {
+		t.Errorf("GetNodeByID should find moved nodes, got %q", ret)
+	}
+}
+
+func TestUpdateIndexes(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/nodes/node.json":           `{"Id":"root","Type":"core.Document"}`,
+		"/nodes/foo/node.json":       `{"Id":"foo","Type":"core.Document","Fields":{"core":{"Title":"Foo"}}}`,
+		"/nodes/foo/node.draft.json": `{"Id":"foo","Type":"core.Document","Fields":{"core":{"Title":"Draft"}}}`,
+		"/nodes/foo/bar/node.json":   `{"Id":"bar","Type":"core.Document","Fields":{"core":{"Title":"Bar"}}}`},
+		"TestUpdateIndexes")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	monsti := &MonstiService{
+		Settings:    new(settings),
+		siteMutexes: map[string]*sync.RWMutex{"site": new(sync.RWMutex)},
+		storages:    map[string]storage{"site": newFSStorage(root)},
+	}
+	monsti.Settings.Config.NodeTypes = map[string]*service.NodeType{
+		"core.Document": {Id: "core.Document", AddableTo: []string{"."}}}
+	if _, err := monsti.nodePathByID("site", "foo"); err != nil {
+		t.Fatalf("Could not build node index: %v", err)
+	}
+	ids := monsti.nodeIndex["site"]
+	search, err := monsti.siteSearchIndex("site")
+	if err != nil {
+		t.Fatalf("Could not build search index: %v", err)
+	}
+
+	err = monsti.PublishNodeDraft(&NodeDraftArgs{Site: "site", Path: "/foo"},
+		new(int))
+	if err != nil {
+		t.Fatalf("Could not publish draft: %v", err)
+	}
+	if !search.Words["draft"]["/foo"] || search.Words["foo"]["/foo"] {
+		t.Errorf("Search index should hold the published draft")
+	}
+	err = monsti.CopyNode(&CopyNodeArgs{Site: "site", Source: "/foo",
+		Target: "/copy", Recursive: true}, new(int))
+	if err != nil {
+		t.Fatalf("Could not copy node: %v", err)
+	}
+	copies := 0
+	for _, nodePath := range ids {
+		if nodePath == "/copy" || nodePath == "/copy/bar" {
+			copies++
+		}
+	}
+	if copies != 2 || search.Docs["/copy/bar"] == nil {
+		t.Errorf("Indexes should hold the copies")
+	}
+	err = monsti.RemoveNode(&RemoveNodeArgs{Site: "site", Node: "/foo"},
+		new(int))
+	if err != nil {
+		t.Fatalf("Could not remove node: %v", err)
+	}
+	if _, ok := ids["bar"]; ok || search.Docs["/foo/bar"] != nil {
+		t.Errorf("Indexes should not hold removed nodes")
+	}
+	var trash []*service.TrashEntry
+	if err := monsti.GetTrash("site", &trash); err != nil || len(trash) != 1 {
+		t.Fatalf("Could not get trash: %v", err)
+	}
+	err = monsti.RestoreTrash(&TrashEntryArgs{Site: "site", Id: trash[0].Id},
+		new(int))
+	if err != nil {
+		t.Fatalf("Could not restore node: %v", err)
+	}
+	if ids["bar"] != "/foo/bar" || search.Docs["/foo/bar"] == nil {
+		t.Errorf("Indexes should hold restored nodes")
+	}
+	err = monsti.RenameNode(&RenameNodeArgs{Site: "site", Source: "/foo",
+		Target: "/moved"}, new(int))
+	if err != nil {
+		t.Fatalf("Could not rename node: %v", err)
+	}
+	if ids["bar"] != "/moved/bar" || search.Docs["/moved/bar"] == nil {
+		t.Errorf("Indexes should hold renamed nodes")
+	}
+	if monsti.nodeIndex["site"] == nil || monsti.searchIndex["site"] != search {
+		t.Errorf("Indexes should be updated instead of being rebuilt")
+	}
+}
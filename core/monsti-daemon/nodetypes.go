@@ -42,15 +42,17 @@ func initNodeTypes(settings *settings, session *service.Session, logger *log.Log
 		Name:      i18n.GenLanguageMap(G("Document"), availableLocales),
 		Fields: []*service.FieldConfig{
 			{
-				Id:       "core.Title",
-				Required: true,
-				Name:     i18n.GenLanguageMap(G("Title"), availableLocales),
-				Type:     new(service.TextFieldType),
+				Id:           "core.Title",
+				Required:     true,
+				Name:         i18n.GenLanguageMap(G("Title"), availableLocales),
+				Type:         new(service.TextFieldType),
+				Translatable: true,
 			},
 			{
-				Id:   "core.Description",
-				Name: i18n.GenLanguageMap(G("Description"), availableLocales),
-				Type: new(service.TextFieldType),
+				Id:           "core.Description",
+				Name:         i18n.GenLanguageMap(G("Description"), availableLocales),
+				Type:         new(service.TextFieldType),
+				Translatable: true,
 			},
 			{
 				Id:   "core.Thumbnail",
@@ -58,10 +60,11 @@ func initNodeTypes(settings *settings, session *service.Session, logger *log.Log
 				Type: new(service.RefFieldType),
 			},
 			{
-				Id:       "core.Body",
-				Required: true,
-				Name:     i18n.GenLanguageMap(G("Body"), availableLocales),
-				Type:     new(service.HTMLFieldType),
+				Id:           "core.Body",
+				Required:     true,
+				Name:         i18n.GenLanguageMap(G("Body"), availableLocales),
+				Type:         new(service.HTMLFieldType),
+				Translatable: true,
 			},
 		},
 	}
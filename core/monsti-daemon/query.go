@@ -0,0 +1,304 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+// queryNode is a node considered by a query.
+type queryNode struct {
+	Path string
+	Data []byte
+	// Attributes holds the decoded node data.
+	Attributes map[string]interface{}
+}
+
+// attribute returns the value of the given node attribute or field
+// (see service.NodeQuery).
+func (n *queryNode) attribute(name string) (interface{}, bool) {
+	parts := strings.SplitN(name, ".", 2)
+	if len(parts) == 1 {
+		value, ok := n.Attributes[name]
+		return value, ok && value != nil
+	}
+	fields, _ := n.Attributes["Fields"].(map[string]interface{})
+	namespace, _ := fields[parts[0]].(map[string]interface{})
+	value, ok := namespace[parts[1]]
+	return value, ok && value != nil
+}
+
+// nodeAttributes decodes the given node data to a map of its
+// attributes and fields. Missing node attributes get their zero value.
+func nodeAttributes(data []byte) (map[string]interface{}, error) {
+	var node service.Node
+	if err := json.Unmarshal(data, &node); err != nil {
+		return nil, err
+	}
+	defaults, err := json.Marshal(node)
+	if err != nil {
+		return nil, err
+	}
+	var attributes, raw map[string]interface{}
+	if err := json.Unmarshal(defaults, &attributes); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	for key, value := range raw {
+		attributes[key] = value
+	}
+	return attributes, nil
+}
+
+// compareValues compares the given decoded JSON values.
+//
+// Returns a negative number if left is less than right, zero if they
+// are equal, and a positive number otherwise. ok is false if the
+// values can't be compared.
+func compareValues(left, right interface{}) (ret int, ok bool) {
+	switch l := left.(type) {
+	case float64:
+		r, ok := right.(float64)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case l < r:
+			return -1, true
+		case l > r:
+			return 1, true
+		}
+		return 0, true
+	case bool:
+		r, ok := right.(bool)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case l == r:
+			return 0, true
+		case r:
+			return -1, true
+		}
+		return 1, true
+	case string:
+		r, ok := right.(string)
+		if !ok {
+			return 0, false
+		}
+		lTime, lErr := time.Parse(time.RFC3339Nano, l)
+		rTime, rErr := time.Parse(time.RFC3339Nano, r)
+		switch {
+		case lErr == nil && rErr == nil:
+			switch {
+			case lTime.Before(rTime):
+				return -1, true
+			case lTime.After(rTime):
+				return 1, true
+			}
+			return 0, true
+		case l < r:
+			return -1, true
+		case l > r:
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// matchFilter checks if the given node matches the filter.
+func matchFilter(node *queryNode, filter *service.NodeFilter) (bool, error) {
+	value, ok := node.attribute(filter.Attribute)
+	if !ok {
+		return filter.Op == "!=", nil
+	}
+	cmp, ok := compareValues(value, filter.Value)
+	switch filter.Op {
+	case "=":
+		return ok && cmp == 0, nil
+	case "!=":
+		return !ok || cmp != 0, nil
+	case "<":
+		return ok && cmp < 0, nil
+	case "<=":
+		return ok && cmp <= 0, nil
+	case ">":
+		return ok && cmp > 0, nil
+	case ">=":
+		return ok && cmp >= 0, nil
+	}
+	return false, fmt.Errorf("Unknown filter operator %q", filter.Op)
+}
+
+// matchQuery checks if the given node matches the types and filters of
+// the query.
+func matchQuery(node *queryNode, query *service.NodeQuery) (bool, error) {
+	if len(query.Types) > 0 {
+		nodeType, _ := node.Attributes["Type"].(string)
+		found := false
+		for _, queryType := range query.Types {
+			if queryType == nodeType {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false, nil
+		}
+	}
+	for i := range query.Filters {
+		if ok, err := matchFilter(node, &query.Filters[i]); !ok || err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// querySorter sorts nodes by the sort keys of a query.
+type querySorter struct {
+	Nodes []*queryNode
+	Keys  []service.NodeSort
+}
+
+func (s *querySorter) Len() int {
+	return len(s.Nodes)
+}
+
+func (s *querySorter) Swap(i, j int) {
+	s.Nodes[i], s.Nodes[j] = s.Nodes[j], s.Nodes[i]
+}
+
+func (s *querySorter) Less(i, j int) bool {
+	for _, key := range s.Keys {
+		left, leftOk := s.Nodes[i].attribute(key.Attribute)
+		right, rightOk := s.Nodes[j].attribute(key.Attribute)
+		var cmp int
+		switch {
+		case !leftOk && !rightOk:
+		case !leftOk:
+			cmp = -1
+		case !rightOk:
+			cmp = 1
+		default:
+			cmp, _ = compareValues(left, right)
+		}
+		if key.Descending {
+			cmp = -cmp
+		}
+		if cmp != 0 {
+			return cmp < 0
+		}
+	}
+	return s.Nodes[i].Path < s.Nodes[j].Path
+}
+
+// queryNodes returns the data of the nodes matching the given query
+// and the total number of matching nodes ignoring offset and limit.
+func queryNodes(nodes storage, query *service.NodeQuery) ([][]byte, int,
+	error) {
+	var matches []*queryNode
+	var visit func(dir string, level int) error
+	visit = func(dir string, level int) error {
+		entries, err := nodes.ReadDir(dir)
+		if err != nil {
+			if os.IsNotExist(err) && level == 1 {
+				return nil
+			}
+			return err
+		}
+		for _, entry := range entries {
+			if !entry.IsDir {
+				continue
+			}
+			nodePath := path.Join(dir, entry.Name)
+			data, err := getNode(nodes, nodePath)
+			if err != nil {
+				return fmt.Errorf("Could not read node %v: %v", nodePath, err)
+			}
+			attributes, err := nodeAttributes(data)
+			if err != nil {
+				return fmt.Errorf("Could not decode node %v: %v", nodePath, err)
+			}
+			node := queryNode{Path: nodePath, Data: data, Attributes: attributes}
+			ok, err := matchQuery(&node, query)
+			if err != nil {
+				return err
+			}
+			if ok {
+				matches = append(matches, &node)
+			}
+			if query.Depth <= 0 || level < query.Depth {
+				if err := visit(nodePath, level+1); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := visit(path.Clean("/"+query.Path), 1); err != nil {
+		return nil, 0, err
+	}
+	sort.Sort(&querySorter{matches, query.Sort})
+	total := len(matches)
+	if query.Offset > 0 {
+		if query.Offset > len(matches) {
+			query.Offset = len(matches)
+		}
+		matches = matches[query.Offset:]
+	}
+	if query.Limit > 0 && query.Limit < len(matches) {
+		matches = matches[:query.Limit]
+	}
+	ret := make([][]byte, 0, len(matches))
+	for _, node := range matches {
+		ret = append(ret, node.Data)
+	}
+	return ret, total, nil
+}
+
+type QueryNodesArgs struct {
+	Site  string
+	Query []byte
+}
+
+func (i *MonstiService) QueryNodes(args *QueryNodesArgs,
+	reply *service.QueryNodesReply) error {
+	var query service.NodeQuery
+	if err := json.Unmarshal(args.Query, &query); err != nil {
+		return fmt.Errorf("Could not decode query: %v", err)
+	}
+	i.siteMutexes[args.Site].RLock()
+	defer i.siteMutexes[args.Site].RUnlock()
+	var err error
+	reply.Nodes, reply.Total, err = queryNodes(i.nodesStorage(args.Site),
+		&query)
+	if err != nil {
+		return fmt.Errorf("Could not query nodes: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"pkg.monsti.org/monsti/api/service"
+	utesting "pkg.monsti.org/monsti/api/util/testing"
+)
+
+func TestQueryNodes(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/blog/node.json":             `{"Type":"core.Blog"}`,
+		"/blog/2015/01/a/node.json":   `{"Type":"core.BlogPost","PublishTime":"2015-01-10T00:00:00Z","Fields":{"core":{"Title":"A"}}}`,
+		"/blog/2015/02/b/node.json":   `{"Type":"core.BlogPost","PublishTime":"2015-02-10T00:00:00.5Z","Fields":{"core":{"Title":"B"}}}`,
+		"/blog/2015/02/c/node.json":   `{"Type":"core.BlogPost","PublishTime":"2015-02-10T00:00:00Z","Order":2,"Fields":{"core":{"Title":"C"}}}`,
+		"/blog/2015/02/c/d/node.json": `{"Type":"core.BlogPost","PublishTime":"2016-01-01T00:00:00Z"}`,
+		"/other/node.json":            `{"Type":"core.BlogPost","PublishTime":"2017-01-01T00:00:00Z"}`,
+	}, "TestQueryNodes")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	nodes := newFSStorage(root)
+
+	tests := []struct {
+		Query service.NodeQuery
+		Paths []string
+		Total int
+	}{
+		{service.NodeQuery{Path: "/blog", Depth: 1}, []string{"/blog/2015"}, 1},
+		{service.NodeQuery{Path: "/blog", Depth: 3, Types: []string{"core.BlogPost"},
+			Sort: []service.NodeSort{{Attribute: "PublishTime", Descending: true}}},
+			[]string{"/blog/2015/02/b", "/blog/2015/02/c", "/blog/2015/01/a"}, 3},
+		{service.NodeQuery{Path: "/blog", Types: []string{"core.BlogPost"},
+			Sort:   []service.NodeSort{{Attribute: "PublishTime"}},
+			Offset: 1, Limit: 2},
+			[]string{"/blog/2015/02/c", "/blog/2015/02/b"}, 4},
+		{service.NodeQuery{Path: "/blog", Filters: []service.NodeFilter{
+			{Attribute: "PublishTime", Op: ">=",
+				Value: time.Date(2015, 2, 1, 0, 0, 0, 0, time.UTC)},
+			{Attribute: "core.Title", Op: "!=", Value: "B"}}},
+			[]string{"/blog/2015/02/c", "/blog/2015/02/c/d"}, 2},
+		{service.NodeQuery{Path: "/blog", Types: []string{"core.BlogPost"},
+			Sort: []service.NodeSort{{Attribute: "Order", Descending: true}},
+			Filters: []service.NodeFilter{
+				{Attribute: "Order", Op: "<", Value: 3}}},
+			[]string{"/blog/2015/02/c", "/blog/2015/01/a", "/blog/2015/02/b",
+				"/blog/2015/02/c/d"}, 4},
+		{service.NodeQuery{Path: "/missing"}, nil, 0},
+	}
+	for i, test := range tests {
+		// The query gets sent as JSON, see service.MonstiClient.QueryNodes.
+		data, err := json.Marshal(test.Query)
+		if err != nil {
+			t.Fatalf("Could not marshal query: %v", err)
+		}
+		var query service.NodeQuery
+		if err := json.Unmarshal(data, &query); err != nil {
+			t.Fatalf("Could not unmarshal query: %v", err)
+		}
+		ret, total, err := queryNodes(nodes, &query)
+		if err != nil {
+			t.Errorf("%v: queryNodes returns error: %v", i, err)
+			continue
+		}
+		var paths []string
+		for _, data := range ret {
+			var node struct{ Path string }
+			if err := json.Unmarshal(data, &node); err != nil {
+				t.Fatalf("Could not unmarshal node: %v", err)
+			}
+			paths = append(paths, node.Path)
+		}
+		if !reflect.DeepEqual(paths, test.Paths) || total != test.Total {
+			t.Errorf("%v: queryNodes should return %v (total %v), got %v (total %v)",
+				i, test.Paths, test.Total, paths, total)
+		}
+	}
+
+	query := service.NodeQuery{Path: "/blog",
+		Filters: []service.NodeFilter{{Attribute: "Order", Op: "~"}}}
+	if _, _, err := queryNodes(nodes, &query); err == nil {
+		t.Errorf("queryNodes should fail for unknown operators")
+	}
+}
@@ -0,0 +1,90 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// recoverSite repairs the given site storage after a crash.
+//
+// Leftover temporary files get removed. Node files which can't be
+// parsed are moved to the directory quarantine/<id> keeping their
+// path, so that the remaining nodes can still be served. If any cache
+// dependency file is corrupt, the whole cache is cleared as
+// dependencies might be lost otherwise.
+//
+// Returns the paths of the quarantined node files.
+func recoverSite(site storage, now time.Time) ([]string, error) {
+	id := strconv.FormatInt(now.UnixNano(), 10)
+	var quarantined []string
+	var clearCache bool
+	walker := func(file string, isDir bool) error {
+		name := path.Base(file)
+		switch {
+		case isDir:
+		case strings.HasPrefix(name, tmpFilePrefix):
+			if err := site.Remove(file); err != nil {
+				return fmt.Errorf("Could not remove temporary file: %v", err)
+			}
+		case name == ".rdeps.json":
+			if !validJSON(site, file) {
+				clearCache = true
+			}
+		case strings.HasPrefix(file, "nodes/") &&
+			(name == "node.json" || name == "node.draft.json"):
+			if validJSON(site, file) {
+				break
+			}
+			target := path.Join("quarantine", id, file)
+			if err := site.Rename(file, target); err != nil {
+				return fmt.Errorf("Could not quarantine %v: %v", file, err)
+			}
+			quarantined = append(quarantined, file)
+		}
+		return nil
+	}
+	for _, dir := range []string{"nodes", "cache"} {
+		if _, err := site.Stat(dir); err != nil {
+			continue
+		}
+		if err := walkStorage(site, dir, walker); err != nil {
+			return nil, err
+		}
+	}
+	if clearCache {
+		if err := site.RemoveAll("cache"); err != nil {
+			return nil, fmt.Errorf("Could not clear cache: %v", err)
+		}
+	}
+	return quarantined, nil
+}
+
+// validJSON checks if the given file contains valid JSON.
+func validJSON(site storage, file string) bool {
+	content, err := site.ReadFile(file)
+	if err != nil {
+		return false
+	}
+	var value interface{}
+	return json.Unmarshal(content, &value) == nil
+}
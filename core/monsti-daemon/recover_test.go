@@ -0,0 +1,67 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	utesting "pkg.monsti.org/monsti/api/util/testing"
+)
+
+func TestRecoverSite(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/nodes/foo/node.json":             `{"Type":"core.Foo"}`,
+		"/nodes/foo/bar/node.json":         `{"Type":"core.F`,
+		"/nodes/foo/bar/node.draft.json":   `{"Type":"core.Foo"}`,
+		"/nodes/foo/.tmp-node.json-123":    `{"Type":"core.F`,
+		"/cache/foo/.rdeps.json":           `{}`,
+		"/cache/foo/.data/foo.some_cache":  `data`,
+		"/cache/foo/bar/.rdeps.json":       `{"`,
+		"/cache/foo/bar/.data/foo.another": `data`},
+		"TestRecoverSite")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	now := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	quarantined, err := recoverSite(newFSStorage(root), now)
+	expected := []string{"nodes/foo/bar/node.json"}
+	if err != nil || !reflect.DeepEqual(quarantined, expected) {
+		t.Errorf("recoverSite = %v, %v, should be %v, nil", quarantined, err,
+			expected)
+	}
+	for file, exists := range map[string]bool{
+		"nodes/foo/node.json":           true,
+		"nodes/foo/bar/node.json":       false,
+		"nodes/foo/bar/node.draft.json": true,
+		"nodes/foo/.tmp-node.json-123":  false,
+		"cache":                         false,
+		"quarantine/1420070400000000000/nodes/foo/bar/node.json": true,
+	} {
+		_, err := os.Stat(filepath.Join(root, file))
+		if exists && err != nil {
+			t.Errorf("%v should exist: %v", file, err)
+		}
+		if !exists && !os.IsNotExist(err) {
+			t.Errorf("%v should not exist: %v", file, err)
+		}
+	}
+}
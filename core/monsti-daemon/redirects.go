@@ -0,0 +1,253 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"pkg.monsti.org/gettext"
+	mtemplate "pkg.monsti.org/monsti/api/util/template"
+)
+
+// The redirect table of a site maps old paths to their new location,
+// i.e. a path or an absolute URL. It's stored as redirects.json in the
+// site's storage.
+
+// readRedirects reads the redirect table of the given site storage.
+func readRedirects(site storage) (map[string]string, error) {
+	redirects := make(map[string]string)
+	content, err := site.ReadFile("redirects.json")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return redirects, nil
+		}
+		return nil, fmt.Errorf("Could not read redirects: %v", err)
+	}
+	if err := json.Unmarshal(content, &redirects); err != nil {
+		return nil, fmt.Errorf("Could not unmarshal redirects: %v", err)
+	}
+	return redirects, nil
+}
+
+// writeRedirects writes the redirect table of the given site storage.
+func writeRedirects(site storage, redirects map[string]string) error {
+	content, err := json.MarshalIndent(redirects, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Could not marshal redirects: %v", err)
+	}
+	if err := site.WriteFile("redirects.json", content); err != nil {
+		return fmt.Errorf("Could not write redirects: %v", err)
+	}
+	return nil
+}
+
+// resolveRedirect returns the location the given path is redirected
+// to, or an empty string if there is no redirect.
+//
+// Redirects apply to whole subtrees, i.e. if /foo redirects to /bar,
+// /foo/baz redirects to /bar/baz.
+func resolveRedirect(redirects map[string]string, p string) string {
+	p = path.Clean(p)
+	for prefix := p; ; prefix = path.Dir(prefix) {
+		if target, ok := redirects[prefix]; ok {
+			if prefix == "/" {
+				return strings.TrimSuffix(target, "/") + p
+			}
+			return target + p[len(prefix):]
+		}
+		if prefix == "/" {
+			return ""
+		}
+	}
+}
+
+// addRenameRedirect records the redirect for a node moved from source
+// to target.
+//
+// Existing redirects to the moved subtree are updated to avoid
+// redirect chains. Redirects from the target get removed as the path
+// is in use again.
+func addRenameRedirect(redirects map[string]string, source, target string) {
+	source, target = path.Clean(source), path.Clean(target)
+	for from, to := range redirects {
+		if to == source || strings.HasPrefix(to, source+"/") {
+			redirects[from] = target + to[len(source):]
+		}
+		if redirects[from] == from {
+			delete(redirects, from)
+		}
+	}
+	delete(redirects, target)
+	redirects[source] = target
+}
+
+type ResolveRedirectArgs struct {
+	Site, Path string
+}
+
+func (i *MonstiService) ResolveRedirect(args *ResolveRedirectArgs,
+	reply *string) error {
+	i.siteMutexes[args.Site].RLock()
+	defer i.siteMutexes[args.Site].RUnlock()
+	redirects, err := readRedirects(i.storages[args.Site])
+	if err != nil {
+		return err
+	}
+	*reply = resolveRedirect(redirects, args.Path)
+	return nil
+}
+
+func (i *MonstiService) GetRedirects(site string,
+	reply *map[string]string) error {
+	i.siteMutexes[site].RLock()
+	defer i.siteMutexes[site].RUnlock()
+	redirects, err := readRedirects(i.storages[site])
+	if err != nil {
+		return err
+	}
+	*reply = redirects
+	return nil
+}
+
+type WriteRedirectsArgs struct {
+	Site      string
+	Redirects map[string]string
+	User      string
+}
+
+func (i *MonstiService) WriteRedirects(args *WriteRedirectsArgs,
+	reply *int) error {
+	i.siteMutexes[args.Site].Lock()
+	defer i.siteMutexes[args.Site].Unlock()
+	if err := writeRedirects(i.storages[args.Site], args.Redirects); err != nil {
+		return err
+	}
+	i.commitSite(args.Site, args.User, "Write redirects.json")
+	return nil
+}
+
+// redirectEntry is a row of the redirects page.
+type redirectEntry struct {
+	From, To string
+}
+
+type redirectEntries []redirectEntry
+
+func (r redirectEntries) Len() int {
+	return len(r)
+}
+
+func (r redirectEntries) Less(i, j int) bool {
+	return r[i].From < r[j].From
+}
+
+func (r redirectEntries) Swap(i, j int) {
+	r[i], r[j] = r[j], r[i]
+}
+
+// validRedirectTarget checks if the given redirect target is an
+// absolute path or an absolute http(s) URL.
+func validRedirectTarget(target string) bool {
+	return path.IsAbs(target) || strings.HasPrefix(target, "http://") ||
+		strings.HasPrefix(target, "https://")
+}
+
+// Redirects lists the redirects of the site and allows to add and
+// remove them.
+func (h *nodeHandler) Redirects(c *reqContext) error {
+	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	m := c.Serv.Monsti()
+	redirects, err := m.GetRedirects(c.Site)
+	if err != nil {
+		return fmt.Errorf("Could not get redirects: %v", err)
+	}
+	context := mtemplate.Context{"Node": c.Node}
+	switch c.Req.Method {
+	case "GET":
+	case "POST":
+		from := strings.TrimSpace(c.Req.FormValue("From"))
+		to := strings.TrimSpace(c.Req.FormValue("To"))
+		switch c.Req.FormValue("Do") {
+		case "add":
+			context["From"], context["To"] = from, to
+			if !path.IsAbs(from) || !validRedirectTarget(to) {
+				context["Error"] = G("Please enter an absolute path and an absolute path or URL.")
+				break
+			}
+			from = path.Clean(from)
+			if path.IsAbs(to) {
+				to = path.Clean(to)
+			}
+			if from == to {
+				context["Error"] = G("A path can't be redirected to itself.")
+				break
+			}
+			existing, err := m.GetNode(c.Site, from)
+			if err != nil {
+				return fmt.Errorf("Could not fetch possibly existing node: %v", err)
+			}
+			if existing != nil {
+				context["Error"] = G("A node with this path does exist. Redirects only apply to missing nodes.")
+				break
+			}
+			redirects[from] = to
+		case "remove":
+			if _, ok := redirects[from]; !ok {
+				context["Error"] = G("Unknown redirect.")
+				break
+			}
+			delete(redirects, from)
+		default:
+			context["Error"] = G("Unknown action.")
+		}
+		if context["Error"] != nil {
+			break
+		}
+		err := m.WriteRedirectsAs(c.Site, redirects, c.UserSession.User.Login)
+		if err != nil {
+			return fmt.Errorf("Could not write redirects: %v", err)
+		}
+		http.Redirect(c.Res, c.Req, path.Join(c.Node.Path, "@@redirects"),
+			http.StatusSeeOther)
+		return nil
+	default:
+		return fmt.Errorf("Request method not supported: %v", c.Req.Method)
+	}
+	entries := make(redirectEntries, 0, len(redirects))
+	for from, to := range redirects {
+		entries = append(entries, redirectEntry{from, to})
+	}
+	sort.Sort(entries)
+	context["Redirects"] = entries
+	body, err := c.Renderer.Render("actions/redirects", context,
+		c.UserSession.Locale, h.Settings.Monsti.GetSiteTemplatesPath(c.Site))
+	if err != nil {
+		return fmt.Errorf("Can't render redirects: %v", err)
+	}
+	env := masterTmplEnv{Node: c.Node, Session: c.UserSession,
+		Flags: EDIT_VIEW, Title: G("Redirects")}
+	rendered, _ := renderInMaster(c.Renderer, []byte(body), env, h.Settings,
+		c.Site, c.SiteSettings, c.UserSession.Locale, c.Serv)
+	c.Res.Write(rendered)
+	return nil
+}
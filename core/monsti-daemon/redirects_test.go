@@ -0,0 +1,78 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestResolveRedirect(t *testing.T) {
+	redirects := map[string]string{
+		"/foo":     "/bar",
+		"/foo/baz": "/cruz",
+		"/old":     "http://example.com/new",
+	}
+	tests := []struct{ Path, Target string }{
+		{"/foo", "/bar"},
+		{"/foo/", "/bar"},
+		{"/foo/child", "/bar/child"},
+		{"/foo/baz/child", "/cruz/child"},
+		{"/old/page", "http://example.com/new/page"},
+		{"/foobar", ""},
+		{"/", ""},
+	}
+	for _, test := range tests {
+		if ret := resolveRedirect(redirects, test.Path); ret != test.Target {
+			t.Errorf("resolveRedirect(_, %q) = %q, should be %q", test.Path, ret,
+				test.Target)
+		}
+	}
+	if ret := resolveRedirect(map[string]string{"/": "/new"},
+		"/foo"); ret != "/new/foo" {
+		t.Errorf(`Redirect of "/" should apply to "/foo", got %q`, ret)
+	}
+}
+
+func TestAddRenameRedirect(t *testing.T) {
+	redirects := map[string]string{
+		"/manual": "/a/child",
+		"/b":      "/elsewhere",
+	}
+	addRenameRedirect(redirects, "/a", "/b")
+	addRenameRedirect(redirects, "/b/", "/c")
+	expected := map[string]string{
+		"/manual": "/c/child",
+		"/a":      "/c",
+		"/b":      "/c",
+	}
+	if !reflect.DeepEqual(redirects, expected) {
+		t.Errorf("addRenameRedirect results in %v, should be %v", redirects,
+			expected)
+	}
+	// Moving back must not result in a redirect loop.
+	addRenameRedirect(redirects, "/c", "/a")
+	expected = map[string]string{
+		"/manual": "/a/child",
+		"/b":      "/a",
+		"/c":      "/a",
+	}
+	if !reflect.DeepEqual(redirects, expected) {
+		t.Errorf("addRenameRedirect results in %v, should be %v", redirects,
+			expected)
+	}
+}
@@ -40,6 +40,47 @@ type masterTmplEnv struct {
 	Session            *service.UserSession
 	Title, Description string
 	Flags              masterTmplFlags
+	// Locale of the content. Defaults to the site's locale.
+	Locale string
+}
+
+// language is an entry of the language switcher.
+type language struct {
+	Locale, URL string
+	// Current is true for the language of the current page.
+	Current bool
+}
+
+// getLanguages returns the languages the given node is available in.
+//
+// locales are the site's locales, the first one being the default
+// locale.
+func getLanguages(node *service.Node, locales []string,
+	current string) []language {
+	var languages []language
+	translated := make(map[string]bool)
+	for _, locale := range node.TranslatedLocales() {
+		translated[locale] = true
+	}
+	nodePath := node.Path
+	if !strings.HasSuffix(nodePath, "/") {
+		nodePath += "/"
+	}
+	for i, locale := range locales {
+		if i > 0 && !translated[locale] {
+			continue
+		}
+		url := nodePath
+		if i > 0 {
+			url = "/" + locale + nodePath
+		}
+		languages = append(languages, language{
+			Locale:  locale,
+			URL:     url,
+			Current: locale == current,
+		})
+	}
+	return languages
 }
 
 // splitFirstDir returns the first directory in the given path.
@@ -55,22 +96,78 @@ type renderedBlock struct {
 	Rendered htmlT.HTML
 }
 
+// adminBarActions are the names of the actions linked in the admin
+// bar.
+var adminBarActions = []string{"edit", "list", "add", "remove", "copy",
+	"move", "history", "settings", "trash", "redirects", "users",
+	"permissions"}
+
+// permittedActions returns the names of the admin bar's actions the
+// session's user might perform on the given node.
+func permittedActions(session *service.UserSession, nodePath string,
+	getGrantedRoles getGrantedRolesFunc) (map[string]bool, error) {
+	permitted := make(map[string]bool)
+	if session.User == nil {
+		return permitted, nil
+	}
+	// Most actions check the same nodes, so only ask once for the
+	// roles granted on them.
+	granted := make(map[string][]string)
+	cachedGetGrantedRoles := func(nodePath, login string) ([]string, error) {
+		if roles, ok := granted[nodePath]; ok {
+			return roles, nil
+		}
+		roles, err := getGrantedRoles(nodePath, login)
+		granted[nodePath] = roles
+		return roles, err
+	}
+	for _, name := range adminBarActions {
+		ok, err := checkPermission(actions[name], session, nodePath,
+			cachedGetGrantedRoles)
+		if err != nil {
+			return nil, fmt.Errorf("Could not check permission for %v: %v", name,
+				err)
+		}
+		permitted[name] = ok
+	}
+	return permitted, nil
+}
+
 // renderInMaster renders the content in the master template.
 func renderInMaster(r template.Renderer, content []byte, env masterTmplEnv,
 	settings *settings, site string, siteSettings *service.Settings,
 	userLocale string,
 	s *service.Session) ([]byte, *service.CacheMods) {
 	mods := &service.CacheMods{Deps: []service.CacheDep{{Node: "/", Descend: -1}}}
+	locales := siteSettings.Locales()
+	locale := env.Locale
+	if locale == "" {
+		locale = locales[0]
+	}
+	var localePrefix string
+	if locale != locales[0] {
+		localePrefix = "/" + locale
+	}
+	permitted, err := permittedActions(env.Session, env.Node.Path,
+		func(nodePath, login string) ([]string, error) {
+			return s.Monsti().GetGrantedRoles(site, nodePath, login)
+		})
+	if err != nil {
+		panic(fmt.Sprintf("Could not get permitted actions: %v", err))
+	}
 	if env.Flags&EDIT_VIEW != 0 {
 		ret, err := r.Render("admin/master", template.Context{
 			"Site":         site,
 			"SiteSettings": siteSettings,
 			"Page": template.Context{
-				"Title":    env.Title,
-				"Node":     env.Node,
-				"EditView": true,
-				"SlimView": env.Flags&SLIM_VIEW != 0,
-				"Content":  htmlT.HTML(content),
+				"Title":        env.Title,
+				"Node":         env.Node,
+				"Locale":       locale,
+				"LocalePrefix": localePrefix,
+				"EditView":     true,
+				"Permitted":    permitted,
+				"SlimView":     env.Flags&SLIM_VIEW != 0,
+				"Content":      htmlT.HTML(content),
 			},
 			"Session": env.Session}, userLocale,
 			settings.Monsti.GetSiteTemplatesPath(site))
@@ -82,10 +179,17 @@ func renderInMaster(r template.Renderer, content []byte, env masterTmplEnv,
 	firstDir := splitFirstDir(env.Node.Path)
 	getNodeFn := func(path string) (*service.Node, error) {
 		node, err := s.Monsti().GetNode(site, path)
+		if node != nil {
+			node = node.Localized(locale)
+		}
 		return node, err
 	}
 	getChildrenFn := func(path string) ([]*service.Node, error) {
-		return s.Monsti().GetChildren(site, path)
+		children, err := s.Monsti().GetChildren(site, path)
+		for i := range children {
+			children[i] = children[i].Localized(locale)
+		}
+		return children, err
 	}
 
 	priNavDepth := 1
@@ -100,6 +204,7 @@ func renderInMaster(r template.Renderer, content []byte, env masterTmplEnv,
 		panic(fmt.Sprint("Could not get primary navigation: ", err))
 	}
 	prinav.MakeAbsolute("/")
+	prinav.AddPrefix(localePrefix)
 
 	var secnav navigation = nil
 	if env.Node.Path != "/" {
@@ -109,6 +214,7 @@ func renderInMaster(r template.Renderer, content []byte, env masterTmplEnv,
 			panic(fmt.Sprint("Could not get secondary navigation: ", err))
 		}
 		secnav.MakeAbsolute(env.Node.Path)
+		secnav.AddPrefix(localePrefix)
 	}
 
 	blocks := make(map[string][]renderedBlock)
@@ -119,7 +225,7 @@ func renderInMaster(r template.Renderer, content []byte, env masterTmplEnv,
 		renderedNav, err := r.Render("blocks/core/Navigation", template.Context{
 			"Id":    "core.PrimaryNavigation",
 			"Links": prinav,
-		}, userLocale, settings.Monsti.GetSiteTemplatesPath(site))
+		}, locale, settings.Monsti.GetSiteTemplatesPath(site))
 		if err != nil {
 			panic(fmt.Sprintf("Could not render navigation: %v", err))
 		}
@@ -130,20 +236,34 @@ func renderInMaster(r template.Renderer, content []byte, env masterTmplEnv,
 	}
 
 	title := getNodeTitle(env.Node)
-	ret, err := r.Render("master", template.Context{
+	page := template.Context{
+		"Node":             env.Node,
+		"Locale":           locale,
+		"LocalePrefix":     localePrefix,
+		"Languages":        getLanguages(env.Node, locales, locale),
+		"PrimaryNav":       prinav, // TODO DEPRECATED
+		"SecondaryNav":     secnav, // TODO DEPRECATED
+		"EditView":         env.Flags&EDIT_VIEW != 0,
+		"Title":            title,
+		"Content":          htmlT.HTML(content),
+		"ShowSecondaryNav": len(secnav) > 0, // TODO DEPRECATED
+		"Blocks":           blocks,
+		"Permitted":        permitted,
+	}
+	context := template.Context{
 		"Site":         site,
 		"SiteSettings": siteSettings,
-		"Page": template.Context{
-			"Node":             env.Node,
-			"PrimaryNav":       prinav, // TODO DEPRECATED
-			"SecondaryNav":     secnav, // TODO DEPRECATED
-			"EditView":         env.Flags&EDIT_VIEW != 0,
-			"Title":            title,
-			"Content":          htmlT.HTML(content),
-			"ShowSecondaryNav": len(secnav) > 0, // TODO DEPRECATED
-			"Blocks":           blocks,
-		},
-		"Session": env.Session}, userLocale,
+		"Page":         page,
+		"Session":      env.Session}
+	// The admin bar is part of the admin interface and as such shown in
+	// the locale of the user, the page in the locale of its content.
+	adminBar, err := r.Render("blocks/admin-bar", context, userLocale,
+		settings.Monsti.GetSiteTemplatesPath(site))
+	if err != nil {
+		panic(fmt.Sprintf("Could not render admin bar: %v", err))
+	}
+	page["AdminBar"] = htmlT.HTML(adminBar)
+	ret, err := r.Render("master", context, locale,
 		settings.Monsti.GetSiteTemplatesPath(site))
 	if err != nil {
 		panic(fmt.Sprintf(
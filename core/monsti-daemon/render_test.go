@@ -17,7 +17,10 @@
 package main
 
 import (
+	"reflect"
 	"testing"
+
+	"pkg.monsti.org/monsti/api/service"
 )
 
 func TestSplitFirstDir(t *testing.T) {
@@ -41,6 +44,63 @@ func TestSplitFirstDir(t *testing.T) {
 	}
 }
 
+func TestGetLanguages(t *testing.T) {
+	node := &service.Node{
+		Path: "/foo",
+		Translations: map[string]map[string]service.Field{
+			"de": {"core.Title": nil},
+			"es": {},
+		},
+	}
+	ret := getLanguages(node, []string{"en", "de", "es", "fr"}, "de")
+	expected := []language{
+		{Locale: "en", URL: "/foo/"},
+		{Locale: "de", URL: "/de/foo/", Current: true}}
+	if !reflect.DeepEqual(ret, expected) {
+		t.Errorf("getLanguages(...) = %v, should be %v", ret, expected)
+	}
+}
+
+func TestPermittedActions(t *testing.T) {
+	getGrantedRoles := func(nodePath, login string) ([]string, error) {
+		if nodePath == "/news" {
+			return []string{"editor"}, nil
+		}
+		return nil, nil
+	}
+	tests := []struct {
+		User      *service.User
+		Path      string
+		Permitted []string
+	}{
+		{nil, "/", nil},
+		{&service.User{Login: "foo", Roles: []string{"reviewer"}}, "/", nil},
+		{&service.User{Login: "foo", Roles: []string{"viewer"}}, "/",
+			[]string{"list", "history"}},
+		{&service.User{Login: "foo", Roles: []string{"viewer"}}, "/news",
+			[]string{"edit", "list", "add", "remove", "copy", "move", "history"}},
+		{&service.User{Login: "foo", Roles: []string{"admin"}}, "/",
+			adminBarActions},
+	}
+	for i, test := range tests {
+		ret, err := permittedActions(&service.UserSession{User: test.User},
+			test.Path, getGrantedRoles)
+		if err != nil {
+			t.Fatalf("Test %v: permittedActions returned error: %v", i, err)
+		}
+		var permitted []string
+		for _, name := range adminBarActions {
+			if ret[name] {
+				permitted = append(permitted, name)
+			}
+		}
+		if !reflect.DeepEqual(permitted, test.Permitted) {
+			t.Errorf("Test %v: permittedActions(...) = %v, should be %v", i,
+				permitted, test.Permitted)
+		}
+	}
+}
+
 /*
 
 func TestRenderInMaster(t *testing.T) {
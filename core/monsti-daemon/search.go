@@ -0,0 +1,130 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util/i18n"
+	mtemplate "pkg.monsti.org/monsti/api/util/template"
+)
+
+// searchPageSize is the number of search hits per page.
+const searchPageSize = 10
+
+// searchPage is a link to a page of search results.
+type searchPage struct {
+	Number  int
+	URL     string
+	Current bool
+}
+
+func getSearchContext(reqId uint, embed *service.EmbedNode,
+	s *service.Session, settings *settings, renderer *mtemplate.Renderer) (
+	map[string][]byte, *service.CacheMods, error) {
+	req, err := s.Monsti().GetRequest(reqId)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not get request: %v", err)
+	}
+	query := req.Query
+	if embed != nil {
+		embedURL, err := url.Parse(embed.URI)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Could not parse embed URI: %v", err)
+		}
+		query = embedURL.Query()
+	}
+	text := strings.TrimSpace(query.Get("q"))
+	page, err := strconv.Atoi(query.Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	context := mtemplate.Context{}
+	context["Embedded"] = embed
+	context["Query"] = text
+	mods := &service.CacheMods{}
+	if text != "" {
+		result, err := s.Monsti().Search(req.Site, &service.SearchQuery{
+			Text:       text,
+			PublicOnly: req.Session.User == nil,
+			Offset:     (page - 1) * searchPageSize,
+			Limit:      searchPageSize,
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("Could not search: %v", err)
+		}
+		context["Result"] = result
+		var pages []searchPage
+		for i := 1; (i-1)*searchPageSize < result.Total; i++ {
+			values := url.Values{"q": {text}, "page": {strconv.Itoa(i)}}
+			pages = append(pages, searchPage{i, "?" + values.Encode(), i == page})
+		}
+		if len(pages) > 1 {
+			context["Pages"] = pages
+		}
+		// Results depend on all nodes of the site.
+		mods.Skip = true
+	}
+	rendered, err := renderer.Render("core/search-results", context,
+		req.Locale, settings.Monsti.GetSiteTemplatesPath(req.Site))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not render template: %v", err)
+	}
+	return map[string][]byte{"SearchResults": rendered}, mods, nil
+}
+
+func initSearch(settings *settings, session *service.Session,
+	sessions *service.SessionPool, logger *log.Logger,
+	renderer *mtemplate.Renderer) error {
+	G := func(in string) string { return in }
+
+	nodeType := service.NodeType{
+		Id:        "core.Search",
+		AddableTo: []string{"."},
+		Name:      i18n.GenLanguageMap(G("Search"), availableLocales),
+		Fields: []*service.FieldConfig{
+			{Id: "core.Title"},
+		},
+	}
+	if err := session.Monsti().RegisterNodeType(&nodeType); err != nil {
+		return fmt.Errorf("Could not register search node type: %v", err)
+	}
+
+	handler := service.NewNodeContextHandler(sessions,
+		func(req uint, session *service.Session, nodeType string,
+			embedNode *service.EmbedNode) (
+			map[string][]byte, *service.CacheMods, error) {
+			if nodeType != "core.Search" {
+				return nil, nil, nil
+			}
+			ctx, mods, err := getSearchContext(req, embedNode, session, settings,
+				renderer)
+			if err != nil {
+				return nil, nil, fmt.Errorf("Could not get search context: %v", err)
+			}
+			return ctx, mods, nil
+		})
+	if err := session.Monsti().AddSignalHandler(handler); err != nil {
+		logger.Fatalf("Could not add signal handler: %v", err)
+	}
+	return nil
+}
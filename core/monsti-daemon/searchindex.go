@@ -0,0 +1,509 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"html/template"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+// searchCoreFields are the fields which are always searchable.
+var searchCoreFields = []string{"core.Title", "core.Description", "core.Body"}
+
+// searchTitleWeight is the weight of words in the node's title
+// relative to words in other fields.
+const searchTitleWeight = 3
+
+// searchSnippetLength is the approximate length of search snippets in
+// bytes.
+const searchSnippetLength = 200
+
+// searchDoc is a node in the full-text search index.
+type searchDoc struct {
+	Path  string
+	Title string
+	// Text holds the text of the searchable fields except the title.
+	Text        string
+	Public      bool
+	PublishTime time.Time
+	// Words maps the node's words to their weight.
+	Words map[string]int
+}
+
+// searchIndex is an inverted index of the nodes of a site.
+type searchIndex struct {
+	// Docs maps node paths to the indexed nodes.
+	Docs map[string]*searchDoc
+	// Words maps words to the paths of the nodes containing them.
+	Words map[string]map[string]bool
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		Docs:  make(map[string]*searchDoc),
+		Words: make(map[string]map[string]bool),
+	}
+}
+
+// searchWords splits the given text into words of letters and digits
+// and calls fn with the lower case word and its position in text.
+func searchWords(text string, fn func(word string, start, end int)) {
+	start := -1
+	for pos, r := range text {
+		isWord := unicode.IsLetter(r) || unicode.IsDigit(r)
+		switch {
+		case isWord && start == -1:
+			start = pos
+		case !isWord && start != -1:
+			fn(strings.ToLower(text[start:pos]), start, pos)
+			start = -1
+		}
+	}
+	if start != -1 {
+		fn(strings.ToLower(text[start:]), start, len(text))
+	}
+}
+
+var htmlTagRegexp = regexp.MustCompile(`<[^>]*>`)
+
+// searchText returns the text of the given decoded field value. HTML
+// tags get removed.
+func searchText(value interface{}) string {
+	var parts []string
+	switch v := value.(type) {
+	case string:
+		text := htmlTagRegexp.ReplaceAllString(v, " ")
+		parts = append(parts, html.UnescapeString(text))
+	case []interface{}:
+		for _, element := range v {
+			parts = append(parts, searchText(element))
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			parts = append(parts, searchText(v[key]))
+		}
+	}
+	return strings.Join(strings.Fields(strings.Join(parts, " ")), " ")
+}
+
+// newSearchDoc returns the search document of the given node data
+// using the given searchable fields.
+func newSearchDoc(nodePath string, content []byte, fields []string) (
+	*searchDoc, error) {
+	var node struct {
+		Public      bool
+		PublishTime time.Time
+		Fields      map[string]map[string]interface{}
+	}
+	if err := json.Unmarshal(content, &node); err != nil {
+		return nil, fmt.Errorf("Could not decode node: %v", err)
+	}
+	doc := &searchDoc{
+		Path:        nodePath,
+		Public:      node.Public,
+		PublishTime: node.PublishTime,
+		Words:       make(map[string]int),
+	}
+	var texts []string
+	for _, field := range fields {
+		parts := strings.SplitN(field, ".", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		text := searchText(node.Fields[parts[0]][parts[1]])
+		weight := 1
+		if field == "core.Title" {
+			doc.Title = text
+			weight = searchTitleWeight
+		} else if text != "" {
+			texts = append(texts, text)
+		}
+		searchWords(text, func(word string, start, end int) {
+			doc.Words[word] += weight
+		})
+	}
+	doc.Text = strings.Join(texts, " ")
+	return doc, nil
+}
+
+// add adds the given document, replacing any document of the same
+// node.
+func (x *searchIndex) add(doc *searchDoc) {
+	x.remove(doc.Path)
+	x.Docs[doc.Path] = doc
+	for word := range doc.Words {
+		if x.Words[word] == nil {
+			x.Words[word] = make(map[string]bool)
+		}
+		x.Words[word][doc.Path] = true
+	}
+}
+
+// remove removes the document of the given node.
+func (x *searchIndex) remove(nodePath string) {
+	doc, ok := x.Docs[nodePath]
+	if !ok {
+		return
+	}
+	for word := range doc.Words {
+		delete(x.Words[word], nodePath)
+		if len(x.Words[word]) == 0 {
+			delete(x.Words, word)
+		}
+	}
+	delete(x.Docs, nodePath)
+}
+
+// inSubtree checks if the given node is root or one of its
+// descendants.
+func inSubtree(root, nodePath string) bool {
+	return nodePath == root || root == "/" ||
+		strings.HasPrefix(nodePath, root+"/")
+}
+
+// removeSubtree removes the documents of the given node and its
+// descendants.
+func (x *searchIndex) removeSubtree(root string) {
+	for nodePath := range x.Docs {
+		if inSubtree(root, nodePath) {
+			x.remove(nodePath)
+		}
+	}
+}
+
+// renameSubtree updates the paths of the documents of the given node
+// and its descendants.
+func (x *searchIndex) renameSubtree(source, target string) {
+	var docs []*searchDoc
+	for nodePath, doc := range x.Docs {
+		if inSubtree(source, nodePath) {
+			docs = append(docs, doc)
+		}
+	}
+	for _, doc := range docs {
+		x.remove(doc.Path)
+	}
+	for _, doc := range docs {
+		doc.Path = path.Join(target, strings.TrimPrefix(doc.Path, source))
+		x.add(doc)
+	}
+}
+
+// matchTerm returns the scores of the nodes containing words starting
+// with the given term. Exact matches score higher.
+func (x *searchIndex) matchTerm(term string) map[string]int {
+	scores := make(map[string]int)
+	for word, paths := range x.Words {
+		if !strings.HasPrefix(word, term) {
+			continue
+		}
+		factor := 1
+		if word == term {
+			factor = 2
+		}
+		for nodePath := range paths {
+			score := x.Docs[nodePath].Words[word] * factor
+			if score > scores[nodePath] {
+				scores[nodePath] = score
+			}
+		}
+	}
+	return scores
+}
+
+// searchHits sorts search hits by score.
+type searchHits struct {
+	Paths  []string
+	Scores map[string]int
+}
+
+func (h *searchHits) Len() int {
+	return len(h.Paths)
+}
+
+func (h *searchHits) Swap(i, j int) {
+	h.Paths[i], h.Paths[j] = h.Paths[j], h.Paths[i]
+}
+
+func (h *searchHits) Less(i, j int) bool {
+	left, right := h.Scores[h.Paths[i]], h.Scores[h.Paths[j]]
+	if left != right {
+		return left > right
+	}
+	return h.Paths[i] < h.Paths[j]
+}
+
+// search returns the nodes containing all terms of the query.
+func (x *searchIndex) search(query *service.SearchQuery,
+	now time.Time) *service.SearchResult {
+	var terms []string
+	searchWords(query.Text, func(word string, start, end int) {
+		terms = append(terms, word)
+	})
+	ret := &service.SearchResult{}
+	if len(terms) == 0 {
+		return ret
+	}
+	var scores map[string]int
+	for _, term := range terms {
+		termScores := x.matchTerm(term)
+		if scores == nil {
+			scores = termScores
+			continue
+		}
+		for nodePath, score := range scores {
+			if termScore, ok := termScores[nodePath]; ok {
+				scores[nodePath] = score + termScore
+			} else {
+				delete(scores, nodePath)
+			}
+		}
+	}
+	hits := searchHits{Scores: scores}
+	for nodePath := range scores {
+		doc := x.Docs[nodePath]
+		if query.PublicOnly && (!doc.Public || doc.PublishTime.After(now)) {
+			continue
+		}
+		hits.Paths = append(hits.Paths, nodePath)
+	}
+	sort.Sort(&hits)
+	ret.Total = len(hits.Paths)
+	paths := hits.Paths
+	if query.Offset > 0 {
+		if query.Offset > len(paths) {
+			query.Offset = len(paths)
+		}
+		paths = paths[query.Offset:]
+	}
+	if query.Limit > 0 && query.Limit < len(paths) {
+		paths = paths[:query.Limit]
+	}
+	for _, nodePath := range paths {
+		doc := x.Docs[nodePath]
+		text := doc.Text
+		if text == "" {
+			text = doc.Title
+		}
+		ret.Hits = append(ret.Hits, service.SearchHit{
+			Path:    doc.Path,
+			Title:   doc.Title,
+			Snippet: searchSnippet(text, terms, searchSnippetLength),
+		})
+	}
+	return ret
+}
+
+// searchSnippet returns an excerpt of about length bytes of the given
+// text around the first word matching any of the terms. Matching
+// words are highlighted.
+func searchSnippet(text string, terms []string, length int) template.HTML {
+	type word struct {
+		Start, End int
+		Match      bool
+	}
+	var words []word
+	first := -1
+	searchWords(text, func(w string, start, end int) {
+		match := false
+		for _, term := range terms {
+			if strings.HasPrefix(w, term) {
+				match = true
+				break
+			}
+		}
+		if match && first == -1 {
+			first = len(words)
+		}
+		words = append(words, word{start, end, match})
+	})
+	if len(words) == 0 {
+		return ""
+	}
+	// Start a few words before the first match.
+	begin := 0
+	if first != -1 {
+		for begin = first; begin > 0 &&
+			words[first].Start-words[begin-1].Start < length/3; begin-- {
+		}
+	}
+	start := words[begin].Start
+	end := len(text)
+	if end-start > length {
+		end = start + length
+		for end < len(text) && !utf8.RuneStart(text[end]) {
+			end++
+		}
+	}
+	var out bytes.Buffer
+	if begin > 0 {
+		out.WriteString("… ")
+	}
+	pos := start
+	for _, w := range words[begin:] {
+		if w.End > end {
+			break
+		}
+		out.WriteString(html.EscapeString(text[pos:w.Start]))
+		if w.Match {
+			out.WriteString("<mark>")
+		}
+		out.WriteString(html.EscapeString(text[w.Start:w.End]))
+		if w.Match {
+			out.WriteString("</mark>")
+		}
+		pos = w.End
+	}
+	if end < len(text) {
+		out.WriteString(" …")
+	} else {
+		out.WriteString(html.EscapeString(text[pos:]))
+	}
+	return template.HTML(out.String())
+}
+
+// searchFields returns the searchable fields of the given node type.
+func (i *MonstiService) searchFields(nodeType string) []string {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+	fields := append([]string{}, searchCoreFields...)
+	if config, ok := i.Settings.Config.NodeTypes[nodeType]; ok {
+		for _, field := range config.Fields {
+			if field.Searchable {
+				fields = append(fields, field.Id)
+			}
+		}
+	}
+	return fields
+}
+
+// newNodeSearchDoc returns the search document of the given node data.
+func (i *MonstiService) newNodeSearchDoc(nodePath string, content []byte) (
+	*searchDoc, error) {
+	var node struct{ Type string }
+	if err := json.Unmarshal(content, &node); err != nil {
+		return nil, fmt.Errorf("Could not decode node: %v", err)
+	}
+	return newSearchDoc(nodePath, content, i.searchFields(node.Type))
+}
+
+// siteSearchIndex returns the full-text search index of the given
+// site.
+//
+// The index gets built on first use. Callers must hold the site's
+// mutex and the search index mutex.
+func (i *MonstiService) siteSearchIndex(site string) (*searchIndex, error) {
+	if i.searchIndex == nil {
+		i.searchIndex = make(map[string]*searchIndex)
+	}
+	if index, ok := i.searchIndex[site]; ok {
+		return index, nil
+	}
+	index := newSearchIndex()
+	nodes := i.nodesStorage(site)
+	walker := func(file string, isDir bool) error {
+		if isDir || path.Base(file) != "node.json" {
+			return nil
+		}
+		content, err := nodes.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		nodePath := path.Clean("/" + path.Dir(file))
+		doc, err := i.newNodeSearchDoc(nodePath, content)
+		if err != nil {
+			i.Logger.Printf("Could not index node %v: %v", nodePath, err)
+			return nil
+		}
+		index.add(doc)
+		return nil
+	}
+	if err := walkStorage(nodes, "/", walker); err != nil {
+		return nil, fmt.Errorf("Could not build search index: %v", err)
+	}
+	i.searchIndex[site] = index
+	return index, nil
+}
+
+// updateSearchIndex calls fn with the site's search index if it has
+// already been built.
+func (i *MonstiService) updateSearchIndex(site string,
+	fn func(index *searchIndex)) {
+	i.searchIndexMutex.Lock()
+	defer i.searchIndexMutex.Unlock()
+	if index, ok := i.searchIndex[site]; ok {
+		fn(index)
+	}
+}
+
+// indexNodeText updates the search index for the given written node
+// data.
+func (i *MonstiService) indexNodeText(site, nodePath string, content []byte) {
+	i.updateSearchIndex(site, func(index *searchIndex) {
+		doc, err := i.newNodeSearchDoc(nodePath, content)
+		if err != nil {
+			i.Logger.Printf("Could not index node %v: %v", nodePath, err)
+			index.remove(nodePath)
+			return
+		}
+		index.add(doc)
+	})
+}
+
+// dropSearchIndex drops the site's search index, e.g. if it could not
+// be updated. It will be rebuilt on next use.
+func (i *MonstiService) dropSearchIndex(site string) {
+	i.searchIndexMutex.Lock()
+	defer i.searchIndexMutex.Unlock()
+	delete(i.searchIndex, site)
+}
+
+type SearchArgs struct {
+	Site  string
+	Query service.SearchQuery
+}
+
+func (i *MonstiService) Search(args *SearchArgs,
+	reply *service.SearchResult) error {
+	i.siteMutexes[args.Site].RLock()
+	defer i.siteMutexes[args.Site].RUnlock()
+	i.searchIndexMutex.Lock()
+	defer i.searchIndexMutex.Unlock()
+	index, err := i.siteSearchIndex(args.Site)
+	if err != nil {
+		return err
+	}
+	*reply = *index.search(&args.Query, time.Now().UTC())
+	return nil
+}
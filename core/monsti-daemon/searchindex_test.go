@@ -0,0 +1,130 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"html/template"
+	"reflect"
+	"testing"
+	"time"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+func TestSearchIndex(t *testing.T) {
+	nodes := map[string]string{
+		"/": `{"Type":"core.Document","Public":true,"Fields":{"core":{
+      "Title":"Welcome","Body":"<p>Monsti is a <b>CMS</b> &amp; more.</p>"}}}`,
+		"/about": `{"Type":"core.Document","Public":true,"Fields":{"core":{
+      "Title":"About Monsti","Description":"Who we are"},
+      "foo":{"Tags":["team","cms"]}}}`,
+		"/about/private": `{"Type":"core.Document","Fields":{"core":{
+      "Title":"Private CMS notes"}}}`,
+		"/news": `{"Type":"core.Document","Public":true,
+      "PublishTime":"2100-01-01T00:00:00Z","Fields":{"core":{"Title":"Future CMS"}}}`,
+	}
+	fields := append(searchCoreFields, "foo.Tags")
+	index := newSearchIndex()
+	for nodePath, content := range nodes {
+		doc, err := newSearchDoc(nodePath, []byte(content), fields)
+		if err != nil {
+			t.Fatalf("newSearchDoc(%v) returns error: %v", nodePath, err)
+		}
+		index.add(doc)
+	}
+	now := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	search := func(text string, publicOnly bool) []string {
+		result := index.search(&service.SearchQuery{Text: text,
+			PublicOnly: publicOnly}, now)
+		var paths []string
+		for _, hit := range result.Hits {
+			paths = append(paths, hit.Path)
+		}
+		if result.Total != len(paths) {
+			t.Errorf("Total should be %v, got %v", len(paths), result.Total)
+		}
+		return paths
+	}
+	tests := []struct {
+		Text       string
+		PublicOnly bool
+		Paths      []string
+	}{
+		{"", false, nil},
+		{"cms", false, []string{"/about/private", "/news", "/", "/about"}},
+		{"CMS", true, []string{"/", "/about"}},
+		{"monsti", false, []string{"/about", "/"}},
+		{"mon wel", false, []string{"/"}},
+		{"team", false, []string{"/about"}},
+		{"unknown", false, nil},
+	}
+	for _, test := range tests {
+		paths := search(test.Text, test.PublicOnly)
+		if !reflect.DeepEqual(paths, test.Paths) {
+			t.Errorf("search(%q, %v) should return %v, got %v", test.Text,
+				test.PublicOnly, test.Paths, paths)
+		}
+	}
+
+	result := index.search(&service.SearchQuery{Text: "cms", Offset: 1,
+		Limit: 2}, now)
+	if result.Total != 4 || len(result.Hits) != 2 ||
+		result.Hits[0].Path != "/news" {
+		t.Errorf("search with offset and limit returns %v", result)
+	}
+	result = index.search(&service.SearchQuery{Text: "cms more"}, now)
+	expected := service.SearchHit{Path: "/", Title: "Welcome",
+		Snippet: "Monsti is a <mark>CMS</mark> &amp; <mark>more</mark>."}
+	if len(result.Hits) != 1 || result.Hits[0] != expected {
+		t.Errorf("search should return %v, got %v", expected, result.Hits)
+	}
+
+	index.renameSubtree("/about", "/team")
+	if paths := search("cms", false); !reflect.DeepEqual(paths,
+		[]string{"/news", "/team/private", "/", "/team"}) {
+		t.Errorf("Renamed nodes should be found, got %v", paths)
+	}
+	index.removeSubtree("/team")
+	if paths := search("cms", false); !reflect.DeepEqual(paths,
+		[]string{"/news", "/"}) {
+		t.Errorf("Removed nodes should not be found, got %v", paths)
+	}
+	if _, ok := index.Words["team"]; ok {
+		t.Errorf("Words of removed nodes should be removed")
+	}
+}
+
+func TestSearchSnippet(t *testing.T) {
+	tests := []struct {
+		Text    string
+		Length  int
+		Snippet template.HTML
+	}{
+		{"", 20, ""},
+		{"a <b> c", 20, "a &lt;b&gt; c"},
+		{"one two three four five six seven eight", 21,
+			"… three <mark>four</mark> five six …"},
+		{"no match here at all", 8, "no match …"},
+	}
+	for _, test := range tests {
+		snippet := searchSnippet(test.Text, []string{"four"}, test.Length)
+		if snippet != test.Snippet {
+			t.Errorf("searchSnippet(%q) should be %q, got %q", test.Text,
+				test.Snippet, snippet)
+		}
+	}
+}
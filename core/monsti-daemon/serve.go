@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"path"
 	"runtime/debug"
 	"strings"
 	"sync"
@@ -45,6 +46,56 @@ type reqContext struct {
 	Site         string
 	SiteSettings *service.Settings
 	Serv         *service.Session
+	// Locale is the locale of the requested content.
+	Locale string
+	// Renderer renders templates putting the session's CSRF token into
+	// forms.
+	Renderer template.Renderer
+}
+
+// localePrefix returns the URL path prefix of the requested locale,
+// i.e. an empty string for the default locale of the site.
+func (c *reqContext) localePrefix() string {
+	if c.Locale == "" || c.Locale == c.SiteSettings.StringValue("core.Locale") {
+		return ""
+	}
+	return "/" + c.Locale
+}
+
+// pageCacheId returns the cache id of the given page cache for the
+// requested locale.
+func (c *reqContext) pageCacheId(id string) string {
+	if prefix := c.localePrefix(); prefix != "" {
+		return id + "." + c.Locale
+	}
+	return id
+}
+
+// actions maps the action names used in URLs (e.g. `/foo/@@edit`) to
+// actions.
+var actions = map[string]service.Action{
+	"view":                   service.ViewAction,
+	"edit":                   service.EditAction,
+	"list":                   service.ListAction,
+	"chooser":                service.ChooserAction,
+	"settings":               service.SettingsAction,
+	"login":                  service.LoginAction,
+	"logout":                 service.LogoutAction,
+	"add":                    service.AddAction,
+	"remove":                 service.RemoveAction,
+	"request-password-token": service.RequestPasswordTokenAction,
+	"change-password":        service.ChangePasswordAction,
+	"history":                service.HistoryAction,
+	"publish":                service.PublishAction,
+	"discard":                service.DiscardAction,
+	"workflow":               service.WorkflowAction,
+	"trash":                  service.TrashAction,
+	"redirects":              service.RedirectsAction,
+	"copy":                   service.CopyAction,
+	"move":                   service.MoveAction,
+	"permissions":            service.PermissionsAction,
+	"users":                  service.UsersAction,
+	"two-factor":             service.TwoFactorAction,
 }
 
 // nodeHandler is a net/http handler to process incoming HTTP requests.
@@ -52,8 +103,13 @@ type nodeHandler struct {
 	Renderer         template.Renderer
 	Settings         *settings
 	InitializedSites map[string]bool
+	// AdminLocales are the locales available for the admin interface.
+	AdminLocales []string
 	// Log is the logger used by the node handler.
 	Log *log.Logger
+	// Throttle delays logins and password requests after failed
+	// attempts.
+	Throttle *throttle
 	// Info is a connection to an INFO service.
 	Monsti        *service.MonstiClient
 	Sessions      *service.SessionPool
@@ -79,6 +135,7 @@ func (n *nodeHandler) GetRequest(id uint) *service.Request {
 		Action:   req.Action,
 		Form:     req.Req.Form,
 		PostForm: req.Req.PostForm,
+		Locale:   req.Locale,
 		/*
 			Node:  req.Node,
 		*/
@@ -103,6 +160,25 @@ func splitAction(path string) (string, string) {
 	return nodePath, action
 }
 
+// splitLocale splits and returns the path and locale of the given
+// node path. The path may start with one of the given locales except
+// the first one, which is the default locale.
+func splitLocale(nodePath string, locales []string) (string, string) {
+	if len(locales) == 0 {
+		return nodePath, ""
+	}
+	for _, locale := range locales[1:] {
+		prefix := "/" + locale
+		if nodePath == prefix {
+			return "/", locale
+		}
+		if strings.HasPrefix(nodePath, prefix+"/") {
+			return nodePath[len(prefix):], locale
+		}
+	}
+	return nodePath, locales[0]
+}
+
 type ServeError string
 
 func (err ServeError) Error() string {
@@ -147,19 +223,7 @@ func (h *nodeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	defer h.Sessions.Free(c.Serv)
 	var nodePath string
 	nodePath, action := splitAction(c.Req.URL.Path)
-	c.Action = map[string]service.Action{
-		"view":                   service.ViewAction,
-		"edit":                   service.EditAction,
-		"list":                   service.ListAction,
-		"chooser":                service.ChooserAction,
-		"settings":               service.SettingsAction,
-		"login":                  service.LoginAction,
-		"logout":                 service.LogoutAction,
-		"add":                    service.AddAction,
-		"remove":                 service.RemoveAction,
-		"request-password-token": service.RequestPasswordTokenAction,
-		"change-password":        service.ChangePasswordAction,
-	}[action]
+	c.Action = actions[action]
 	c.Site = strings.SplitN(c.Req.Host, ":", 2)[0]
 	if v, ok := h.InitializedSites[c.Site]; !(ok && v) {
 		ok, err := c.Serv.Monsti().InitSite(c.Site)
@@ -187,7 +251,14 @@ func (h *nodeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		serveError("Could not get client session: %v", err)
 	}
-	c.UserSession.Locale = c.SiteSettings.Fields["core.Locale"].Value().(string)
+	nodePath, c.Locale = splitLocale(nodePath, c.SiteSettings.Locales())
+	c.UserSession.Locale = c.Locale
+	// Public pages are shown in the requested locale (c.Locale), the
+	// admin interface including the admin bar of public pages and
+	// other actions in the locale of the user.
+	if c.Action != service.ViewAction || c.UserSession.User != nil {
+		c.UserSession.Locale = h.adminLocale(&c)
+	}
 
 	h.Log.Printf("(%v) %v %v", c.Site, c.Req.Method, c.Req.URL.Path)
 
@@ -195,13 +266,43 @@ func (h *nodeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		serveError("Could not parse form: %v", err)
 	}
 
+	if c.Req.Method != "GET" && c.Req.Method != "HEAD" &&
+		!checkCSRFToken(c.Req, c.Session) {
+		h.Log.Printf("(%v) Invalid CSRF token", c.Site)
+		http.Error(w, "Invalid CSRF token.", http.StatusForbidden)
+		return
+	}
+	if requireTwoFactor(&c) {
+		switch c.Action {
+		case service.TwoFactorAction, service.LogoutAction:
+		default:
+			http.Redirect(c.Res, c.Req, "/@@two-factor", http.StatusSeeOther)
+			return
+		}
+	}
+	// Public pages might get cached, so their forms get a placeholder
+	// which is replaced by the session's token when writing the page.
+	c.UserSession.CSRFToken = csrfPlaceholder
+	if c.Action != service.ViewAction {
+		c.UserSession.CSRFToken, err = c.csrfToken()
+		if err != nil {
+			serveError("Could not get CSRF token: %v", err)
+		}
+	}
+	c.Renderer = h.Renderer
+	c.Renderer.CSRFToken = c.UserSession.CSRFToken
+
 	// Try to serve page from cache
 	if c.UserSession.User == nil && c.Action == service.ViewAction &&
 		nodePath[len(nodePath)-1] == '/' &&
 		len(c.Req.Form) == 0 {
 		content, _, err := c.Serv.Monsti().FromCache(c.Site, nodePath,
-			"core.page.full")
+			c.pageCacheId("core.page.full"))
 		if err == nil && content != nil {
+			content, err = c.insertCSRFToken(content)
+			if err != nil {
+				serveError("Could not insert CSRF token: %v", err)
+			}
 			c.Res.Write(content)
 			return
 		}
@@ -212,6 +313,22 @@ func (h *nodeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		serveError("Error getting node %v of site %v: %v",
 			nodePath, c.Site, err)
 	}
+	if c.Node == nil && (c.Req.Method == "GET" || c.Req.Method == "HEAD") {
+		target, err := c.Serv.Monsti().ResolveRedirect(c.Site, nodePath)
+		if err != nil {
+			serveError("Could not resolve redirect: %v", err)
+		}
+		if target != "" {
+			// Keep any trailing slash and action of the requested URL.
+			location := c.localePrefix() + target + strings.TrimPrefix(
+				c.Req.URL.Path, c.localePrefix()+path.Clean(nodePath))
+			if c.Req.URL.RawQuery != "" {
+				location += "?" + c.Req.URL.RawQuery
+			}
+			http.Redirect(c.Res, c.Req, location, http.StatusMovedPermanently)
+			return
+		}
+	}
 	if c.Node == nil ||
 		(c.Action == service.ViewAction && c.UserSession.User == nil &&
 			(c.Node.Public == false || c.Node.PublishTime.After(time.Now()))) {
@@ -223,13 +340,18 @@ func (h *nodeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if c.Node.Type.Id == "core.Path" {
 		switch c.Action {
 		case service.ViewAction, service.EditAction,
-			service.AddAction, service.RemoveAction:
+			service.AddAction, service.RemoveAction, service.CopyAction,
+			service.MoveAction:
 			http.Redirect(c.Res, c.Req, filepath.Join(c.Node.Path, "@@list"),
 				http.StatusSeeOther)
 			return
 		}
 	}
-	if !checkPermission(c.Action, c.UserSession) {
+	permitted, err := h.mayPerform(&c, c.Action, c.Node.Path)
+	if err != nil {
+		serveError("Could not check permission: %v", err)
+	}
+	if !permitted {
 		http.Error(w, "Unauthorized.", http.StatusUnauthorized)
 		return
 	}
@@ -254,6 +376,28 @@ func (h *nodeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		err = h.RequestPasswordToken(&c)
 	case service.ChangePasswordAction:
 		err = h.ChangePassword(&c)
+	case service.HistoryAction:
+		err = h.History(&c)
+	case service.PublishAction:
+		err = h.Publish(&c)
+	case service.DiscardAction:
+		err = h.Discard(&c)
+	case service.WorkflowAction:
+		err = h.Workflow(&c)
+	case service.TrashAction:
+		err = h.Trash(&c)
+	case service.RedirectsAction:
+		err = h.Redirects(&c)
+	case service.CopyAction:
+		err = h.Copy(&c)
+	case service.MoveAction:
+		err = h.Move(&c)
+	case service.PermissionsAction:
+		err = h.Permissions(&c)
+	case service.UsersAction:
+		err = h.Users(&c)
+	case service.TwoFactorAction:
+		err = h.TwoFactor(&c)
 	default:
 		err = h.View(&c)
 	}
@@ -44,6 +44,28 @@ func TestSplitAction(t *testing.T) {
 	}
 }
 
+func TestSplitLocale(t *testing.T) {
+	locales := []string{"en", "de", "fr"}
+	tests := []struct {
+		Path, NodePath, Locale string
+	}{
+		{"/", "/", "en"},
+		{"/foo/", "/foo/", "en"},
+		{"/en/foo/", "/en/foo/", "en"},
+		{"/de", "/", "de"},
+		{"/de/", "/", "de"},
+		{"/de/foo", "/foo", "de"},
+		{"/fr/foo/bar/", "/foo/bar/", "fr"},
+		{"/deutsch/", "/deutsch/", "en"}}
+	for _, v := range tests {
+		rnode, rlocale := splitLocale(v.Path, locales)
+		if rnode != v.NodePath || rlocale != v.Locale {
+			t.Errorf("splitLocale(%v, %v) returns (%v,%v), expected (%v,%v)",
+				v.Path, locales, rnode, rlocale, v.NodePath, v.Locale)
+		}
+	}
+}
+
 type responseWriter struct {
 	Body []byte
 }
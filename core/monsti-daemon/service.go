@@ -28,6 +28,9 @@ import (
 	"path"
 	"path/filepath"
 	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -55,6 +58,8 @@ type MonstiService struct {
 	// Mutex to syncronize data access
 	mutex         sync.RWMutex
 	siteMutexes   map[string]*sync.RWMutex
+	storages      map[string]storage
+	gitRepos      map[string]*gitRepo
 	Settings      *settings
 	Logger        *log.Logger
 	Handler       *nodeHandler
@@ -62,6 +67,28 @@ type MonstiService struct {
 	subscriptions map[string][]string
 	subscriber    map[string]chan *signal
 	subscriberRet map[string]chan emitRet
+
+	// nodeIndex maps node ids to node paths per site.
+	nodeIndex      map[string]map[string]string
+	nodeIndexMutex sync.Mutex
+	// searchIndex holds the full-text search index per site.
+	searchIndex      map[string]*searchIndex
+	searchIndexMutex sync.Mutex
+}
+
+// nodesStorage returns the storage of the given site's nodes.
+func (i *MonstiService) nodesStorage(site string) storage {
+	return storageDir(i.storages[site], "nodes")
+}
+
+// historyStorage returns the storage of the given site's node history.
+func (i *MonstiService) historyStorage(site string) storage {
+	return storageDir(i.storages[site], "history")
+}
+
+// cacheStorage returns the storage of the given site's cache.
+func (i *MonstiService) cacheStorage(site string) storage {
+	return storageDir(i.storages[site], "cache")
 }
 
 type PublishServiceArgs struct {
@@ -72,22 +99,82 @@ func (i *MonstiService) InitSite(host *string, reply *bool) error {
 	i.mutex.Lock()
 	defer i.mutex.Unlock()
 	root := i.Settings.Monsti.GetSiteDataPath(filepath.Base(*host))
-	version, err := ioutil.ReadFile(filepath.Join(root, "version"))
+	_, err := os.Stat(filepath.Join(root, "version"))
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil
 		}
 		return fmt.Errorf("Could not read version of site %v: %v", host, err)
 	}
-	if strings.Trim(string(version), " ") != monstiVersion {
-		return fmt.Errorf("Wrong database version for %v: %v, expected %v",
-			*host, string(version), monstiVersion)
+	if _, ok := i.siteMutexes[*host]; !ok {
+		store, err := openStorage(i.Settings, *host)
+		if err != nil {
+			return fmt.Errorf("Could not open storage of %v: %v", *host, err)
+		}
+		// The site only gets registered if it could be prepared. A
+		// later request will try again.
+		repo, report, err := i.prepareSite(*host, root, store)
+		if err != nil {
+			if err := closeStorage(store); err != nil {
+				i.Logger.Printf("Could not close storage of %v: %v", *host, err)
+			}
+			return err
+		}
+		if i.storages == nil {
+			i.storages = make(map[string]storage)
+		}
+		i.storages[*host] = store
+		if repo != nil {
+			if i.gitRepos == nil {
+				i.gitRepos = make(map[string]*gitRepo)
+			}
+			i.gitRepos[*host] = repo
+		}
+		if len(report) > 0 {
+			i.commitSite(*host, "", "Apply migrations")
+		}
+		i.siteMutexes[*host] = new(sync.RWMutex)
+		go i.cleanTrashPeriodically(*host)
 	}
-	i.siteMutexes[*host] = new(sync.RWMutex)
 	*reply = true
 	return nil
 }
 
+// prepareSite recovers and migrates the given site and opens its git
+// repository if enabled. Returns the repository and the migration
+// report.
+func (i *MonstiService) prepareSite(site, root string, store storage) (
+	*gitRepo, []string, error) {
+	quarantined, err := recoverSite(store, time.Now().UTC())
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not recover site %v: %v", site, err)
+	}
+	for _, file := range quarantined {
+		i.Logger.Printf("Moved corrupt node file %v of site %v to quarantine",
+			file, site)
+	}
+	report, err := migrateSite(store, root, false)
+	for _, line := range report {
+		i.Logger.Printf("Migrating site %v: %v", site, line)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not migrate site %v: %v", site, err)
+	}
+	if !i.Settings.Storage.Git {
+		return nil, report, nil
+	}
+	if _, ok := store.(*fsStorage); !ok {
+		return nil, nil, fmt.Errorf(
+			"Git requires the filesystem storage backend")
+	}
+	repo, err := openGitRepo(root)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not open git repository of %v: %v",
+			site, err)
+	}
+	return repo, report, nil
+}
+
 func (i *MonstiService) PublishService(args PublishServiceArgs,
 	reply *int) error {
 	i.mutex.Lock()
@@ -223,11 +310,10 @@ func (m *MonstiService) FinishSignal(args *FinishSignalArgs, _ *int) error {
 // If it's an existing path but not a regular note, a node of type
 // core.Path will be returned.
 // It adds a path attribute with the given path.
-func getNode(root, path string) (node []byte, err error) {
-	nodePath := filepath.Join(root, path[1:])
-	node, err = ioutil.ReadFile(filepath.Join(nodePath, "node.json"))
+func getNode(nodes storage, nodePath string) (node []byte, err error) {
+	node, err = nodes.ReadFile(path.Join(nodePath, "node.json"))
 	if os.IsNotExist(err) {
-		_, err = os.Open(nodePath)
+		_, err = nodes.Stat(nodePath)
 		if os.IsNotExist(err) {
 			return nil, nil
 		}
@@ -239,28 +325,33 @@ func getNode(root, path string) (node []byte, err error) {
 	if err != nil {
 		return
 	}
-	pathJSON := fmt.Sprintf(`{"Path":%q,`, path)
-	node = bytes.Replace(node, []byte("{"), []byte(pathJSON), 1)
+	node = addNodePath(node, nodePath)
 	return
 }
 
+// addNodePath adds a path attribute to the given node data.
+func addNodePath(node []byte, path string) []byte {
+	pathJSON := fmt.Sprintf(`{"Path":%q,`, path)
+	return bytes.Replace(node, []byte("{"), []byte(pathJSON), 1)
+}
+
 // getChildren looks up child nodes of the given node.
-func getChildren(root, path string) (nodes [][]byte, err error) {
-	files, err := ioutil.ReadDir(filepath.Join(root, path))
+func getChildren(s storage, nodePath string) (nodes [][]byte, err error) {
+	files, err := s.ReadDir(nodePath)
 	if err != nil {
 		return
 	}
 	for _, file := range files {
-		node, _ := getNode(root, filepath.Join(path, file.Name()))
-		if err != nil {
-			return nil, err
+		if !file.IsDir {
+			continue
 		}
+		node, _ := getNode(s, path.Join(nodePath, file.Name))
 		if node != nil {
 			nodes = append(nodes, node)
-		} else if file.IsDir() {
+		} else {
 			nodes = append(nodes,
 				[]byte(fmt.Sprintf(`{"Path":%q,"Type":"core.Path"}`,
-					filepath.Join(path, file.Name()))))
+					path.Join(nodePath, file.Name))))
 		}
 	}
 	return
@@ -274,8 +365,7 @@ func (i *MonstiService) GetChildren(args GetChildrenArgs,
 	reply *[][]byte) error {
 	i.siteMutexes[args.Site].RLock()
 	defer i.siteMutexes[args.Site].RUnlock()
-	site := i.Settings.Monsti.GetSiteNodesPath(args.Site)
-	ret, err := getChildren(site, args.Path)
+	ret, err := getChildren(i.nodesStorage(args.Site), args.Path)
 	*reply = ret
 	return err
 }
@@ -286,8 +376,7 @@ func (i *MonstiService) GetNode(args *GetNodeDataArgs,
 	reply *[]byte) error {
 	i.siteMutexes[args.Site].RLock()
 	defer i.siteMutexes[args.Site].RUnlock()
-	site := i.Settings.Monsti.GetSiteNodesPath(args.Site)
-	ret, err := getNode(site, args.Path)
+	ret, err := getNode(i.nodesStorage(args.Site), args.Path)
 	*reply = ret
 	return err
 }
@@ -298,9 +387,8 @@ func (i *MonstiService) GetNodeData(args *GetNodeDataArgs,
 	reply *[]byte) error {
 	i.siteMutexes[args.Site].RLock()
 	defer i.siteMutexes[args.Site].RUnlock()
-	site := i.Settings.Monsti.GetSiteNodesPath(args.Site)
-	path := filepath.Join(site, args.Path[1:], filepath.Base(args.File))
-	ret, err := ioutil.ReadFile(path)
+	ret, err := i.nodesStorage(args.Site).ReadFile(
+		path.Join(args.Path, path.Base(args.File)))
 	if os.IsNotExist(err) {
 		*reply = nil
 		return nil
@@ -309,30 +397,320 @@ func (i *MonstiService) GetNodeData(args *GetNodeDataArgs,
 	return err
 }
 
+// getRevisionIds returns the ids of the given node's revisions in
+// ascending order.
+func getRevisionIds(history storage, node string) ([]int, error) {
+	files, err := history.ReadDir(path.Join(node, ".revisions"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var ids []int
+	for _, file := range files {
+		name := file.Name
+		if !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		id, err := strconv.Atoi(strings.TrimSuffix(name, ".json"))
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+// getRevision returns the given revision of the node.
+//
+// If there is no such revision, it returns nil.
+func getRevision(history storage, node string, id int) ([]byte, error) {
+	content, err := history.ReadFile(path.Join(node, ".revisions",
+		strconv.Itoa(id)+".json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return addNodePath(content, node), nil
+}
+
+// archiveNode keeps the current content of the given node as a new
+// revision in the history.
+//
+// Does nothing if the node does not exist.
+func archiveNode(nodes, history storage, node string) error {
+	content, err := nodes.ReadFile(path.Join(node, "node.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("Could not read node: %v", err)
+	}
+	ids, err := getRevisionIds(history, node)
+	if err != nil {
+		return fmt.Errorf("Could not get revisions: %v", err)
+	}
+	next := 1
+	if len(ids) > 0 {
+		next = ids[len(ids)-1] + 1
+	}
+	revision := path.Join(node, ".revisions", strconv.Itoa(next)+".json")
+	if err := history.WriteFile(revision, content); err != nil {
+		return fmt.Errorf("Could not write revision: %v", err)
+	}
+	return nil
+}
+
+type NodeRevisionData struct {
+	Id   int
+	Node []byte
+}
+
+func (i *MonstiService) GetNodeRevisions(args *GetNodeArgs,
+	reply *[]NodeRevisionData) error {
+	i.siteMutexes[args.Site].RLock()
+	defer i.siteMutexes[args.Site].RUnlock()
+	history := i.historyStorage(args.Site)
+	ids, err := getRevisionIds(history, args.Path)
+	if err != nil {
+		return fmt.Errorf("Could not get revisions: %v", err)
+	}
+	revisions := make([]NodeRevisionData, 0, len(ids))
+	for j := len(ids) - 1; j >= 0; j-- {
+		content, err := getRevision(history, args.Path, ids[j])
+		if err != nil {
+			return fmt.Errorf("Could not read revision: %v", err)
+		}
+		revisions = append(revisions, NodeRevisionData{ids[j], content})
+	}
+	*reply = revisions
+	return nil
+}
+
+type GetNodeRevisionArgs struct {
+	Site, Path string
+	Revision   int
+}
+
+func (i *MonstiService) GetNodeRevision(args *GetNodeRevisionArgs,
+	reply *[]byte) error {
+	i.siteMutexes[args.Site].RLock()
+	defer i.siteMutexes[args.Site].RUnlock()
+	ret, err := getRevision(i.historyStorage(args.Site), args.Path,
+		args.Revision)
+	if err != nil {
+		return fmt.Errorf("Could not read revision: %v", err)
+	}
+	*reply = ret
+	return nil
+}
+
+// getNodeDraft looks up the draft of the given node.
+//
+// If the node has no draft, it returns nil.
+func getNodeDraft(nodes storage, nodePath string) ([]byte, error) {
+	node, err := nodes.ReadFile(path.Join(nodePath, "node.draft.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return addNodePath(node, nodePath), nil
+}
+
+// getDraftFiles returns the names of the draft data files of the
+// given node, i.e. all files prefixed with "draft.".
+func getDraftFiles(nodes storage, node string) ([]string, error) {
+	files, err := nodes.ReadDir(node)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, file := range files {
+		if !file.IsDir && strings.HasPrefix(file.Name, "draft.") {
+			names = append(names, file.Name)
+		}
+	}
+	return names, nil
+}
+
+// publishDraft replaces the given node and its data files with the
+// node's draft.
+func publishDraft(nodes, history storage, node string) error {
+	draft := path.Join(node, "node.draft.json")
+	if _, err := nodes.Stat(draft); err != nil {
+		return fmt.Errorf("Could not find draft: %v", err)
+	}
+	if err := archiveNode(nodes, history, node); err != nil {
+		return fmt.Errorf("Could not archive node: %v", err)
+	}
+	files, err := getDraftFiles(nodes, node)
+	if err != nil {
+		return fmt.Errorf("Could not get draft files: %v", err)
+	}
+	for _, name := range files {
+		if name == "node.draft.json" {
+			continue
+		}
+		if err := nodes.Rename(path.Join(node, name),
+			path.Join(node, strings.TrimPrefix(name, "draft."))); err != nil {
+			return fmt.Errorf("Could not publish draft data: %v", err)
+		}
+	}
+	// The new name is only kept until the draft gets published.
+	if err := clearDraftRename(nodes, draft); err != nil {
+		return err
+	}
+	if err := nodes.Rename(draft, path.Join(node, "node.json")); err != nil {
+		return fmt.Errorf("Could not publish draft: %v", err)
+	}
+	return nil
+}
+
+// validNodeName matches valid names of nodes.
+var validNodeName = regexp.MustCompile(`^[-\w.]+$`)
+
+// draftRename returns the new name of the given node set by its draft
+// (see service.Node.Rename), if any.
+func draftRename(nodes storage, node string) (string, error) {
+	content, err := nodes.ReadFile(path.Join(node, "node.draft.json"))
+	if err != nil {
+		return "", fmt.Errorf("Could not read draft: %v", err)
+	}
+	var draft struct{ Rename string }
+	if err := json.Unmarshal(content, &draft); err != nil {
+		return "", fmt.Errorf("Could not unmarshal draft: %v", err)
+	}
+	if draft.Rename != "" && (!validNodeName.MatchString(draft.Rename) ||
+		draft.Rename == "." || draft.Rename == "..") {
+		return "", fmt.Errorf("Invalid node name %q", draft.Rename)
+	}
+	return draft.Rename, nil
+}
+
+// clearDraftRename removes the new name from the given draft file.
+func clearDraftRename(nodes storage, draft string) error {
+	content, err := nodes.ReadFile(draft)
+	if err != nil {
+		return fmt.Errorf("Could not read draft: %v", err)
+	}
+	var data map[string]*json.RawMessage
+	if err := json.Unmarshal(content, &data); err != nil {
+		return fmt.Errorf("Could not unmarshal draft: %v", err)
+	}
+	if _, ok := data["Rename"]; !ok {
+		return nil
+	}
+	delete(data, "Rename")
+	content, err = json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Could not marshal draft: %v", err)
+	}
+	if err := nodes.WriteFile(draft, content); err != nil {
+		return fmt.Errorf("Could not write draft: %v", err)
+	}
+	return nil
+}
+
+// discardDraft removes the draft of the given node and its draft data
+// files.
+func discardDraft(nodes storage, node string) error {
+	files, err := getDraftFiles(nodes, node)
+	if err != nil {
+		return fmt.Errorf("Could not get draft files: %v", err)
+	}
+	files = append(files, "node.draft.json")
+	for _, name := range files {
+		err := nodes.Remove(path.Join(node, name))
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Could not remove draft: %v", err)
+		}
+	}
+	return nil
+}
+
+func (i *MonstiService) GetNodeDraft(args *GetNodeArgs, reply *[]byte) error {
+	i.siteMutexes[args.Site].RLock()
+	defer i.siteMutexes[args.Site].RUnlock()
+	ret, err := getNodeDraft(i.nodesStorage(args.Site), args.Path)
+	if err != nil {
+		return fmt.Errorf("Could not read draft: %v", err)
+	}
+	*reply = ret
+	return nil
+}
+
+type NodeDraftArgs struct{ Site, Path, User string }
+
+func (i *MonstiService) PublishNodeDraft(args *NodeDraftArgs,
+	reply *int) error {
+	i.siteMutexes[args.Site].Lock()
+	defer i.siteMutexes[args.Site].Unlock()
+	nodes := i.nodesStorage(args.Site)
+	rename, err := draftRename(nodes, args.Path)
+	if err != nil {
+		return err
+	}
+	target := path.Join(path.Dir(path.Clean(args.Path)), rename)
+	if rename != "" {
+		if _, err := nodes.Stat(target); err == nil {
+			return fmt.Errorf("Can't rename node: %v does already exist", target)
+		} else if !os.IsNotExist(err) {
+			return fmt.Errorf("Can't stat rename target: %v", err)
+		}
+	}
+	if err := publishDraft(nodes, i.historyStorage(args.Site),
+		args.Path); err != nil {
+		return err
+	}
+	i.reindexNodes(args.Site, path.Clean(args.Path), false)
+	i.commitSite(args.Site, args.User, "Publish draft of "+args.Path)
+	if rename != "" {
+		return i.renameNode(args.Site, path.Clean(args.Path), target,
+			args.User)
+	}
+	return nil
+}
+
+func (i *MonstiService) DiscardNodeDraft(args *NodeDraftArgs,
+	reply *int) error {
+	i.siteMutexes[args.Site].Lock()
+	defer i.siteMutexes[args.Site].Unlock()
+	if err := discardDraft(i.nodesStorage(args.Site), args.Path); err != nil {
+		return err
+	}
+	i.commitSite(args.Site, args.User, "Discard draft of "+args.Path)
+	return nil
+}
+
 type WriteSiteSettingsArgs struct {
 	Site     string
 	Settings []byte
+	User     string
 }
 
 func (i *MonstiService) WriteSiteSettings(args *WriteSiteSettingsArgs,
 	reply *int) error {
 	i.siteMutexes[args.Site].Lock()
 	defer i.siteMutexes[args.Site].Unlock()
-	site := i.Settings.Monsti.GetSiteDataPath(args.Site)
-	path := filepath.Join(site, "settings.json")
-	if err := ioutil.WriteFile(path, []byte(args.Settings), 0660); err != nil {
+	err := i.storages[args.Site].WriteFile("settings.json", args.Settings)
+	if err != nil {
 		return fmt.Errorf("Could not write site settings data: %v", err)
 	}
+	i.commitSite(args.Site, args.User, "Write settings.json")
 	return nil
 }
 
 func (i *MonstiService) LoadSiteSettings(site string, reply *[]byte) error {
 	i.siteMutexes[site].RLock()
 	defer i.siteMutexes[site].RUnlock()
-	path := filepath.Join(i.Settings.Monsti.GetSiteDataPath(site),
-		"settings.json")
 	var err error
-	*reply, err = ioutil.ReadFile(path)
+	*reply, err = i.storages[site].ReadFile("settings.json")
 	if err != nil && !os.IsNotExist(err) {
 		return fmt.Errorf("Colud not read site settings: %v", err)
 	}
@@ -340,69 +718,101 @@ func (i *MonstiService) LoadSiteSettings(site string, reply *[]byte) error {
 }
 
 type WriteNodeDataArgs struct {
-	Site, Path, File string
-	Content          []byte
+	Site, Path, File, User, Token string
+	Content                       []byte
+}
+
+// nodeToken returns the token of the given node and its draft (see
+// service.NodeToken).
+func nodeToken(nodes storage, node string) (string, error) {
+	read := func(file string) (*service.Node, error) {
+		content, err := nodes.ReadFile(path.Join(node, file))
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		var data struct{ Changed time.Time }
+		if err := json.Unmarshal(content, &data); err != nil {
+			return nil, err
+		}
+		return &service.Node{Changed: data.Changed}, nil
+	}
+	current, err := read("node.json")
+	if err != nil {
+		return "", err
+	}
+	if current == nil {
+		// Nodes without node.json are served as core.Path nodes.
+		current = &service.Node{}
+	}
+	draft, err := read("node.draft.json")
+	if err != nil {
+		return "", err
+	}
+	return service.NodeToken(current, draft), nil
 }
 
 func (i *MonstiService) WriteNodeData(args *WriteNodeDataArgs,
 	reply *int) error {
 	i.siteMutexes[args.Site].Lock()
 	defer i.siteMutexes[args.Site].Unlock()
-	site := i.Settings.Monsti.GetSiteNodesPath(args.Site)
-	path := filepath.Join(site, args.Path[1:], filepath.Base(args.File))
-	err := os.MkdirAll(filepath.Dir(path), 0770)
-	if err != nil {
-		return fmt.Errorf("Could not create node directory: %v", err)
+	nodes := i.nodesStorage(args.Site)
+	if args.Token != "" {
+		token, err := nodeToken(nodes, args.Path)
+		if err != nil {
+			return fmt.Errorf("Could not get node token: %v", err)
+		}
+		if token != args.Token {
+			return &service.ConflictError{Path: args.Path}
+		}
 	}
-	err = ioutil.WriteFile(path, []byte(args.Content), 0660)
-	if err != nil {
+	if path.Base(args.File) == "node.json" {
+		err := archiveNode(nodes, i.historyStorage(args.Site), args.Path)
+		if err != nil {
+			return fmt.Errorf("Could not archive node: %v", err)
+		}
+	}
+	file := path.Join(args.Path, path.Base(args.File))
+	if err := nodes.WriteFile(file, args.Content); err != nil {
 		return fmt.Errorf("Could not write node data: %v", err)
 	}
+	if path.Base(args.File) == "node.json" {
+		i.indexNode(args.Site, path.Clean(args.Path), args.Content)
+		i.indexNodeText(args.Site, path.Clean(args.Path), args.Content)
+	}
+	i.commitSite(args.Site, args.User, "Write "+file)
 	return nil
 }
 
 type RemoveNodeDataArgs struct {
-	Site, Path, File string
+	Site, Path, File, User string
 }
 
 func (i *MonstiService) RemoveNodeData(args *RemoveNodeDataArgs,
 	reply *int) error {
 	i.siteMutexes[args.Site].Lock()
 	defer i.siteMutexes[args.Site].Unlock()
-	site := i.Settings.Monsti.GetSiteNodesPath(args.Site)
-	path := filepath.Join(site, args.Path[1:], filepath.Base(args.File))
-	if err := os.Remove(path); err != nil {
+	file := path.Join(args.Path, path.Base(args.File))
+	if err := i.nodesStorage(args.Site).Remove(file); err != nil {
 		return fmt.Errorf("Could not remove node data: %v", err)
 	}
+	i.commitSite(args.Site, args.User, "Remove "+file)
 	return nil
 }
 
-type RemoveNodeArgs struct {
-	Site, Node string
-}
-
-func (i *MonstiService) RemoveNode(args *RemoveNodeArgs, reply *int) error {
-	i.siteMutexes[args.Site].Lock()
-	defer i.siteMutexes[args.Site].Unlock()
-	root := i.Settings.Monsti.GetSiteNodesPath(args.Site)
-	cacheRoot := i.Settings.Monsti.GetSiteCachePath(args.Site)
-	nodePath := filepath.Join(root, args.Node[1:])
-	// Mark all reverse deps.
-	walker := func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if info.Name() == "node.json" {
-			cacheNodePath, err := filepath.Rel(root, filepath.Dir(path))
-			if err != nil {
-				return err
-			}
-			rdeps, err := readRdeps(cacheRoot, "/"+cacheNodePath)
+// markSubtree marks all reverse cache dependencies of the given node
+// and its descendants.
+func markSubtree(nodes, cache storage, node string) error {
+	walker := func(file string, isDir bool) error {
+		if path.Base(file) == "node.json" {
+			rdeps, err := readRdeps(cache, path.Dir(file))
 			if err != nil {
 				return err
 			}
 			for _, rdep := range rdeps {
-				err := markDep(cacheRoot, rdep.Dep, 0)
+				err := markDep(cache, rdep.Dep, 0)
 				if err != nil {
 					return err
 				}
@@ -410,32 +820,126 @@ func (i *MonstiService) RemoveNode(args *RemoveNodeArgs, reply *int) error {
 		}
 		return nil
 	}
-	if err := filepath.Walk(nodePath, walker); err != nil {
-		return fmt.Errorf("Could not walk to be removed subtree: %v", err)
+	return walkStorage(nodes, node, walker)
+}
+
+// reindexNodes updates the index of node ids and the search index for
+// the given node and, if recursive is true, its descendants. Use it
+// after writing nodes by other means than WriteNodeData, e.g. by
+// publishing drafts or copying nodes.
+//
+// If the nodes can't be read, the indexes get dropped.
+func (i *MonstiService) reindexNodes(site, root string, recursive bool) {
+	nodes := i.nodesStorage(site)
+	index := func(file string) error {
+		content, err := nodes.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		nodePath := path.Clean("/" + path.Dir(file))
+		i.indexNode(site, nodePath, content)
+		i.indexNodeText(site, nodePath, content)
+		return nil
+	}
+	var err error
+	if recursive {
+		err = walkStorage(nodes, root, func(file string, isDir bool) error {
+			if isDir || path.Base(file) != "node.json" {
+				return nil
+			}
+			return index(file)
+		})
+	} else {
+		err = index(path.Join(root, "node.json"))
+	}
+	if err != nil {
+		i.Logger.Printf("Could not index nodes of site %v: %v", site, err)
+		i.dropNodeIndex(site)
+		i.dropSearchIndex(site)
+	}
+}
+
+type RemoveNodeArgs struct {
+	Site, Node, User string
+}
+
+func (i *MonstiService) RemoveNode(args *RemoveNodeArgs, reply *int) error {
+	i.siteMutexes[args.Site].Lock()
+	defer i.siteMutexes[args.Site].Unlock()
+	if err := markSubtree(i.nodesStorage(args.Site), i.cacheStorage(args.Site),
+		args.Node); err != nil {
+		return fmt.Errorf("Could not mark to be removed subtree: %v", err)
 	}
-	if err := os.RemoveAll(nodePath); err != nil {
-		return fmt.Errorf("Can't remove node: %v", err)
+	_, err := trashNode(i.storages[args.Site], args.Node, args.User,
+		time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("Can't move node to trash: %v", err)
 	}
+	i.updateNodeIndex(args.Site, func(index map[string]string) {
+		removeIdsOfSubtree(index, path.Clean(args.Node))
+	})
+	i.updateSearchIndex(args.Site, func(index *searchIndex) {
+		index.removeSubtree(path.Clean(args.Node))
+	})
+	i.commitSite(args.Site, args.User, "Remove "+args.Node)
 	return nil
 }
 
 type RenameNodeArgs struct {
-	Site, Source, Target string
+	Site, Source, Target, User string
 }
 
 func (i *MonstiService) RenameNode(args *RenameNodeArgs, reply *int) error {
 	i.siteMutexes[args.Site].Lock()
 	defer i.siteMutexes[args.Site].Unlock()
-	root := i.Settings.Monsti.GetSiteNodesPath(args.Site)
-	if err := os.MkdirAll(
-		filepath.Dir(filepath.Join(root, args.Target)), 0770); err != nil {
-		return fmt.Errorf("Can't create parent directory: %v", err)
-	}
-	if err := os.Rename(
-		filepath.Join(root, args.Source),
-		filepath.Join(root, args.Target)); err != nil {
+	return i.renameNode(args.Site, args.Source, args.Target, args.User)
+}
+
+// renameNode moves the given node of the site to the given target. The
+// caller has to hold the site's lock.
+func (i *MonstiService) renameNode(site, source, target, user string) error {
+	nodes := i.nodesStorage(site)
+	// Caches depending on the old paths are outdated.
+	if err := markSubtree(nodes, i.cacheStorage(site), source); err != nil {
+		return fmt.Errorf("Could not mark to be moved subtree: %v", err)
+	}
+	if err := nodes.Rename(source, target); err != nil {
 		return fmt.Errorf("Can't move node: %v", err)
 	}
+	// Caches of the old and new parents, e.g. navigations, are outdated.
+	for _, parent := range []string{source, target} {
+		err := markDep(i.cacheStorage(site),
+			service.CacheDep{Node: path.Dir(path.Clean(parent))}, 0)
+		if err != nil {
+			return fmt.Errorf("Could not mark parent: %v", err)
+		}
+	}
+	history := i.historyStorage(site)
+	_, err := history.Stat(source)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Can't stat node history: %v", err)
+	}
+	if err == nil {
+		if err := history.Rename(source, target); err != nil {
+			return fmt.Errorf("Can't move node history: %v", err)
+		}
+	}
+	redirects, err := readRedirects(i.storages[site])
+	if err != nil {
+		return err
+	}
+	addRenameRedirect(redirects, source, target)
+	if err := writeRedirects(i.storages[site], redirects); err != nil {
+		return err
+	}
+	i.updateNodeIndex(site, func(index map[string]string) {
+		renameIdsOfSubtree(index, path.Clean(source), path.Clean(target))
+	})
+	i.updateSearchIndex(site, func(index *searchIndex) {
+		index.renameSubtree(path.Clean(source), path.Clean(target))
+	})
+	i.commitSite(site, user,
+		fmt.Sprintf("Rename %v to %v", source, target))
 	return nil
 }
 
@@ -566,10 +1070,9 @@ type cacheData struct {
 	Data      []byte
 }
 
-func fromCache(root, node, id string) ([]byte, *service.CacheMods, error) {
-	path := filepath.Join(root, node[1:], ".data",
-		filepath.Base(id))
-	raw, err := ioutil.ReadFile(path)
+func fromCache(cache storage, node, id string) ([]byte, *service.CacheMods,
+	error) {
+	raw, err := cache.ReadFile(path.Join(node, ".data", path.Base(id)))
 	if os.IsNotExist(err) {
 		return nil, nil, nil
 	}
@@ -598,9 +1101,8 @@ func (i *MonstiService) FromCache(args *FromCacheArgs,
 	reply *FromCacheRet) error {
 	i.siteMutexes[args.Site].RLock()
 	defer i.siteMutexes[args.Site].RUnlock()
-	cacheRoot := i.Settings.Monsti.GetSiteCachePath(args.Site)
-	var err error
-	content, mods, err := fromCache(cacheRoot, args.Node, args.Id)
+	content, mods, err := fromCache(i.cacheStorage(args.Site), args.Node,
+		args.Id)
 	*reply = FromCacheRet{mods, content}
 	return err
 }
@@ -612,9 +1114,8 @@ type CacheDepPair struct {
 
 type CacheDepMap []CacheDepPair
 
-func readRdeps(root, node string) (CacheDepMap, error) {
-	rdepsPath := filepath.Join(root, node[1:], ".rdeps.json")
-	content, err := ioutil.ReadFile(rdepsPath)
+func readRdeps(cache storage, node string) (CacheDepMap, error) {
+	content, err := cache.ReadFile(path.Join(node, ".rdeps.json"))
 	if err != nil && !os.IsNotExist(err) {
 		return nil, fmt.Errorf("Could not read rdeps: %v", err)
 	}
@@ -629,53 +1130,46 @@ func readRdeps(root, node string) (CacheDepMap, error) {
 	return depMap, nil
 }
 
-func writeRdeps(root, node string, rdeps CacheDepMap) error {
+func writeRdeps(cache storage, node string, rdeps CacheDepMap) error {
 	content, err := json.MarshalIndent(rdeps, "", "  ")
 	if err != nil {
 		return fmt.Errorf("Could not marshal rdeps: %v", err)
 	}
-	rdepsPath := filepath.Join(root, node[1:], ".rdeps.json")
-	if err := os.MkdirAll(filepath.Dir(rdepsPath), 0770); err != nil {
-		return fmt.Errorf("Could not create node cache directory: %v", err)
-	}
-	if err := ioutil.WriteFile(rdepsPath, content, 0660); err != nil {
+	err = cache.WriteFile(path.Join(node, ".rdeps.json"), content)
+	if err != nil {
 		return fmt.Errorf("Could not write rdeps: %v", err)
 	}
 	return nil
 }
 
-func appendRdeps(root string, dep service.CacheDep,
+func appendRdeps(cache storage, dep service.CacheDep,
 	rdeps []service.CacheDep) error {
-	depMap, err := readRdeps(root, dep.Node)
+	depMap, err := readRdeps(cache, dep.Node)
 	if err != nil {
 		return fmt.Errorf("Could not read rdeps: %v", err)
 	}
 	depMap = append(depMap, CacheDepPair{dep, rdeps})
-	if err := writeRdeps(root, dep.Node, depMap); err != nil {
+	if err := writeRdeps(cache, dep.Node, depMap); err != nil {
 		return fmt.Errorf("Could not write rdeps: %v", err)
 	}
 	return nil
 }
 
-func toCache(root, node, id string, content []byte,
+func toCache(cache storage, node, id string, content []byte,
 	mods *service.CacheMods) error {
 	// Write deps to filesystem.
 	thisDep := service.CacheDep{Node: node, Cache: id}
 	if mods != nil {
 		for _, dep := range mods.Deps {
-			err := appendRdeps(root, dep, []service.CacheDep{thisDep})
+			err := appendRdeps(cache, dep, []service.CacheDep{thisDep})
 			if err != nil {
 				return fmt.Errorf("Could not write rdeps: %v", err)
 			}
 		}
 	}
 
-	// Write cache to filesystem.
-	nodePath := filepath.Join(root, node[1:])
-	path := filepath.Join(nodePath, ".data", filepath.Base(id))
-	if err := os.MkdirAll(filepath.Dir(path), 0770); err != nil {
-		return fmt.Errorf("Could not create node cache directory: %v", err)
-	}
+	// Write cache to storage.
+	file := path.Join(node, ".data", path.Base(id))
 	if mods != nil {
 		mods.Deps = nil
 	}
@@ -685,7 +1179,7 @@ func toCache(root, node, id string, content []byte,
 	if err := enc.Encode(&data); err != nil {
 		return fmt.Errorf("Could not encode cache data: %v", err)
 	}
-	if err := ioutil.WriteFile(path, raw.Bytes(), 0660); err != nil {
+	if err := cache.WriteFile(file, raw.Bytes()); err != nil {
 		return fmt.Errorf("Could not write node cache: %v", err)
 	}
 
@@ -701,18 +1195,18 @@ type ToCacheArgs struct {
 func (i *MonstiService) ToCache(args *ToCacheArgs, reply *int) error {
 	i.siteMutexes[args.Site].Lock()
 	defer i.siteMutexes[args.Site].Unlock()
-	cacheRoot := i.Settings.Monsti.GetSiteCachePath(args.Site)
-	return toCache(cacheRoot, args.Node, args.Id, args.Content, args.Mods)
+	return toCache(i.cacheStorage(args.Site), args.Node, args.Id, args.Content,
+		args.Mods)
 }
 
-func markDep(root string, dep service.CacheDep, level int) error {
-	rdeps, err := readRdeps(root, dep.Node)
+func markDep(cache storage, dep service.CacheDep, level int) error {
+	rdeps, err := readRdeps(cache, dep.Node)
 	if err != nil {
 		return fmt.Errorf("Could not read rdeps: %v", err)
 	}
 	if dep.Cache != "" {
-		path := filepath.Join(root, dep.Node[1:], ".data", dep.Cache)
-		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		file := path.Join(dep.Node, ".data", dep.Cache)
+		if err := cache.Remove(file); err != nil && !os.IsNotExist(err) {
 			return fmt.Errorf("Could not remove cached data: %v", err)
 		}
 	}
@@ -730,16 +1224,16 @@ func markDep(root string, dep service.CacheDep, level int) error {
 			newDeps = append(newDeps, rdep)
 		}
 	}
-	if err := writeRdeps(root, dep.Node, newDeps); err != nil {
+	if err := writeRdeps(cache, dep.Node, newDeps); err != nil {
 		return fmt.Errorf("Could not write new rdeps: %v", err)
 	}
 	for _, dep := range toBeMarked {
-		markDep(root, dep, 0)
+		markDep(cache, dep, 0)
 	}
 
 	if dep.Node != "/" {
 		dep.Node = path.Dir(dep.Node)
-		if err := markDep(root, dep, level+1); err != nil {
+		if err := markDep(cache, dep, level+1); err != nil {
 			return fmt.Errorf("Could not mark parent: %v", err)
 		}
 	}
@@ -754,6 +1248,5 @@ type MarkDepArgs struct {
 func (i *MonstiService) MarkDep(args *MarkDepArgs, reply *int) error {
 	i.siteMutexes[args.Site].Lock()
 	defer i.siteMutexes[args.Site].Unlock()
-	cacheRoot := i.Settings.Monsti.GetSiteCachePath(args.Site)
-	return markDep(cacheRoot, args.Dep, 0)
+	return markDep(i.cacheStorage(args.Site), args.Dep, 0)
 }
@@ -21,6 +21,7 @@ import (
 	"os"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -38,7 +39,7 @@ func TestGetNode(t *testing.T) {
 		t.Fatalf("Could not create directory tree: ", err)
 	}
 	defer cleanup()
-	ret, err := getNode(root, "/foo")
+	ret, err := getNode(newFSStorage(root), "/foo")
 	expected := `{"Path":"/foo","Type":"core.Foo"}`
 	if err != nil {
 		t.Errorf("Got error: %v", err)
@@ -46,7 +47,7 @@ func TestGetNode(t *testing.T) {
 		t.Fatalf(`getNode(%q, "/foo") = %v, nil, should be %v, nil`,
 			root, string(ret), expected)
 	}
-	ret, err = getNode(root, "/foo/bar")
+	ret, err = getNode(newFSStorage(root), "/foo/bar")
 	expected = `{"Path":"/foo/bar","Type":"core.Path"}`
 	if err != nil {
 		t.Errorf("Got error: %v", err)
@@ -54,7 +55,7 @@ func TestGetNode(t *testing.T) {
 		t.Fatalf(`getNode(%q, "/foo/bar") = %v, nil, should be %v, nil`,
 			root, string(ret), expected)
 	}
-	ret, err = getNode(root, "/unavailable")
+	ret, err = getNode(newFSStorage(root), "/unavailable")
 	if err != nil {
 		t.Errorf("Got error: %v", err)
 	} else if ret != nil {
@@ -89,7 +90,7 @@ func TestGetChildren(t *testing.T) {
 		{"/foo", []string{"/foo/child1", "/foo/child2", "/foo/child3"}},
 		{"/bar", []string{}}}
 	for _, test := range tests {
-		ret, err := getChildren(root, test.Path)
+		ret, err := getChildren(newFSStorage(root), test.Path)
 		if err != nil {
 			t.Errorf(`getChildren(%q, %q) = %v, %v, should be _, nil`,
 				root, test.Path, ret, err)
@@ -195,32 +196,32 @@ func TestCache(t *testing.T) {
 		t.Fatalf("Could not create directory tree: ", err)
 	}
 	defer cleanup()
-	err = toCache(root, "/foo/bar/cruz", "foo.some_cache", []byte("test"), nil)
+	err = toCache(newFSStorage(root), "/foo/bar/cruz", "foo.some_cache", []byte("test"), nil)
 	if err != nil {
 		t.Fatalf("Could not cache data: %v", err)
 	}
-	err = toCache(root, "/foo/bar", "foo.another_cache", []byte("test2"),
+	err = toCache(newFSStorage(root), "/foo/bar", "foo.another_cache", []byte("test2"),
 		&service.CacheMods{Deps: []service.CacheDep{{Node: "/foo/bar/cruz"}}})
 	if err != nil {
 		t.Fatalf("Could not cache data: %v", err)
 	}
-	err = toCache(root, "/foo", "foo.another_cache", []byte("test3"),
+	err = toCache(newFSStorage(root), "/foo", "foo.another_cache", []byte("test3"),
 		&service.CacheMods{Deps: []service.CacheDep{{Node: "/foo/bar/cruz"}}})
 	if err != nil {
 		t.Fatalf("Could not cache data: %v", err)
 	}
-	ret, _, err := fromCache(root, "/foo", "foo.another_cache")
+	ret, _, err := fromCache(newFSStorage(root), "/foo", "foo.another_cache")
 	if err != nil {
 		t.Fatalf("Could not get cached data: %v", err)
 	}
 	if !reflect.DeepEqual(ret, []byte("test3")) {
 		t.Fatalf("test3 should be in cache, got %v", string(ret))
 	}
-	err = markDep(root, service.CacheDep{Node: "/foo/bar/cruz"}, 0)
+	err = markDep(newFSStorage(root), service.CacheDep{Node: "/foo/bar/cruz"}, 0)
 	if err != nil {
 		t.Fatalf("Could not mark dep: %v", err)
 	}
-	ret, _, err = fromCache(root, "/foo", "foo.another_cache")
+	ret, _, err = fromCache(newFSStorage(root), "/foo", "foo.another_cache")
 	if err != nil {
 		t.Fatalf("Could not get cached data: %v", err)
 	}
@@ -235,38 +236,38 @@ func TestCacheMarkDescend(t *testing.T) {
 		t.Fatalf("Could not create directory tree: ", err)
 	}
 	defer cleanup()
-	err = toCache(root, "/foo/bar/cruz", "foo.some_cache", []byte("test"), nil)
+	err = toCache(newFSStorage(root), "/foo/bar/cruz", "foo.some_cache", []byte("test"), nil)
 	if err != nil {
 		t.Fatalf("Could not cache data: %v", err)
 	}
-	err = toCache(root, "/foo/bar", "foo.some_cache", []byte("test2"), nil)
+	err = toCache(newFSStorage(root), "/foo/bar", "foo.some_cache", []byte("test2"), nil)
 	if err != nil {
 		t.Fatalf("Could not cache data: %v", err)
 	}
 
 	// Descend one level
 	var ret []byte
-	err = toCache(root, "/foo", "foo.another_cache", []byte("test3"),
+	err = toCache(newFSStorage(root), "/foo", "foo.another_cache", []byte("test3"),
 		&service.CacheMods{Deps: []service.CacheDep{{Node: "/foo", Descend: 1}}})
 	if err != nil {
 		t.Fatalf("Could not cache data: %v", err)
 	}
-	err = markDep(root, service.CacheDep{Node: "/foo/bar/cruz"}, 0)
+	err = markDep(newFSStorage(root), service.CacheDep{Node: "/foo/bar/cruz"}, 0)
 	if err != nil {
 		t.Fatalf("Could not mark dep: %v", err)
 	}
-	ret, _, err = fromCache(root, "/foo", "foo.another_cache")
+	ret, _, err = fromCache(newFSStorage(root), "/foo", "foo.another_cache")
 	if err != nil {
 		t.Fatalf("Could not get cached data: %v", err)
 	}
 	if ret == nil {
 		t.Errorf("Cache should not be nil")
 	}
-	err = markDep(root, service.CacheDep{Node: "/foo/bar"}, 0)
+	err = markDep(newFSStorage(root), service.CacheDep{Node: "/foo/bar"}, 0)
 	if err != nil {
 		t.Fatalf("Could not mark dep: %v", err)
 	}
-	ret, _, err = fromCache(root, "/foo", "foo.another_cache")
+	ret, _, err = fromCache(newFSStorage(root), "/foo", "foo.another_cache")
 	if err != nil {
 		t.Fatalf("Could not get cached data: %v", err)
 	}
@@ -275,16 +276,16 @@ func TestCacheMarkDescend(t *testing.T) {
 	}
 
 	// Descend all levels
-	err = toCache(root, "/foo", "foo.another_cache", []byte("test3"),
+	err = toCache(newFSStorage(root), "/foo", "foo.another_cache", []byte("test3"),
 		&service.CacheMods{Deps: []service.CacheDep{{Node: "/foo", Descend: -1}}})
 	if err != nil {
 		t.Fatalf("Could not cache data: %v", err)
 	}
-	err = markDep(root, service.CacheDep{Node: "/foo/bar/cruz"}, 0)
+	err = markDep(newFSStorage(root), service.CacheDep{Node: "/foo/bar/cruz"}, 0)
 	if err != nil {
 		t.Fatalf("Could not mark dep: %v", err)
 	}
-	ret, _, err = fromCache(root, "/foo", "foo.another_cache")
+	ret, _, err = fromCache(newFSStorage(root), "/foo", "foo.another_cache")
 	if err != nil {
 		t.Fatalf("Could not get cached data: %v", err)
 	}
@@ -302,11 +303,11 @@ func TestCacheMods(t *testing.T) {
 	mods := &service.CacheMods{
 		Deps:   []service.CacheDep{{Node: "/foo/bar"}},
 		Expire: time.Now().AddDate(1, 0, 0)}
-	err = toCache(root, "/foo", "foo.foo", []byte("test"), mods)
+	err = toCache(newFSStorage(root), "/foo", "foo.foo", []byte("test"), mods)
 	if err != nil {
 		t.Fatalf("Could not cache data: %v", err)
 	}
-	_, retMods, err := fromCache(root, "/foo", "foo.foo")
+	_, retMods, err := fromCache(newFSStorage(root), "/foo", "foo.foo")
 	if err != nil {
 		t.Fatalf("Could not get cached data: %v", err)
 	}
@@ -322,12 +323,12 @@ func TestCacheExpire(t *testing.T) {
 		t.Fatalf("Could not create directory tree: ", err)
 	}
 	defer cleanup()
-	err = toCache(root, "/foo", "foo.foo", []byte("test"),
+	err = toCache(newFSStorage(root), "/foo", "foo.foo", []byte("test"),
 		&service.CacheMods{Expire: time.Now().AddDate(-1, 0, 0)})
 	if err != nil {
 		t.Fatalf("Could not cache data: %v", err)
 	}
-	ret, _, err := fromCache(root, "/foo", "foo.foo")
+	ret, _, err := fromCache(newFSStorage(root), "/foo", "foo.foo")
 	if err != nil {
 		t.Fatalf("Could not get cached data: %v", err)
 	}
@@ -335,3 +336,214 @@ func TestCacheExpire(t *testing.T) {
 		t.Errorf("Cache should have been expired.")
 	}
 }
+
+func TestArchiveNode(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/nodes/foo/node.json": `{"Type":"core.Foo","Order":1}`},
+		"TestArchiveNode")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	nodesRoot := newFSStorage(filepath.Join(root, "nodes"))
+	historyRoot := newFSStorage(filepath.Join(root, "history"))
+	if err := archiveNode(nodesRoot, historyRoot, "/unknown"); err != nil {
+		t.Errorf("archiveNode for unknown node returned error: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := archiveNode(nodesRoot, historyRoot, "/foo"); err != nil {
+			t.Fatalf("Could not archive node: %v", err)
+		}
+	}
+	ids, err := getRevisionIds(historyRoot, "/foo")
+	if err != nil || !reflect.DeepEqual(ids, []int{1, 2}) {
+		t.Errorf(`getRevisionIds(_, "/foo") = %v, %v, should be [1 2], nil`,
+			ids, err)
+	}
+	ret, err := getRevision(historyRoot, "/foo", 2)
+	expected := `{"Path":"/foo","Type":"core.Foo","Order":1}`
+	if err != nil || string(ret) != expected {
+		t.Errorf(`getRevision(_, "/foo", 2) = %s, %v, should be %s, nil`,
+			ret, err, expected)
+	}
+	ret, err = getRevision(historyRoot, "/foo", 3)
+	if err != nil || ret != nil {
+		t.Errorf(`getRevision(_, "/foo", 3) = %s, %v, should be nil, nil`,
+			ret, err)
+	}
+}
+
+func TestPublishAndDiscardDraft(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/nodes/foo/node.json":              `{"Type":"core.Foo","Order":1}`,
+		"/nodes/foo/node.draft.json":        `{"Type":"core.Foo","Order":2}`,
+		"/nodes/foo/__file_core.File":       "old",
+		"/nodes/foo/draft.__file_core.File": "new",
+		"/nodes/bar/node.json":              `{"Type":"core.Foo","Order":1}`,
+		"/nodes/bar/node.draft.json":        `{"Type":"core.Foo","Order":2}`,
+		"/nodes/bar/draft.__file_core.File": "new"},
+		"TestPublishAndDiscardDraft")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	nodesRoot := newFSStorage(filepath.Join(root, "nodes"))
+	historyRoot := newFSStorage(filepath.Join(root, "history"))
+	ret, err := getNodeDraft(nodesRoot, "/foo")
+	expected := `{"Path":"/foo","Type":"core.Foo","Order":2}`
+	if err != nil || string(ret) != expected {
+		t.Errorf(`getNodeDraft(_, "/foo") = %s, %v, should be %s, nil`,
+			ret, err, expected)
+	}
+	children, err := getChildren(nodesRoot, "/foo")
+	if err != nil || len(children) != 0 {
+		t.Errorf(`getChildren(_, "/foo") = %s, %v, should be empty`,
+			children, err)
+	}
+	if err := publishDraft(nodesRoot, historyRoot, "/foo"); err != nil {
+		t.Fatalf("Could not publish draft: %v", err)
+	}
+	ret, err = getNode(nodesRoot, "/foo")
+	if err != nil || string(ret) != expected {
+		t.Errorf(`getNode(_, "/foo") = %s, %v, should be %s, nil`,
+			ret, err, expected)
+	}
+	ret, err = getRevision(historyRoot, "/foo", 1)
+	expected = `{"Path":"/foo","Type":"core.Foo","Order":1}`
+	if err != nil || string(ret) != expected {
+		t.Errorf(`getRevision(_, "/foo", 1) = %s, %v, should be %s, nil`,
+			ret, err, expected)
+	}
+	file, err := nodesRoot.ReadFile("foo/__file_core.File")
+	if err != nil || string(file) != "new" {
+		t.Errorf("Published file data is %q, %v, should be \"new\", nil",
+			file, err)
+	}
+	if err := publishDraft(nodesRoot, historyRoot, "/foo"); err == nil {
+		t.Errorf("publishDraft without draft should fail")
+	}
+	if err := discardDraft(nodesRoot, "/bar"); err != nil {
+		t.Fatalf("Could not discard draft: %v", err)
+	}
+	files, err := nodesRoot.ReadDir("bar")
+	if err != nil || len(files) != 1 || files[0].Name != "node.json" {
+		t.Errorf("Discarding the draft should only keep node.json")
+	}
+}
+
+func TestWriteNodeDataConflict(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/nodes/foo/node.json": `{"Type":"core.Foo","Changed":"2015-01-01T00:00:00Z"}`},
+		"TestWriteNodeDataConflict")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	monsti := &MonstiService{
+		siteMutexes: map[string]*sync.RWMutex{"site": new(sync.RWMutex)},
+		storages:    map[string]storage{"site": newFSStorage(root)},
+	}
+	token := service.NodeToken(&service.Node{
+		Changed: time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)}, nil)
+	args := &WriteNodeDataArgs{Site: "site", Path: "/foo",
+		File: "node.draft.json", Token: token,
+		Content: []byte(`{"Type":"core.Foo","Changed":"2015-01-02T00:00:00Z"}`)}
+	if err := monsti.WriteNodeData(args, new(int)); err != nil {
+		t.Fatalf("Could not write draft with current token: %v", err)
+	}
+	// The token is stale now as the draft has been written.
+	err = monsti.WriteNodeData(args, new(int))
+	if _, ok := err.(*service.ConflictError); !ok {
+		t.Errorf("WriteNodeData with stale token = %v, should be a conflict", err)
+	}
+	args.Token = ""
+	if err := monsti.WriteNodeData(args, new(int)); err != nil {
+		t.Errorf("WriteNodeData without token should not check: %v", err)
+	}
+}
+
+func TestRenameNodeMarksParents(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/nodes/old/node.json":     `{"Type":"core.Foo"}`,
+		"/nodes/old/foo/node.json": `{"Type":"core.Foo"}`,
+		"/nodes/new/node.json":     `{"Type":"core.Foo"}`},
+		"TestRenameNodeMarksParents")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	monsti := &MonstiService{
+		siteMutexes: map[string]*sync.RWMutex{"site": new(sync.RWMutex)},
+		storages:    map[string]storage{"site": newFSStorage(root)},
+	}
+	cache := monsti.cacheStorage("site")
+	for _, parent := range []string{"/old", "/new"} {
+		err := toCache(cache, parent, "foo.navigation", []byte("nav"),
+			&service.CacheMods{Deps: []service.CacheDep{{Node: parent,
+				Descend: 1}}})
+		if err != nil {
+			t.Fatalf("Could not cache data: %v", err)
+		}
+	}
+	err = monsti.RenameNode(&RenameNodeArgs{Site: "site", Source: "/old/foo",
+		Target: "/new/foo"}, new(int))
+	if err != nil {
+		t.Fatalf("Could not rename node: %v", err)
+	}
+	for _, parent := range []string{"/old", "/new"} {
+		ret, _, err := fromCache(cache, parent, "foo.navigation")
+		if err != nil {
+			t.Fatalf("Could not get cached data: %v", err)
+		}
+		if ret != nil {
+			t.Errorf("Cache of parent %v should be marked, got %q", parent, ret)
+		}
+	}
+}
+
+func TestPublishNodeDraftRename(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/nodes/foo/node.json":       `{"Type":"core.Foo","Order":1}`,
+		"/nodes/foo/node.draft.json": `{"Type":"core.Foo","Order":2,"Rename":"bar"}`,
+		"/nodes/baz/node.json":       `{"Type":"core.Foo"}`,
+		"/nodes/baz/node.draft.json": `{"Type":"core.Foo","Rename":"bar"}`},
+		"TestPublishNodeDraftRename")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	monsti := &MonstiService{
+		siteMutexes: map[string]*sync.RWMutex{"site": new(sync.RWMutex)},
+		storages:    map[string]storage{"site": newFSStorage(root)},
+	}
+	err = monsti.PublishNodeDraft(&NodeDraftArgs{Site: "site", Path: "/foo"},
+		new(int))
+	if err != nil {
+		t.Fatalf("Could not publish draft: %v", err)
+	}
+	nodes := monsti.nodesStorage("site")
+	if _, err := nodes.Stat("foo"); !os.IsNotExist(err) {
+		t.Errorf("Published draft should have renamed /foo")
+	}
+	ret, err := getNode(nodes, "/bar")
+	if err != nil {
+		t.Fatalf("Could not get renamed node: %v", err)
+	}
+	var node struct {
+		Order  int
+		Rename string
+	}
+	if err := json.Unmarshal(ret, &node); err != nil || node.Order != 2 ||
+		node.Rename != "" {
+		t.Errorf("Renamed node should be the published draft without the "+
+			"new name, got %s", ret)
+	}
+	err = monsti.PublishNodeDraft(&NodeDraftArgs{Site: "site", Path: "/baz"},
+		new(int))
+	if err == nil {
+		t.Errorf("Publishing a draft renaming to an existing node should fail")
+	}
+	if _, err := nodes.Stat("baz/node.draft.json"); err != nil {
+		t.Errorf("Failed publish should keep the draft: %v", err)
+	}
+}
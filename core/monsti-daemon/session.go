@@ -41,30 +41,136 @@ type loginFormData struct {
 	Login, Password string
 }
 
+type secondFactorFormData struct {
+	Code string
+}
+
+// secondFactorTimeout is the time users have to enter the code of
+// their second factor after entering their password.
+const secondFactorTimeout = 5 * time.Minute
+
+// pendingLogin returns the user who entered the correct password but
+// still has to enter the code of the second factor. If there is no
+// such user or the second step timed out, returns nil.
+func (h *nodeHandler) pendingLogin(c *reqContext) (*service.User, error) {
+	login, _ := c.Session.Values["pending-login"].(string)
+	started, _ := c.Session.Values["pending-login-time"].(int64)
+	if login == "" ||
+		time.Since(time.Unix(started, 0)) > secondFactorTimeout {
+		return nil, nil
+	}
+	user, err := getUser(login, h.Settings.Monsti.GetSiteDataPath(c.Site))
+	if err != nil {
+		return nil, err
+	}
+	if user == nil || user.Disabled || user.TwoFactor == nil {
+		return nil, nil
+	}
+	return user, nil
+}
+
 // Login handles login requests.
+//
+// Users who enabled two-factor authentication have to enter the code
+// of their authenticator or a recovery code after their password.
 func (h *nodeHandler) Login(c *reqContext) error {
 	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	dataDir := h.Settings.Monsti.GetSiteDataPath(c.Site)
 	data := loginFormData{}
-
 	form := htmlwidgets.NewForm(&data)
 	form.AddWidget(new(htmlwidgets.TextWidget), "Login", G("User name"), "")
 	form.AddWidget(new(htmlwidgets.PasswordWidget), "Password", G("Password"), "")
 
+	codeData := secondFactorFormData{}
+	codeForm := htmlwidgets.NewForm(&codeData)
+	codeForm.AddWidget(&htmlwidgets.TextWidget{MinLength: 1,
+		ValidationError: G("Required.")}, "Code", G("Authentication code"),
+		G("The code shown by your authenticator app or a recovery code."))
+	secondFactor := false
+
 	switch c.Req.Method {
 	case "GET":
 	case "POST":
+		if _, ok := c.Req.PostForm["Code"]; ok {
+			user, err := h.pendingLogin(c)
+			if err != nil {
+				return fmt.Errorf("Could not get pending login: %v", err)
+			}
+			if user == nil {
+				form.AddError("", G("Your login timed out. Please try again."))
+				break
+			}
+			secondFactor = true
+			if !codeForm.Fill(c.Req.PostForm) {
+				break
+			}
+			client, account, ip := h.Throttle.throttleKeys(c, "login", user.Login)
+			if wait := h.Throttle.Wait(client, account); wait > 0 {
+				h.Log.Printf("(%v) Throttled login for %q from %v", c.Site,
+					user.Login, ip)
+				retryAfter(c.Res, wait)
+				codeForm.AddError("", G("Too many failed attempts. Please try again later."))
+				break
+			}
+			valid, err := verifySecondFactor(user.TwoFactor, codeData.Code,
+				time.Now())
+			if err != nil {
+				return fmt.Errorf("Could not verify second factor: %v", err)
+			}
+			if !valid {
+				h.Log.Printf("(%v) Authentication failure for %q from %v", c.Site,
+					user.Login, ip)
+				h.Throttle.Fail(client, account)
+				codeForm.AddError("Code", G("Wrong code."))
+				break
+			}
+			h.Throttle.Reset(account)
+			// Verifying the code updates the factor to prevent replays.
+			err = c.Serv.Monsti().WriteUserTwoFactor(c.Site, user.Login,
+				user.TwoFactor)
+			if err != nil {
+				return fmt.Errorf("Could not write second factor: %v", err)
+			}
+			delete(c.Session.Values, "pending-login")
+			delete(c.Session.Values, "pending-login-time")
+			c.Session.Values["login"] = user.Login
+			c.Session.Save(c.Req, c.Res)
+			http.Redirect(c.Res, c.Req, c.Node.Path+"/", http.StatusSeeOther)
+			return nil
+		}
 		if form.Fill(c.Req.Form) {
-			user, err := getUser(data.Login,
-				h.Settings.Monsti.GetSiteDataPath(c.Site))
+			client, account, ip := h.Throttle.throttleKeys(c, "login", data.Login)
+			if wait := h.Throttle.Wait(client, account); wait > 0 {
+				h.Log.Printf("(%v) Throttled login for %q from %v", c.Site,
+					data.Login, ip)
+				retryAfter(c.Res, wait)
+				form.AddError("", G("Too many failed attempts. Please try again later."))
+				break
+			}
+			user, err := getUser(data.Login, dataDir)
 			if err != nil {
 				return fmt.Errorf("Could not get user: %v", err)
 			}
-			if user != nil && passwordEqual(user.Password, data.Password) {
+			if user != nil && !user.Disabled &&
+				passwordEqual(user.Password, data.Password) {
+				// Failed attempts are kept until the second factor is
+				// verified, too.
+				if user.TwoFactor != nil {
+					c.Session.Values["pending-login"] = user.Login
+					c.Session.Values["pending-login-time"] = time.Now().Unix()
+					c.Session.Save(c.Req, c.Res)
+					secondFactor = true
+					break
+				}
+				h.Throttle.Reset(account)
 				c.Session.Values["login"] = user.Login
 				c.Session.Save(c.Req, c.Res)
 				http.Redirect(c.Res, c.Req, c.Node.Path+"/", http.StatusSeeOther)
 				return nil
 			}
+			h.Log.Printf("(%v) Authentication failure for %q from %v", c.Site,
+				data.Login, ip)
+			h.Throttle.Fail(client, account)
 			form.AddError("", G("Wrong login or password."))
 		}
 	default:
@@ -72,16 +178,21 @@ func (h *nodeHandler) Login(c *reqContext) error {
 	}
 	data.Password = ""
 
-	body, err := h.Renderer.Render("actions/loginform", template.Context{
-		"Form": form.RenderData()}, c.UserSession.Locale,
-		h.Settings.Monsti.GetSiteTemplatesPath(c.Site))
+	context := template.Context{"Form": form.RenderData(),
+		"SecondFactor": secondFactor}
+	if secondFactor {
+		codeData.Code = ""
+		context["Form"] = codeForm.RenderData()
+	}
+	body, err := c.Renderer.Render("actions/loginform", context,
+		c.UserSession.Locale, h.Settings.Monsti.GetSiteTemplatesPath(c.Site))
 	if err != nil {
 		return fmt.Errorf("Can't render login form: %v", err)
 	}
 	env := masterTmplEnv{Node: c.Node, Session: c.UserSession, Title: G("Login"),
 		Description: G("Login with your site account."),
 		Flags:       EDIT_VIEW}
-	rendered, _ := renderInMaster(h.Renderer, []byte(body), env, h.Settings,
+	rendered, _ := renderInMaster(c.Renderer, []byte(body), env, h.Settings,
 		c.Site, c.SiteSettings, c.UserSession.Locale, c.Serv)
 	c.Res.Write(rendered)
 	return nil
@@ -115,41 +226,29 @@ func (h *nodeHandler) RequestPasswordToken(c *reqContext) error {
 		}
 	case "POST":
 		if form.Fill(c.Req.Form) {
+			// Each request counts as failed attempt to limit the number of
+			// mails.
+			client, account, ip := h.Throttle.throttleKeys(c, "password-token",
+				data.User)
+			if wait := h.Throttle.Wait(client, account); wait > 0 {
+				h.Log.Printf("(%v) Throttled password token request for %q from %v",
+					c.Site, data.User, ip)
+				retryAfter(c.Res, wait)
+				form.AddError("", G("Too many requests. Please try again later."))
+				break
+			}
+			h.Throttle.Fail(client, account)
+			h.Log.Printf("(%v) Password token request for %q from %v", c.Site,
+				data.User, ip)
 			user, err := getUser(data.User,
 				h.Settings.Monsti.GetSiteDataPath(c.Site))
 			if err != nil {
 				return fmt.Errorf("Could not get user: %v", err)
 			}
-			if user != nil {
-				link := getRequestPasswordToken(c.Site, data.User,
-					c.SiteSettings.StringValue("core.PasswordTokenKey"))
-
-				// Send email to user
-				mail := gomail.NewMessage()
-				mail.SetAddressHeader("From",
-					c.SiteSettings.StringValue("core.EmailAddress"),
-					c.SiteSettings.StringValue("core.EmailName"))
-				mail.SetAddressHeader("To", user.Email, user.Login)
-				mail.SetHeader("Subject", G("Password request"))
-
-				body, err := h.Renderer.Render("mails/change_password",
-					template.Context{
-						"SiteSettings": c.SiteSettings,
-						"Account":      data.User,
-						"ChangeLink": c.SiteSettings.StringValue("core.BaseURL") +
-							"/@@change-password?token=" + link,
-					}, c.UserSession.Locale, h.Settings.Monsti.GetSiteTemplatesPath(c.Site))
-				if err != nil {
-					return fmt.Errorf("Can't render password change mail: %v", err)
-				}
-				mail.SetBody("text/plain", string(body))
-				mailer := gomail.NewCustomMailer("", nil, gomail.SetSendMail(
-					c.Serv.Monsti().SendMailFunc()))
-				err = mailer.Send(mail)
-				if err != nil {
-					return fmt.Errorf("Could not send mail: %v", err)
+			if user != nil && !user.Disabled {
+				if err := h.sendPasswordTokenMail(c, user); err != nil {
+					return err
 				}
-
 				http.Redirect(c.Res, c.Req, "@@request-password-token?sent",
 					http.StatusSeeOther)
 				return nil
@@ -161,7 +260,7 @@ func (h *nodeHandler) RequestPasswordToken(c *reqContext) error {
 		return fmt.Errorf("Request method not supported: %v", c.Req.Method)
 	}
 
-	body, err := h.Renderer.Render("actions/request_password_token_form",
+	body, err := c.Renderer.Render("actions/request_password_token_form",
 		template.Context{
 			"Sent": sent,
 			"Form": form.RenderData()}, c.UserSession.Locale,
@@ -174,12 +273,46 @@ func (h *nodeHandler) RequestPasswordToken(c *reqContext) error {
 		Session: c.UserSession,
 		Title:   G("Request new password"),
 		Flags:   EDIT_VIEW}
-	rendered, _ := renderInMaster(h.Renderer, []byte(body), env, h.Settings,
+	rendered, _ := renderInMaster(c.Renderer, []byte(body), env, h.Settings,
 		c.Site, c.SiteSettings, c.UserSession.Locale, c.Serv)
 	c.Res.Write(rendered)
 	return nil
 }
 
+// sendPasswordTokenMail sends the given user a mail with a link to
+// change the login password.
+func (h *nodeHandler) sendPasswordTokenMail(c *reqContext,
+	user *service.User) error {
+	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	link := getRequestPasswordToken(c.Site, user.Login,
+		c.SiteSettings.StringValue("core.PasswordTokenKey"))
+
+	mail := gomail.NewMessage()
+	mail.SetAddressHeader("From",
+		c.SiteSettings.StringValue("core.EmailAddress"),
+		c.SiteSettings.StringValue("core.EmailName"))
+	mail.SetAddressHeader("To", user.Email, user.Login)
+	mail.SetHeader("Subject", G("Password request"))
+
+	body, err := c.Renderer.Render("mails/change_password",
+		template.Context{
+			"SiteSettings": c.SiteSettings,
+			"Account":      user.Login,
+			"ChangeLink": c.SiteSettings.StringValue("core.BaseURL") +
+				"/@@change-password?token=" + link,
+		}, c.UserSession.Locale, h.Settings.Monsti.GetSiteTemplatesPath(c.Site))
+	if err != nil {
+		return fmt.Errorf("Can't render password change mail: %v", err)
+	}
+	mail.SetBody("text/plain", string(body))
+	mailer := gomail.NewCustomMailer("", nil, gomail.SetSendMail(
+		c.Serv.Monsti().SendMailFunc()))
+	if err := mailer.Send(mail); err != nil {
+		return fmt.Errorf("Could not send mail: %v", err)
+	}
+	return nil
+}
+
 type changePasswordFormData struct {
 	OldPassword, Password string
 }
@@ -263,7 +396,7 @@ func (h *nodeHandler) ChangePassword(c *reqContext) error {
 		return fmt.Errorf("Request method not supported: %v", c.Req.Method)
 	}
 
-	body, err := h.Renderer.Render("actions/change_password",
+	body, err := c.Renderer.Render("actions/change_password",
 		template.Context{
 			"TokenInvalid": tokenInvalid,
 			"Changed":      changed,
@@ -277,7 +410,7 @@ func (h *nodeHandler) ChangePassword(c *reqContext) error {
 		Session: c.UserSession,
 		Title:   G("Change password"),
 		Flags:   EDIT_VIEW}
-	rendered, _ := renderInMaster(h.Renderer, []byte(body), env, h.Settings,
+	rendered, _ := renderInMaster(c.Renderer, []byte(body), env, h.Settings,
 		c.Site, c.SiteSettings, c.UserSession.Locale, c.Serv)
 	c.Res.Write(rendered)
 	return nil
@@ -314,7 +447,7 @@ func getClientSession(session *sessions.Session,
 		err = fmt.Errorf("Could not get user: %v", err)
 		return
 	}
-	if user == nil {
+	if user == nil || user.Disabled {
 		delete(session.Values, "login")
 		return
 	}
@@ -344,7 +477,7 @@ func writeUserDatabase(users map[string]service.User, dataDir string) error {
 	if err != nil {
 		return fmt.Errorf("Could not marshal user database: %v", err)
 	}
-	if err = ioutil.WriteFile(path, content, 0660); err != nil {
+	if err = writeFileAtomic(path, content, 0660); err != nil {
 		return fmt.Errorf("Could not write user database: %v", err)
 	}
 	return nil
@@ -379,22 +512,6 @@ func writeUser(user *service.User, dataDir string) error {
 	return nil
 }
 
-// checkPermission checks if the session's user might perform the given action.
-func checkPermission(action service.Action, session *service.UserSession) bool {
-	auth := session.User != nil
-	switch action {
-	case service.RemoveAction, service.EditAction, service.AddAction,
-		service.LogoutAction, service.ListAction, service.ChooserAction,
-		service.SettingsAction:
-		if auth {
-			return true
-		}
-	default:
-		return true
-	}
-	return false
-}
-
 // passwordEqual returns true iff the hash matches the password.
 func passwordEqual(hash, password string) bool {
 	if err := bcrypt.CompareHashAndPassword([]byte(hash),
@@ -438,6 +555,9 @@ func verifyRequestPasswordToken(site string,
 	if err != nil {
 		return nil, fmt.Errorf("Could not get user: %v", err)
 	}
+	if user == nil || user.Disabled {
+		return nil, nil
+	}
 	timeSubstring := parts[userPartsCount]
 	generated, err := strconv.Atoi(timeSubstring)
 	if err != nil || int64(generated) < user.PasswordChanged.Unix() {
@@ -46,9 +46,13 @@ func TestCheckPermission(t *testing.T) {
 	for _, v := range tests {
 		var user *service.User
 		if v.Auth {
-			user = &service.User{}
+			user = &service.User{Roles: []string{"admin"}}
+		}
+		ret, err := checkPermission(v.Action, &service.UserSession{User: user},
+			"/", func(string, string) ([]string, error) { return nil, nil })
+		if err != nil {
+			t.Fatalf("checkPermission returns error: %v", err)
 		}
-		ret := checkPermission(v.Action, &service.UserSession{User: user})
 		if ret != v.Grant {
 			t.Errorf("checkPermission(%v, %v) = %v, expected %v", v.Action,
 				user, ret, v.Grant)
@@ -104,7 +108,7 @@ func WriteUser(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Error reading changed user: %v", err)
 	}
-	if *userChanged != user {
+	if !reflect.DeepEqual(*userChanged, user) {
 		t.Errorf("Users differ: %v\n %v", user, userChanged)
 	}
 }
@@ -65,7 +65,9 @@ func (h *nodeHandler) SettingsAction(c *reqContext) error {
 					settings.Fields[field.Id].FromFormData(formData.Fields.Get(field.Id))
 				}
 			}
-			if err := m.WriteSiteSettings(c.Site, settings); err != nil {
+			err := m.WriteSiteSettingsAs(c.Site, settings,
+				c.UserSession.User.Login)
+			if err != nil {
 				return fmt.Errorf("Could not update settings: %v", err)
 			}
 			/*
@@ -82,7 +84,7 @@ func (h *nodeHandler) SettingsAction(c *reqContext) error {
 	default:
 		return fmt.Errorf("Request method not supported: %v", c.Req.Method)
 	}
-	rendered, err := h.Renderer.Render("actions/settings",
+	rendered, err := c.Renderer.Render("actions/settings",
 		mtemplate.Context{
 			"Form":  form.RenderData(),
 			"Saved": c.Req.FormValue("saved"),
@@ -92,7 +94,7 @@ func (h *nodeHandler) SettingsAction(c *reqContext) error {
 		return fmt.Errorf("Could not render settings template: %v", err)
 	}
 
-	content, _ := renderInMaster(h.Renderer, []byte(rendered),
+	content, _ := renderInMaster(c.Renderer, []byte(rendered),
 		masterTmplEnv{Node: c.Node, Session: c.UserSession,
 			Title: G("Settings"), Flags: EDIT_VIEW},
 		h.Settings, c.Site, c.SiteSettings, c.UserSession.Locale, c.Serv)
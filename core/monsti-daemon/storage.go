@@ -0,0 +1,281 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// storageEntry is an entry of a storage directory.
+type storageEntry struct {
+	Name  string
+	IsDir bool
+}
+
+// storage is a hierarchical store for site data like nodes, node data
+// files, settings, and the cache.
+//
+// Paths are slash separated and relative to the root of the storage. A
+// leading slash is ignored. Errors for missing files or directories
+// satisfy os.IsNotExist.
+type storage interface {
+	// ReadFile returns the content of the given file.
+	ReadFile(path string) ([]byte, error)
+	// WriteFile writes the given file, creating any missing parent
+	// directories.
+	WriteFile(path string, content []byte) error
+	// Remove removes the given file or empty directory.
+	Remove(path string) error
+	// RemoveAll removes the given file or directory including its
+	// content. It's no error if the path does not exist.
+	RemoveAll(path string) error
+	// Rename moves the given file or directory, creating any missing
+	// parent directories of the target.
+	Rename(source, target string) error
+	// ReadDir returns the entries of the given directory sorted by name.
+	ReadDir(path string) ([]storageEntry, error)
+	// Stat checks if the given path exists and returns if it's a
+	// directory.
+	Stat(path string) (isDir bool, err error)
+	// MkdirAll creates the given directory and any missing parents.
+	MkdirAll(path string) error
+}
+
+// cleanStoragePath converts the given path to a clean relative path.
+//
+// The root is represented by the empty string.
+func cleanStoragePath(p string) string {
+	p = strings.TrimPrefix(path.Clean("/"+p), "/")
+	return p
+}
+
+// notExistError returns an error for the given missing path which
+// satisfies os.IsNotExist.
+func notExistError(op, path string) error {
+	return &os.PathError{Op: op, Path: path, Err: os.ErrNotExist}
+}
+
+// subStorage is a view on a directory of another storage.
+type subStorage struct {
+	Storage storage
+	Prefix  string
+}
+
+// storageDir returns a storage for the given directory of the storage.
+func storageDir(s storage, dir string) storage {
+	return &subStorage{s, cleanStoragePath(dir)}
+}
+
+func (s *subStorage) join(p string) string {
+	return path.Join(s.Prefix, cleanStoragePath(p))
+}
+
+func (s *subStorage) ReadFile(p string) ([]byte, error) {
+	return s.Storage.ReadFile(s.join(p))
+}
+
+func (s *subStorage) WriteFile(p string, content []byte) error {
+	return s.Storage.WriteFile(s.join(p), content)
+}
+
+func (s *subStorage) Remove(p string) error {
+	return s.Storage.Remove(s.join(p))
+}
+
+func (s *subStorage) RemoveAll(p string) error {
+	return s.Storage.RemoveAll(s.join(p))
+}
+
+func (s *subStorage) Rename(source, target string) error {
+	return s.Storage.Rename(s.join(source), s.join(target))
+}
+
+func (s *subStorage) ReadDir(p string) ([]storageEntry, error) {
+	return s.Storage.ReadDir(s.join(p))
+}
+
+func (s *subStorage) Stat(p string) (bool, error) {
+	return s.Storage.Stat(s.join(p))
+}
+
+func (s *subStorage) MkdirAll(p string) error {
+	return s.Storage.MkdirAll(s.join(p))
+}
+
+// walkStorage calls fn for the given path and, if it's a directory,
+// recursively for all its entries.
+func walkStorage(s storage, p string, fn func(path string, isDir bool) error) error {
+	isDir, err := s.Stat(p)
+	if err != nil {
+		return err
+	}
+	if err := fn(p, isDir); err != nil {
+		return err
+	}
+	if !isDir {
+		return nil
+	}
+	entries, err := s.ReadDir(p)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := walkStorage(s, path.Join(p, entry.Name), fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fsStorage stores the data in a directory of the filesystem.
+type fsStorage struct {
+	Root string
+}
+
+// newFSStorage returns a storage using the given directory.
+func newFSStorage(root string) storage {
+	return &fsStorage{root}
+}
+
+func (s *fsStorage) path(p string) string {
+	return filepath.Join(s.Root, filepath.FromSlash(cleanStoragePath(p)))
+}
+
+func (s *fsStorage) ReadFile(p string) ([]byte, error) {
+	return ioutil.ReadFile(s.path(p))
+}
+
+func (s *fsStorage) WriteFile(p string, content []byte) error {
+	path := s.path(p)
+	if err := os.MkdirAll(filepath.Dir(path), 0770); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, content, 0660)
+}
+
+func (s *fsStorage) Remove(p string) error {
+	return os.Remove(s.path(p))
+}
+
+func (s *fsStorage) RemoveAll(p string) error {
+	return os.RemoveAll(s.path(p))
+}
+
+func (s *fsStorage) Rename(source, target string) error {
+	targetPath := s.path(target)
+	if err := os.MkdirAll(filepath.Dir(targetPath), 0770); err != nil {
+		return err
+	}
+	return os.Rename(s.path(source), targetPath)
+}
+
+func (s *fsStorage) ReadDir(p string) ([]storageEntry, error) {
+	files, err := ioutil.ReadDir(s.path(p))
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]storageEntry, 0, len(files))
+	for _, file := range files {
+		isDir := file.IsDir()
+		// Follow symbolic links, e.g. for nodes linked to other nodes.
+		if file.Mode()&os.ModeSymlink != 0 {
+			isDir, _ = s.Stat(path.Join(p, file.Name()))
+		}
+		entries = append(entries, storageEntry{file.Name(), isDir})
+	}
+	return entries, nil
+}
+
+func (s *fsStorage) Stat(p string) (bool, error) {
+	info, err := os.Stat(s.path(p))
+	if err != nil {
+		return false, err
+	}
+	return info.IsDir(), nil
+}
+
+func (s *fsStorage) MkdirAll(p string) error {
+	return os.MkdirAll(s.path(p), 0770)
+}
+
+// tmpFilePrefix is the name prefix of temporary files written by
+// writeFileAtomic.
+const tmpFilePrefix = ".tmp-"
+
+// writeFileAtomic writes the given file using a temporary file which
+// gets synced and renamed to the target. Readers will either see the
+// old or the new content, but never a partially written file.
+func writeFileAtomic(name string, content []byte, perm os.FileMode) error {
+	dir := filepath.Dir(name)
+	tmp, err := ioutil.TempFile(dir, tmpFilePrefix+filepath.Base(name)+"-")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(content)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), perm)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), name)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	// Sync the directory to persist the rename.
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// openStorage opens the storage of the given site using the
+// configured backend.
+func openStorage(settings *settings, site string) (storage, error) {
+	dataPath := settings.Monsti.GetSiteDataPath(site)
+	switch settings.Storage.Backend {
+	case "", "filesystem":
+		return newFSStorage(dataPath), nil
+	case "bolt":
+		return newBoltStorage(filepath.Join(dataPath, "data.db"))
+	default:
+		return nil, fmt.Errorf("Unknown storage backend %q",
+			settings.Storage.Backend)
+	}
+}
+
+// closeStorage closes the given storage if its backend has to be
+// closed.
+func closeStorage(store storage) error {
+	if closer, ok := store.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
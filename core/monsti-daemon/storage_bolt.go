@@ -0,0 +1,283 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// boltStorage stores the data in a BoltDB database.
+//
+// Directories are represented by nested buckets, files by keys of
+// these buckets. All data is kept below the bucket "root".
+type boltStorage struct {
+	DB *bolt.DB
+}
+
+var boltRootBucket = []byte("root")
+
+// boltTimeout is the time to wait for the lock of a database which is
+// used by another process (e.g. a running daemon).
+var boltTimeout = 10 * time.Second
+
+// newBoltStorage opens or creates the given database file.
+func newBoltStorage(file string) (storage, error) {
+	db, err := bolt.Open(file, 0660, &bolt.Options{Timeout: boltTimeout})
+	if err == bolt.ErrTimeout {
+		return nil, fmt.Errorf("Database %v is locked by another process", file)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not open database: %v", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltRootBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Could not create root bucket: %v", err)
+	}
+	return &boltStorage{db}, nil
+}
+
+// Close closes the database.
+func (s *boltStorage) Close() error {
+	return s.DB.Close()
+}
+
+// splitBoltPath splits the given path into its elements.
+func splitBoltPath(p string) []string {
+	p = cleanStoragePath(p)
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+// boltBucket returns the bucket for the given directory elements.
+//
+// Returns nil if the bucket does not exist and create is false.
+func boltBucket(tx *bolt.Tx, elements []string, create bool) (
+	*bolt.Bucket, error) {
+	bucket := tx.Bucket(boltRootBucket)
+	for _, element := range elements {
+		next := bucket.Bucket([]byte(element))
+		if next == nil {
+			if !create {
+				return nil, nil
+			}
+			var err error
+			next, err = bucket.CreateBucket([]byte(element))
+			if err != nil {
+				return nil, err
+			}
+		}
+		bucket = next
+	}
+	return bucket, nil
+}
+
+// boltLookup returns the parent bucket of the given path and checks if
+// the path exists and is a directory.
+func boltLookup(tx *bolt.Tx, p string) (parent *bolt.Bucket, name []byte,
+	exists, isDir bool) {
+	elements := splitBoltPath(p)
+	if len(elements) == 0 {
+		return nil, nil, true, true
+	}
+	parent, _ = boltBucket(tx, elements[:len(elements)-1], false)
+	if parent == nil {
+		return nil, nil, false, false
+	}
+	name = []byte(elements[len(elements)-1])
+	if parent.Bucket(name) != nil {
+		return parent, name, true, true
+	}
+	k, _ := parent.Cursor().Seek(name)
+	return parent, name, bytes.Equal(k, name), false
+}
+
+// copyBoltBucket recursively copies the content of the source bucket
+// to the target bucket.
+func copyBoltBucket(source, target *bolt.Bucket) error {
+	return source.ForEach(func(k, v []byte) error {
+		if child := source.Bucket(k); child != nil {
+			targetChild, err := target.CreateBucket(k)
+			if err != nil {
+				return err
+			}
+			return copyBoltBucket(child, targetChild)
+		}
+		return target.Put(k, append([]byte{}, v...))
+	})
+}
+
+func (s *boltStorage) ReadFile(p string) ([]byte, error) {
+	var content []byte
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		parent, name, exists, isDir := boltLookup(tx, p)
+		if !exists {
+			return notExistError("open", p)
+		}
+		if isDir {
+			return fmt.Errorf("%v is a directory", p)
+		}
+		content = append([]byte{}, parent.Get(name)...)
+		return nil
+	})
+	return content, err
+}
+
+func (s *boltStorage) WriteFile(p string, content []byte) error {
+	elements := splitBoltPath(p)
+	if len(elements) == 0 {
+		return fmt.Errorf("Can't write to the root directory")
+	}
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		parent, err := boltBucket(tx, elements[:len(elements)-1], true)
+		if err != nil {
+			return err
+		}
+		return parent.Put([]byte(elements[len(elements)-1]),
+			append([]byte{}, content...))
+	})
+}
+
+func (s *boltStorage) Remove(p string) error {
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		parent, name, exists, isDir := boltLookup(tx, p)
+		if !exists {
+			return notExistError("remove", p)
+		}
+		if parent == nil {
+			return fmt.Errorf("Can't remove the root directory")
+		}
+		if isDir {
+			if k, _ := parent.Bucket(name).Cursor().First(); k != nil {
+				return fmt.Errorf("Directory %v is not empty", p)
+			}
+			return parent.DeleteBucket(name)
+		}
+		return parent.Delete(name)
+	})
+}
+
+func (s *boltStorage) RemoveAll(p string) error {
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		parent, name, exists, isDir := boltLookup(tx, p)
+		if !exists {
+			return nil
+		}
+		if parent == nil {
+			if err := tx.DeleteBucket(boltRootBucket); err != nil {
+				return err
+			}
+			_, err := tx.CreateBucket(boltRootBucket)
+			return err
+		}
+		if isDir {
+			return parent.DeleteBucket(name)
+		}
+		return parent.Delete(name)
+	})
+}
+
+func (s *boltStorage) Rename(source, target string) error {
+	source, target = cleanStoragePath(source), cleanStoragePath(target)
+	if source == target {
+		return nil
+	}
+	if source == "" || strings.HasPrefix(target, source+"/") {
+		return fmt.Errorf("Can't move %v into itself", source)
+	}
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		_, _, exists, isDir := boltLookup(tx, source)
+		if !exists {
+			return notExistError("rename", source)
+		}
+		targetElements := splitBoltPath(target)
+		targetParent, err := boltBucket(tx,
+			targetElements[:len(targetElements)-1], true)
+		if err != nil {
+			return err
+		}
+		targetName := []byte(targetElements[len(targetElements)-1])
+		// Look up the source again as creating buckets might have
+		// invalidated the references.
+		sourceParent, sourceName, _, _ := boltLookup(tx, source)
+		if isDir {
+			if targetParent.Bucket(targetName) != nil {
+				return fmt.Errorf("Target %v does already exist", target)
+			}
+			targetBucket, err := targetParent.CreateBucket(targetName)
+			if err != nil {
+				return err
+			}
+			if err := copyBoltBucket(sourceParent.Bucket(sourceName),
+				targetBucket); err != nil {
+				return err
+			}
+			return sourceParent.DeleteBucket(sourceName)
+		}
+		content := append([]byte{}, sourceParent.Get(sourceName)...)
+		if err := targetParent.Put(targetName, content); err != nil {
+			return err
+		}
+		return sourceParent.Delete(sourceName)
+	})
+}
+
+func (s *boltStorage) ReadDir(p string) ([]storageEntry, error) {
+	var entries []storageEntry
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		bucket, _ := boltBucket(tx, splitBoltPath(p), false)
+		if bucket == nil {
+			return notExistError("open", p)
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			entries = append(entries, storageEntry{
+				Name: string(k), IsDir: bucket.Bucket(k) != nil})
+			return nil
+		})
+	})
+	return entries, err
+}
+
+func (s *boltStorage) Stat(p string) (bool, error) {
+	var isDir bool
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		var exists bool
+		_, _, exists, isDir = boltLookup(tx, p)
+		if !exists {
+			return notExistError("stat", p)
+		}
+		return nil
+	})
+	return isDir, err
+}
+
+func (s *boltStorage) MkdirAll(p string) error {
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		_, err := boltBucket(tx, splitBoltPath(p), true)
+		return err
+	})
+}
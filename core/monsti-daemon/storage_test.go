@@ -0,0 +1,181 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	utesting "pkg.monsti.org/monsti/api/util/testing"
+)
+
+// testStorage runs the common storage tests on the given storage.
+func testStorage(t *testing.T, s storage) {
+	if _, err := s.ReadFile("/foo/node.json"); !os.IsNotExist(err) {
+		t.Errorf("ReadFile of missing file should fail with IsNotExist: %v", err)
+	}
+	for _, file := range []string{"/foo/node.json", "/foo/bar/node.json",
+		"foo/baz/node.json", "/settings.json"} {
+		if err := s.WriteFile(file, []byte(file)); err != nil {
+			t.Fatalf("Could not write %v: %v", file, err)
+		}
+	}
+	ret, err := s.ReadFile("foo/bar/node.json")
+	if err != nil || string(ret) != "/foo/bar/node.json" {
+		t.Errorf(`ReadFile("foo/bar/node.json") = %q, %v`, ret, err)
+	}
+	entries, err := s.ReadDir("/foo")
+	expected := []storageEntry{{"bar", true}, {"baz", true},
+		{"node.json", false}}
+	if err != nil || !reflect.DeepEqual(entries, expected) {
+		t.Errorf(`ReadDir("/foo") = %v, %v, should be %v, nil`,
+			entries, err, expected)
+	}
+	if isDir, err := s.Stat("/foo/bar"); err != nil || !isDir {
+		t.Errorf(`Stat("/foo/bar") = %v, %v, should be true, nil`, isDir, err)
+	}
+	if isDir, err := s.Stat("/settings.json"); err != nil || isDir {
+		t.Errorf(`Stat("/settings.json") = %v, %v, should be false, nil`,
+			isDir, err)
+	}
+	if _, err := s.Stat("/unknown"); !os.IsNotExist(err) {
+		t.Errorf(`Stat("/unknown") should fail with IsNotExist: %v`, err)
+	}
+	if err := s.Rename("/foo/bar", "/moved/bar"); err != nil {
+		t.Fatalf("Could not rename directory: %v", err)
+	}
+	ret, err = s.ReadFile("/moved/bar/node.json")
+	if err != nil || string(ret) != "/foo/bar/node.json" {
+		t.Errorf("Renamed file has content %q, %v", ret, err)
+	}
+	if _, err := s.Stat("/foo/bar"); !os.IsNotExist(err) {
+		t.Errorf("Renamed directory should be gone: %v", err)
+	}
+	if err := s.Rename("/foo/node.json", "/foo/node.old.json"); err != nil {
+		t.Fatalf("Could not rename file: %v", err)
+	}
+	if err := s.Remove("/foo/node.old.json"); err != nil {
+		t.Errorf("Could not remove file: %v", err)
+	}
+	if err := s.Remove("/foo"); err == nil {
+		t.Errorf("Remove of non empty directory should fail")
+	}
+	if err := s.RemoveAll("/foo"); err != nil {
+		t.Errorf("Could not remove directory: %v", err)
+	}
+	if err := s.RemoveAll("/unknown"); err != nil {
+		t.Errorf("RemoveAll of missing path should not fail: %v", err)
+	}
+	if err := s.MkdirAll("/empty/dir"); err != nil {
+		t.Errorf("Could not create directory: %v", err)
+	}
+	var walked []string
+	err = walkStorage(s, "/", func(path string, isDir bool) error {
+		walked = append(walked, path)
+		return nil
+	})
+	expectedWalk := []string{"/", "/empty", "/empty/dir", "/moved",
+		"/moved/bar", "/moved/bar/node.json", "/settings.json"}
+	if err != nil || !reflect.DeepEqual(walked, expectedWalk) {
+		t.Errorf("walkStorage visited %v, %v, should be %v, nil",
+			walked, err, expectedWalk)
+	}
+	sub := storageDir(s, "/moved")
+	ret, err = sub.ReadFile("/bar/node.json")
+	if err != nil || string(ret) != "/foo/bar/node.json" {
+		t.Errorf("ReadFile of sub storage = %q, %v", ret, err)
+	}
+}
+
+func TestFSStorage(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{},
+		"TestFSStorage")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	testStorage(t, newFSStorage(root))
+}
+
+func TestBoltStorage(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{},
+		"TestBoltStorage")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	s, err := newBoltStorage(filepath.Join(root, "data.db"))
+	if err != nil {
+		t.Fatalf("Could not open bolt storage: %v", err)
+	}
+	defer s.(*boltStorage).DB.Close()
+	testStorage(t, s)
+}
+
+func TestBoltStorageLocked(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{},
+		"TestBoltStorageLocked")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	s, err := newBoltStorage(filepath.Join(root, "data.db"))
+	if err != nil {
+		t.Fatalf("Could not open bolt storage: %v", err)
+	}
+	defer closeStorage(s)
+	timeout := boltTimeout
+	boltTimeout = 50 * time.Millisecond
+	defer func() { boltTimeout = timeout }()
+	if _, err := newBoltStorage(filepath.Join(root, "data.db")); err == nil {
+		t.Errorf("Opening a locked database should fail")
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/foo/node.json": "old"}, "TestWriteFileAtomic")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	file := filepath.Join(root, "foo", "node.json")
+	if err := writeFileAtomic(file, []byte("new"), 0640); err != nil {
+		t.Fatalf("Could not write file: %v", err)
+	}
+	content, err := ioutil.ReadFile(file)
+	if err != nil || string(content) != "new" {
+		t.Errorf("File content is %q, %v, should be \"new\", nil", content, err)
+	}
+	info, err := os.Stat(file)
+	if err != nil || info.Mode().Perm() != 0640 {
+		t.Errorf("File mode is %v, %v, should be 0640", info.Mode(), err)
+	}
+	files, err := ioutil.ReadDir(filepath.Join(root, "foo"))
+	if err != nil || len(files) != 1 {
+		t.Errorf("writeFileAtomic should not leave temporary files")
+	}
+	err = writeFileAtomic(filepath.Join(root, "missing", "node.json"),
+		[]byte("new"), 0640)
+	if err == nil {
+		t.Errorf("writeFileAtomic into missing directory should fail")
+	}
+}
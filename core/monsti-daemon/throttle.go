@@ -0,0 +1,225 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// throttleSettings configure the throttling of failed logins and
+// password requests. Zero values select the defaults.
+type throttleSettings struct {
+	// Disabled turns off throttling.
+	Disabled bool
+	// FreeAttempts is the number of failed attempts of a client or for
+	// an account before further attempts get delayed. Defaults to 5.
+	FreeAttempts int
+	// Delay is the delay in seconds after the free attempts. It gets
+	// doubled with each further failed attempt. Defaults to 1.
+	Delay int
+	// MaxDelay is the maximum delay in seconds. Defaults to 900.
+	MaxDelay int
+	// Lockout is the number of failed attempts after which an account
+	// gets locked. Defaults to 20.
+	Lockout int
+	// LockoutDuration is the duration of account lockouts in minutes.
+	// Defaults to 60.
+	LockoutDuration int
+	// ResetAfter is the time in minutes after which failed attempts
+	// are forgotten. Defaults to 1440, i.e. one day.
+	ResetAfter int
+	// ClientIPHeader is the header holding the client's IP address if
+	// Monsti is running behind a reverse proxy, e.g. X-Real-IP or
+	// X-Forwarded-For. If the header holds a list of addresses, the
+	// last one is used.
+	ClientIPHeader string
+}
+
+// withDefaults returns the settings with defaults for unset values.
+func (s throttleSettings) withDefaults() throttleSettings {
+	defaults := []struct {
+		Value   *int
+		Default int
+	}{
+		{&s.FreeAttempts, 5},
+		{&s.Delay, 1},
+		{&s.MaxDelay, 900},
+		{&s.Lockout, 20},
+		{&s.LockoutDuration, 60},
+		{&s.ResetAfter, 1440},
+	}
+	for _, d := range defaults {
+		if *d.Value == 0 {
+			*d.Value = d.Default
+		}
+	}
+	return s
+}
+
+// clientIP returns the IP address of the request's client.
+func (s throttleSettings) clientIP(req *http.Request) string {
+	if s.ClientIPHeader != "" {
+		if value := req.Header.Get(s.ClientIPHeader); value != "" {
+			addresses := strings.Split(value, ",")
+			return strings.TrimSpace(addresses[len(addresses)-1])
+		}
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// throttleKeys returns the throttle keys of the request's client and
+// of the given account, and the client's IP address. The kind of the
+// account key separates e.g. logins from password requests.
+func (t *throttle) throttleKeys(c *reqContext, kind, login string) (
+	client, account, ip string) {
+	ip = t.Settings.clientIP(c.Req)
+	return "ip:" + ip, kind + ":" + c.Site + ":" + login, ip
+}
+
+// retryAfter sets the Retry-After header of the response to the given
+// wait.
+func retryAfter(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After",
+		fmt.Sprint(int64((wait+time.Second-1)/time.Second)))
+}
+
+// throttleEntry keeps the failed attempts of a client or account.
+type throttleEntry struct {
+	Failures int
+	Last     time.Time
+}
+
+// throttle delays further attempts of clients and for accounts after
+// failed attempts. The delay grows exponentially. Accounts get locked
+// after too many failed attempts.
+type throttle struct {
+	Settings throttleSettings
+	// Now returns the current time.
+	Now       func() time.Time
+	mutex     sync.Mutex
+	entries   map[string]*throttleEntry
+	lastSweep time.Time
+}
+
+// newThrottle returns a new throttle with the given settings.
+func newThrottle(settings throttleSettings) *throttle {
+	return &throttle{
+		Settings: settings.withDefaults(),
+		Now:      time.Now,
+		entries:  make(map[string]*throttleEntry)}
+}
+
+// delay returns the delay of the next attempt after the given entry.
+func (t *throttle) delay(entry *throttleEntry, account bool) time.Duration {
+	s := t.Settings
+	if account && entry.Failures >= s.Lockout {
+		return time.Duration(s.LockoutDuration) * time.Minute
+	}
+	n := entry.Failures - s.FreeAttempts
+	if n < 0 {
+		return 0
+	}
+	maxDelay := time.Duration(s.MaxDelay) * time.Second
+	// Double the delay step by step to stop before it could overflow.
+	delay := time.Duration(s.Delay) * time.Second
+	for ; n > 0 && delay < maxDelay; n-- {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		return maxDelay
+	}
+	return delay
+}
+
+// expired returns true if the given entry may be forgotten.
+func (t *throttle) expired(entry *throttleEntry, now time.Time) bool {
+	return now.Sub(entry.Last) > time.Duration(t.Settings.ResetAfter)*time.Minute &&
+		now.Sub(entry.Last) > t.delay(entry, true)
+}
+
+// Wait returns the time the client has to wait before the next
+// attempt for the given account. The arguments are the keys of the
+// client and the account (see throttleKeys).
+func (t *throttle) Wait(client, account string) time.Duration {
+	if t.Settings.Disabled {
+		return 0
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	now := t.Now()
+	var wait time.Duration
+	for _, key := range []string{client, account} {
+		entry, ok := t.entries[key]
+		if !ok {
+			continue
+		}
+		if t.expired(entry, now) {
+			delete(t.entries, key)
+			continue
+		}
+		left := entry.Last.Add(t.delay(entry, key == account)).Sub(now)
+		if left > wait {
+			wait = left
+		}
+	}
+	return wait
+}
+
+// Fail records a failed attempt for the given keys.
+func (t *throttle) Fail(keys ...string) {
+	if t.Settings.Disabled {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	now := t.Now()
+	if now.Sub(t.lastSweep) > time.Minute {
+		for key, entry := range t.entries {
+			if t.expired(entry, now) {
+				delete(t.entries, key)
+			}
+		}
+		t.lastSweep = now
+	}
+	for _, key := range keys {
+		entry, ok := t.entries[key]
+		if !ok {
+			entry = new(throttleEntry)
+			t.entries[key] = entry
+		}
+		entry.Failures++
+		entry.Last = now
+	}
+}
+
+// Reset forgets the failed attempts for the given keys.
+func (t *throttle) Reset(keys ...string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, key := range keys {
+		delete(t.entries, key)
+	}
+}
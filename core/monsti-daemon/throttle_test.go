@@ -0,0 +1,128 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestThrottle(t *testing.T) {
+	now := time.Unix(1000, 0)
+	th := newThrottle(throttleSettings{FreeAttempts: 2, Delay: 10,
+		MaxDelay: 60, Lockout: 6, LockoutDuration: 30, ResetAfter: 120})
+	th.Now = func() time.Time { return now }
+	tests := []struct {
+		Client, Account time.Duration
+	}{
+		{0, 0},
+		{0, 0},
+		{10 * time.Second, 10 * time.Second},
+		{20 * time.Second, 20 * time.Second},
+		{40 * time.Second, 40 * time.Second},
+		{60 * time.Second, 60 * time.Second},
+		{60 * time.Second, 30 * time.Minute},
+	}
+	for i, test := range tests {
+		if wait := th.Wait("ip:a", "other"); wait != test.Client {
+			t.Errorf("After %v failures, client should wait %v, got %v",
+				i, test.Client, wait)
+		}
+		if wait := th.Wait("ip:b", "login:bob"); wait != test.Account {
+			t.Errorf("After %v failures, account should wait %v, got %v",
+				i, test.Account, wait)
+		}
+		th.Fail("ip:a", "login:bob")
+	}
+
+	now = now.Add(time.Minute)
+	if wait := th.Wait("ip:a", "other"); wait != 0 {
+		t.Errorf("Client should not wait after the delay, got %v", wait)
+	}
+	if wait := th.Wait("ip:b", "login:bob"); wait != 29*time.Minute {
+		t.Errorf("Account should be locked for 29m, got %v", wait)
+	}
+	th.Reset("login:bob")
+	if wait := th.Wait("ip:b", "login:bob"); wait != 0 {
+		t.Errorf("Account should not be locked after reset, got %v", wait)
+	}
+
+	th.Fail("ip:a")
+	if wait := th.Wait("ip:a", "other"); wait != 60*time.Second {
+		t.Errorf("Client should wait 60s, got %v", wait)
+	}
+	now = now.Add(3 * time.Hour)
+	if wait := th.Wait("ip:a", "other"); wait != 0 {
+		t.Errorf("Client should not wait after reset period, got %v", wait)
+	}
+	th.Fail("ip:c")
+	if len(th.entries) != 1 {
+		t.Errorf("Expired entries should be removed, got %v", th.entries)
+	}
+
+	th = newThrottle(throttleSettings{Disabled: true})
+	for i := 0; i < 100; i++ {
+		th.Fail("ip:a", "login:bob")
+	}
+	if wait := th.Wait("ip:a", "login:bob"); wait != 0 {
+		t.Errorf("Disabled throttle should not delay, got %v", wait)
+	}
+}
+
+func TestThrottleLargeDelay(t *testing.T) {
+	th := newThrottle(throttleSettings{FreeAttempts: 1, Delay: 3600,
+		MaxDelay: 86400, Lockout: 1000, LockoutDuration: 60, ResetAfter: 1440})
+	entry := &throttleEntry{}
+	for _, failures := range []int{30, 31, 64, 100, 999} {
+		entry.Failures = failures
+		if delay := th.delay(entry, true); delay != 24*time.Hour {
+			t.Errorf("After %v failures, delay should be %v, got %v", failures,
+				24*time.Hour, delay)
+		}
+	}
+	th.Now = func() time.Time { return time.Unix(1000, 0) }
+	for i := 0; i < 100; i++ {
+		th.Fail("ip:a")
+	}
+	if wait := th.Wait("ip:a", "other"); wait != 24*time.Hour {
+		t.Errorf("After many failures, client should wait %v, got %v",
+			24*time.Hour, wait)
+	}
+}
+
+func TestThrottleClientIP(t *testing.T) {
+	tests := []struct {
+		Header, RemoteAddr, Forwarded, Expected string
+	}{
+		{"", "1.2.3.4:1234", "", "1.2.3.4"},
+		{"", "[::1]:1234", "5.6.7.8", "::1"},
+		{"X-Forwarded-For", "127.0.0.1:1234", "", "127.0.0.1"},
+		{"X-Forwarded-For", "127.0.0.1:1234", "9.9.9.9, 5.6.7.8", "5.6.7.8"},
+	}
+	for _, test := range tests {
+		req := &http.Request{RemoteAddr: test.RemoteAddr, Header: http.Header{}}
+		if test.Forwarded != "" {
+			req.Header.Set("X-Forwarded-For", test.Forwarded)
+		}
+		settings := throttleSettings{ClientIPHeader: test.Header}
+		if ip := settings.clientIP(req); ip != test.Expected {
+			t.Errorf("clientIP(%v, %q) = %v, should be %v", test.RemoteAddr,
+				test.Forwarded, ip, test.Expected)
+		}
+	}
+}
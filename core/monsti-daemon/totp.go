@@ -0,0 +1,190 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"pkg.monsti.org/monsti/api/service"
+)
+
+// Users may enable two-factor authentication with an authenticator
+// app generating time-based one-time passwords (TOTP, RFC 6238) and
+// with single-use recovery codes in case they lose the authenticator.
+
+const (
+	// totpPeriod is the validity of a TOTP code.
+	totpPeriod = 30
+	// totpDigits is the length of TOTP codes.
+	totpDigits = 6
+	// totpSkew is the number of periods before and after the current
+	// one whose codes are accepted to allow for clock drift.
+	totpSkew = 1
+	// totpSecretSize is the length of TOTP secrets in bytes.
+	totpSecretSize = 20
+	// recoveryCodeCount is the number of generated recovery codes.
+	recoveryCodeCount = 10
+)
+
+// randomBase32 returns a base32 encoded random string of n bytes.
+func randomBase32(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("Could not read random bytes: %v", err)
+	}
+	return strings.TrimRight(base32.StdEncoding.EncodeToString(buf), "="), nil
+}
+
+// newTOTPSecret returns a new base32 encoded TOTP secret.
+func newTOTPSecret() (string, error) {
+	return randomBase32(totpSecretSize)
+}
+
+// decodeTOTPSecret decodes the given base32 encoded TOTP secret.
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.Replace(secret, " ", "", -1))
+	if n := len(secret) % 8; n != 0 {
+		secret += strings.Repeat("=", 8-n)
+	}
+	return base32.StdEncoding.DecodeString(secret)
+}
+
+// validTOTPSecret returns true if the given secret is a base32 encoded
+// secret of the expected length.
+func validTOTPSecret(secret string) bool {
+	key, err := decodeTOTPSecret(secret)
+	return err == nil && len(key) == totpSecretSize
+}
+
+// totpStep returns the TOTP time step of the given time.
+func totpStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+// totpCode returns the TOTP code of the given secret and time step.
+func totpCode(secret string, step int64) (string, error) {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil {
+		return "", fmt.Errorf("Could not decode secret: %v", err)
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1000000), nil
+}
+
+// checkTOTP checks the given code against the user's authenticator
+// and returns the time step of the matching code. Codes of steps up
+// to the last accepted one are rejected to prevent replays.
+func checkTOTP(factor *service.TwoFactor, code string, now time.Time) (
+	int64, bool, error) {
+	code = strings.Replace(code, " ", "", -1)
+	if len(code) != totpDigits {
+		return 0, false, nil
+	}
+	current := totpStep(now)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= factor.TOTPStep {
+			continue
+		}
+		expected, err := totpCode(factor.TOTPSecret, step)
+		if err != nil {
+			return 0, false, err
+		}
+		if hmac.Equal([]byte(expected), []byte(code)) {
+			return step, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// newRecoveryCodes returns new recovery codes and their hashes.
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		code, err := randomBase32(5)
+		if err != nil {
+			return nil, nil, err
+		}
+		code = strings.ToLower(code[:4] + "-" + code[4:])
+		hash, err := bcrypt.GenerateFromPassword([]byte(code), 0)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Could not hash recovery code: %v", err)
+		}
+		codes = append(codes, code)
+		hashes = append(hashes, string(hash))
+	}
+	return codes, hashes, nil
+}
+
+// useRecoveryCode removes the given recovery code from the user's
+// unused codes. Returns false if the code is unknown.
+func useRecoveryCode(factor *service.TwoFactor, code string) bool {
+	code = strings.ToLower(strings.TrimSpace(code))
+	for i, hash := range factor.RecoveryCodes {
+		if passwordEqual(hash, code) {
+			factor.RecoveryCodes = append(factor.RecoveryCodes[:i],
+				factor.RecoveryCodes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// verifySecondFactor checks the given TOTP or recovery code of the
+// user and updates the user's second factor to prevent reuse. The
+// caller has to save the user if the code is valid.
+func verifySecondFactor(factor *service.TwoFactor, code string,
+	now time.Time) (bool, error) {
+	step, ok, err := checkTOTP(factor, code, now)
+	if err != nil {
+		return false, fmt.Errorf("Could not check TOTP code: %v", err)
+	}
+	if ok {
+		factor.TOTPStep = step
+		return true, nil
+	}
+	return useRecoveryCode(factor, code), nil
+}
+
+// totpURI returns the provisioning URI of the given TOTP secret. It
+// may be shown as QR code to be scanned by authenticator apps.
+func totpURI(issuer, login, secret string) string {
+	label := url.QueryEscape(issuer) + ":" + url.QueryEscape(login)
+	query := url.Values{
+		"secret": {secret},
+		"issuer": {issuer},
+		"digits": {fmt.Sprint(totpDigits)},
+		"period": {fmt.Sprint(totpPeriod)},
+	}
+	return "otpauth://totp/" + strings.Replace(label, "+", "%20", -1) + "?" +
+		query.Encode()
+}
@@ -0,0 +1,140 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+// rfcSecret is the base32 encoded SHA1 secret of the RFC 6238 test
+// vectors.
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCode(t *testing.T) {
+	tests := []struct {
+		Time int64
+		Code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, test := range tests {
+		code, err := totpCode(rfcSecret, totpStep(time.Unix(test.Time, 0)))
+		if err != nil || code != test.Code {
+			t.Errorf("totpCode(%v) = %v, %v, should be %v, nil", test.Time,
+				code, err, test.Code)
+		}
+	}
+	if _, err := totpCode("1", 1); err == nil {
+		t.Errorf("totpCode should refuse invalid secrets")
+	}
+}
+
+func TestValidTOTPSecret(t *testing.T) {
+	secret, err := newTOTPSecret()
+	if err != nil {
+		t.Fatalf("newTOTPSecret returns error: %v", err)
+	}
+	tests := []struct {
+		Secret string
+		Valid  bool
+	}{
+		{secret, true},
+		{strings.ToLower(secret), true},
+		{rfcSecret, true},
+		{"", false},
+		{"AAAAAAAA", false},
+		{rfcSecret + "AAAAAAAA", false},
+		{strings.Repeat("1", 32), false},
+	}
+	for _, test := range tests {
+		if ret := validTOTPSecret(test.Secret); ret != test.Valid {
+			t.Errorf("validTOTPSecret(%q) = %v, should be %v", test.Secret, ret,
+				test.Valid)
+		}
+	}
+}
+
+func TestCheckTOTP(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	factor := &service.TwoFactor{TOTPSecret: rfcSecret}
+	tests := []struct {
+		Code  string
+		Valid bool
+	}{
+		{"050471", true},
+		{"050 471", true},
+		{"081804", true},
+		{"000000", false},
+		{"05047", false},
+	}
+	for _, test := range tests {
+		_, valid, err := checkTOTP(factor, test.Code, now)
+		if err != nil || valid != test.Valid {
+			t.Errorf("checkTOTP(%q) = %v, %v, should be %v, nil", test.Code,
+				valid, err, test.Valid)
+		}
+	}
+	valid, err := verifySecondFactor(factor, "050471", now)
+	if err != nil || !valid {
+		t.Fatalf("verifySecondFactor = %v, %v, should be true, nil", valid, err)
+	}
+	for _, code := range []string{"050471", "081804"} {
+		if valid, _ := verifySecondFactor(factor, code, now); valid {
+			t.Errorf("verifySecondFactor should refuse reused code %v", code)
+		}
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		t.Fatalf("newRecoveryCodes returns error: %v", err)
+	}
+	if len(codes) != recoveryCodeCount || len(hashes) != recoveryCodeCount {
+		t.Fatalf("newRecoveryCodes should return %v codes and hashes",
+			recoveryCodeCount)
+	}
+	factor := &service.TwoFactor{TOTPSecret: rfcSecret, RecoveryCodes: hashes}
+	now := time.Unix(1111111111, 0)
+	valid, err := verifySecondFactor(factor, strings.ToUpper(codes[3]), now)
+	if err != nil || !valid {
+		t.Fatalf("verifySecondFactor = %v, %v, should accept recovery codes",
+			valid, err)
+	}
+	if len(factor.RecoveryCodes) != recoveryCodeCount-1 {
+		t.Errorf("verifySecondFactor should remove used recovery codes")
+	}
+	if valid, _ := verifySecondFactor(factor, codes[3], now); valid {
+		t.Errorf("verifySecondFactor should refuse used recovery codes")
+	}
+}
+
+func TestTOTPURI(t *testing.T) {
+	uri := totpURI("My Site", "bob@example.com", "ABC")
+	expected := "otpauth://totp/My%20Site:bob%40example.com?digits=6&issuer=My+Site&period=30&secret=ABC"
+	if uri != expected {
+		t.Errorf("totpURI(...) = %v, should be %v", uri, expected)
+	}
+}
@@ -0,0 +1,320 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+
+	"pkg.monsti.org/gettext"
+	"pkg.monsti.org/monsti/api/service"
+	mtemplate "pkg.monsti.org/monsti/api/util/template"
+)
+
+// The trash directory of a site storage contains a directory for each
+// removed node subtree. Each of these directories contains the
+// metadata file trash.json, the removed subtree in the directory node
+// and the subtree's history in the directory history.
+
+// validTrashId checks if the given id may be used as trash entry
+// directory name.
+func validTrashId(id string) bool {
+	return id != "" && id != "." && id != ".." && path.Base(id) == id
+}
+
+// trashNode moves the given node's subtree and its history to the
+// trash of the given site storage and returns the id of the new trash
+// entry.
+func trashNode(site storage, node, user string, now time.Time) (
+	string, error) {
+	id := strconv.FormatInt(now.UnixNano(), 10)
+	entryPath := path.Join("trash", id)
+	content, err := json.MarshalIndent(service.TrashEntry{
+		Path: node, Removed: now, RemovedBy: user}, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("Could not marshal trash entry: %v", err)
+	}
+	err = site.WriteFile(path.Join(entryPath, "trash.json"), content)
+	if err != nil {
+		return "", fmt.Errorf("Could not write trash entry: %v", err)
+	}
+	if err := site.Rename(path.Join("nodes", node),
+		path.Join(entryPath, "node")); err != nil {
+		return "", fmt.Errorf("Could not move node: %v", err)
+	}
+	err = site.Rename(path.Join("history", node),
+		path.Join(entryPath, "history"))
+	if err != nil && !os.IsNotExist(err) {
+		return "", fmt.Errorf("Could not move node history: %v", err)
+	}
+	return id, nil
+}
+
+// readTrashEntry reads the metadata of the given trash entry.
+func readTrashEntry(site storage, id string) (*service.TrashEntry, error) {
+	content, err := site.ReadFile(path.Join("trash", id, "trash.json"))
+	if err != nil {
+		return nil, fmt.Errorf("Could not read trash entry: %v", err)
+	}
+	entry := new(service.TrashEntry)
+	if err := json.Unmarshal(content, entry); err != nil {
+		return nil, fmt.Errorf("Could not unmarshal trash entry: %v", err)
+	}
+	entry.Id = id
+	return entry, nil
+}
+
+// getTrashEntries returns the entries of the given site storage's
+// trash, newest first.
+func getTrashEntries(site storage) ([]*service.TrashEntry, error) {
+	files, err := site.ReadDir("trash")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	entries := make([]*service.TrashEntry, 0, len(files))
+	for _, file := range files {
+		if !file.IsDir {
+			continue
+		}
+		entry, err := readTrashEntry(site, file.Name)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	sort.Sort(sort.Reverse(trashEntriesByRemoval(entries)))
+	return entries, nil
+}
+
+type trashEntriesByRemoval []*service.TrashEntry
+
+func (t trashEntriesByRemoval) Len() int {
+	return len(t)
+}
+
+func (t trashEntriesByRemoval) Less(i, j int) bool {
+	return t[i].Removed.Before(t[j].Removed)
+}
+
+func (t trashEntriesByRemoval) Swap(i, j int) {
+	t[i], t[j] = t[j], t[i]
+}
+
+// restoreTrash moves the given trash entry back to its original
+// path and returns this path.
+func restoreTrash(site storage, id string) (string, error) {
+	if !validTrashId(id) {
+		return "", fmt.Errorf("Invalid trash entry %q", id)
+	}
+	entry, err := readTrashEntry(site, id)
+	if err != nil {
+		return "", err
+	}
+	entryPath := path.Join("trash", id)
+	target := path.Join("nodes", entry.Path)
+	if _, err := site.Stat(target); !os.IsNotExist(err) {
+		return "", fmt.Errorf("Node %q does already exist", entry.Path)
+	}
+	if err := site.Rename(path.Join(entryPath, "node"), target); err != nil {
+		return "", fmt.Errorf("Could not move node: %v", err)
+	}
+	if _, err := site.Stat(path.Join(entryPath, "history")); err == nil {
+		historyTarget := path.Join("history", entry.Path)
+		if err := site.RemoveAll(historyTarget); err != nil {
+			return "", fmt.Errorf("Could not remove stale history: %v", err)
+		}
+		if err := site.Rename(path.Join(entryPath, "history"),
+			historyTarget); err != nil {
+			return "", fmt.Errorf("Could not move node history: %v", err)
+		}
+	}
+	if err := site.RemoveAll(entryPath); err != nil {
+		return "", fmt.Errorf("Could not remove trash entry: %v", err)
+	}
+	return entry.Path, nil
+}
+
+// purgeTrash deletes the given trash entry.
+func purgeTrash(site storage, id string) error {
+	if !validTrashId(id) {
+		return fmt.Errorf("Invalid trash entry %q", id)
+	}
+	if err := site.RemoveAll(path.Join("trash", id)); err != nil {
+		return fmt.Errorf("Could not remove trash entry: %v", err)
+	}
+	return nil
+}
+
+// cleanTrash deletes all trash entries removed before the given
+// time.
+func cleanTrash(site storage, before time.Time) error {
+	entries, err := getTrashEntries(site)
+	if err != nil {
+		return fmt.Errorf("Could not get trash entries: %v", err)
+	}
+	for _, entry := range entries {
+		if entry.Removed.Before(before) {
+			if err := purgeTrash(site, entry.Id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// cleanTrashPeriodically cleans the given site's trash every hour
+// according to the configured retention period.
+func (i *MonstiService) cleanTrashPeriodically(site string) {
+	if i.Settings.Trash.Retention <= 0 {
+		return
+	}
+	retention := time.Duration(i.Settings.Trash.Retention) * 24 * time.Hour
+	for {
+		i.siteMutexes[site].Lock()
+		err := cleanTrash(i.storages[site], time.Now().Add(-retention))
+		if err == nil {
+			i.commitSite(site, "", "Clean trash")
+		}
+		i.siteMutexes[site].Unlock()
+		if err != nil {
+			i.Logger.Printf("Could not clean trash of site %q: %v", site, err)
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+func (i *MonstiService) GetTrash(site string,
+	reply *[]*service.TrashEntry) error {
+	i.siteMutexes[site].RLock()
+	defer i.siteMutexes[site].RUnlock()
+	entries, err := getTrashEntries(i.storages[site])
+	if err != nil {
+		return fmt.Errorf("Could not get trash entries: %v", err)
+	}
+	*reply = entries
+	return nil
+}
+
+type TrashEntryArgs struct {
+	Site, Id, User string
+}
+
+func (i *MonstiService) RestoreTrash(args *TrashEntryArgs, reply *int) error {
+	i.siteMutexes[args.Site].Lock()
+	defer i.siteMutexes[args.Site].Unlock()
+	node, err := restoreTrash(i.storages[args.Site], args.Id)
+	if err != nil {
+		return err
+	}
+	if i.Settings.Workflow.Enabled {
+		if err := unpublishNodes(i.nodesStorage(args.Site), node); err != nil {
+			return fmt.Errorf("Could not unpublish restored node: %v", err)
+		}
+	}
+	i.reindexNodes(args.Site, node, true)
+	i.commitSite(args.Site, args.User, "Restore "+node+" from trash")
+	return nil
+}
+
+func (i *MonstiService) PurgeTrash(args *TrashEntryArgs, reply *int) error {
+	i.siteMutexes[args.Site].Lock()
+	defer i.siteMutexes[args.Site].Unlock()
+	if err := purgeTrash(i.storages[args.Site], args.Id); err != nil {
+		return err
+	}
+	i.commitSite(args.Site, args.User, "Purge trash entry "+args.Id)
+	return nil
+}
+
+// Trash lists the removed nodes of the site and allows to restore or
+// purge them.
+func (h *nodeHandler) Trash(c *reqContext) error {
+	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	m := c.Serv.Monsti()
+	entries, err := m.GetTrash(c.Site)
+	if err != nil {
+		return fmt.Errorf("Could not get trash: %v", err)
+	}
+	context := mtemplate.Context{"Node": c.Node}
+	switch c.Req.Method {
+	case "GET":
+	case "POST":
+		var entry *service.TrashEntry
+		for _, e := range entries {
+			if e.Id == c.Req.FormValue("Id") {
+				entry = e
+			}
+		}
+		if entry == nil {
+			context["Error"] = G("Unknown trash entry.")
+			break
+		}
+		switch c.Req.FormValue("Do") {
+		case "restore":
+			existing, err := m.GetNode(c.Site, entry.Path)
+			if err != nil {
+				return fmt.Errorf("Could not fetch possibly existing node: %v", err)
+			}
+			if existing != nil {
+				context["Error"] = G("A node with this path does already exist.")
+				break
+			}
+			if err := m.RestoreTrashAs(c.Site, entry.Id,
+				c.UserSession.User.Login); err != nil {
+				return fmt.Errorf("Could not restore node: %v", err)
+			}
+			err = m.MarkDep(c.Site, service.CacheDep{Node: path.Clean(entry.Path)})
+			if err != nil {
+				return fmt.Errorf("Could not mark node: %v", err)
+			}
+			http.Redirect(c.Res, c.Req, entry.Path, http.StatusSeeOther)
+			return nil
+		case "purge":
+			if err := m.PurgeTrashAs(c.Site, entry.Id,
+				c.UserSession.User.Login); err != nil {
+				return fmt.Errorf("Could not purge trash entry: %v", err)
+			}
+			http.Redirect(c.Res, c.Req, path.Join(c.Node.Path, "@@trash"),
+				http.StatusSeeOther)
+			return nil
+		}
+	default:
+		return fmt.Errorf("Request method not supported: %v", c.Req.Method)
+	}
+	context["Entries"] = entries
+	context["Retention"] = h.Settings.Trash.Retention
+	body, err := c.Renderer.Render("actions/trash", context,
+		c.UserSession.Locale, h.Settings.Monsti.GetSiteTemplatesPath(c.Site))
+	if err != nil {
+		return fmt.Errorf("Can't render trash: %v", err)
+	}
+	env := masterTmplEnv{Node: c.Node, Session: c.UserSession,
+		Flags: EDIT_VIEW, Title: G("Trash")}
+	rendered, _ := renderInMaster(c.Renderer, []byte(body), env, h.Settings,
+		c.Site, c.SiteSettings, c.UserSession.Locale, c.Serv)
+	c.Res.Write(rendered)
+	return nil
+}
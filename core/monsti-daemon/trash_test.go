@@ -0,0 +1,100 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	utesting "pkg.monsti.org/monsti/api/util/testing"
+)
+
+func TestTrash(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/nodes/foo/node.json":               `{"Type":"core.Foo"}`,
+		"/nodes/foo/bar/node.json":           `{"Type":"core.Foo"}`,
+		"/nodes/baz/node.json":               `{"Type":"core.Foo"}`,
+		"/history/foo/.revisions/1.json":     `{"Type":"core.Foo"}`,
+		"/history/foo/bar/.revisions/1.json": `{"Type":"core.Foo"}`},
+		"TestTrash")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	site := newFSStorage(root)
+	entries, err := getTrashEntries(site)
+	if err != nil || len(entries) != 0 {
+		t.Errorf("getTrashEntries on missing trash = %v, %v, should be empty",
+			entries, err)
+	}
+	then := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	fooId, err := trashNode(site, "/foo", "admin",
+		then)
+	if err != nil {
+		t.Fatalf("Could not trash /foo: %v", err)
+	}
+	bazId, err := trashNode(site, "/baz", "admin",
+		then.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("Could not trash /baz: %v", err)
+	}
+	for _, path := range []string{"nodes/foo", "history/foo", "nodes/baz"} {
+		if _, err := os.Stat(filepath.Join(root, path)); !os.IsNotExist(err) {
+			t.Errorf("%v should have been moved to the trash", path)
+		}
+	}
+	entries, err = getTrashEntries(site)
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("getTrashEntries = %v, %v, should contain two entries",
+			entries, err)
+	}
+	if entries[0].Id != bazId || entries[0].Path != "/baz" ||
+		entries[1].Id != fooId || entries[1].RemovedBy != "admin" ||
+		!entries[1].Removed.Equal(then) {
+		t.Errorf("getTrashEntries returned unexpected entries: %v, %v",
+			entries[0], entries[1])
+	}
+	if _, err := restoreTrash(site, "../nodes"); err == nil {
+		t.Errorf("restoreTrash should fail for invalid ids")
+	}
+	path, err := restoreTrash(site, fooId)
+	if err != nil || path != "/foo" {
+		t.Fatalf("restoreTrash = %v, %v, should be /foo, nil", path, err)
+	}
+	for _, path := range []string{"nodes/foo/bar/node.json",
+		"history/foo/bar/.revisions/1.json"} {
+		if _, err := os.Stat(filepath.Join(root, path)); err != nil {
+			t.Errorf("%v should have been restored: %v", path, err)
+		}
+	}
+	if err := cleanTrash(site, then.Add(time.Minute)); err != nil {
+		t.Fatalf("Could not clean trash: %v", err)
+	}
+	entries, _ = getTrashEntries(site)
+	if len(entries) != 1 {
+		t.Errorf("cleanTrash should keep newer entries")
+	}
+	if err := cleanTrash(site, then.Add(2*time.Hour)); err != nil {
+		t.Fatalf("Could not clean trash: %v", err)
+	}
+	entries, _ = getTrashEntries(site)
+	if len(entries) != 0 {
+		t.Errorf("cleanTrash should have purged all entries: %v", entries)
+	}
+}
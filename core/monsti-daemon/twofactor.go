@@ -0,0 +1,146 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"path"
+	"time"
+
+	"pkg.monsti.org/gettext"
+	"pkg.monsti.org/monsti/api/service"
+	mtemplate "pkg.monsti.org/monsti/api/util/template"
+)
+
+// requireTwoFactor returns true if the request's user has to enable
+// two-factor authentication before using the site.
+func requireTwoFactor(c *reqContext) bool {
+	return c.UserSession.User != nil && c.UserSession.User.TwoFactor == nil &&
+		c.SiteSettings.Fields["core.RequireTwoFactor"].Value().(bool)
+}
+
+// TwoFactor allows users to enable and disable two-factor
+// authentication and to renew their recovery codes.
+func (h *nodeHandler) TwoFactor(c *reqContext) error {
+	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	dataDir := h.Settings.Monsti.GetSiteDataPath(c.Site)
+	user, err := getUser(c.UserSession.User.Login, dataDir)
+	if err != nil {
+		return fmt.Errorf("Could not get user: %v", err)
+	}
+	required := c.SiteSettings.Fields["core.RequireTwoFactor"].Value().(bool)
+	context := mtemplate.Context{"Node": c.Node, "Required": required}
+	// The secret to enable is generated here and kept in the session
+	// until it gets confirmed by the first code.
+	var secret string
+	if user.TwoFactor == nil {
+		secret, _ = c.Session.Values["pending-totp-secret"].(string)
+		if !validTOTPSecret(secret) {
+			if secret, err = newTOTPSecret(); err != nil {
+				return fmt.Errorf("Could not generate secret: %v", err)
+			}
+			c.Session.Values["pending-totp-secret"] = secret
+			if err := c.Session.Save(c.Req, c.Res); err != nil {
+				return fmt.Errorf("Could not save session: %v", err)
+			}
+		}
+	}
+	switch c.Req.Method {
+	case "GET":
+	case "POST":
+		code := c.Req.FormValue("Code")
+		do := c.Req.FormValue("Do")
+		var factor *service.TwoFactor
+		switch {
+		case do == "enable" && user.TwoFactor == nil:
+			factor = &service.TwoFactor{TOTPSecret: secret}
+		case (do == "renew" || do == "disable") && user.TwoFactor != nil:
+			factor = user.TwoFactor
+		default:
+			context["Error"] = G("Unknown action.")
+		}
+		if factor == nil {
+			break
+		}
+		if do == "disable" && required {
+			context["Error"] = G("Two-factor authentication is required on this site.")
+			break
+		}
+		valid, err := verifySecondFactor(factor, code, time.Now())
+		if err != nil {
+			return fmt.Errorf("Could not verify second factor: %v", err)
+		}
+		if !valid {
+			context["Error"] = G("Wrong code.")
+			break
+		}
+		if do == "disable" {
+			user.TwoFactor = nil
+		} else {
+			codes, hashes, err := newRecoveryCodes()
+			if err != nil {
+				return fmt.Errorf("Could not generate recovery codes: %v", err)
+			}
+			factor.RecoveryCodes = hashes
+			user.TwoFactor = factor
+			// Recovery codes are shown only once.
+			context["RecoveryCodes"] = codes
+		}
+		err = c.Serv.Monsti().WriteUserTwoFactor(c.Site, user.Login,
+			user.TwoFactor)
+		if err != nil {
+			return fmt.Errorf("Could not write second factor: %v", err)
+		}
+		if do == "enable" {
+			delete(c.Session.Values, "pending-totp-secret")
+			if err := c.Session.Save(c.Req, c.Res); err != nil {
+				return fmt.Errorf("Could not save session: %v", err)
+			}
+		}
+		if do == "disable" {
+			http.Redirect(c.Res, c.Req, path.Join(c.Node.Path, "@@two-factor"),
+				http.StatusSeeOther)
+			return nil
+		}
+	default:
+		return fmt.Errorf("Request method not supported: %v", c.Req.Method)
+	}
+	if user.TwoFactor == nil {
+		issuer := c.SiteSettings.StringValue("core.Title")
+		if issuer == "" {
+			issuer = c.Site
+		}
+		context["Secret"] = secret
+		context["URI"] = template.URL(totpURI(issuer, user.Login, secret))
+	} else {
+		context["RecoveryCodesLeft"] = len(user.TwoFactor.RecoveryCodes)
+	}
+	context["Enabled"] = user.TwoFactor != nil
+	body, err := c.Renderer.Render("actions/two_factor", context,
+		c.UserSession.Locale, h.Settings.Monsti.GetSiteTemplatesPath(c.Site))
+	if err != nil {
+		return fmt.Errorf("Can't render two-factor authentication: %v", err)
+	}
+	env := masterTmplEnv{Node: c.Node, Session: c.UserSession,
+		Flags: EDIT_VIEW, Title: G("Two-factor authentication")}
+	rendered, _ := renderInMaster(c.Renderer, []byte(body), env, h.Settings,
+		c.Site, c.SiteSettings, c.UserSession.Locale, c.Serv)
+	c.Res.Write(rendered)
+	return nil
+}
@@ -0,0 +1,390 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"pkg.monsti.org/gettext"
+	"pkg.monsti.org/monsti/api/service"
+	mtemplate "pkg.monsti.org/monsti/api/util/template"
+)
+
+// validLogin matches valid user logins.
+var validLogin = regexp.MustCompile(`^[-\w.@]+$`)
+
+type usersByLogin []*service.User
+
+func (u usersByLogin) Len() int {
+	return len(u)
+}
+
+func (u usersByLogin) Less(i, j int) bool {
+	return u[i].Login < u[j].Login
+}
+
+func (u usersByLogin) Swap(i, j int) {
+	u[i], u[j] = u[j], u[i]
+}
+
+// hideSecrets removes the password hash and the second factor's
+// secrets of the given user.
+func hideSecrets(user *service.User) {
+	user.Password = ""
+	if user.TwoFactor != nil {
+		user.TwoFactor = &service.TwoFactor{}
+	}
+}
+
+// listUsers returns the users of the given user database ordered by
+// login. Password hashes and second factors are omitted.
+func listUsers(users map[string]service.User) []*service.User {
+	list := make(usersByLogin, 0, len(users))
+	for login := range users {
+		user := users[login]
+		user.Login = login
+		hideSecrets(&user)
+		list = append(list, &user)
+	}
+	sort.Sort(list)
+	return list
+}
+
+// updateUser adds or updates the given user in the given user
+// database. If password is not empty, it gets hashed and set as new
+// password. Otherwise, the user keeps the current password. The
+// user's second factor is kept as well.
+func updateUser(users map[string]service.User, user service.User,
+	password string) error {
+	if !validLogin.MatchString(user.Login) {
+		return fmt.Errorf("Invalid login %q", user.Login)
+	}
+	existing := users[user.Login]
+	user.Password = existing.Password
+	user.PasswordChanged = existing.PasswordChanged
+	user.TwoFactor = existing.TwoFactor
+	if password != "" {
+		hashed, err := bcrypt.GenerateFromPassword([]byte(password), 0)
+		if err != nil {
+			return fmt.Errorf("Could not hash user password: %v", err)
+		}
+		user.Password = string(hashed)
+		user.PasswordChanged = time.Now().UTC()
+	}
+	users[user.Login] = user
+	return nil
+}
+
+func (i *MonstiService) GetUsers(site string, reply *[]*service.User) error {
+	i.siteMutexes[site].RLock()
+	defer i.siteMutexes[site].RUnlock()
+	users, err := getUserDatabase(i.Settings.Monsti.GetSiteDataPath(site))
+	if err != nil {
+		return err
+	}
+	*reply = listUsers(users)
+	return nil
+}
+
+type GetUserArgs struct {
+	Site, Login string
+}
+
+func (i *MonstiService) GetUser(args *GetUserArgs, reply *service.User) error {
+	i.siteMutexes[args.Site].RLock()
+	defer i.siteMutexes[args.Site].RUnlock()
+	user, err := getUser(args.Login,
+		i.Settings.Monsti.GetSiteDataPath(args.Site))
+	if err != nil {
+		return err
+	}
+	if user != nil {
+		*reply = *user
+		hideSecrets(reply)
+	}
+	return nil
+}
+
+type WriteUserArgs struct {
+	Site     string
+	User     service.User
+	Password string
+}
+
+func (i *MonstiService) WriteUser(args *WriteUserArgs, reply *int) error {
+	i.siteMutexes[args.Site].Lock()
+	defer i.siteMutexes[args.Site].Unlock()
+	dataDir := i.Settings.Monsti.GetSiteDataPath(args.Site)
+	users, err := getUserDatabase(dataDir)
+	if err != nil {
+		return err
+	}
+	if err := updateUser(users, args.User, args.Password); err != nil {
+		return err
+	}
+	return writeUserDatabase(users, dataDir)
+}
+
+type RemoveUserArgs struct {
+	Site, Login string
+}
+
+func (i *MonstiService) RemoveUser(args *RemoveUserArgs, reply *int) error {
+	i.siteMutexes[args.Site].Lock()
+	defer i.siteMutexes[args.Site].Unlock()
+	dataDir := i.Settings.Monsti.GetSiteDataPath(args.Site)
+	users, err := getUserDatabase(dataDir)
+	if err != nil {
+		return err
+	}
+	if _, ok := users[args.Login]; !ok {
+		return fmt.Errorf("Unknown user %q", args.Login)
+	}
+	delete(users, args.Login)
+	return writeUserDatabase(users, dataDir)
+}
+
+// setTwoFactor replaces the second factor of the existing user with
+// the given login.
+func setTwoFactor(users map[string]service.User, login string,
+	factor *service.TwoFactor) error {
+	user, ok := users[login]
+	if !ok {
+		return fmt.Errorf("Unknown user %q", login)
+	}
+	user.TwoFactor = factor
+	users[login] = user
+	return nil
+}
+
+type WriteUserTwoFactorArgs struct {
+	Site, Login string
+	TwoFactor   *service.TwoFactor
+}
+
+func (i *MonstiService) WriteUserTwoFactor(args *WriteUserTwoFactorArgs,
+	reply *int) error {
+	i.siteMutexes[args.Site].Lock()
+	defer i.siteMutexes[args.Site].Unlock()
+	dataDir := i.Settings.Monsti.GetSiteDataPath(args.Site)
+	users, err := getUserDatabase(dataDir)
+	if err != nil {
+		return err
+	}
+	if err := setTwoFactor(users, args.Login, args.TwoFactor); err != nil {
+		return err
+	}
+	return writeUserDatabase(users, dataDir)
+}
+
+// assignableRoles returns the roles which may be assigned to users:
+// the permission roles and the roles of the workflow transitions.
+func (h *nodeHandler) assignableRoles() []string {
+	roles := append([]string{}, userRoles...)
+	if h.Settings.Workflow.Enabled {
+		for _, transition := range h.Settings.Workflow.transitions() {
+			for _, role := range transition.Roles {
+				if !hasRole(roles, role) {
+					roles = append(roles, role)
+				}
+			}
+		}
+	}
+	return roles
+}
+
+// checkUser returns why the given user of the users form may not be
+// saved by the user with the given login, or an empty string if it may
+// be saved.
+func checkUser(G func(string) string, user *service.User,
+	self string) string {
+	if !strings.Contains(user.Email, "@") {
+		return G("Please enter a valid email address.")
+	}
+	// Users without any of these roles may not do anything.
+	if !user.HasRole(userRoles...) {
+		return G("Please choose at least one of the roles viewer, author, editor, and admin.")
+	}
+	if user.Login == self && (user.Disabled || !user.HasRole("admin")) {
+		return G("You can't disable yourself or revoke your own admin role.")
+	}
+	return ""
+}
+
+// userRoleOption is a role checkbox of the user form.
+type userRoleOption struct {
+	Role    string
+	Checked bool
+}
+
+// Users lists the users of the site and allows to add, edit, disable,
+// and remove them, and to send them password change mails.
+func (h *nodeHandler) Users(c *reqContext) error {
+	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	m := c.Serv.Monsti()
+	context := mtemplate.Context{"Node": c.Node, "Locales": h.AdminLocales}
+	// The user of the form, if any.
+	var user *service.User
+	newUser := false
+	if _, ok := c.Req.Form["new"]; ok {
+		user = &service.User{Roles: []string{"viewer"}}
+		newUser = true
+	} else if login := c.Req.FormValue("edit"); login != "" {
+		var err error
+		user, err = m.GetUser(c.Site, login)
+		if err != nil {
+			return fmt.Errorf("Could not get user: %v", err)
+		}
+		if user == nil {
+			http.Error(c.Res, "User not found", http.StatusNotFound)
+			return nil
+		}
+	}
+	switch c.Req.Method {
+	case "GET":
+		if _, ok := c.Req.Form["sent"]; ok {
+			context["Message"] = G("The password change mail has been sent.")
+		}
+	case "POST":
+		login := strings.TrimSpace(c.Req.FormValue("Login"))
+		self := c.UserSession.User.Login
+		switch c.Req.FormValue("Do") {
+		case "save":
+			if user == nil {
+				context["Error"] = G("Unknown action.")
+				break
+			}
+			if newUser {
+				user.Login = login
+				if !validLogin.MatchString(login) {
+					context["Error"] = G("Please enter a login consisting only of the characters A-Z, a-z, 0-9, '.', '@', and '-'.")
+					break
+				}
+				existing, err := m.GetUser(c.Site, login)
+				if err != nil {
+					return fmt.Errorf("Could not get user: %v", err)
+				}
+				if existing != nil {
+					context["Error"] = G("A user with this login does already exist.")
+					break
+				}
+			}
+			user.Name = strings.TrimSpace(c.Req.FormValue("Name"))
+			user.Email = strings.TrimSpace(c.Req.FormValue("Email"))
+			user.Locale = c.Req.FormValue("Locale")
+			user.Roles = c.Req.Form["Roles"]
+			user.Disabled = c.Req.FormValue("Disabled") != ""
+			password := c.Req.FormValue("Password")
+			if msg := checkUser(G, user, self); msg != "" {
+				context["Error"] = msg
+				break
+			}
+			if err := m.WriteUser(c.Site, user, password); err != nil {
+				return fmt.Errorf("Could not write user: %v", err)
+			}
+			// New users without password choose one themselves.
+			if newUser && password == "" {
+				if err := h.sendPasswordTokenMail(c, user); err != nil {
+					return err
+				}
+			}
+		case "reset":
+			target, err := m.GetUser(c.Site, login)
+			if err != nil {
+				return fmt.Errorf("Could not get user: %v", err)
+			}
+			if target == nil || target.Disabled {
+				context["Error"] = G("Unknown user.")
+				break
+			}
+			if err := h.sendPasswordTokenMail(c, target); err != nil {
+				return err
+			}
+			http.Redirect(c.Res, c.Req, "@@users?sent", http.StatusSeeOther)
+			return nil
+		case "reset-two-factor":
+			dataDir := h.Settings.Monsti.GetSiteDataPath(c.Site)
+			target, err := getUser(login, dataDir)
+			if err != nil {
+				return fmt.Errorf("Could not get user: %v", err)
+			}
+			if target == nil || target.TwoFactor == nil {
+				context["Error"] = G("Unknown user.")
+				break
+			}
+			err = c.Serv.Monsti().WriteUserTwoFactor(c.Site, login, nil)
+			if err != nil {
+				return fmt.Errorf("Could not reset second factor: %v", err)
+			}
+		case "remove":
+			if login == self {
+				context["Error"] = G("You can't remove yourself.")
+				break
+			}
+			if err := m.RemoveUser(c.Site, login); err != nil {
+				return fmt.Errorf("Could not remove user: %v", err)
+			}
+		default:
+			context["Error"] = G("Unknown action.")
+		}
+		if context["Error"] != nil {
+			break
+		}
+		http.Redirect(c.Res, c.Req, "@@users", http.StatusSeeOther)
+		return nil
+	default:
+		return fmt.Errorf("Request method not supported: %v", c.Req.Method)
+	}
+	if user != nil {
+		var roles []userRoleOption
+		for _, role := range h.assignableRoles() {
+			roles = append(roles, userRoleOption{role, user.HasRole(role)})
+		}
+		for _, role := range user.Roles {
+			if !hasRole(h.assignableRoles(), role) {
+				roles = append(roles, userRoleOption{role, true})
+			}
+		}
+		context["User"] = user
+		context["NewUser"] = newUser
+		context["Roles"] = roles
+	} else {
+		users, err := m.GetUsers(c.Site)
+		if err != nil {
+			return fmt.Errorf("Could not get users: %v", err)
+		}
+		context["Users"] = users
+		context["Self"] = c.UserSession.User.Login
+	}
+	body, err := c.Renderer.Render("actions/users", context,
+		c.UserSession.Locale, h.Settings.Monsti.GetSiteTemplatesPath(c.Site))
+	if err != nil {
+		return fmt.Errorf("Can't render users: %v", err)
+	}
+	env := masterTmplEnv{Node: c.Node, Session: c.UserSession,
+		Flags: EDIT_VIEW, Title: G("Users")}
+	rendered, _ := renderInMaster(c.Renderer, []byte(body), env, h.Settings,
+		c.Site, c.SiteSettings, c.UserSession.Locale, c.Serv)
+	c.Res.Write(rendered)
+	return nil
+}
@@ -0,0 +1,140 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"pkg.monsti.org/monsti/api/service"
+)
+
+func TestListUsers(t *testing.T) {
+	users := map[string]service.User{
+		"bob": {Name: "Bob", Password: "hash",
+			TwoFactor: &service.TwoFactor{TOTPSecret: "secret"}},
+		"alice": {Name: "Alice", Password: "hash"},
+	}
+	list := listUsers(users)
+	if len(list) != 2 || list[0].Login != "alice" || list[1].Login != "bob" {
+		t.Fatalf("listUsers(...) = %v, should list alice and bob", list)
+	}
+	for _, user := range list {
+		if user.Password != "" {
+			t.Errorf("listUsers(...) should omit the password hash of %v",
+				user.Login)
+		}
+	}
+	if list[0].TwoFactor != nil || list[1].TwoFactor == nil ||
+		list[1].TwoFactor.TOTPSecret != "" {
+		t.Errorf("listUsers(...) should only tell if bob has a second factor")
+	}
+	if users["bob"].Password != "hash" ||
+		users["bob"].TwoFactor.TOTPSecret != "secret" {
+		t.Errorf("listUsers altered the user database")
+	}
+}
+
+func TestUpdateUser(t *testing.T) {
+	changed := time.Unix(1, 0).UTC()
+	users := map[string]service.User{
+		"bob": {Name: "Bob", Password: "hash", PasswordChanged: changed,
+			TwoFactor: &service.TwoFactor{TOTPSecret: "secret"}},
+	}
+	err := updateUser(users, service.User{Login: "bob", Name: "Robert",
+		Roles: []string{"editor"}}, "")
+	if err != nil {
+		t.Fatalf("updateUser returns error: %v", err)
+	}
+	bob := users["bob"]
+	if bob.Name != "Robert" || !bob.HasRole("editor") ||
+		bob.Password != "hash" || !bob.PasswordChanged.Equal(changed) ||
+		bob.TwoFactor == nil || bob.TwoFactor.TOTPSecret != "secret" {
+		t.Errorf("updateUser should update bob keeping the password and second factor, got %v", bob)
+	}
+	err = updateUser(users, service.User{Login: "alice"}, "secret")
+	if err != nil {
+		t.Fatalf("updateUser returns error: %v", err)
+	}
+	alice := users["alice"]
+	if !passwordEqual(alice.Password, "secret") ||
+		alice.PasswordChanged.IsZero() {
+		t.Errorf("updateUser should set the password of alice, got %v", alice)
+	}
+	if err := updateUser(users, service.User{Login: "a/b"}, ""); err == nil {
+		t.Errorf("updateUser should refuse invalid logins")
+	}
+	if err := updateUser(users, service.User{}, ""); err == nil {
+		t.Errorf("updateUser should refuse empty logins")
+	}
+}
+
+func TestSetTwoFactor(t *testing.T) {
+	users := map[string]service.User{
+		"bob": {Name: "Bob", Password: "hash"},
+	}
+	factor := &service.TwoFactor{TOTPSecret: "secret"}
+	if err := setTwoFactor(users, "bob", factor); err != nil {
+		t.Fatalf("setTwoFactor returns error: %v", err)
+	}
+	bob := users["bob"]
+	if bob.Name != "Bob" || bob.Password != "hash" || bob.TwoFactor != factor {
+		t.Errorf("setTwoFactor should only set the second factor of bob, got %v", bob)
+	}
+	if err := setTwoFactor(users, "bob", nil); err != nil {
+		t.Fatalf("setTwoFactor returns error: %v", err)
+	}
+	if users["bob"].TwoFactor != nil {
+		t.Errorf("setTwoFactor should remove the second factor of bob")
+	}
+	if err := setTwoFactor(users, "alice", factor); err == nil {
+		t.Errorf("setTwoFactor should refuse unknown users")
+	}
+	if _, ok := users["alice"]; ok {
+		t.Errorf("setTwoFactor should not add unknown users")
+	}
+}
+
+func TestCheckUser(t *testing.T) {
+	G := func(msg string) string { return msg }
+	tests := []struct {
+		User  service.User
+		Valid bool
+	}{
+		{service.User{Login: "bob", Email: "bob@example.com",
+			Roles: []string{"viewer"}}, true},
+		{service.User{Login: "bob", Email: "bob@example.com",
+			Roles: []string{"reviewer", "author"}}, true},
+		{service.User{Login: "bob", Email: "bob"}, false},
+		{service.User{Login: "bob", Email: "bob@example.com"}, false},
+		{service.User{Login: "bob", Email: "bob@example.com",
+			Roles: []string{"reviewer"}}, false},
+		{service.User{Login: "alice", Email: "alice@example.com",
+			Roles: []string{"admin"}}, true},
+		{service.User{Login: "alice", Email: "alice@example.com",
+			Roles: []string{"editor"}}, false},
+		{service.User{Login: "alice", Email: "alice@example.com",
+			Roles: []string{"admin"}, Disabled: true}, false},
+	}
+	for i, test := range tests {
+		msg := checkUser(G, &test.User, "alice")
+		if (msg == "") != test.Valid {
+			t.Errorf("Test %v: checkUser(%v) = %q, should be valid: %v", i,
+				test.User, msg, test.Valid)
+		}
+	}
+}
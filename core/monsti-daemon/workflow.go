@@ -0,0 +1,318 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+
+	"github.com/chrneumann/htmlwidgets"
+	gomail "gopkg.in/gomail.v1"
+	"pkg.monsti.org/gettext"
+	"pkg.monsti.org/monsti/api/service"
+	mtemplate "pkg.monsti.org/monsti/api/util/template"
+)
+
+// Workflow states of drafts.
+const (
+	stateDraft     = "draft"
+	stateReview    = "review"
+	stateApproved  = "approved"
+	statePublished = "published"
+)
+
+// workflowTransition is a transition between two workflow states.
+type workflowTransition struct {
+	From, To string
+	// Roles lists the roles allowed to perform the transition.
+	Roles []string
+	// OtherUser requires the transition to be performed by another user
+	// than the last editor of the draft.
+	OtherUser bool
+}
+
+// defaultWorkflowTransitions are used if the workflow is enabled but
+// no transitions have been configured.
+var defaultWorkflowTransitions = []workflowTransition{
+	{From: stateDraft, To: stateReview, Roles: []string{"editor", "reviewer"}},
+	{From: stateReview, To: stateDraft, Roles: []string{"reviewer"}},
+	{From: stateReview, To: stateApproved, Roles: []string{"reviewer"},
+		OtherUser: true},
+	{From: stateApproved, To: statePublished,
+		Roles: []string{"editor", "reviewer"}},
+}
+
+// workflowSettings configure the editorial workflow.
+type workflowSettings struct {
+	// Enabled activates the workflow. If the workflow is disabled, any
+	// authenticated user may publish drafts.
+	Enabled bool
+	// Transitions lists the allowed transitions. Defaults to
+	// defaultWorkflowTransitions.
+	Transitions []workflowTransition
+}
+
+// transitions returns the configured or default transitions.
+func (w *workflowSettings) transitions() []workflowTransition {
+	if len(w.Transitions) == 0 {
+		return defaultWorkflowTransitions
+	}
+	return w.Transitions
+}
+
+// unpublishNodes hides the given node and its descendants from the
+// public. Nodes which are added by copying or restoring them from the
+// trash have to pass the workflow before they get public again.
+func unpublishNodes(nodes storage, nodePath string) error {
+	entries, err := nodes.ReadDir(nodePath)
+	if err != nil {
+		return fmt.Errorf("Could not read node directory: %v", err)
+	}
+	for _, entry := range entries {
+		entryPath := path.Join(nodePath, entry.Name)
+		if entry.IsDir {
+			if err := unpublishNodes(nodes, entryPath); err != nil {
+				return err
+			}
+			continue
+		}
+		if entry.Name != "node.json" {
+			continue
+		}
+		content, err := nodes.ReadFile(entryPath)
+		if err != nil {
+			return fmt.Errorf("Could not read node: %v", err)
+		}
+		var node map[string]*json.RawMessage
+		if err := json.Unmarshal(content, &node); err != nil {
+			return fmt.Errorf("Could not unmarshal node %v: %v", entryPath, err)
+		}
+		public := json.RawMessage("false")
+		node["Public"] = &public
+		content, err = json.MarshalIndent(node, "", "  ")
+		if err != nil {
+			return fmt.Errorf("Could not marshal node: %v", err)
+		}
+		if err := nodes.WriteFile(entryPath, content); err != nil {
+			return fmt.Errorf("Could not write node: %v", err)
+		}
+	}
+	return nil
+}
+
+// draftState returns the workflow state of the given draft.
+func draftState(draft *service.Node) string {
+	if draft.WorkflowState == "" {
+		return stateDraft
+	}
+	return draft.WorkflowState
+}
+
+// allowedTransitions returns the transitions the given user may
+// perform on the given draft.
+func (w *workflowSettings) allowedTransitions(user *service.User,
+	draft *service.Node) []workflowTransition {
+	var allowed []workflowTransition
+	state := draftState(draft)
+	for _, transition := range w.transitions() {
+		if transition.From != state || !user.HasRole(transition.Roles...) {
+			continue
+		}
+		if transition.OtherUser && draft.ChangedBy == user.Login {
+			continue
+		}
+		allowed = append(allowed, transition)
+	}
+	return allowed
+}
+
+// mayPublish returns true if the given user may publish the given
+// draft.
+func (w *workflowSettings) mayPublish(user *service.User,
+	draft *service.Node) bool {
+	if !w.Enabled {
+		return true
+	}
+	for _, transition := range w.allowedTransitions(user, draft) {
+		if transition.To == statePublished {
+			return true
+		}
+	}
+	return false
+}
+
+// recipients returns the users which may perform any transition from
+// the given state, except the user with the given login.
+func (w *workflowSettings) recipients(users map[string]service.User,
+	state, except string) []service.User {
+	var logins []string
+	for login, user := range users {
+		if login == except {
+			continue
+		}
+		for _, transition := range w.transitions() {
+			if transition.From == state && user.HasRole(transition.Roles...) {
+				logins = append(logins, login)
+				break
+			}
+		}
+	}
+	sort.Strings(logins)
+	recipients := make([]service.User, 0, len(logins))
+	for _, login := range logins {
+		user := users[login]
+		user.Login = login
+		recipients = append(recipients, user)
+	}
+	return recipients
+}
+
+// notifyWorkflowChange sends an email to all users which may act on
+// the new state of the given draft.
+func (h *nodeHandler) notifyWorkflowChange(c *reqContext,
+	draft *service.Node) error {
+	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	users, err := getUserDatabase(h.Settings.Monsti.GetSiteDataPath(c.Site))
+	if err != nil {
+		return fmt.Errorf("Could not get user database: %v", err)
+	}
+	recipients := h.Settings.Workflow.recipients(users, draftState(draft),
+		c.UserSession.User.Login)
+	if len(recipients) == 0 {
+		return nil
+	}
+	body, err := c.Renderer.Render("mails/workflow", mtemplate.Context{
+		"SiteSettings": c.SiteSettings,
+		"User":         c.UserSession.User,
+		"State":        draftState(draft),
+		"Link": c.SiteSettings.StringValue("core.BaseURL") +
+			path.Join(draft.Path, "@@workflow"),
+	}, c.UserSession.Locale, h.Settings.Monsti.GetSiteTemplatesPath(c.Site))
+	if err != nil {
+		return fmt.Errorf("Can't render workflow mail: %v", err)
+	}
+	mailer := gomail.NewCustomMailer("", nil, gomail.SetSendMail(
+		c.Serv.Monsti().SendMailFunc()))
+	for _, user := range recipients {
+		if user.Email == "" {
+			continue
+		}
+		mail := gomail.NewMessage()
+		mail.SetAddressHeader("From",
+			c.SiteSettings.StringValue("core.EmailAddress"),
+			c.SiteSettings.StringValue("core.EmailName"))
+		mail.SetAddressHeader("To", user.Email, user.Login)
+		mail.SetHeader("Subject", G("Workflow state changed"))
+		mail.SetBody("text/plain", string(body))
+		if err := mailer.Send(mail); err != nil {
+			return fmt.Errorf("Could not send mail: %v", err)
+		}
+	}
+	return nil
+}
+
+type workflowFormData struct {
+	Confirm string
+}
+
+// Workflow shows the workflow state of a node's draft and performs
+// state transitions.
+func (h *nodeHandler) Workflow(c *reqContext) error {
+	G, _, _, _ := gettext.DefaultLocales.Use("", c.UserSession.Locale)
+	m := c.Serv.Monsti()
+	draft, err := m.GetNodeDraft(c.Site, c.Node.Path)
+	if err != nil {
+		return fmt.Errorf("Could not get draft: %v", err)
+	}
+	data := workflowFormData{}
+	form := htmlwidgets.NewForm(&data)
+	form.AddWidget(new(htmlwidgets.HiddenWidget), "Confirm", "", "")
+	var allowed []workflowTransition
+	if draft != nil {
+		draft.Path = c.Node.Path
+		allowed = h.Settings.Workflow.allowedTransitions(c.UserSession.User,
+			draft)
+	}
+	switch c.Req.Method {
+	case "GET":
+		data.Confirm = "ok"
+	case "POST":
+		if !form.Fill(c.Req.Form) || data.Confirm != "ok" || draft == nil ||
+			!h.Settings.Workflow.Enabled {
+			break
+		}
+		to := c.Req.Form.Get("To")
+		found := false
+		for _, transition := range allowed {
+			if transition.To == to {
+				found = true
+			}
+		}
+		if !found {
+			form.AddError("", G("You are not allowed to perform this transition."))
+			break
+		}
+		draft.WorkflowState = to
+		if err := m.WriteNodeDraft(c.Site, draft.Path, draft); err != nil {
+			return fmt.Errorf("Could not write draft: %v", err)
+		}
+		nodePath := c.Node.Path
+		if to == statePublished {
+			err := m.PublishNodeDraftAs(c.Site, draft.Path,
+				c.UserSession.User.Login)
+			if err != nil {
+				return fmt.Errorf("Could not publish draft: %v", err)
+			}
+			nodePath = publishedPath(draft.Path, draft)
+			err = m.MarkDep(c.Site, service.CacheDep{Node: nodePath})
+			if err != nil {
+				return fmt.Errorf("Could not mark node: %v", err)
+			}
+		}
+		if err := h.notifyWorkflowChange(c, draft); err != nil {
+			return fmt.Errorf("Could not notify users: %v", err)
+		}
+		http.Redirect(c.Res, c.Req, path.Join(nodePath, "@@workflow"),
+			http.StatusSeeOther)
+		return nil
+	default:
+		return fmt.Errorf("Request method not supported: %v", c.Req.Method)
+	}
+	context := mtemplate.Context{
+		"Node":        c.Node,
+		"Draft":       draft,
+		"Enabled":     h.Settings.Workflow.Enabled,
+		"Transitions": allowed,
+		"Form":        form.RenderData()}
+	if draft != nil {
+		context["State"] = draftState(draft)
+	}
+	body, err := c.Renderer.Render("actions/workflow", context,
+		c.UserSession.Locale, h.Settings.Monsti.GetSiteTemplatesPath(c.Site))
+	if err != nil {
+		return fmt.Errorf("Can't render workflow: %v", err)
+	}
+	env := masterTmplEnv{Node: c.Node, Session: c.UserSession,
+		Flags: EDIT_VIEW, Title: G("Workflow")}
+	rendered, _ := renderInMaster(c.Renderer, []byte(body), env, h.Settings,
+		c.Site, c.SiteSettings, c.UserSession.Locale, c.Serv)
+	c.Res.Write(rendered)
+	return nil
+}
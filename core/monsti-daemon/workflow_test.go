@@ -0,0 +1,127 @@
+// This file is part of Monsti, a web content management system.
+// Copyright 2012-2015 Christian Neumann
+//
+// Monsti is free software: you can redistribute it and/or modify it under the
+// terms of the GNU Affero General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// Monsti is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE.  See the GNU Affero General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with Monsti.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"pkg.monsti.org/monsti/api/service"
+	utesting "pkg.monsti.org/monsti/api/util/testing"
+)
+
+func TestWorkflowTransitions(t *testing.T) {
+	workflow := workflowSettings{Enabled: true}
+	editor := &service.User{Login: "editor", Roles: []string{"editor"}}
+	reviewer := &service.User{Login: "reviewer", Roles: []string{"reviewer"}}
+	guest := &service.User{Login: "guest"}
+	tests := []struct {
+		User    *service.User
+		State   string
+		Author  string
+		Allowed []string
+		Publish bool
+	}{
+		{editor, "", "editor", []string{stateReview}, false},
+		{guest, stateDraft, "editor", nil, false},
+		{editor, stateReview, "editor", nil, false},
+		{reviewer, stateReview, "editor", []string{stateDraft, stateApproved},
+			false},
+		{reviewer, stateReview, "reviewer", []string{stateDraft}, false},
+		{editor, stateApproved, "reviewer", []string{statePublished}, true},
+	}
+	for i, test := range tests {
+		draft := &service.Node{WorkflowState: test.State,
+			ChangedBy: test.Author}
+		var allowed []string
+		for _, transition := range workflow.allowedTransitions(test.User, draft) {
+			allowed = append(allowed, transition.To)
+		}
+		if len(allowed) != len(test.Allowed) {
+			t.Errorf("%v: allowedTransitions returned %v, should be %v", i,
+				allowed, test.Allowed)
+			continue
+		}
+		for j := range allowed {
+			if allowed[j] != test.Allowed[j] {
+				t.Errorf("%v: allowedTransitions returned %v, should be %v", i,
+					allowed, test.Allowed)
+			}
+		}
+		if publish := workflow.mayPublish(test.User, draft); publish != test.Publish {
+			t.Errorf("%v: mayPublish returned %v, should be %v", i, publish,
+				test.Publish)
+		}
+	}
+	workflow.Enabled = false
+	if !workflow.mayPublish(guest, &service.Node{}) {
+		t.Errorf("mayPublish should return true if the workflow is disabled")
+	}
+}
+
+func TestWorkflowRecipients(t *testing.T) {
+	workflow := workflowSettings{Enabled: true}
+	users := map[string]service.User{
+		"a": {Roles: []string{"reviewer"}},
+		"b": {Roles: []string{"editor"}},
+		"c": {Roles: []string{"reviewer", "editor"}},
+		"d": {}}
+	recipients := workflow.recipients(users, stateReview, "c")
+	if len(recipients) != 1 || recipients[0].Login != "a" {
+		t.Errorf("recipients returned %v, should only contain user a",
+			recipients)
+	}
+}
+
+func TestUnpublishNodes(t *testing.T) {
+	root, cleanup, err := utesting.CreateDirectoryTree(map[string]string{
+		"/foo/node.json":            `{"Type":"core.Document","Public":true}`,
+		"/foo/__file_body":          "body",
+		"/foo/child/node.json":      `{"Type":"core.Document","Public":true}`,
+		"/foo/child/deep/node.json": `{"Type":"core.Document"}`,
+		"/other/node.json":          `{"Type":"core.Document","Public":true}`,
+	}, "TestUnpublishNodes")
+	if err != nil {
+		t.Fatalf("Could not create directory tree: %v", err)
+	}
+	defer cleanup()
+	nodes := newFSStorage(root)
+	if err := unpublishNodes(nodes, "/foo"); err != nil {
+		t.Fatalf("unpublishNodes failed: %v", err)
+	}
+	for dir, public := range map[string]bool{"/foo": false,
+		"/foo/child": false, "/foo/child/deep": false, "/other": true} {
+		content, err := nodes.ReadFile(dir + "/node.json")
+		if err != nil {
+			t.Fatalf("Could not read %v: %v", dir, err)
+		}
+		var node struct {
+			Type   string
+			Public bool
+		}
+		if err := json.Unmarshal(content, &node); err != nil {
+			t.Fatalf("Could not unmarshal %v: %v", dir, err)
+		}
+		if node.Public != public || node.Type == "" {
+			t.Errorf("%v should have public %v, got %v", dir, public, node)
+		}
+	}
+	body, err := nodes.ReadFile("/foo/__file_body")
+	if err != nil || string(body) != "body" {
+		t.Errorf("unpublishNodes should keep data files, got %q, %v", body, err)
+	}
+}
@@ -0,0 +1,458 @@
+// Tool to check a site's data directory for problems.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util/settings"
+)
+
+// problem is a problem found in the data directory.
+type problem struct {
+	// File is the path of the affected file relative to the data
+	// directory.
+	File    string
+	Message string
+	// Fixed is true if the problem has been repaired.
+	Fixed bool
+}
+
+func (p problem) String() string {
+	ret := fmt.Sprintf("%v: %v", p.File, p.Message)
+	if p.Fixed {
+		ret += " (fixed)"
+	}
+	return ret
+}
+
+// checker checks the data directory of a site.
+type checker struct {
+	// DataDir is the site's data directory.
+	DataDir string
+	// NodeTypes holds all known node types.
+	NodeTypes map[string]*service.NodeType
+	// Monsti and Site are passed to service.DecodeNode. Monsti may be
+	// nil.
+	Monsti *service.MonstiClient
+	Site   string
+	// Fix enables repairs of problems which can be fixed safely.
+	Fix bool
+	// Now is used to name the quarantine directory.
+	Now      time.Time
+	Problems []problem
+}
+
+func (c *checker) report(file string, fixed bool, format string,
+	args ...interface{}) {
+	c.Problems = append(c.Problems, problem{filepath.ToSlash(file),
+		fmt.Sprintf(format, args...), fixed})
+}
+
+// quarantine moves the given file to the quarantine directory keeping
+// its path.
+func (c *checker) quarantine(file string) error {
+	target := filepath.Join(c.DataDir, "quarantine",
+		strconv.FormatInt(c.Now.UnixNano(), 10), file)
+	if err := os.MkdirAll(filepath.Dir(target), 0770); err != nil {
+		return err
+	}
+	return os.Rename(filepath.Join(c.DataDir, file), target)
+}
+
+// Check runs all checks.
+func (c *checker) Check() error {
+	if err := c.checkNodes(); err != nil {
+		return fmt.Errorf("Could not check nodes: %v", err)
+	}
+	if err := c.checkCache(); err != nil {
+		return fmt.Errorf("Could not check cache: %v", err)
+	}
+	if err := c.checkUsers(); err != nil {
+		return fmt.Errorf("Could not check users: %v", err)
+	}
+	return nil
+}
+
+// nodeFiles returns the slash separated paths of all files and
+// directories below the nodes directory relative to the data
+// directory.
+func (c *checker) nodeFiles() (dirs, files []string, err error) {
+	root := filepath.Join(c.DataDir, "nodes")
+	if _, err := os.Stat(root); os.IsNotExist(err) {
+		return nil, nil, nil
+	}
+	err = filepath.Walk(root, func(file string, info os.FileInfo,
+		err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(c.DataDir, file)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if info.IsDir() {
+			dirs = append(dirs, rel)
+		} else {
+			files = append(files, rel)
+		}
+		return nil
+	})
+	return
+}
+
+// checkNodes checks the node files, references between nodes, and the
+// node data files.
+func (c *checker) checkNodes() error {
+	dirs, files, err := c.nodeFiles()
+	if err != nil {
+		return err
+	}
+
+	// Collect existing nodes to check references.
+	paths := make(map[string]bool)
+	ids := make(map[string]bool)
+	for _, file := range files {
+		if path.Base(file) != "node.json" {
+			continue
+		}
+		paths[path.Clean("/"+strings.TrimPrefix(path.Dir(file), "nodes"))] = true
+		var node struct{ Id string }
+		content, err := ioutil.ReadFile(filepath.Join(c.DataDir, file))
+		if err == nil && json.Unmarshal(content, &node) == nil && node.Id != "" {
+			ids[node.Id] = true
+		}
+	}
+
+	for _, dir := range dirs {
+		nodeType := c.checkNodeFile(path.Join(dir, "node.json"), paths, ids)
+		draftType := c.checkNodeFile(path.Join(dir, "node.draft.json"), paths,
+			ids)
+		entries, err := ioutil.ReadDir(filepath.Join(c.DataDir, dir))
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			switch {
+			case entry.IsDir():
+			case strings.HasPrefix(name, "__file_"):
+				c.checkDataFile(path.Join(dir, name), nodeType, "node.json")
+			case strings.HasPrefix(name, "draft.__file_"):
+				c.checkDataFile(path.Join(dir, name), draftType, "node.draft.json")
+			}
+		}
+	}
+	return nil
+}
+
+// checkNodeFile checks the given node file.
+//
+// Returns the node's type if the node could be decoded, nil otherwise.
+func (c *checker) checkNodeFile(file string, paths, ids map[string]bool) *service.NodeType {
+	content, err := ioutil.ReadFile(filepath.Join(c.DataDir, file))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		c.report(file, false, "could not read node: %v", err)
+		return nil
+	}
+	var raw struct{ Type string }
+	if err := json.Unmarshal(content, &raw); err != nil {
+		c.report(file, false, "could not parse node: %v", err)
+		return nil
+	}
+	nodeType, ok := c.NodeTypes[raw.Type]
+	if !ok {
+		c.report(file, false, "unknown node type %q", raw.Type)
+		return nil
+	}
+	getNodeType := func(string) (*service.NodeType, error) {
+		return nodeType, nil
+	}
+	node, err := service.DecodeNode(content, getNodeType, c.Monsti, c.Site)
+	if err != nil {
+		c.report(file, false, "could not decode node: %v", err)
+		return nil
+	}
+	for _, config := range nodeType.Fields {
+		for _, ref := range fieldRefs(node.Fields[config.Id]) {
+			if !refExists(ref, paths, ids) {
+				c.report(file, false, "field %v references missing node %q",
+					config.Id, ref)
+			}
+		}
+	}
+	return nodeType
+}
+
+// fieldRefs returns the non empty references of the given field
+// including the ones of nested fields.
+func fieldRefs(field service.Field) []string {
+	var refs []string
+	switch f := field.(type) {
+	case *service.RefField:
+		if *f != "" {
+			refs = append(refs, string(*f))
+		}
+	case *service.ListField:
+		for _, element := range f.Fields {
+			refs = append(refs, fieldRefs(element)...)
+		}
+	case *service.MapField:
+		for _, element := range f.Fields {
+			refs = append(refs, fieldRefs(element)...)
+		}
+	case *service.CombinedField:
+		for _, element := range f.Fields {
+			refs = append(refs, fieldRefs(element)...)
+		}
+	}
+	sort.Strings(refs)
+	return refs
+}
+
+// refExists checks if the given reference (see service.RefField)
+// points to an existing node.
+func refExists(ref string, paths, ids map[string]bool) bool {
+	uri, err := url.Parse(ref)
+	if err != nil {
+		return false
+	}
+	if id, ok := service.ParseNodeURI(uri); ok {
+		return ids[id]
+	}
+	return paths[path.Clean("/"+uri.Path)]
+}
+
+// checkDataFile checks if the given data file belongs to a field of
+// the node stored in nodeFile, which is of the given type.
+//
+// If the node file is missing or has no such field, the data file is
+// moved to the quarantine in fix mode.
+func (c *checker) checkDataFile(file string, nodeType *service.NodeType,
+	nodeFile string) {
+	field := strings.TrimPrefix(strings.TrimPrefix(path.Base(file), "draft."),
+		"__file_")
+	var message string
+	if _, err := os.Stat(filepath.Join(c.DataDir, path.Dir(file),
+		nodeFile)); os.IsNotExist(err) {
+		message = fmt.Sprintf("orphaned data file, missing %v", nodeFile)
+	} else if nodeType == nil {
+		// The node could not be decoded, which has been reported already.
+		return
+	} else {
+		for _, config := range nodeType.Fields {
+			if config.Id == field {
+				return
+			}
+		}
+		message = fmt.Sprintf("orphaned data file, node type %v has no field %v",
+			nodeType.Id, field)
+	}
+	fixed := false
+	if c.Fix {
+		if err := c.quarantine(file); err != nil {
+			message += fmt.Sprintf(", could not quarantine: %v", err)
+		} else {
+			fixed = true
+		}
+	}
+	c.report(file, fixed, "%v", message)
+}
+
+// cacheDepPair is an entry of a .rdeps.json file listing the caches
+// depending on Dep.
+type cacheDepPair struct {
+	Dep   service.CacheDep
+	RDeps []service.CacheDep
+}
+
+// checkCache checks the reverse cache dependencies.
+//
+// In fix mode, entries pointing to missing caches are removed. If any
+// dependency file can't be parsed, the whole cache gets cleared.
+func (c *checker) checkCache() error {
+	root := filepath.Join(c.DataDir, "cache")
+	if _, err := os.Stat(root); os.IsNotExist(err) {
+		return nil
+	}
+	var corrupt bool
+	err := filepath.Walk(root, func(file string, info os.FileInfo,
+		err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || info.Name() != ".rdeps.json" {
+			return nil
+		}
+		rel, err := filepath.Rel(c.DataDir, file)
+		if err != nil {
+			return err
+		}
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		var depMap []cacheDepPair
+		if err := json.Unmarshal(content, &depMap); err != nil {
+			corrupt = true
+			c.report(rel, c.Fix, "could not parse cache dependencies: %v", err)
+			return nil
+		}
+		var stale int
+		var newDepMap []cacheDepPair
+		for _, pair := range depMap {
+			var rdeps []service.CacheDep
+			for _, rdep := range pair.RDeps {
+				cached := filepath.Join(root, filepath.FromSlash(
+					path.Clean("/"+rdep.Node)), ".data", path.Base(rdep.Cache))
+				if _, err := os.Stat(cached); os.IsNotExist(err) {
+					stale++
+					continue
+				}
+				rdeps = append(rdeps, rdep)
+			}
+			if len(rdeps) > 0 {
+				pair.RDeps = rdeps
+				newDepMap = append(newDepMap, pair)
+			}
+		}
+		if stale == 0 {
+			return nil
+		}
+		if c.Fix {
+			content, err := json.MarshalIndent(newDepMap, "", "  ")
+			if err != nil {
+				return fmt.Errorf("Could not marshal rdeps: %v", err)
+			}
+			if err := ioutil.WriteFile(file, content, 0660); err != nil {
+				return fmt.Errorf("Could not write rdeps: %v", err)
+			}
+		}
+		c.report(rel, c.Fix, "%v dependencies on missing caches", stale)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if corrupt && c.Fix {
+		if err := os.RemoveAll(root); err != nil {
+			return fmt.Errorf("Could not clear cache: %v", err)
+		}
+	}
+	return nil
+}
+
+// checkUsers checks the password hashes of the site's users.
+func (c *checker) checkUsers() error {
+	content, err := ioutil.ReadFile(filepath.Join(c.DataDir, "users.json"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	users := make(map[string]service.User)
+	if err := json.Unmarshal(content, &users); err != nil {
+		c.report("users.json", false, "could not parse users: %v", err)
+		return nil
+	}
+	logins := make([]string, 0, len(users))
+	for login := range users {
+		logins = append(logins, login)
+	}
+	sort.Strings(logins)
+	for _, login := range logins {
+		if _, err := bcrypt.Cost([]byte(users[login].Password)); err != nil {
+			c.report("users.json", false, "invalid password hash of user %q: %v",
+				login, err)
+		}
+	}
+	return nil
+}
+
+func main() {
+	fix := flag.Bool("fix", false,
+		"Repair problems which can be fixed safely.")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr,
+			"Usage: %v [options] <config directory> <site>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	monsti, err := settings.LoadMonstiSettings(
+		settings.GetConfigPath(flag.Arg(0)))
+	if err != nil {
+		log.Fatalf("Could not load settings: %v", err)
+	}
+	site := flag.Arg(1)
+	dataPath := monsti.GetSiteDataPath(site)
+	if _, err := os.Stat(dataPath); err != nil {
+		log.Fatalf("Could not find site %v: %v", site, err)
+	}
+
+	// The node types get registered by the running modules.
+	client, err := service.NewMonstiConnection(
+		monsti.GetServicePath(service.MonstiService.String()))
+	if err != nil {
+		log.Fatalf("Could not connect to Monsti (is it running?): %v", err)
+	}
+	typeIds, err := client.GetNodeTypes()
+	if err != nil {
+		log.Fatalf("Could not get node types: %v", err)
+	}
+	nodeTypes := make(map[string]*service.NodeType)
+	for _, id := range typeIds {
+		if nodeTypes[id], err = client.GetNodeType(id); err != nil {
+			log.Fatalf("Could not get node type %v: %v", id, err)
+		}
+	}
+
+	c := checker{
+		DataDir:   dataPath,
+		NodeTypes: nodeTypes,
+		Monsti:    client,
+		Site:      site,
+		Fix:       *fix,
+		Now:       time.Now().UTC(),
+	}
+	if err := c.Check(); err != nil {
+		log.Fatalf("Could not check site %v: %v", site, err)
+	}
+	remaining := 0
+	for _, p := range c.Problems {
+		fmt.Println(p)
+		if !p.Fixed {
+			remaining++
+		}
+	}
+	if len(c.Problems) == 0 {
+		log.Printf("No problems found")
+		return
+	}
+	log.Printf("Found %v problems (%v fixed)", len(c.Problems),
+		len(c.Problems)-remaining)
+	if remaining > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"pkg.monsti.org/monsti/api/service"
+	mtesting "pkg.monsti.org/monsti/api/util/testing"
+)
+
+func TestCheck(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("foofoo"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Could not hash password: %v", err)
+	}
+	users, _ := json.Marshal(map[string]service.User{
+		"admin": {Password: string(hash)},
+		"bob":   {Password: "secret"},
+	})
+	site := map[string]string{
+		"/users.json": string(users),
+		"/nodes/node.json": `{"Id":"root","Type":"test.Doc","Fields":{"test":{
+       "Ref":"/foo","Refs":["node:root","node:missing"]}}}`,
+		"/nodes/__file_core.File":           "file",
+		"/nodes/foo/node.json":              `{"Type":"test.Doc","Fields":{"test":{"Ref":"/bar"}}}`,
+		"/nodes/foo/__file_test.Gone":       "file",
+		"/nodes/foo/draft.__file_core.File": "file",
+		"/nodes/unknown/node.json":          `{"Type":"test.Unknown"}`,
+		"/nodes/unknown/__file_core.File":   "file",
+		"/nodes/broken/node.json":           `{"Type":`,
+		"/nodes/empty/__file_core.File":     "file",
+		"/cache/foo/.data/nav":              "cached",
+		"/cache/foo/.rdeps.json": `[{"Dep":{"Node":"/foo"},"RDeps":[
+       {"Node":"/foo","Cache":"nav"},{"Node":"/","Cache":"nav"}]},
+       {"Dep":{"Node":"/foo","Descend":1},"RDeps":[{"Node":"/","Cache":"x"}]}]`,
+	}
+	root, cleanup, err := mtesting.CreateDirectoryTree(site, "TestCheck")
+	if err != nil {
+		t.Fatalf("Could not create site: %v", err)
+	}
+	defer cleanup()
+
+	nodeTypes := map[string]*service.NodeType{
+		"test.Doc": {
+			Id: "test.Doc",
+			Fields: []*service.FieldConfig{
+				{Id: "test.Ref", Type: new(service.RefFieldType)},
+				{Id: "test.Refs",
+					Type: &service.ListFieldType{ElementType: new(service.RefFieldType)}},
+				{Id: "core.File", Type: new(service.FileFieldType)},
+			},
+		},
+	}
+	now := time.Unix(1, 0)
+	c := checker{DataDir: root, NodeTypes: nodeTypes, Now: now}
+	if err := c.Check(); err != nil {
+		t.Fatalf("Check returns error: %v", err)
+	}
+	expected := []string{
+		"nodes/node.json: field test.Refs references missing node \"node:missing\"",
+		"nodes/broken/node.json: could not parse node: unexpected end of JSON input",
+		"nodes/empty/__file_core.File: orphaned data file, missing node.json",
+		"nodes/foo/node.json: field test.Ref references missing node \"/bar\"",
+		"nodes/foo/__file_test.Gone: orphaned data file, node type test.Doc has no field test.Gone",
+		"nodes/foo/draft.__file_core.File: orphaned data file, missing node.draft.json",
+		"nodes/unknown/node.json: unknown node type \"test.Unknown\"",
+		"cache/foo/.rdeps.json: 2 dependencies on missing caches",
+		"users.json: invalid password hash of user \"bob\": crypto/bcrypt: hashedSecret too short to be a bcrypted password",
+	}
+	var problems []string
+	for _, p := range c.Problems {
+		problems = append(problems, p.String())
+	}
+	if !reflect.DeepEqual(problems, expected) {
+		t.Errorf("Check found\n%v\nshould be\n%v", problems, expected)
+	}
+
+	c = checker{DataDir: root, NodeTypes: nodeTypes, Now: now, Fix: true}
+	if err := c.Check(); err != nil {
+		t.Fatalf("Check returns error: %v", err)
+	}
+	fixed := 0
+	for _, p := range c.Problems {
+		if p.Fixed {
+			fixed++
+		}
+	}
+	if fixed != 4 {
+		t.Errorf("Check should fix 4 problems, fixed %v: %v", fixed, c.Problems)
+	}
+	quarantined := filepath.Join(root, "quarantine", "1000000000", "nodes",
+		"foo", "__file_test.Gone")
+	if _, err := os.Stat(quarantined); err != nil {
+		t.Errorf("Orphaned data file should be quarantined: %v", err)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(root, "cache", "foo",
+		".rdeps.json"))
+	if err != nil {
+		t.Fatalf("Could not read rdeps: %v", err)
+	}
+	var rdeps []cacheDepPair
+	if err := json.Unmarshal(content, &rdeps); err != nil {
+		t.Fatalf("Could not unmarshal rdeps: %v", err)
+	}
+	expectedRdeps := []cacheDepPair{{
+		Dep:   service.CacheDep{Node: "/foo"},
+		RDeps: []service.CacheDep{{Node: "/foo", Cache: "nav"}}}}
+	if !reflect.DeepEqual(rdeps, expectedRdeps) {
+		t.Errorf("rdeps should be %v, got %v", expectedRdeps, rdeps)
+	}
+
+	c = checker{DataDir: root, NodeTypes: nodeTypes, Now: now}
+	if err := c.Check(); err != nil {
+		t.Fatalf("Check returns error: %v", err)
+	}
+	if len(c.Problems) != 5 {
+		t.Errorf("Check should find 5 remaining problems, got %v", c.Problems)
+	}
+}
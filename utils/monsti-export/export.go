@@ -0,0 +1,51 @@
+// Tool to export a site to an archive.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"pkg.monsti.org/monsti/api/util/archive"
+	"pkg.monsti.org/monsti/api/util/settings"
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr,
+			"Usage: %v <config directory> <site> <archive>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 3 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	monsti, err := settings.LoadMonstiSettings(
+		settings.GetConfigPath(flag.Arg(0)))
+	if err != nil {
+		log.Fatalf("Could not load settings: %v", err)
+	}
+	site := flag.Arg(1)
+	dataPath := monsti.GetSiteDataPath(site)
+	if _, err := os.Stat(dataPath); err != nil {
+		log.Fatalf("Could not find site %v: %v", site, err)
+	}
+	file, err := os.Create(flag.Arg(2))
+	if err != nil {
+		log.Fatalf("Could not create archive: %v", err)
+	}
+	manifest, err := archive.Export(file, dataPath, site, time.Now().UTC())
+	if err == nil {
+		err = file.Close()
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(flag.Arg(2))
+		log.Fatalf("Could not export site: %v", err)
+	}
+	log.Printf("Exported site %v (version %v, node types %v)", site,
+		manifest.MonstiVersion, manifest.NodeTypes)
+}
@@ -0,0 +1,83 @@
+// Tool to import a site from an archive.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path"
+
+	"pkg.monsti.org/monsti/api/service"
+	"pkg.monsti.org/monsti/api/util/archive"
+	"pkg.monsti.org/monsti/api/util/settings"
+)
+
+func main() {
+	prefix := flag.String("prefix", "",
+		"Merge the nodes into the existing site below the given path.")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr,
+			"Usage: %v [options] <config directory> <site> <archive>\n",
+			os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 3 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	monsti, err := settings.LoadMonstiSettings(
+		settings.GetConfigPath(flag.Arg(0)))
+	if err != nil {
+		log.Fatalf("Could not load settings: %v", err)
+	}
+
+	// The node types get registered by the running modules.
+	client, err := service.NewMonstiConnection(
+		monsti.GetServicePath(service.MonstiService.String()))
+	if err != nil {
+		log.Fatalf("Could not connect to Monsti (is it running?): %v", err)
+	}
+	types, err := client.GetNodeTypes()
+	if err != nil {
+		log.Fatalf("Could not get node types: %v", err)
+	}
+	nodeTypes := make(map[string]bool)
+	for _, nodeType := range types {
+		nodeTypes[nodeType] = true
+	}
+
+	file, err := os.Open(flag.Arg(2))
+	if err != nil {
+		log.Fatalf("Could not open archive: %v", err)
+	}
+	defer file.Close()
+	site := flag.Arg(1)
+	manifest, err := archive.Import(file, monsti.GetSiteDataPath(site),
+		archive.ImportOptions{
+			Prefix:    *prefix,
+			NodeTypes: nodeTypes,
+			CheckManifest: func(manifest *archive.Manifest) error {
+				for _, nodeType := range manifest.NodeTypes {
+					if !nodeTypes[nodeType] {
+						return fmt.Errorf("Node type %q is not registered by any module",
+							nodeType)
+					}
+				}
+				return nil
+			}})
+	if err != nil {
+		log.Fatalf("Could not import site: %v", err)
+	}
+	// Cached pages of the existing site, e.g. navigations, may be
+	// outdated now.
+	if *prefix != "" {
+		err := client.MarkDep(site, service.CacheDep{Node: path.Clean("/" + *prefix)})
+		if err != nil {
+			log.Fatalf("Could not mark imported nodes: %v", err)
+		}
+	}
+	log.Printf("Imported site %v exported on %v", manifest.Site,
+		manifest.Created)
+}